@@ -11,5 +11,6 @@ require (
 	github.com/google/uuid v1.2.0
 	github.com/gorilla/websocket v1.4.2
 	github.com/smartystreets/goconvey v1.7.2 // indirect
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	gopkg.in/ini.v1 v1.67.0 // indirect
 )
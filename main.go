@@ -1,16 +1,46 @@
 package main
 
 import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"wjjmjh/hermes/managers"
+	"wjjmjh/hermes/managers/logic"
+	"wjjmjh/hermes/pkg/logging"
 	"wjjmjh/hermes/pkg/setting"
+	"wjjmjh/hermes/pkg/util/jwt_"
 )
 
 func init() {
 	setting.Setup()
+	logging.Setup()
+	jwt_.Setup()
 }
 
 func main() {
 	chatManager := managers.InitialiseManager()
-	chatManager.RunWsServer()
-	return
+	go func() {
+		if err := chatManager.RunWsServer(); err != nil {
+			log.Fatalf("ListenAndServe Error: %v", err)
+		}
+	}()
+
+	// Drain connections on SIGINT / SIGTERM
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	log.Println("[INFO] shutting down")
+
+	timeout := setting.WsServerSetting.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = logic.DefaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := chatManager.Shutdown(ctx); err != nil {
+		log.Printf("[ERROR] shutdown did not complete: %v", err)
+	}
 }
@@ -1,11 +1,14 @@
 package managers
 
 import (
+	"context"
 	"flag"
-	"fmt"
+	"log"
 	"net/http"
 	"wjjmjh/hermes/managers/logic"
+	"wjjmjh/hermes/pkg/backplane"
 	"wjjmjh/hermes/pkg/setting"
+	routers "wjjmjh/hermes/routers/api/v0"
 )
 
 /*
@@ -17,6 +20,7 @@ type ChatServerManager struct {
 	UserManager    *UserManager
 	ChannelManager *ChannelManager
 	wsServer       *logic.WsServer
+	httpServer     *http.Server
 }
 
 // Handles all business logic relating to a User
@@ -36,9 +40,42 @@ func InitialiseManager() *ChatServerManager {
 
 	controller := new(ChatServerManager)
 
+	// Initialise the message history, read position, audit log, channel
+	// metadata and notification setting storage
+	store, err := logic.NewMessageStore(setting.StorageSetting)
+	if err != nil {
+		log.Fatalf("managers.InitialiseManager, fail to open message store: %v", err)
+	}
+	reads, err := logic.NewReadStore(setting.StorageSetting)
+	if err != nil {
+		log.Fatalf("managers.InitialiseManager, fail to open read position store: %v", err)
+	}
+	audit, err := logic.NewAuditStore(setting.StorageSetting)
+	if err != nil {
+		log.Fatalf("managers.InitialiseManager, fail to open audit log: %v", err)
+	}
+	metaStore, err := logic.NewChannelStore(setting.StorageSetting)
+	if err != nil {
+		log.Fatalf("managers.InitialiseManager, fail to open channel store: %v", err)
+	}
+	notifications, err := logic.NewNotificationStore(setting.StorageSetting)
+	if err != nil {
+		log.Fatalf("managers.InitialiseManager, fail to open notification setting store: %v", err)
+	}
+
+	// Initialise the backplane shared with the other nodes
+	bp, err := backplane.New(setting.BackplaneSetting, setting.RedisSetting)
+	if err != nil {
+		log.Fatalf("managers.InitialiseManager, fail to connect backplane: %v", err)
+	}
+
 	// Initialise the websocketServer
-	server := logic.NewWsServer()
+	server, err := logic.NewWsServer(store, reads, audit, metaStore, notifications, bp)
+	if err != nil {
+		log.Fatalf("managers.InitialiseManager, fail to subscribe to backplane: %v", err)
+	}
 	controller.wsServer = server
+	controller.httpServer = newHTTPServer(server)
 
 	// Initialise child structs
 	um := new(UserManager)
@@ -51,23 +88,49 @@ func InitialiseManager() *ChatServerManager {
 
 }
 
-// RunWsServer starts the websocket server, and beings listening on the port
-// specified in config. On client connection/upgrade request, it will attempt
-// to establish a websocket handshake.
-func (chatManager *ChatServerManager) RunWsServer() {
+// newHTTPServer serves websocket upgrades on /ws and the REST API under /api/
+// from the port specified in config.
+func newHTTPServer(server *logic.WsServer) *http.Server {
 	var addr = flag.String("addr", setting.WsServerSetting.Port, "http service address")
 
-	// Start websocket register listener
-	go chatManager.wsServer.Run()
+	mux := http.NewServeMux()
 
 	// Start websocket read/write pump listening
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		chatManager.wsServer.ServeWs(w, r)
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		server.ServeWs(w, r)
 	})
 
+	// REST API
+	mux.Handle("/api/", routers.InitRouter(server))
+
+	return &http.Server{Addr: *addr, Handler: mux}
+}
+
+// RunWsServer starts the websocket server, and beings listening on the port
+// specified in config. On client connection/upgrade request, it will attempt
+// to establish a websocket handshake. It blocks until the server fails or
+// Shutdown is called, in which case nil is returned.
+func (chatManager *ChatServerManager) RunWsServer() error {
+	// Start websocket register listener
+	go chatManager.wsServer.Run()
+
 	// Port listening
-	err := http.ListenAndServe(*addr, nil)
-	if err != nil {
-		fmt.Println("ListenAndServe Error: ", err)
+	err := chatManager.httpServer.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops listening, then drains the websocket connections: each
+// client gets its queued frames followed by a CloseGoingAway frame telling it
+// when to reconnect. It returns once everything is closed or ctx is done.
+func (chatManager *ChatServerManager) Shutdown(ctx context.Context) error {
+	// Upgraded connections are hijacked, so the http server does not wait for them
+	httpErr := chatManager.httpServer.Shutdown(ctx)
+
+	if err := chatManager.wsServer.Shutdown(ctx); err != nil {
+		return err
 	}
+	return httpErr
 }
@@ -0,0 +1,279 @@
+package logic
+
+import (
+	"sync"
+	"wjjmjh/hermes/pkg/api_response"
+)
+
+// Account is a person, identified by the stable ID of their auth account. It
+// owns every live connection (User) of that person to this node and holds
+// their channel and thread memberships, so all of their devices are in the
+// same channels and every delivery reaches each of them. An account lives as
+// long as it has a connection.
+type Account struct {
+	accountID string
+	username  string
+	wsServer  *WsServer
+
+	// Guards sessions, channels, threads and closed
+	mu       sync.RWMutex
+	sessions map[*User]bool
+	channels map[*Channel]bool
+	threads  map[*Thread]bool
+
+	// Set once the last session left; memberships are refused from then on
+	closed bool
+}
+
+func newAccount(accountID string, username string, wsServer *WsServer) *Account {
+	return &Account{
+		accountID: accountID,
+		username:  username,
+		wsServer:  wsServer,
+		sessions:  make(map[*User]bool),
+		channels:  make(map[*Channel]bool),
+		threads:   make(map[*Thread]bool),
+	}
+}
+
+func (account *Account) GetID() string {
+	return account.accountID
+}
+
+func (account *Account) GetUsername() *string {
+	return &account.username
+}
+
+// Info identifies the account on the wire
+func (account *Account) Info() *SenderInfo {
+	return &SenderInfo{ID: account.accountID, Name: account.username}
+}
+
+// Sessions returns a snapshot of the account's live connections.
+func (account *Account) Sessions() []*User {
+	account.mu.RLock()
+	defer account.mu.RUnlock()
+	sessions := make([]*User, 0, len(account.sessions))
+	for user := range account.sessions {
+		sessions = append(sessions, user)
+	}
+	return sessions
+}
+
+// GetChannels returns a snapshot of the channels the account is in.
+func (account *Account) GetChannels() map[*Channel]bool {
+	account.mu.RLock()
+	defer account.mu.RUnlock()
+	channels := make(map[*Channel]bool, len(account.channels))
+	for channel, value := range account.channels {
+		channels[channel] = value
+	}
+	return channels
+}
+
+// GetThreads returns a snapshot of the threads the account follows.
+func (account *Account) GetThreads() map[*Thread]bool {
+	account.mu.RLock()
+	defer account.mu.RUnlock()
+	threads := make(map[*Thread]bool, len(account.threads))
+	for thread, value := range account.threads {
+		threads[thread] = value
+	}
+	return threads
+}
+
+/*
+	Sessions
+*/
+
+// addSession attaches a connection. Returns false once the account closed.
+func (account *Account) addSession(user *User) bool {
+	account.mu.Lock()
+	defer account.mu.Unlock()
+	if account.closed {
+		return false
+	}
+	account.sessions[user] = true
+	return true
+}
+
+// removeSession detaches a connection. When it was the last one the account
+// closes and hands back the memberships it held, which the caller must leave.
+func (account *Account) removeSession(user *User) (last bool, channels map[*Channel]bool, threads map[*Thread]bool) {
+	account.mu.Lock()
+	defer account.mu.Unlock()
+	delete(account.sessions, user)
+	if len(account.sessions) > 0 || account.closed {
+		return false, nil, nil
+	}
+
+	account.closed = true
+	channels, threads = account.channels, account.threads
+	account.channels = make(map[*Channel]bool)
+	account.threads = make(map[*Thread]bool)
+	return true, channels, threads
+}
+
+// send delivers an encoded frame to every live connection of the account.
+// Returns false if no connection queued it.
+func (account *Account) send(message []byte) bool {
+	sent := false
+	for _, user := range account.Sessions() {
+		if user.send(message) {
+			sent = true
+		}
+	}
+	return sent
+}
+
+// sendFrame delivers a frame to every live connection of the account
+func (account *Account) sendFrame(frame *OutboundFrame) {
+	account.send(FrameMarshal(frame))
+}
+
+/*
+	Memberships
+*/
+
+// joinChannel adds the account to the named channel, creating it if needed
+// and implicit creation is on. Private channels can only be joined by name
+// once invited, and no channel by accounts banned from it.
+func (account *Account) joinChannel(channelName string) (*Channel, error) {
+
+	var channel *Channel
+	if account.wsServer.implicitChannelCreate {
+		channel = account.wsServer.getOrCreateChannel(channelName, account.accountID)
+	} else if channel = account.wsServer.findChannelByName(channelName); channel == nil {
+		return nil, newFrameError(api_response.ERROR_NOT_EXIST_CHANNEL, "channel %s", channelName)
+	}
+
+	if channel.IsBanned(account.accountID) {
+		return nil, newFrameError(api_response.ERROR_BANNED, "channel %s", channelName)
+	}
+	if !channel.mayJoin(account.accountID) {
+		return nil, newFrameError(api_response.ERROR_PRIVATE_CHANNEL, "channel %s", channelName)
+	}
+
+	if err := account.enter(channel, nil).err(channelName); err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+// joinConversation adds the account to a conversation it takes part in. sender
+// is the participant who opened the conversation, if it was just opened.
+func (account *Account) joinConversation(channel *Channel, sender *SenderInfo) error {
+	if !channel.IsParticipant(account.accountID) {
+		return newFrameError(api_response.ERROR_NOT_CHANNEL_MEMBER, "channel %s", *channel.GetID())
+	}
+
+	return account.enter(channel, sender).err(*channel.GetID())
+}
+
+// enterResult is what became of an account entering a channel
+type enterResult int
+
+const (
+	entered enterResult = iota
+	alreadyMember
+	accountClosed
+	channelStopped
+)
+
+// err is the frame error reporting that the account could not enter the
+// channel, or nil if it is a member
+func (result enterResult) err(channel string) error {
+	switch result {
+	case accountClosed:
+		return newFrameError(api_response.ERROR, "connection closed")
+	case channelStopped:
+		return newFrameError(api_response.ERROR_NOT_EXIST_CHANNEL, "channel %s", channel)
+	}
+	return nil
+}
+
+// enter makes the account a member of the channel, unless it already is or
+// has closed.
+func (account *Account) enter(channel *Channel, sender *SenderInfo) enterResult {
+	if result := account.addChannel(channel); result != entered {
+		return result
+	}
+
+	if !channel.join(account) {
+		account.removeChannel(channel)
+		return channelStopped
+	}
+
+	account.notifyChannelJoined(channel, sender)
+
+	// The account and the channel members now follow each other's presence
+	account.wsServer.presence.sendMembers(account, channel)
+	if frame, ok := account.wsServer.presence.frame(account.accountID); ok {
+		channel.relay(&channelEvent{Frame: FrameMarshal(frame)})
+	}
+	return entered
+}
+
+func (account *Account) notifyChannelJoined(channel *Channel, sender *SenderInfo) {
+	frame := newFrame(ChannelJoinedAction, *channel.GetID(), channel.Payload())
+	frame.Sender = sender
+
+	account.sendFrame(frame)
+}
+
+func (account *Account) isInChannel(channel *Channel) bool {
+	account.mu.RLock()
+	defer account.mu.RUnlock()
+	return account.channels[channel]
+}
+
+// addChannel records channel membership, unless the account is already in
+// the channel or has closed.
+func (account *Account) addChannel(channel *Channel) enterResult {
+	account.mu.Lock()
+	defer account.mu.Unlock()
+	if account.closed {
+		return accountClosed
+	}
+	if account.channels[channel] {
+		return alreadyMember
+	}
+	account.channels[channel] = true
+	return entered
+}
+
+// removeChannel forgets channel membership. Returns false if the account was
+// not in the channel.
+func (account *Account) removeChannel(channel *Channel) bool {
+	account.mu.Lock()
+	defer account.mu.Unlock()
+	if !account.channels[channel] {
+		return false
+	}
+	delete(account.channels, channel)
+	return true
+}
+
+// followThread subscribes the account to the thread's messages.
+func (account *Account) followThread(thread *Thread) {
+	account.mu.Lock()
+	defer account.mu.Unlock()
+	if account.closed {
+		return
+	}
+	if thread.addMember(account) {
+		account.threads[thread] = true
+	}
+}
+
+// unfollowThread stops the account following the thread. Returns false if it
+// did not follow it.
+func (account *Account) unfollowThread(thread *Thread) bool {
+	account.mu.Lock()
+	defer account.mu.Unlock()
+	if !thread.removeMember(account) {
+		return false
+	}
+	delete(account.threads, thread)
+	return true
+}
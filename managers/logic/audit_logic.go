@@ -0,0 +1,150 @@
+package logic
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+	"wjjmjh/hermes/pkg/setting"
+)
+
+// DefaultAuditLogLimit is the number of audit log entries returned when no
+// limit is given, MaxAuditLogLimit the most returned at once
+const DefaultAuditLogLimit = 50
+const MaxAuditLogLimit = 200
+
+// AuditEntry records a moderation action taken in a channel. Action is the
+// frame type of the action, see moderation_logic.go. Until is set for mutes
+// and Interval, in seconds, for slow mode changes.
+type AuditEntry struct {
+	ID        string      `json:"id"`
+	ChannelID string      `json:"channel_id"`
+	Action    string      `json:"action"`
+	Actor     SenderInfo  `json:"actor"`
+	Target    *SenderInfo `json:"target,omitempty"`
+	Reason    string      `json:"reason,omitempty"`
+	Until     *time.Time  `json:"until,omitempty"`
+	Interval  int         `json:"interval,omitempty"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// AuditStore persists the moderation actions of every channel. ListChannel
+// returns at most limit of the latest entries of a channel, oldest first.
+type AuditStore interface {
+	Append(entry *AuditEntry) error
+	ListChannel(channelID string, limit int) ([]*AuditEntry, error)
+	Close() error
+}
+
+// NewAuditStore builds the AuditStore configured in the storage settings.
+func NewAuditStore(storage *setting.Storage) (AuditStore, error) {
+	switch storage.Type {
+	case "", MemoryStorage:
+		return NewMemoryAuditStore(), nil
+	case FileStorage:
+		return OpenFileAuditStore(storage.Path)
+	default:
+		return nil, fmt.Errorf("unknown audit log storage type: %s", storage.Type)
+	}
+}
+
+// clampAuditLimit applies the default and maximum audit log page sizes
+func clampAuditLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultAuditLogLimit
+	} else if limit > MaxAuditLogLimit {
+		return MaxAuditLogLimit
+	}
+	return limit
+}
+
+/*
+	In-memory store
+*/
+
+// MemoryAuditStore keeps the audit log in memory; it is lost on restart.
+type MemoryAuditStore struct {
+	mu       sync.RWMutex
+	channels map[string][]*AuditEntry
+}
+
+func NewMemoryAuditStore() *MemoryAuditStore {
+	return &MemoryAuditStore{channels: make(map[string][]*AuditEntry)}
+}
+
+func (store *MemoryAuditStore) Append(entry *AuditEntry) error {
+	stored := *entry
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.channels[stored.ChannelID] = append(store.channels[stored.ChannelID], &stored)
+	return nil
+}
+
+func (store *MemoryAuditStore) ListChannel(channelID string, limit int) ([]*AuditEntry, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	entries := store.channels[channelID]
+	if len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+
+	page := make([]*AuditEntry, 0, len(entries))
+	for _, entry := range entries {
+		c := *entry
+		page = append(page, &c)
+	}
+	return page, nil
+}
+
+func (store *MemoryAuditStore) Close() error {
+	return nil
+}
+
+/*
+	On-disk store
+*/
+
+// FileAuditStore appends every entry to a journal, which is replayed into
+// memory on open.
+type FileAuditStore struct {
+	*MemoryAuditStore
+	mu      sync.Mutex
+	journal *journal
+}
+
+// OpenFileAuditStore opens (or creates) the audit log in directory dir.
+func OpenFileAuditStore(dir string) (*FileAuditStore, error) {
+	store := &FileAuditStore{MemoryAuditStore: NewMemoryAuditStore()}
+	journal, err := openJournal(dir, "audit.log", store.replay)
+	if err != nil {
+		return nil, err
+	}
+	store.journal = journal
+	return store, nil
+}
+
+// replay loads a logged entry back into memory.
+func (store *FileAuditStore) replay(record []byte) error {
+	var entry AuditEntry
+	if err := json.Unmarshal(record, &entry); err != nil {
+		return err
+	}
+	return store.MemoryAuditStore.Append(&entry)
+}
+
+func (store *FileAuditStore) Append(entry *AuditEntry) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.journal.Append(entry); err != nil {
+		return err
+	}
+	return store.MemoryAuditStore.Append(entry)
+}
+
+func (store *FileAuditStore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.journal.Close()
+}
@@ -0,0 +1,360 @@
+package logic
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/backplane"
+)
+
+// Topics the nodes exchange events on
+const (
+	channelTopic  = "hermes:channel"
+	presenceTopic = "hermes:presence"
+	directTopic   = "hermes:direct"
+)
+
+// channelEvent carries a frame for the members of a channel, or of one of
+// its threads, connected to other nodes. Every node gives a channel and its
+// threads the same IDs (see channelIDFor), and renamed channels keep theirs.
+type channelEvent struct {
+	Node      string `json:"node"`
+	ChannelID string `json:"channel_id"`
+	ThreadID  string `json:"thread_id,omitempty"`
+
+	// Account on whose behalf a privileged event was published, which
+	// receivers check against their copy of the channel
+	Actor string `json:"actor,omitempty"`
+
+	// Set when the event creates the thread of this message
+	ParentMessageID string `json:"parent_message_id,omitempty"`
+
+	// Set when the frame is a chat message every node records in its history,
+	// or edits or deletes one, which every node updates in its history
+	Message *Message `json:"message,omitempty"`
+	Changed *Message `json:"changed,omitempty"`
+
+	// Set when the frame moves a read position every node records
+	Read *ReadPosition `json:"read,omitempty"`
+
+	// Set when an account joined or left the channel on the publishing node,
+	// which every node records in its roster of the channel
+	Member *memberChange `json:"member,omitempty"`
+
+	// Set when the frame changes a role, invites a user or pins a message,
+	// which every node applies to its copy of the channel
+	Role   *RolePayload `json:"role,omitempty"`
+	Invite *invitation  `json:"invite,omitempty"`
+	Pin    *PinPayload  `json:"pin,omitempty"`
+
+	// Set when the frame announces a moderation action, which every node
+	// records in its audit log and applies
+	Moderation *AuditEntry `json:"moderation,omitempty"`
+
+	// Set when the frame changes the channel metadata, which every node
+	// stores and applies
+	Metadata *ChannelMetadata `json:"metadata,omitempty"`
+
+	// Set when a user changed the notification settings of the channel,
+	// which every node stores. Carries no frame.
+	Notifications *NotificationSetting `json:"notifications,omitempty"`
+
+	// Set when a channel was created, renamed, archived or unarchived, or
+	// deleted. Created events carry no frame.
+	Created  *ChannelRecord `json:"created,omitempty"`
+	Renamed  string         `json:"renamed,omitempty"`
+	Archived *bool          `json:"archived,omitempty"`
+	Deleted  bool           `json:"deleted,omitempty"`
+
+	// Set when a node tells the others its record of an ephemeral channel,
+	// see receiveSnapshot, or asks for their records, see requestSync.
+	// Carries no frame.
+	Snapshot *ChannelRecord `json:"snapshot,omitempty"`
+	Sync     bool           `json:"sync,omitempty"`
+
+	Frame json.RawMessage `json:"frame"`
+}
+
+// memberChange is an account joining or leaving a channel on one node
+type memberChange struct {
+	UserID string `json:"user_id"`
+	Joined bool   `json:"joined,omitempty"`
+}
+
+// invitation is a user invited to a channel, and who invited them
+type invitation struct {
+	User SenderInfo `json:"user"`
+	By   SenderInfo `json:"by"`
+}
+
+// presenceEvent carries the status of a user on one node to the other nodes,
+// along with the channels whose members follow the user.
+type presenceEvent struct {
+	Node       string    `json:"node"`
+	UserID     string    `json:"user_id"`
+	Username   string    `json:"username"`
+	Status     string    `json:"status"`
+	LastSeen   time.Time `json:"last_seen"`
+	ChannelIDs []string  `json:"channel_ids,omitempty"`
+}
+
+// directEvent tells the other nodes that the sender opened a conversation
+// between the participants, so they know it and add the participants
+// connected to them.
+type directEvent struct {
+	Node         string       `json:"node"`
+	Participants []SenderInfo `json:"participants"`
+	Sender       SenderInfo   `json:"sender"`
+}
+
+// subscribeBackplane starts receiving the events other nodes publish
+func (server *WsServer) subscribeBackplane() error {
+	if err := server.backplane.Subscribe(channelTopic, server.receiveChannelEvent); err != nil {
+		return err
+	}
+	if err := server.backplane.Subscribe(presenceTopic, server.receivePresenceEvent); err != nil {
+		return err
+	}
+	return server.backplane.Subscribe(directTopic, server.receiveDirectEvent)
+}
+
+// publishEvent relays an event to the other nodes. Events already reached the
+// users of this node, so failures are logged rather than returned.
+func (server *WsServer) publishEvent(topic string, event interface{}) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[ERROR] unable to encode %s event: %v", topic, err)
+		return
+	}
+	if err := server.backplane.Publish(topic, payload); err != nil && err != backplane.ErrClosed {
+		log.Printf("[WARN] unable to publish %s event: %v", topic, err)
+	}
+}
+
+func (server *WsServer) receiveChannelEvent(payload []byte) {
+	var event channelEvent
+	if !server.decodeEvent(channelTopic, payload, &event) || event.Node == server.nodeID {
+		return
+	}
+
+	// Keep this node's history complete, even for channels nobody here joined
+	if event.Message != nil {
+		if err := server.store.Append(event.Message); err != nil {
+			log.Printf("[ERROR] unable to store message %s: %v", event.Message.ID, err)
+		}
+	}
+	if event.Read != nil {
+		if err := server.reads.Set(event.Read); err != nil {
+			log.Printf("[ERROR] unable to store read position of %s: %v", event.Read.UserID, err)
+		}
+	}
+
+	if event.Notifications != nil {
+		if err := server.notifications.Set(event.Notifications); err != nil {
+			log.Printf("[ERROR] unable to store notification settings of %s: %v", event.Notifications.UserID, err)
+		}
+		return
+	}
+
+	if event.Created != nil {
+		event.Created.ChannelID = event.ChannelID
+		server.adoptChannel(event.Created)
+		return
+	}
+	if event.Snapshot != nil {
+		event.Snapshot.ChannelID = event.ChannelID
+		server.receiveSnapshot(event.Snapshot)
+		return
+	}
+	if event.Sync {
+		server.answerSync(event.ChannelID)
+		return
+	}
+
+	// Mentioned accounts are notified even if this node has no copy of the
+	// channel
+	channel := server.findChannelByID(event.ChannelID)
+	if event.Message != nil {
+		server.notifyMentions(channel, event.Message)
+	}
+	if channel == nil {
+		if event.privileged() {
+			log.Printf("[WARN] ignoring privileged event for unknown channel %s", event.ChannelID)
+		}
+		return
+	}
+	if err := channel.verify(&event); err != nil {
+		log.Printf("[WARN] ignoring event of %s for channel %s: %v", event.Actor, event.ChannelID, err)
+		return
+	}
+
+	if event.Changed != nil {
+		if err := server.store.Update(event.Changed); err != nil {
+			log.Printf("[ERROR] unable to update message %s: %v", event.Changed.ID, err)
+		}
+	}
+	if event.Moderation != nil {
+		if err := server.audit.Append(event.Moderation); err != nil {
+			log.Printf("[ERROR] unable to store audit log entry %s: %v", event.Moderation.ID, err)
+		}
+	}
+
+	if event.Member != nil {
+		channel.applyMember(event.Node, event.Member)
+	}
+	if event.ParentMessageID != "" {
+		channel.CreateThread(event.ParentMessageID)
+	}
+	if event.Role != nil {
+		channel.setRole(event.Role.UserID, event.Role.Role)
+	}
+	if event.Pin != nil {
+		channel.applyPin(event.Pin)
+	}
+	if event.Changed != nil {
+		channel.applyMessageChange(event.Changed)
+	}
+	if event.Renamed != "" {
+		if _, err := server.renameChannel(channel, event.Renamed); err != nil {
+			log.Printf("[WARN] unable to rename channel %s to %s: %v", event.ChannelID, event.Renamed, err)
+		}
+	}
+	if event.Archived != nil {
+		channel.applyArchived(*event.Archived)
+	}
+	if event.Metadata != nil {
+		channel.applyMetadata(event.Metadata)
+	}
+	if event.Role != nil || event.Archived != nil || event.Metadata != nil {
+		channel.save()
+	}
+	channel.deliver(&event)
+	if event.Invite != nil {
+		channel.addInvite(&event.Invite.User, &event.Invite.By)
+	}
+	if event.Moderation != nil {
+		channel.applyModeration(event.Moderation)
+	}
+	if event.Deleted {
+		server.removeChannel(channel)
+	}
+}
+
+// privileged reports whether the event needs permissions beyond posting
+func (event *channelEvent) privileged() bool {
+	return event.Role != nil || event.Invite != nil || event.Pin != nil || event.Changed != nil ||
+		event.Moderation != nil || event.Metadata != nil || event.Renamed != "" ||
+		event.Archived != nil || event.Deleted
+}
+
+// verify checks that the actor of a privileged event from another node holds
+// the permissions it needs on this node's copy of the channel, the same
+// checks the publishing node made. Events are verified before they are
+// applied and in the order they were published, so the actor's role is the
+// one it had when acting.
+func (channel *Channel) verify(event *channelEvent) error {
+	if !event.privileged() {
+		return nil
+	}
+	if event.Actor == "" {
+		return ErrPermissionDenied
+	}
+	actor := &SenderInfo{ID: event.Actor}
+
+	if change := event.Role; change != nil {
+		// An owner handing over ownership becomes an admin, once the new
+		// owner is one
+		handover := change.UserID == actor.ID && change.Role == RoleAdmin &&
+			channel.RoleOf(actor.ID) == RoleOwner && channel.owners() > 1
+		if !handover {
+			if err := channel.checkRoleChange(actor.ID, change.UserID, change.Role); err != nil {
+				return err
+			}
+		}
+	}
+	if event.Invite != nil && (channel.Direct || event.Invite.By.ID != actor.ID || !channel.Can(actor.ID, PermInvite)) {
+		return ErrPermissionDenied
+	}
+	if event.Pin != nil && !channel.Can(actor.ID, PermPin) {
+		return ErrPermissionDenied
+	}
+	if event.Changed != nil {
+		if err := channel.verifyChange(actor, event.Changed); err != nil {
+			return err
+		}
+	}
+	if entry := event.Moderation; entry != nil {
+		if entry.Actor.ID != actor.ID {
+			return ErrPermissionDenied
+		}
+		if err := channel.checkModeration(entry); err != nil {
+			return err
+		}
+	}
+	if event.Metadata != nil && (channel.Direct || !channel.Can(actor.ID, PermEditMetadata)) {
+		return ErrPermissionDenied
+	}
+	if event.Renamed != "" && !channel.Can(actor.ID, PermRename) {
+		return ErrPermissionDenied
+	}
+	if event.Archived != nil && (channel.Direct || !channel.Can(actor.ID, PermArchive)) {
+		return ErrPermissionDenied
+	}
+	if event.Deleted && !channel.Can(actor.ID, PermDelete) {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// verifyChange checks a changed message against this node's copy. Changing
+// the text or deleting a message takes its author or a moderator ranked
+// above them, anything else is a reaction.
+func (channel *Channel) verifyChange(actor *SenderInfo, changed *Message) error {
+	stored, err := channel.GetMessage(changed.ID)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		return newFrameError(api_response.ERROR_NOT_EXIST_MESSAGE, "message %s", changed.ID)
+	}
+	if stored.SenderID != changed.SenderID {
+		return ErrPermissionDenied
+	}
+
+	if stored.Text != changed.Text || len(stored.Edits) != len(changed.Edits) ||
+		(stored.DeletedAt == nil) != (changed.DeletedAt == nil) {
+		if actor.ID == stored.SenderID {
+			return nil
+		}
+		return channel.checkModerator(actor, stored.SenderID, PermManageMessages)
+	}
+	if !channel.Can(actor.ID, PermReact) {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+func (server *WsServer) receivePresenceEvent(payload []byte) {
+	var event presenceEvent
+	if !server.decodeEvent(presenceTopic, payload, &event) || event.Node == server.nodeID {
+		return
+	}
+	server.presence.receive(&event)
+}
+
+func (server *WsServer) receiveDirectEvent(payload []byte) {
+	var event directEvent
+	if !server.decodeEvent(directTopic, payload, &event) || event.Node == server.nodeID {
+		return
+	}
+	server.openConversation(event.Participants, &event.Sender)
+}
+
+func (server *WsServer) decodeEvent(topic string, payload []byte, event interface{}) bool {
+	if err := json.Unmarshal(payload, event); err != nil {
+		log.Printf("[WARN] ignoring malformed %s event: %v", topic, err)
+		return false
+	}
+	return true
+}
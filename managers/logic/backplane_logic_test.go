@@ -0,0 +1,326 @@
+package logic
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/backplane"
+)
+
+func TestBroadcastAcrossNodes(t *testing.T) {
+	bp := backplane.NewMemory()
+	nodeA, nodeB := newTestNode(t, bp), newTestNode(t, bp)
+	alice := nodeA.connect(t, newTestAccount(t, "alice"))
+	bob := nodeB.connect(t, newTestAccount(t, "bob"))
+
+	channelID := alice.join("shared")
+	if id := bob.join("shared"); id != channelID {
+		t.Fatalf("nodes gave the channel IDs %s and %s", channelID, id)
+	}
+	alice.expect(ofType(UserJoinedChannelAction))
+
+	// Both sides post at once; each sees every message of the other
+	const messages = 30
+	var wg sync.WaitGroup
+	for _, client := range []*testClient{alice, bob} {
+		wg.Add(1)
+		go func(client *testClient) {
+			defer wg.Done()
+			for n := 0; n < messages; n++ {
+				client.send(SendMessageAction, channelID, TextPayload{Text: fmt.Sprintf("%s-%d", client.account.ID, n)})
+			}
+		}(client)
+	}
+	wg.Wait()
+	for _, pair := range [][2]*testClient{{alice, bob}, {bob, alice}} {
+		receiver, sender := pair[0], pair[1]
+		for n := 0; n < messages; n++ {
+			receiver.expect(withText(fmt.Sprintf("%s-%d", sender.account.ID, n)))
+		}
+	}
+
+	// Both nodes recorded the whole history
+	for _, node := range []*testNode{nodeA, nodeB} {
+		history, err := node.server.store.FetchChannel(channelID, "", 2*messages)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 2*messages {
+			t.Fatalf("node has %d messages, want %d", len(history), 2*messages)
+		}
+	}
+}
+
+func TestMentionMembersOnOtherNodes(t *testing.T) {
+	bp := backplane.NewMemory()
+	nodeA, nodeB := newTestNode(t, bp), newTestNode(t, bp)
+	alice := nodeA.connect(t, newTestAccount(t, "alice"))
+	bob := nodeB.connect(t, newTestAccount(t, "bob"))
+	outsider := nodeB.connect(t, newTestAccount(t, "outsider"))
+
+	channelID := alice.join("mentions")
+	bob.join("mentions")
+	alice.expect(ofType(UserJoinedChannelAction))
+
+	// Bob is a member on the other node, the outsider is in no channel
+	alice.send(SendMessageAction, channelID, TextPayload{
+		Text: fmt.Sprintf("@%s and @%s", bob.account.Username, outsider.account.Username),
+	})
+	frame := bob.expect(ofType(MentionAction))
+	if frame.ChannelID != channelID {
+		t.Fatalf("mention of channel %s, want %s", frame.ChannelID, channelID)
+	}
+
+	// The message itself tells who it mentions
+	message := alice.expect(ofType(SendMessageAction))
+	var content MessageContentPayload
+	if err := json.Unmarshal(message.Payload, &content); err != nil {
+		t.Fatal(err)
+	}
+	if content.Mentions == nil || len(content.Mentions.Users) != 1 || content.Mentions.Users[0].ID != bob.account.ID {
+		t.Fatalf("message mentions %+v, want bob only", content.Mentions)
+	}
+}
+
+func TestForgedEventsAreIgnored(t *testing.T) {
+	bp := backplane.NewMemory()
+	nodeA, nodeB := newTestNode(t, bp), newTestNode(t, bp)
+	alice := nodeA.connect(t, newTestAccount(t, "alice"))
+	bob := nodeB.connect(t, newTestAccount(t, "bob"))
+
+	alice.send(CreateChannelAction, "", CreateChannelPayload{Name: "owned"})
+	channelID := alice.expect(ofType(ChannelJoinedAction)).ChannelID
+	eventually(t, "the channel to be announced", func() bool { return nodeB.server.findChannelByID(channelID) != nil })
+	bob.join("owned")
+	alice.expect(ofType(UserJoinedChannelAction))
+
+	// A node publishes privileged events on behalf of a member who holds no
+	// role, and on behalf of nobody
+	forge := func(event *channelEvent) {
+		event.Node = "forger"
+		event.ChannelID = channelID
+		nodeB.server.publishEvent(channelTopic, event)
+	}
+	forge(&channelEvent{Actor: bob.account.ID, Role: &RolePayload{UserID: bob.account.ID, Role: RoleOwner}})
+	forge(&channelEvent{Role: &RolePayload{UserID: bob.account.ID, Role: RoleAdmin}})
+	forge(&channelEvent{Actor: bob.account.ID, Moderation: &AuditEntry{
+		ID:        "forged",
+		ChannelID: channelID,
+		Action:    BanAction,
+		Actor:     SenderInfo{ID: bob.account.ID},
+		Target:    &SenderInfo{ID: alice.account.ID},
+	}})
+	forge(&channelEvent{Actor: bob.account.ID, Deleted: true})
+
+	// Events are handled in order, so the forged ones were handled once the
+	// owner's role change arrives
+	alice.send(SetRoleAction, channelID, RolePayload{UserID: bob.account.ID, Role: RoleModerator})
+	for _, node := range []*testNode{nodeA, nodeB} {
+		eventually(t, "the owner's role change", func() bool {
+			channel := node.server.findChannelByID(channelID)
+			return channel != nil && channel.RoleOf(bob.account.ID) == RoleModerator
+		})
+		channel := node.server.findChannelByID(channelID)
+		if channel.IsBanned(alice.account.ID) {
+			t.Fatal("forged ban was applied")
+		}
+		if channel.RoleOf(alice.account.ID) != RoleOwner {
+			t.Fatalf("owner's role is %s", channel.RoleOf(alice.account.ID))
+		}
+	}
+}
+
+func TestVerifyChange(t *testing.T) {
+	roles := map[string]string{"owner": RoleOwner, "moderator": RoleModerator, "guest": RoleGuest}
+	edited := func(message *Message) { message.Text = "edited" }
+	deleted := func(message *Message) {
+		now := time.Now().UTC()
+		message.Text = ""
+		message.DeletedAt = &now
+	}
+	reacted := func(message *Message) {
+		message.Reactions = []Reaction{{Emoji: "👍", Count: 1, Users: []SenderInfo{{ID: "bob"}}}}
+	}
+	tests := []struct {
+		name   string
+		author string
+		actor  string
+		change func(message *Message)
+		code   int
+	}{
+		{"author edits", "alice", "alice", edited, api_response.SUCCESS},
+		{"author deletes", "alice", "alice", deleted, api_response.SUCCESS},
+		{"member edits another's", "alice", "bob", edited, api_response.ERROR_PERMISSION_DENIED},
+		{"moderator deletes a member's", "alice", "moderator", deleted, api_response.SUCCESS},
+		{"moderator edits the owner's", "owner", "moderator", edited, api_response.ERROR_PERMISSION_DENIED},
+		{"member reacts", "alice", "bob", reacted, api_response.SUCCESS},
+		{"guest reacts", "alice", "guest", reacted, api_response.ERROR_PERMISSION_DENIED},
+		{"author changed", "alice", "bob", func(message *Message) { message.SenderID = "bob" }, api_response.ERROR_PERMISSION_DENIED},
+		{"unknown message", "alice", "alice", func(message *Message) { message.ID = "unknown" }, api_response.ERROR_NOT_EXIST_MESSAGE},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			channel := newTestChannel(t, roles)
+			changed := *postTestMessage(t, channel, test.author, "original")
+			test.change(&changed)
+			err := channel.verifyChange(&SenderInfo{ID: test.actor}, &changed)
+			if code := errorCode(err); code != test.code {
+				t.Fatalf("change answered %d (%v), want %d", code, err, test.code)
+			}
+		})
+	}
+}
+
+func TestImplicitChannelOwnerAcrossNodes(t *testing.T) {
+	bp := backplane.NewMemory()
+	nodeA, nodeB := newTestNode(t, bp), newTestNode(t, bp)
+	alice := nodeA.connect(t, newTestAccount(t, "alice"))
+	bob := nodeB.connect(t, newTestAccount(t, "bob"))
+	carol := newTestAccount(t, "carol")
+
+	// The node the channel is joined on second learned who created it
+	channelID := alice.join("town")
+	eventually(t, "the other node to store the channel", func() bool {
+		record, _ := nodeB.server.metaStore.Get(channelID)
+		return record != nil
+	})
+	bob.join("town")
+	for _, node := range []*testNode{nodeA, nodeB} {
+		channel := node.server.GetChannel(channelID)
+		if channel.RoleOf(alice.account.ID) != RoleOwner || channel.RoleOf(bob.account.ID) != RoleMember {
+			t.Fatalf("roles on a node are %+v, want alice to own the channel", channel.Roles())
+		}
+	}
+
+	// A channel created earlier elsewhere wins, a later one loses
+	rival := nodeA.server.GetChannel(channelID).record()
+	rival.CreatedAt = rival.CreatedAt.Add(-time.Minute)
+	rival.CreatedBy = carol.ID
+	rival.Roles = map[string]string{carol.ID: RoleOwner}
+	late := rival.copy()
+	late.CreatedAt = time.Now().Add(time.Minute)
+	late.CreatedBy = bob.account.ID
+	late.Roles = map[string]string{bob.account.ID: RoleOwner}
+	for _, record := range []*ChannelRecord{rival, &late} {
+		nodeA.server.publishEvent(channelTopic, &channelEvent{Node: "rival", ChannelID: channelID, Snapshot: record})
+	}
+	for _, node := range []*testNode{nodeA, nodeB} {
+		channel := node.server.GetChannel(channelID)
+		eventually(t, "carol to own the channel", func() bool {
+			return channel.RoleOf(carol.ID) == RoleOwner && channel.RoleOf(alice.account.ID) == RoleMember
+		})
+		if record, _ := node.server.metaStore.Get(channelID); record == nil || record.CreatedBy != carol.ID {
+			t.Fatalf("stored record is %+v", record)
+		}
+	}
+
+	// Events are handled in order, so once a channel created later on the
+	// other node is stored the later snapshot was handled, and changed nothing
+	barriers := []struct {
+		client *testClient
+		node   *testNode
+	}{{alice, nodeB}, {bob, nodeA}}
+	for _, barrier := range barriers {
+		afterID := barrier.client.join("after " + barrier.client.account.Username)
+		eventually(t, "the later channel to be stored", func() bool {
+			record, _ := barrier.node.server.metaStore.Get(afterID)
+			return record != nil
+		})
+		if channel := barrier.node.server.GetChannel(channelID); channel.RoleOf(bob.account.ID) != RoleMember {
+			t.Fatalf("a later creation took the channel over: %+v", channel.Roles())
+		}
+	}
+}
+
+func TestChannelMetadataAcrossNodes(t *testing.T) {
+	bp := backplane.NewMemory()
+	nodeA, nodeB := newTestNode(t, bp), newTestNode(t, bp)
+	alice := newTestAccount(t, "alice")
+	mallory := newTestAccount(t, "mallory")
+	topic := "shared topic"
+
+	channel, err := nodeA.server.CreateChannel("announcements", false, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channelID := *channel.GetID()
+	eventually(t, "the other node to register the channel", func() bool {
+		return nodeB.server.GetChannel(channelID) != nil
+	})
+	if _, err := nodeA.server.UpdateChannel(channelID, alice.ID, &UpdateChannelPayload{Topic: &topic}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The other node applies and stores the update, keeping who created it
+	eventually(t, "the other node to store the update", func() bool {
+		record, _ := nodeB.server.metaStore.Get(channelID)
+		return record != nil && record.Topic == topic
+	})
+	if got := nodeB.server.GetChannel(channelID).Metadata(); got.Topic != topic || got.CreatedBy != alice.ID {
+		t.Fatalf("metadata on the other node is %+v", got)
+	}
+
+	// Updates by accounts without the permission are refused
+	if _, err := nodeA.server.UpdateChannel(channelID, mallory.ID, &UpdateChannelPayload{Topic: &topic}); err != ErrPermissionDenied {
+		t.Fatalf("update by a member got %v", err)
+	}
+}
+
+func TestRolesReachLateNodes(t *testing.T) {
+	bp := backplane.NewMemory()
+	nodeA := newTestNode(t, bp)
+	alice := nodeA.connect(t, newTestAccount(t, "alice"))
+	bob := newTestAccount(t, "bob")
+	carol := newTestAccount(t, "carol")
+
+	staff, err := nodeA.server.CreateChannel("staff", true, alice.account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staffID := *staff.GetID()
+	if err := nodeA.server.SetChannelRole(staffID, alice.account.ID, bob.ID, RoleModerator); err != nil {
+		t.Fatal(err)
+	}
+
+	// A node started later registers the channel with its roles
+	nodeB := newTestNode(t, bp)
+	eventually(t, "the late node to register the channel", func() bool {
+		channel := nodeB.server.GetChannel(staffID)
+		return channel != nil && channel.RoleOf(bob.ID) == RoleModerator
+	})
+	if record, _ := nodeB.server.metaStore.Get(staffID); record == nil || record.Roles[alice.account.ID] != RoleOwner {
+		t.Fatalf("the late node stored %+v", record)
+	}
+
+	// A node not running an ephemeral channel misses its role changes, and
+	// catches up when the channel is joined there
+	cafeID := alice.join("cafe")
+	eventually(t, "the other node to store the channel", func() bool {
+		record, _ := nodeB.server.metaStore.Get(cafeID)
+		return record != nil
+	})
+	if err := nodeA.server.SetChannelRole(cafeID, alice.account.ID, carol.ID, RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	nodeB.connect(t, carol).join("cafe")
+	eventually(t, "the other node to catch up", func() bool {
+		return nodeB.server.GetChannel(cafeID).RoleOf(carol.ID) == RoleAdmin
+	})
+	local, remote := nodeA.server.GetChannel(cafeID).record(), nodeB.server.GetChannel(cafeID).record()
+	if local.Revision != remote.Revision {
+		t.Fatalf("nodes are at revisions %d and %d", local.Revision, remote.Revision)
+	}
+
+	// Later changes are applied and stored by both nodes
+	if err := nodeA.server.SetChannelRole(cafeID, alice.account.ID, bob.ID, RoleGuest); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the other node to store the change", func() bool {
+		record, _ := nodeB.server.metaStore.Get(cafeID)
+		return record != nil && record.Roles[bob.ID] == RoleGuest
+	})
+}
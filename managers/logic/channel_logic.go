@@ -4,17 +4,98 @@ import (
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"log"
+	"sync"
+	"time"
+	"wjjmjh/hermes/pkg/api_response"
 )
 
 type Channel struct {
+	// Guards members, threads, channelName and the fields below, which are
+	// also read by the REST API
+	mu          sync.RWMutex
 	channelID   *string
 	channelName *string
-	users       map[*User]bool
+	members     map[*Account]bool
 	threads     map[*Thread]bool
-	register    chan *User
-	unregister  chan *User
+	register    chan *Account
+	unregister  chan *Account
 	broadcast   chan *Message
+	quit        chan struct{}
+	stopOnce    sync.Once
+	store       MessageStore
+	reads       ReadStore
+	audit       AuditStore
+	metaStore   ChannelStore
+	server      *WsServer
 	Private     bool `json:"private"`
+
+	// Set for direct message conversations, see conversation_logic.go
+	Direct       bool `json:"direct"`
+	participants []SenderInfo
+
+	// Guarded by mu: roles by account ID (see role_logic.go), accounts
+	// invited to the channel and IDs of the pinned messages
+	roles   map[string]string
+	invited map[string]bool
+	pins    []string
+
+	// Guarded by mu: moderation state (see moderation_logic.go), the banned
+	// accounts, when muted accounts may post again, the slow mode interval
+	// and when each account last posted
+	bans     map[string]bool
+	mutes    map[string]time.Time
+	slowMode time.Duration
+	lastPost map[string]time.Time
+
+	// Guarded by mu: whether the channel was created by joining it and is
+	// stopped once idle (see lifecycle_logic.go), whether posts are
+	// rejected, and since when the channel has had no members
+	ephemeral  bool
+	archived   bool
+	emptySince time.Time
+
+	// Guarded by mu: topic, description, icon and attributes, and how many
+	// changes the channel's record has seen, see metadata_logic.go. recordMu
+	// serialises writes of the record.
+	metadata ChannelMetadata
+	revision uint64
+	recordMu sync.Mutex
+
+	// Serialises edits, deletions and reactions of the channel's messages,
+	// see edit_logic.go and reaction_logic.go
+	editMu sync.Mutex
+
+	// Guarded by mu: the nodes each account connected to another node is a
+	// member on, learned from their join and leave events
+	remoteMembers map[string]map[string]bool
+}
+
+// The IDs of channels created by joining them, and of threads, are derived
+// from the channel name and the parent message, so that every node of a
+// cluster gives them the same ID. A renamed channel keeps its ID, so a
+// channel created by joining its old name is given the next ID derived from
+// the name that is free. Explicitly created channels are given a random ID,
+// which the other nodes learn when the channel is announced.
+var (
+	channelNamespace = uuid.MustParse("6f1b7a4e-2c1d-5e8f-9a3b-4c5d6e7f8a9b")
+	threadNamespace  = uuid.MustParse("0d4c3b2a-1f0e-5d9c-8b7a-6f5e4d3c2b1a")
+)
+
+func channelIDFor(channelName string) string {
+	return uuid.NewSHA1(channelNamespace, []byte(normaliseChannelName(channelName))).String()
+}
+
+// nextChannelIDFor derives the nth ID after channelIDFor's for a channel
+// name. Normalised names have no line breaks, so these IDs are never
+// derived for another name.
+func nextChannelIDFor(channelName string, n int) string {
+	key := fmt.Sprintf("%s\n%d", normaliseChannelName(channelName), n)
+	return uuid.NewSHA1(channelNamespace, []byte(key)).String()
+}
+
+func threadIDFor(parentMessageID string) string {
+	return uuid.NewSHA1(threadNamespace, []byte(parentMessageID)).String()
 }
 
 // Create channel method -> Used by channel_manager.go
@@ -22,41 +103,100 @@ type Channel struct {
 func CreateChannel(channelName string, private bool) *Channel {
 
 	// Initialise fields
-	channelID := uuid.New().String()
-	users := make(map[*User]bool)
+	channelID := channelIDFor(channelName)
+	members := make(map[*Account]bool)
 	threads := make(map[*Thread]bool)
-	register := make(chan *User)
-	unregister := make(chan *User)
+	register := make(chan *Account)
+	unregister := make(chan *Account)
 	broadcast := make(chan *Message)
+	quit := make(chan struct{})
 
-	return &Channel{&channelID,
-		&channelName,
-		users,
-		threads,
-		register,
-		unregister,
-		broadcast,
-		private}
+	return &Channel{
+		channelID:     &channelID,
+		channelName:   &channelName,
+		members:       members,
+		threads:       threads,
+		register:      register,
+		unregister:    unregister,
+		broadcast:     broadcast,
+		quit:          quit,
+		Private:       private,
+		roles:         make(map[string]string),
+		invited:       make(map[string]bool),
+		bans:          make(map[string]bool),
+		mutes:         make(map[string]time.Time),
+		lastPost:      make(map[string]time.Time),
+		emptySince:    time.Now(),
+		metadata:      ChannelMetadata{ChannelID: channelID, CreatedAt: time.Now().UTC()},
+		remoteMembers: make(map[string]map[string]bool),
+	}
 }
 
 func (channel *Channel) Run() {
-	fmt.Println("Channel %s Running", channel.channelName)
+	log.Printf("[INFO] channel %s running", *channel.GetName())
 	for {
 		select {
 
 		// If content exists in channel.register chan, pull it out
-		case user := <-channel.register:
-			channel.registerUser(user)
+		case account := <-channel.register:
+			channel.registerMember(account)
 
-		case user := <-channel.unregister:
-			channel.unregisterUser(user)
+		case account := <-channel.unregister:
+			channel.unregisterMember(account)
 
 		case message := <-channel.broadcast:
-			channel.broadcastToUsers(MessageMarshal(*message))
+			channel.publish(message)
+
+		case <-channel.quit:
+			return
 		}
 	}
 }
 
+// Stop ends the channel's Run loop. It is safe to call more than once.
+func (channel *Channel) Stop() {
+	channel.stopOnce.Do(func() { close(channel.quit) })
+}
+
+// stopped reports whether the channel's Run loop was stopped
+func (channel *Channel) stopped() bool {
+	select {
+	case <-channel.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// join, leave and post hand work to the Run loop. They return false once the
+// channel has stopped, so callers never block on a loop that is gone.
+func (channel *Channel) join(account *Account) bool {
+	select {
+	case channel.register <- account:
+		return true
+	case <-channel.quit:
+		return false
+	}
+}
+
+func (channel *Channel) leave(account *Account) bool {
+	select {
+	case channel.unregister <- account:
+		return true
+	case <-channel.quit:
+		return false
+	}
+}
+
+func (channel *Channel) post(message *Message) bool {
+	select {
+	case channel.broadcast <- message:
+		return true
+	case <-channel.quit:
+		return false
+	}
+}
+
 /*
 	Methods to get channel fields
 */
@@ -66,18 +206,81 @@ func (channel *Channel) GetID() *string {
 }
 
 func (channel *Channel) GetName() *string {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
 	return channel.channelName
 }
 
-func (channel *Channel) GetAllUsers() map[*User]bool {
-	return channel.users
+// IsEphemeral reports whether the channel was created by joining it, and
+// is stopped once it has been idle for the channel TTL
+func (channel *Channel) IsEphemeral() bool {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	return channel.ephemeral
+}
+
+// setID gives a channel that is not registered yet its ID
+func (channel *Channel) setID(channelID string) {
+	channel.channelID = &channelID
+	channel.metadata.ChannelID = channelID
+}
+
+// GetMembers returns a snapshot of the accounts in the channel.
+func (channel *Channel) GetMembers() map[*Account]bool {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	members := make(map[*Account]bool, len(channel.members))
+	for account, value := range channel.members {
+		members[account] = value
+	}
+	return members
+}
+
+// HasMember reports whether the account with the given ID is in the channel.
+func (channel *Channel) HasMember(accountID string) bool {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	for account := range channel.members {
+		if account.accountID == accountID {
+			return true
+		}
+	}
+	return false
+}
+
+// FetchHistory returns a page of the channel history, see MessageStore.
+func (channel *Channel) FetchHistory(before string, limit int) ([]*Message, error) {
+	if channel.store == nil {
+		return []*Message{}, nil
+	}
+	return channel.store.FetchChannel(*channel.channelID, before, clampHistoryLimit(limit))
+}
 
+// clampHistoryLimit applies the default and maximum history page sizes
+func clampHistoryLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultHistoryLimit
+	} else if limit > MaxHistoryLimit {
+		return MaxHistoryLimit
+	}
+	return limit
 }
 
 func (channel *Channel) getThreads() map[*Thread]bool {
 	return channel.threads
 }
 
+// ListThreads returns the threads of the channel.
+func (channel *Channel) ListThreads() []*Thread {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	threads := make([]*Thread, 0, len(channel.threads))
+	for thread := range channel.threads {
+		threads = append(threads, thread)
+	}
+	return threads
+}
+
 // Description:    Gets all users in a specific Channel.
 // Input:          getUsersParams struct (logicParameters.go).
 // Returns:        List of pointers to user username or userID and error.
@@ -85,8 +288,11 @@ func (channel *Channel) GetUsers(p GetUsersParams_) ([]*string, error) {
 	var users []*string
 	var errorMsg error = nil
 
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+
 	// Loop through and append to return array all users satisfying users: True
-	for User, value := range channel.users {
+	for User, value := range channel.members {
 		if value {
 			if p.ReturnType == "username" {
 				users = append(users, User.GetUsername())
@@ -107,6 +313,8 @@ func (channel *Channel) GetUsers(p GetUsersParams_) ([]*string, error) {
 	Channel modification methods
 */
 func (channel *Channel) UpdateName(p UpdateName_) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
 	channel.channelName = &p.UpdatedName
 }
 
@@ -114,56 +322,382 @@ func (channel *Channel) UpdateName(p UpdateName_) {
 	Channel Threads Methods
 */
 
-// Create a new thread within a channel. Function must be called from an instantiated channel.
-func (channel *Channel) CreateThread() *Thread {
-	threadID := uuid.New().String()
-	users := make(map[*User]bool)
-	return &Thread{&threadID, users, channel}
+// Create a new thread within a channel, anchored to the channel message
+// parentMessageID. There is at most one thread per parent message, so the
+// existing thread is returned if there already is one.
+func (channel *Channel) CreateThread(parentMessageID string) *Thread {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+
+	for thread := range channel.threads {
+		if thread.parentMessageID == parentMessageID {
+			return thread
+		}
+	}
+
+	threadID := threadIDFor(parentMessageID)
+	members := make(map[*Account]bool)
+	thread := &Thread{sync.RWMutex{}, &threadID, parentMessageID, members, channel}
+	channel.threads[thread] = true
+	return thread
+}
+
+// FindThread returns the thread of the channel with the given ID, or nil.
+func (channel *Channel) FindThread(threadID string) *Thread {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	for thread := range channel.threads {
+		if *thread.threadID == threadID {
+			return thread
+		}
+	}
+	return nil
+}
+
+// FetchThreadHistory returns a page of a thread's history, see MessageStore.
+func (channel *Channel) FetchThreadHistory(threadID string, before string, limit int) ([]*Message, error) {
+	if channel.store == nil {
+		return []*Message{}, nil
+	}
+	return channel.store.FetchThread(threadID, before, clampHistoryLimit(limit))
 }
 
-// Adds a user to a room
-func (channel *Channel) registerUser(user *User) {
-	// Send join message to room
-	message := &Message{Action: JoinChannelAction,
-		Message: fmt.Sprintf("Welcome %s to the %s!", *user.username, *channel.channelName)}
-	channel.broadcastToUsers(MessageMarshal(*message))
+// GetMessage returns a message from the channel history, or nil.
+func (channel *Channel) GetMessage(messageID string) (*Message, error) {
+	if channel.store == nil {
+		return nil, nil
+	}
+	message, err := channel.store.Get(messageID)
+	if err != nil || message == nil || message.ChannelID != *channel.channelID {
+		return nil, err
+	}
+	return message, nil
+}
 
-	// Register user
-	channel.users[user] = true
+// markRead moves the user's read position forward to message, announcing it
+// to the channel. Reports false when the user had already read past it.
+func (channel *Channel) markRead(user *User, message *Message) (bool, error) {
+	if channel.reads == nil {
+		return false, nil
+	}
 
-	// Notify channel members that someone joined
-	channel.notifyUserJoined(user)
+	current, err := channel.reads.Get(user.UserId, *channel.GetID())
+	if err != nil {
+		return false, err
+	}
+	if current != nil {
+		read, err := channel.store.Get(current.MessageID)
+		if err != nil {
+			return false, err
+		}
+		if read != nil && !message.Timestamp.After(read.Timestamp) {
+			return false, nil
+		}
+	}
+
+	position := &ReadPosition{
+		UserID:    user.UserId,
+		ChannelID: *channel.GetID(),
+		MessageID: message.ID,
+		ReadAt:    time.Now().UTC(),
+	}
+	if err := channel.reads.Set(position); err != nil {
+		return false, err
+	}
+
+	frame := newFrame(ReadPositionAction, *channel.GetID(), position)
+	frame.Sender = user.Info()
+	channel.relay(&channelEvent{Read: position, Frame: FrameMarshal(frame)})
+	return true, nil
 }
 
-// Removes user from a room
-func (channel *Channel) unregisterUser(user *User) {
-	// Send leave message to room
-	message := &Message{Action: "User Left",
-		Message: fmt.Sprintf("%s left the channel", *user.username)}
-	channel.broadcastToUsers(MessageMarshal(*message))
+// ReadPositions lists the read position of every member who has read anything
+func (channel *Channel) ReadPositions() ([]*ReadPosition, error) {
+	if channel.reads == nil {
+		return []*ReadPosition{}, nil
+	}
+	return channel.reads.ListChannel(*channel.GetID())
+}
 
+// UnreadCount is the number of messages the user has not read, not counting
+// the user's own.
+func (channel *Channel) UnreadCount(userID string) (int, error) {
+	if channel.store == nil {
+		return 0, nil
+	}
+
+	after := ""
+	if channel.reads != nil {
+		position, err := channel.reads.Get(userID, *channel.GetID())
+		if err != nil {
+			return 0, err
+		}
+		if position != nil {
+			after = position.MessageID
+		}
+	}
+	return channel.store.CountAfter(*channel.GetID(), after, userID)
+}
+
+// Adds an account to a room
+func (channel *Channel) registerMember(account *Account) {
+	// Register account
+	channel.mu.Lock()
+	channel.members[account] = true
+	channel.emptySince = time.Time{}
+	channel.mu.Unlock()
+
+	// Notify channel members that someone joined. Conversation participants
+	// are members whenever they are connected, which is not news.
+	if !channel.Direct {
+		channel.notifyUserJoined(account)
+	}
+}
+
+// Removes an account from a room
+func (channel *Channel) unregisterMember(account *Account) {
 	// Remove from room
-	if _, ok := channel.users[user]; ok {
-		delete(channel.users, user)
+	channel.mu.Lock()
+	_, ok := channel.members[account]
+	delete(channel.members, account)
+	if ok && len(channel.members) == 0 {
+		channel.emptySince = time.Now()
+	}
+	channel.mu.Unlock()
+
+	// Send leave message to room
+	if ok && !channel.Direct {
+		message := newUserMessage(UserLeftChannelAction, account.Info(),
+			fmt.Sprintf("%s left the channel", *account.GetUsername()))
+		message.ChannelID = *channel.GetID()
+		channel.relay(&channelEvent{
+			Member: &memberChange{UserID: account.accountID},
+			Frame:  MessageMarshal(*message),
+		})
+	}
+}
+
+// publish stamps a message with its server ID and timestamp (unless the sender
+// already did), records it in the channel history and delivers it to every
+// member, or to the thread followers for thread replies.
+func (channel *Channel) publish(message *Message) {
+	if message.ID == "" {
+		message.stamp()
+	}
+	message.ChannelID = *channel.channelID
+
+	if channel.store != nil {
+		if err := channel.store.Append(message); err != nil {
+			log.Printf("[ERROR] unable to store message %s: %v", message.ID, err)
+		}
 	}
 
+	// Thread replies go to the thread followers rather than the whole channel
+	channel.relay(&channelEvent{ThreadID: message.ThreadID, Message: message, Frame: MessageMarshal(*message)})
+	if channel.server != nil {
+		channel.server.notifyMentions(channel, message)
+	}
+}
+
+// relay delivers the event's frame to the channel members connected to this
+// node and publishes it for the members connected to other nodes.
+func (channel *Channel) relay(event *channelEvent) {
+	event.ChannelID = *channel.GetID()
+	channel.deliver(event)
+	if channel.server != nil {
+		event.Node = channel.server.nodeID
+		channel.server.publishEvent(channelTopic, event)
+	}
+}
+
+// deliver sends the event's frame to the local channel members, or to the
+// local thread followers for thread events.
+func (channel *Channel) deliver(event *channelEvent) {
+	if event.ThreadID != "" {
+		if thread := channel.FindThread(event.ThreadID); thread != nil {
+			thread.broadcastToUsers(event.Frame)
+		}
+		return
+	}
+
+	channel.broadcastToUsers(event.Frame)
 }
 
+// broadcastToUsers delivers a message to every connection of every member
 func (channel *Channel) broadcastToUsers(message []byte) {
-	for user := range channel.users {
-		user.dataBuffer <- message
+	for account := range channel.GetMembers() {
+		account.send(message)
 	}
 }
 
-// Notifies the room that the user with username x joined.
-func (channel *Channel) notifyUserJoined(user *User) {
+// Notifies the room that the account with username x joined.
+func (channel *Channel) notifyUserJoined(account *Account) {
 	const welcomeMessage = "%s joined the room"
-	message := &Message{
-		Action:  SendMessageAction,
-		Target:  channel,
-		Message: fmt.Sprintf(welcomeMessage, *user.GetUsername()),
-	}
+	message := newUserMessage(UserJoinedChannelAction, account.Info(), fmt.Sprintf(welcomeMessage, *account.GetUsername()))
+	message.ChannelID = *channel.GetID()
 
 	// Send to all the users of the channel.
-	channel.broadcastToUsers(MessageMarshal(*message))
+	channel.relay(&channelEvent{
+		Member: &memberChange{UserID: account.accountID, Joined: true},
+		Frame:  MessageMarshal(*message),
+	})
+}
+
+// applyMember records an account joining or leaving the channel on another
+// node
+func (channel *Channel) applyMember(node string, change *memberChange) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	nodes := channel.remoteMembers[change.UserID]
+	if change.Joined {
+		if nodes == nil {
+			nodes = make(map[string]bool)
+			channel.remoteMembers[change.UserID] = nodes
+		}
+		nodes[node] = true
+		return
+	}
+	delete(nodes, node)
+	if len(nodes) == 0 {
+		delete(channel.remoteMembers, change.UserID)
+	}
+}
+
+// isMember reports whether the account is in the channel on any node of the
+// cluster, or takes part in the conversation
+func (channel *Channel) isMember(accountID string) bool {
+	if channel.Direct {
+		return channel.IsParticipant(accountID)
+	}
+	if channel.HasMember(accountID) {
+		return true
+	}
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	return len(channel.remoteMembers[accountID]) > 0
+}
+
+// Payload describes the channel on the wire
+func (channel *Channel) Payload() ChannelPayload {
+	metadata := channel.Metadata()
+	return ChannelPayload{
+		ID:           *channel.GetID(),
+		Name:         *channel.GetName(),
+		Private:      channel.Private,
+		Direct:       channel.Direct,
+		Participants: channel.GetParticipants(),
+		Pinned:       channel.GetPins(),
+		SlowMode:     int(channel.GetSlowMode() / time.Second),
+		Archived:     channel.IsArchived(),
+		Ephemeral:    channel.IsEphemeral(),
+		Topic:        metadata.Topic,
+		Description:  metadata.Description,
+		IconURL:      metadata.IconURL,
+		Attributes:   metadata.Attributes,
+		CreatedAt:    metadata.CreatedAt,
+		CreatedBy:    metadata.CreatedBy,
+	}
+}
+
+/*
+	Invitations and pins
+*/
+
+// mayJoin reports whether the account may join the channel by name. Private
+// channels can only be joined by invitation, or by accounts holding a role.
+func (channel *Channel) mayJoin(accountID string) bool {
+	if !channel.Private {
+		return true
+	}
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	_, hasRole := channel.roles[accountID]
+	return hasRole || channel.invited[accountID]
+}
+
+// Invite lets the target account join the channel, adds it right away if it
+// is connected to any node, and announces it to the channel.
+func (channel *Channel) Invite(actor *SenderInfo, target *SenderInfo) error {
+	if channel.Direct || !channel.Can(actor.ID, PermInvite) {
+		return ErrPermissionDenied
+	}
+	if channel.IsBanned(target.ID) {
+		return newFrameError(api_response.ERROR_BANNED, "user %s", target.ID)
+	}
+
+	channel.addInvite(target, actor)
+
+	frame := newFrame(UserInvitedAction, *channel.GetID(), target)
+	frame.Sender = actor
+	channel.relay(&channelEvent{Actor: actor.ID, Invite: &invitation{*target, *actor}, Frame: FrameMarshal(frame)})
+	return nil
+}
+
+// addInvite records an invitation and adds the target if it is connected to
+// this node
+func (channel *Channel) addInvite(target *SenderInfo, actor *SenderInfo) {
+	channel.mu.Lock()
+	channel.invited[target.ID] = true
+	channel.mu.Unlock()
+
+	if channel.server == nil {
+		return
+	}
+	if account := channel.server.findAccountByID(target.ID); account != nil {
+		account.enter(channel, actor)
+	}
+}
+
+// GetPins returns the IDs of the pinned messages, oldest pin first
+func (channel *Channel) GetPins() []string {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	return append([]string(nil), channel.pins...)
+}
+
+// SetPinned pins or unpins a channel message on behalf of the actor and
+// announces it to the channel. Pinning a pinned message, or unpinning one
+// that is not, changes nothing.
+func (channel *Channel) SetPinned(actor *SenderInfo, messageID string, pinned bool) error {
+	if !channel.Can(actor.ID, PermPin) {
+		return ErrPermissionDenied
+	}
+
+	message, err := channel.GetMessage(messageID)
+	if err != nil {
+		return err
+	}
+	if message == nil || message.ThreadID != "" {
+		return newFrameError(api_response.ERROR_NOT_EXIST_MESSAGE, "message %s", messageID)
+	}
+
+	change := &PinPayload{MessageID: messageID, Pinned: pinned}
+	if !channel.applyPin(change) {
+		return nil
+	}
+
+	frame := newFrame(PinnedAction, *channel.GetID(), change)
+	frame.Sender = actor
+	channel.relay(&channelEvent{Actor: actor.ID, Pin: change, Frame: FrameMarshal(frame)})
+	return nil
+}
+
+// applyPin records a pin change. Returns false if it changes nothing.
+func (channel *Channel) applyPin(change *PinPayload) bool {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	for i, messageID := range channel.pins {
+		if messageID == change.MessageID {
+			if change.Pinned {
+				return false
+			}
+			channel.pins = append(channel.pins[:i:i], channel.pins[i+1:]...)
+			return true
+		}
+	}
+	if !change.Pinned {
+		return false
+	}
+	channel.pins = append(channel.pins, change.MessageID)
+	return true
 }
@@ -0,0 +1,108 @@
+package logic
+
+import (
+	"fmt"
+	"testing"
+
+	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/backplane"
+)
+
+// newTestChannel builds a channel of a server with memory stores, with the
+// given roles by account ID. Its loop is not started, so events are handled
+// by the calling goroutine.
+func newTestChannel(t testing.TB, roles map[string]string) *Channel {
+	t.Helper()
+	channel := newTestServer(t, backplane.NewMemory()).newChannel("test", false)
+	for accountID, role := range roles {
+		channel.setRole(accountID, role)
+	}
+	return channel
+}
+
+// postTestMessage stores a chat message of the sender in the channel
+func postTestMessage(t testing.TB, channel *Channel, senderID string, text string) *Message {
+	t.Helper()
+	message := newUserMessage(SendMessageAction, &SenderInfo{ID: senderID, Name: senderID}, text)
+	message.ChannelID = *channel.GetID()
+	message.stamp()
+	if err := channel.store.Append(message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+// errorCode is the code of the error frame an error is answered with
+func errorCode(err error) int {
+	if err == nil {
+		return api_response.SUCCESS
+	}
+	return toFrameError(err, "").Code
+}
+
+func TestEnterChannel(t *testing.T) {
+	server := newTestServer(t, backplane.NewMemory())
+	account := newAccount("enterer", "enterer", server)
+
+	channel := server.newChannel("open", false)
+	server.runChannel(channel)
+	if result := account.enter(channel, nil); result != entered {
+		t.Fatalf("entering got %d, want entered", result)
+	}
+	if result := account.enter(channel, nil); result != alreadyMember || result.err("open") != nil {
+		t.Fatalf("entering again got %d, want alreadyMember", result)
+	}
+
+	stopped := server.newChannel("stopped", false)
+	stopped.Stop()
+	if result := account.enter(stopped, nil); result != channelStopped || errorCode(result.err("stopped")) != api_response.ERROR_NOT_EXIST_CHANNEL {
+		t.Fatalf("entering a stopped channel got %d, want channelStopped", result)
+	}
+	if account.isInChannel(stopped) {
+		t.Fatal("account kept a stopped channel")
+	}
+
+	// The last connection went away
+	account.removeSession(nil)
+	if result := account.enter(server.newChannel("late", false), nil); result != accountClosed || result.err("late") == nil {
+		t.Fatalf("entering after closing got %d, want accountClosed", result)
+	}
+}
+
+// BenchmarkFanOut delivers a chat message to every member of a channel. The
+// members' connections are drained as fast as frames arrive.
+func BenchmarkFanOut(b *testing.B) {
+	for _, members := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("members=%d", members), func(b *testing.B) {
+			server := newTestServer(b, backplane.NewMemory())
+			channel := CreateChannel("fan-out", false)
+
+			done := make(chan struct{})
+			defer close(done)
+			for i := 0; i < members; i++ {
+				user := CreateUser(fmt.Sprintf("member-%d", i), fmt.Sprintf("member %d", i), nil, server)
+				channel.members[server.accounts.Attach(user)] = true
+				go func() {
+					for {
+						select {
+						case <-user.dataBuffer:
+						case <-done:
+							return
+						}
+					}
+				}()
+			}
+
+			message := newUserMessage(SendMessageAction, &SenderInfo{ID: "sender", Name: "sender"}, "hello everyone")
+			message.ChannelID = *channel.GetID()
+			message.stamp()
+			frame := MessageMarshal(*message)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				channel.broadcastToUsers(frame)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package logic
+
+import (
+	"github.com/google/uuid"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Direct message conversations are channels between a fixed set of
+// participants. They are not named and cannot be joined: every participant
+// is a member, and nobody else can read or post in them. Their ID is derived
+// from the participants, in any order, so A→B and B→A is one conversation
+// and every node of a cluster agrees on it. The participants are kept with
+// the conversation's record, which brings conversations back when the
+// server restarts.
+var conversationNamespace = uuid.MustParse("3a9e5c1b-7d2f-5b4e-8c6a-1f0d9e8b7a6c")
+
+func conversationIDFor(participants []SenderInfo) string {
+	ids := make([]string, 0, len(participants))
+	for _, participant := range participants {
+		ids = append(ids, participant.ID)
+	}
+	sort.Strings(ids)
+	return uuid.NewSHA1(conversationNamespace, []byte(strings.Join(ids, "\n"))).String()
+}
+
+// CreateConversation builds the conversation between the given participants
+func CreateConversation(participants []SenderInfo) *Channel {
+	sorted := append([]SenderInfo(nil), participants...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	names := make([]string, 0, len(sorted))
+	for _, participant := range sorted {
+		names = append(names, participant.Name)
+	}
+
+	channel := CreateChannel(strings.Join(names, ", "), true)
+	channelID := conversationIDFor(sorted)
+	channel.channelID = &channelID
+	channel.Direct = true
+	channel.participants = sorted
+	return channel
+}
+
+// IsParticipant reports whether the account takes part in the conversation.
+// It is always false for channels.
+func (channel *Channel) IsParticipant(accountID string) bool {
+	for _, participant := range channel.participants {
+		if participant.ID == accountID {
+			return true
+		}
+	}
+	return false
+}
+
+// GetParticipants returns the participants of a conversation, ordered by ID
+func (channel *Channel) GetParticipants() []SenderInfo {
+	return channel.participants
+}
+
+// ConversationRegistry indexes conversations by ID and by participant. It is
+// safe for concurrent use.
+type ConversationRegistry struct {
+	mu            sync.RWMutex
+	byID          map[string]*Channel
+	byParticipant map[string][]*Channel
+}
+
+func NewConversationRegistry() *ConversationRegistry {
+	return &ConversationRegistry{
+		byID:          make(map[string]*Channel),
+		byParticipant: make(map[string][]*Channel),
+	}
+}
+
+// GetOrCreate returns the conversation between the given participants,
+// registering the one built by create if there is none. created reports
+// whether create was used.
+func (registry *ConversationRegistry) GetOrCreate(participants []SenderInfo, create func() *Channel) (channel *Channel, created bool) {
+	id := conversationIDFor(participants)
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if channel, ok := registry.byID[id]; ok {
+		return channel, false
+	}
+
+	channel = create()
+	registry.byID[id] = channel
+	for _, participant := range participants {
+		registry.byParticipant[participant.ID] = append(registry.byParticipant[participant.ID], channel)
+	}
+	return channel, true
+}
+
+// Get returns the conversation with the given ID, or nil.
+func (registry *ConversationRegistry) Get(id string) *Channel {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	return registry.byID[id]
+}
+
+// ForParticipant returns a snapshot of the conversations an account takes
+// part in.
+func (registry *ConversationRegistry) ForParticipant(accountID string) []*Channel {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	return append([]*Channel(nil), registry.byParticipant[accountID]...)
+}
+
+// List returns a snapshot of every conversation.
+func (registry *ConversationRegistry) List() []*Channel {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	conversations := make([]*Channel, 0, len(registry.byID))
+	for _, channel := range registry.byID {
+		conversations = append(conversations, channel)
+	}
+	return conversations
+}
+
+// getOrCreateConversation returns the conversation between the given
+// participants, creating and starting it first if it does not exist yet.
+// creatorID opened the conversation, unless it is stored already.
+func (server *WsServer) getOrCreateConversation(participants []SenderInfo, creatorID string) *Channel {
+	channel, created := server.conversations.GetOrCreate(participants, func() *Channel {
+		channel := CreateConversation(participants)
+		channel.store = server.store
+		channel.reads = server.reads
+		channel.metaStore = server.metaStore
+		channel.server = server
+		return channel
+	})
+	if created {
+		if !server.loadRecord(channel) {
+			channel.setCreator(creatorID)
+			channel.save()
+		}
+		server.runChannel(channel)
+	}
+	return channel
+}
+
+// restoreConversations starts the conversations found in the channel store
+func (server *WsServer) restoreConversations(stored []ChannelRecord) {
+	restored := 0
+	for _, record := range stored {
+		if len(record.Participants) > 0 {
+			server.getOrCreateConversation(record.Participants, record.CreatedBy)
+			restored++
+		}
+	}
+	if restored > 0 {
+		log.Printf("[INFO] restored %d conversations", restored)
+	}
+}
+
+// openConversation returns the conversation between the given participants
+// and makes the accounts of those connected to this node members of it.
+// sender is the participant who opened it.
+func (server *WsServer) openConversation(participants []SenderInfo, sender *SenderInfo) *Channel {
+	channel := server.getOrCreateConversation(participants, sender.ID)
+	for _, participant := range participants {
+		if account := server.findAccountByID(participant.ID); account != nil {
+			account.joinConversation(channel, sender)
+		}
+	}
+	return channel
+}
+
+// joinConversations makes a newly connected account a member of every
+// conversation it takes part in.
+func (server *WsServer) joinConversations(account *Account) {
+	for _, channel := range server.conversations.ForParticipant(account.accountID) {
+		account.joinConversation(channel, nil)
+	}
+}
@@ -0,0 +1,143 @@
+package logic
+
+import (
+	"time"
+	"wjjmjh/hermes/pkg/api_response"
+)
+
+// MaxEditHistory is how many earlier versions of a message are kept
+const MaxEditHistory = 50
+
+// Chat messages can be edited and deleted by their author, or by a
+// moderator ranked above the author. Edits keep the replaced text in the
+// message's edit history. Deleted messages become tombstones: they keep their
+// place in history, so that clients render them consistently, but lose their
+// text, edit history, reactions and mentions. Edits and deletions update the
+// stored message and are announced to the channel, or to the thread
+// followers for thread replies.
+
+// MessageEdit is an earlier version of an edited message, and when and by
+// whom it was replaced
+type MessageEdit struct {
+	Text     string    `json:"text"`
+	EditedAt time.Time `json:"edited_at"`
+	EditedBy string    `json:"edited_by"`
+}
+
+// EditMessage replaces the text of a chat message on behalf of the actor.
+// Authors need to be allowed to post; editing a message to the text it
+// already has changes nothing.
+func (channel *Channel) EditMessage(actor *SenderInfo, messageID string, text string) error {
+	if channel.IsArchived() {
+		return newFrameError(api_response.ERROR_ARCHIVED_CHANNEL, "channel %s", *channel.GetID())
+	}
+
+	channel.editMu.Lock()
+	defer channel.editMu.Unlock()
+
+	message, err := channel.changeableMessage(actor, messageID)
+	if err != nil {
+		return err
+	}
+	if message.SenderID == actor.ID {
+		if !channel.Can(actor.ID, PermPost) {
+			return ErrPermissionDenied
+		}
+		if until, muted := channel.MutedUntil(actor.ID); muted {
+			return newFrameError(api_response.ERROR_MUTED, "muted until %s", until.Format(time.RFC3339))
+		}
+	}
+	if message.Text == text {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	edits := append(append([]MessageEdit(nil), message.Edits...), MessageEdit{Text: message.Text, EditedAt: now, EditedBy: actor.ID})
+	if len(edits) > MaxEditHistory {
+		edits = edits[len(edits)-MaxEditHistory:]
+	}
+	message.Text = text
+	message.Edits = edits
+	message.EditedAt = &now
+	message.Mentions = channel.mentionsIn(text)
+	if err := channel.store.Update(message); err != nil {
+		return err
+	}
+
+	frame := newFrame(MessageEditedAction, message.ChannelID, MessageEditedPayload{MessageID: message.ID, Text: text, EditedAt: now, Mentions: message.Mentions})
+	frame.ThreadID = message.ThreadID
+	frame.Sender = actor
+	channel.relay(&channelEvent{Actor: actor.ID, ThreadID: message.ThreadID, Changed: message, Frame: FrameMarshal(frame)})
+	return nil
+}
+
+// DeleteMessage turns a chat message into a tombstone on behalf of the actor
+func (channel *Channel) DeleteMessage(actor *SenderInfo, messageID string) error {
+	channel.editMu.Lock()
+	defer channel.editMu.Unlock()
+
+	message, err := channel.changeableMessage(actor, messageID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	message.Text = ""
+	message.Edits = nil
+	message.EditedAt = nil
+	message.Reactions = nil
+	message.Mentions = nil
+	message.DeletedAt = &now
+	message.DeletedBy = actor.ID
+	if err := channel.store.Update(message); err != nil {
+		return err
+	}
+	channel.applyMessageChange(message)
+
+	frame := newFrame(MessageDeletedAction, message.ChannelID, MessageDeletedPayload{MessageID: message.ID, DeletedAt: now})
+	frame.ThreadID = message.ThreadID
+	frame.Sender = actor
+	channel.relay(&channelEvent{Actor: actor.ID, ThreadID: message.ThreadID, Changed: message, Frame: FrameMarshal(frame)})
+	return nil
+}
+
+// changeableMessage returns the chat message of the channel the actor may
+// edit or delete. Deleted messages and server notices cannot be changed.
+func (channel *Channel) changeableMessage(actor *SenderInfo, messageID string) (*Message, error) {
+	message, err := channel.GetMessage(messageID)
+	if err != nil {
+		return nil, err
+	}
+	if message == nil || message.DeletedAt != nil ||
+		(message.Type != SendMessageAction && message.Type != SendThreadMessageAction) {
+		return nil, newFrameError(api_response.ERROR_NOT_EXIST_MESSAGE, "message %s", messageID)
+	}
+
+	if message.SenderID != actor.ID {
+		if err := channel.checkModerator(actor, message.SenderID, PermManageMessages); err != nil {
+			return nil, err
+		}
+	}
+	return message, nil
+}
+
+// applyMessageChange applies an edited or deleted message to this node's
+// copy of the channel: deleted messages are no longer pinned.
+func (channel *Channel) applyMessageChange(message *Message) {
+	if message.DeletedAt != nil {
+		channel.applyPin(&PinPayload{MessageID: message.ID, Pinned: false})
+	}
+}
+
+// EditHistory returns the earlier versions of a channel message, oldest
+// first
+func (channel *Channel) EditHistory(messageID string) ([]MessageEdit, error) {
+	message, err := channel.GetMessage(messageID)
+	if err != nil {
+		return nil, err
+	}
+	if message == nil {
+		return nil, newFrameError(api_response.ERROR_NOT_EXIST_MESSAGE, "message %s", messageID)
+	}
+	return append([]MessageEdit{}, message.Edits...), nil
+}
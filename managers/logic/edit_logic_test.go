@@ -0,0 +1,132 @@
+package logic
+
+import (
+	"strings"
+	"testing"
+
+	"wjjmjh/hermes/pkg/api_response"
+)
+
+func TestEditMessage(t *testing.T) {
+	roles := map[string]string{"owner": RoleOwner, "moderator": RoleModerator, "guest": RoleGuest}
+	tests := []struct {
+		name   string
+		author string
+		actor  string
+		text   string
+		code   int
+	}{
+		{"author", "alice", "alice", "fixed", api_response.SUCCESS},
+		{"moderator over a member", "alice", "moderator", "fixed", api_response.SUCCESS},
+		{"owner over a moderator", "moderator", "owner", "fixed", api_response.SUCCESS},
+		{"another member", "alice", "bob", "fixed", api_response.ERROR_PERMISSION_DENIED},
+		{"moderator over the owner", "owner", "moderator", "fixed", api_response.ERROR_PERMISSION_DENIED},
+		{"author who may no longer post", "guest", "guest", "fixed", api_response.ERROR_PERMISSION_DENIED},
+		{"unchanged text", "alice", "alice", "original", api_response.SUCCESS},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			channel := newTestChannel(t, roles)
+			message := postTestMessage(t, channel, test.author, "original")
+
+			err := channel.EditMessage(&SenderInfo{ID: test.actor}, message.ID, test.text)
+			if code := errorCode(err); code != test.code {
+				t.Fatalf("edit answered %d (%v), want %d", code, err, test.code)
+			}
+
+			stored, _ := channel.GetMessage(message.ID)
+			edits, _ := channel.EditHistory(message.ID)
+			switch {
+			case test.code != api_response.SUCCESS || test.text == "original":
+				if stored.Text != "original" || len(edits) != 0 || stored.EditedAt != nil {
+					t.Fatalf("message changed to %q with %d edits", stored.Text, len(edits))
+				}
+			default:
+				if stored.Text != test.text || stored.EditedAt == nil {
+					t.Fatalf("message is %q, want %q", stored.Text, test.text)
+				}
+				if len(edits) != 1 || edits[0].Text != "original" || edits[0].EditedBy != test.actor {
+					t.Fatalf("edit history is %+v", edits)
+				}
+			}
+		})
+	}
+}
+
+func TestEditHistoryIsBounded(t *testing.T) {
+	channel := newTestChannel(t, nil)
+	message := postTestMessage(t, channel, "alice", "version 0")
+	for i := 1; i <= MaxEditHistory+5; i++ {
+		if err := channel.EditMessage(&SenderInfo{ID: "alice"}, message.ID, strings.Repeat("x", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	edits, _ := channel.EditHistory(message.ID)
+	if len(edits) != MaxEditHistory {
+		t.Fatalf("%d edits kept, want %d", len(edits), MaxEditHistory)
+	}
+	if edits[len(edits)-1].Text != strings.Repeat("x", MaxEditHistory+4) {
+		t.Fatal("latest replaced text is not the last edit")
+	}
+}
+
+func TestDeleteMessageLeavesTombstone(t *testing.T) {
+	tests := []struct {
+		name  string
+		actor string
+		code  int
+	}{
+		{"author", "alice", api_response.SUCCESS},
+		{"moderator", "moderator", api_response.SUCCESS},
+		{"another member", "bob", api_response.ERROR_PERMISSION_DENIED},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			channel := newTestChannel(t, map[string]string{"moderator": RoleModerator})
+			message := postTestMessage(t, channel, "alice", "original")
+			if err := channel.EditMessage(&SenderInfo{ID: "alice"}, message.ID, "edited"); err != nil {
+				t.Fatal(err)
+			}
+
+			err := channel.DeleteMessage(&SenderInfo{ID: test.actor}, message.ID)
+			if code := errorCode(err); code != test.code {
+				t.Fatalf("delete answered %d (%v), want %d", code, err, test.code)
+			}
+			if err != nil {
+				return
+			}
+
+			// The tombstone keeps its place in history, without its text
+			history, _ := channel.FetchHistory("", DefaultHistoryLimit)
+			if len(history) != 1 || history[0].ID != message.ID {
+				t.Fatalf("history is %+v, want the tombstone", history)
+			}
+			tombstone := history[0]
+			if tombstone.DeletedAt == nil || tombstone.DeletedBy != test.actor || tombstone.Text != "" || len(tombstone.Edits) != 0 {
+				t.Fatalf("tombstone is %+v", tombstone)
+			}
+
+			// Tombstones cannot be edited or deleted again
+			if code := errorCode(channel.EditMessage(&SenderInfo{ID: "alice"}, message.ID, "back")); code != api_response.ERROR_NOT_EXIST_MESSAGE {
+				t.Fatalf("editing a tombstone answered %d", code)
+			}
+			if code := errorCode(channel.DeleteMessage(&SenderInfo{ID: "alice"}, message.ID)); code != api_response.ERROR_NOT_EXIST_MESSAGE {
+				t.Fatalf("deleting a tombstone answered %d", code)
+			}
+		})
+	}
+}
+
+func TestServerNoticesCannotBeEdited(t *testing.T) {
+	channel := newTestChannel(t, map[string]string{"owner": RoleOwner})
+	notice := &Message{Type: UserJoinedChannelAction, ChannelID: *channel.GetID(), SenderID: "alice", Text: "alice joined"}
+	notice.stamp()
+	if err := channel.store.Append(notice); err != nil {
+		t.Fatal(err)
+	}
+	for _, actor := range []string{"alice", "owner"} {
+		if code := errorCode(channel.EditMessage(&SenderInfo{ID: actor}, notice.ID, "edited")); code != api_response.ERROR_NOT_EXIST_MESSAGE {
+			t.Fatalf("%s editing a notice answered %d", actor, code)
+		}
+	}
+}
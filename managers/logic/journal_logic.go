@@ -0,0 +1,236 @@
+package logic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"wjjmjh/hermes/pkg/setting"
+	"wjjmjh/hermes/pkg/util/files"
+)
+
+// The file stores keep their state in memory and append every change to a
+// journal, a log file of JSON records, one per line, which is replayed into
+// memory when the store is opened. Lines may be of any length. A crash while
+// appending can leave the last line without its newline: it is kept if it
+// decodes, and cut off otherwise, so the store opens again.
+//
+// Appends are synced to disk straight away, or every SyncInterval seconds of
+// the [storage] settings. Records superseded by later ones are dropped when
+// the store is opened again, by rewriting the journal as a snapshot of the
+// state it replayed to.
+
+// journalBufferSize is the initial read buffer of a replay; longer lines grow
+// it
+const journalBufferSize = 1024 * 1024
+
+// journal is an append-only log of JSON records. Callers serialise appends.
+type journal struct {
+	path string
+	file *os.File
+
+	// Records replayed or appended since the journal was last rewritten
+	records int
+
+	// With a sync interval, dirty is set by appends and cleared by the syncer
+	mu       sync.Mutex
+	interval time.Duration
+	dirty    bool
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// openJournal opens (or creates) the journal named name in directory dir and
+// hands every record to replay, oldest first.
+func openJournal(dir string, name string, replay func(record []byte) error) (*journal, error) {
+	if err := files.IsNotExistMkDir(dir); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, name)
+	file, err := files.Open(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	journal := &journal{path: path, file: file, interval: setting.StorageSetting.SyncInterval}
+	if err := journal.replay(replay); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	if journal.interval > 0 {
+		journal.stop = make(chan struct{})
+		journal.stopped = make(chan struct{})
+		go journal.syncer()
+	}
+	return journal, nil
+}
+
+func (journal *journal) replay(replay func(record []byte) error) error {
+	reader := bufio.NewReaderSize(journal.file, journalBufferSize)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return journal.repair(offset, line, replay)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if record := bytes.TrimSpace(line); len(record) > 0 {
+			if err := replay(record); err != nil {
+				return fmt.Errorf("corrupt entry in %s at offset %d: %v", journal.path, offset, err)
+			}
+			journal.records++
+		}
+		offset += int64(len(line))
+	}
+}
+
+// repair deals with a last line missing its newline, found at offset: it is
+// completed if its record decodes, and cut off otherwise.
+func (journal *journal) repair(offset int64, line []byte, replay func(record []byte) error) error {
+	if record := bytes.TrimSpace(line); len(record) > 0 && replay(record) == nil {
+		journal.records++
+		_, err := journal.file.Write([]byte{'\n'})
+		return err
+	}
+	return journal.file.Truncate(offset)
+}
+
+// compact rewrites the journal as the records written by snapshot, the
+// current state, when it holds more than live records, the number snapshot
+// writes. The snapshot replaces the journal only once it is fully on disk.
+func (journal *journal) compact(live int, snapshot func(write func(record interface{}) error) error) error {
+	if journal.records <= live {
+		return nil
+	}
+
+	path := journal.path + ".compact"
+	file, err := files.Open(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	writer := bufio.NewWriterSize(file, journalBufferSize)
+	written := 0
+	err = snapshot(func(record interface{}) error {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		written++
+		_, err = writer.Write(append(line, '\n'))
+		return err
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("compacting %s: %v", journal.path, err)
+	}
+
+	if err := os.Rename(path, journal.path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(journal.path)); err != nil {
+		return err
+	}
+
+	reopened, err := files.Open(journal.path, os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	journal.mu.Lock()
+	_ = journal.file.Close()
+	journal.file = reopened
+	journal.mu.Unlock()
+	journal.records = written
+	return nil
+}
+
+// syncDir makes a rename in directory dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Append writes a record as the last line of the journal, and syncs it unless
+// the journal syncs on an interval
+func (journal *journal) Append(record interface{}) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := journal.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	journal.records++
+
+	if journal.interval > 0 {
+		journal.mu.Lock()
+		journal.dirty = true
+		journal.mu.Unlock()
+		return nil
+	}
+	return journal.file.Sync()
+}
+
+// syncer syncs appended records every interval, until the journal closes
+func (journal *journal) syncer() {
+	defer close(journal.stopped)
+	ticker := time.NewTicker(journal.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			journal.sync()
+		case <-journal.stop:
+			return
+		}
+	}
+}
+
+// sync flushes appended records to disk, if there are any
+func (journal *journal) sync() error {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	if !journal.dirty {
+		return nil
+	}
+	journal.dirty = false
+	return journal.file.Sync()
+}
+
+func (journal *journal) Close() error {
+	if journal.stop != nil {
+		close(journal.stop)
+		<-journal.stopped
+	}
+	err := journal.sync()
+	if closeErr := journal.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,218 @@
+package logic
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"wjjmjh/hermes/pkg/setting"
+)
+
+func TestJournalReplaysLongLines(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenFileMessageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := &Message{ID: "long", ChannelID: "channel", Text: strings.Repeat("x", 3*journalBufferSize)}
+	if err := store.Append(long); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenFileMessageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	message, _ := store.Get("long")
+	if message == nil || message.Text != long.Text {
+		t.Fatal("long message was not replayed")
+	}
+}
+
+func TestJournalTornLastLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		torn  string
+		kept  bool
+		after string
+	}{
+		{"cut off", `{"id":"b","channel_id":"c","te`, false, `{"id":"a","channel_id":"c"}` + "\n"},
+		{"complete record", `{"id":"b","channel_id":"c"}`, true, `{"id":"a","channel_id":"c"}` + "\n" + `{"id":"b","channel_id":"c"}` + "\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "messages.log")
+			content := `{"id":"a","channel_id":"c"}` + "\n" + test.torn
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			store, err := OpenFileMessageStore(dir)
+			if err != nil {
+				t.Fatalf("torn journal did not open: %v", err)
+			}
+			if message, _ := store.Get("a"); message == nil {
+				t.Fatal("complete record was lost")
+			}
+			if message, _ := store.Get("b"); (message != nil) != test.kept {
+				t.Fatalf("torn record kept: %v, want %v", message != nil, test.kept)
+			}
+
+			// Later records start on a line of their own
+			if err := store.Append(&Message{ID: "z", ChannelID: "c"}); err != nil {
+				t.Fatal(err)
+			}
+			_ = store.Close()
+			got, _ := ioutil.ReadFile(path)
+			want := test.after + `{"id":"z",`
+			if !strings.HasPrefix(string(got), want) {
+				t.Fatalf("journal is %q, want it to start with %q", got, want)
+			}
+		})
+	}
+}
+
+func TestJournalCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	content := "not json\n" + `{"id":"a","channel_id":"c"}` + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "reads.log"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFileReadStore(dir); err == nil {
+		t.Fatal("expected a corrupt record to be refused")
+	}
+}
+
+// journalLines counts the records in the journal at path
+func journalLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestJournalCompactsOnOpen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "messages.log")
+	store, err := OpenFileMessageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if err := store.Append(&Message{ID: id, ChannelID: "channel", Text: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Append(&Message{ID: "reply", ChannelID: "channel", ThreadID: "thread", Text: "reply"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := store.Update(&Message{ID: "b", ChannelID: "channel", Text: strings.Repeat("b", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = store.Close()
+	if lines := journalLines(t, path); lines != 14 {
+		t.Fatalf("journal has %d records before compaction, want 14", lines)
+	}
+
+	// Reopening drops the superseded versions, and keeps history in order
+	store, err = OpenFileMessageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := journalLines(t, path); lines != 4 {
+		t.Fatalf("journal has %d records after compaction, want 4", lines)
+	}
+	if err := store.Append(&Message{ID: "d", ChannelID: "channel", Text: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Close()
+
+	store, err = OpenFileMessageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if lines := journalLines(t, path); lines != 5 {
+		t.Fatalf("journal without superseded records rewritten to %d records, want 5", lines)
+	}
+	history, _ := store.FetchChannel("channel", "", 10)
+	var texts []string
+	for _, message := range history {
+		texts = append(texts, message.Text)
+	}
+	if got := strings.Join(texts, ","); got != "a,bbbbbbbbb,c,d" {
+		t.Fatalf("history after compaction is %s", got)
+	}
+	if replies, _ := store.FetchThread("thread", "", 10); len(replies) != 1 {
+		t.Fatalf("thread has %d replies after compaction, want 1", len(replies))
+	}
+}
+
+func TestJournalCompactsDeletedChannels(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenFileChannelStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Set(&ChannelRecord{ChannelMetadata: ChannelMetadata{ChannelID: "kept", Topic: "old"}, Name: "kept"})
+	_ = store.Set(&ChannelRecord{ChannelMetadata: ChannelMetadata{ChannelID: "kept", Topic: "new"}, Name: "kept"})
+	_ = store.Set(&ChannelRecord{ChannelMetadata: ChannelMetadata{ChannelID: "gone"}, Name: "gone"})
+	_ = store.Delete("gone")
+	_ = store.Close()
+
+	store, err = OpenFileChannelStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if lines := journalLines(t, filepath.Join(dir, "channels.log")); lines != 1 {
+		t.Fatalf("journal has %d records after compaction, want 1", lines)
+	}
+	if record, _ := store.Get("kept"); record == nil || record.Topic != "new" || record.Name != "kept" {
+		t.Fatalf("compacted record is %+v", record)
+	}
+	if record, _ := store.Get("gone"); record != nil {
+		t.Fatal("deleted record came back after compaction")
+	}
+}
+
+func TestJournalSyncInterval(t *testing.T) {
+	previous := setting.StorageSetting.SyncInterval
+	setting.StorageSetting.SyncInterval = 10 * time.Millisecond
+	defer func() { setting.StorageSetting.SyncInterval = previous }()
+
+	dir := t.TempDir()
+	store, err := OpenFileReadStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := store.Set(&ReadPosition{UserID: "user", ChannelID: "channel", MessageID: string(rune('a' + i))}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenFileReadStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if position, _ := store.Get("user", "channel"); position == nil || position.MessageID != "e" {
+		t.Fatalf("position after reopening is %+v", position)
+	}
+}
@@ -0,0 +1,306 @@
+package logic
+
+import (
+	"log"
+	"time"
+	"wjjmjh/hermes/pkg/api_response"
+)
+
+// Channels are created explicitly, with create-channel or the REST API, or,
+// when ImplicitChannelCreate is set, by joining a channel name nobody used
+// yet. Either way the account creating a channel owns it on every node.
+//
+// Explicitly created channels are announced to every node, and registered
+// again from their stored record when a node starts. Channels created by
+// joining are ephemeral: once they have been empty for the channel TTL the
+// reaper unregisters them and stops their Run loop. Joining the name again
+// starts the channel again with the same ID, restored from its record. Every
+// node creates such a channel on its own when it is first joined there, so
+// the nodes tell each other who created it: the one created first wins. A
+// renamed ephemeral channel is kept like an explicitly created one.
+//
+// Every node stores its own record of every channel it runs. A node that
+// starts, or starts an ephemeral channel again, asks the others for their
+// records, and takes the latest if it missed changes meanwhile.
+//
+// Archived channels stay readable and joinable, but nobody can post in them
+// until they are unarchived. Deleted channels are gone, their members are
+// told so. Explicitly created channels are given a random ID, so creating a
+// channel with the name of a deleted one starts a new, empty history.
+
+// IsArchived reports whether the channel rejects posts
+func (channel *Channel) IsArchived() bool {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	return channel.archived
+}
+
+// SetArchived archives or unarchives the channel on behalf of the actor and
+// announces it to the channel. Archiving an archived channel, or
+// unarchiving one that is not, changes nothing.
+func (channel *Channel) SetArchived(actor *SenderInfo, archived bool) error {
+	if channel.Direct || !channel.Can(actor.ID, PermArchive) {
+		return ErrPermissionDenied
+	}
+	if !channel.applyArchived(archived) {
+		return nil
+	}
+	channel.save()
+
+	action := ChannelArchivedAction
+	if !archived {
+		action = ChannelUnarchivedAction
+	}
+	frame := newFrame(action, *channel.GetID(), channel.Payload())
+	frame.Sender = actor
+	channel.relay(&channelEvent{Actor: actor.ID, Archived: &archived, Frame: FrameMarshal(frame)})
+	return nil
+}
+
+// applyArchived records whether the channel is archived. Returns false if it
+// changes nothing.
+func (channel *Channel) applyArchived(archived bool) bool {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	if channel.archived == archived {
+		return false
+	}
+	channel.archived = archived
+	return true
+}
+
+// idleFor returns how long an ephemeral channel has been empty, zero for
+// channels with members and channels that are not ephemeral
+func (channel *Channel) idleFor(now time.Time) time.Duration {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	if !channel.ephemeral || len(channel.members) > 0 {
+		return 0
+	}
+	return now.Sub(channel.emptySince)
+}
+
+// registerChannel registers a channel from its record, failing with
+// ErrChannelExists if its name or ID is taken. Its loop is not started.
+func (server *WsServer) registerChannel(record *ChannelRecord) (*Channel, error) {
+	channel := server.newChannel(record.Name, record.Private)
+	channel.setID(record.ChannelID)
+	channel.restore(record)
+	if err := server.channels.Add(channel); err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+// restoreChannels registers and starts the channels found in the channel
+// store, but for ephemeral channels and conversations
+func (server *WsServer) restoreChannels(stored []ChannelRecord) {
+	restored := 0
+	for i := range stored {
+		record := &stored[i]
+		if record.Name == "" || record.Ephemeral || len(record.Participants) > 0 {
+			continue
+		}
+		channel, err := server.registerChannel(record)
+		if err != nil {
+			log.Printf("[WARN] unable to restore channel %s (%s): %v", record.Name, record.ChannelID, err)
+			continue
+		}
+		server.runChannel(channel)
+		restored++
+	}
+	if restored > 0 {
+		log.Printf("[INFO] restored %d channels", restored)
+	}
+}
+
+// announceCreated relays an explicitly created or kept channel to the other
+// nodes, so they register it too
+func (server *WsServer) announceCreated(channel *Channel) {
+	server.publishEvent(channelTopic, &channelEvent{
+		Node:      server.nodeID,
+		ChannelID: *channel.GetID(),
+		Created:   channel.record(),
+	})
+}
+
+// adoptChannel registers a channel created on another node, unless this node
+// already has a channel with its name. If it has the channel, the records
+// are reconciled.
+func (server *WsServer) adoptChannel(record *ChannelRecord) {
+	if channel := server.channels.GetByID(record.ChannelID); channel != nil {
+		server.reconcile(channel, record)
+		return
+	}
+	channel, err := server.registerChannel(record)
+	if err != nil {
+		return
+	}
+	channel.persist()
+	server.runChannel(channel)
+}
+
+// renameChannel renames a registered channel and stores it. An ephemeral
+// channel is kept from then on; kept reports whether it was ephemeral.
+// Renaming a kept channel to its name changes nothing: the rename may have
+// been taken from another node's record already.
+func (server *WsServer) renameChannel(channel *Channel, channelName string) (kept bool, err error) {
+	if *channel.GetName() == channelName && !channel.IsEphemeral() {
+		return false, nil
+	}
+	if err := server.channels.Rename(channel, channelName); err != nil {
+		return false, err
+	}
+	channel.mu.Lock()
+	kept = channel.ephemeral
+	channel.ephemeral = false
+	channel.mu.Unlock()
+	channel.save()
+	return kept, nil
+}
+
+// announceSnapshot tells the other nodes this node's record of an ephemeral
+// channel, so they agree on who created it and on its latest state
+func (server *WsServer) announceSnapshot(channel *Channel) {
+	server.publishEvent(channelTopic, &channelEvent{
+		Node:      server.nodeID,
+		ChannelID: *channel.GetID(),
+		Snapshot:  channel.record(),
+	})
+}
+
+// announceRecord tells the other nodes this node's record of a channel:
+// kept channels are announced as created, so nodes that do not know them
+// register them
+func (server *WsServer) announceRecord(channel *Channel) {
+	if channel.IsEphemeral() {
+		server.announceSnapshot(channel)
+	} else {
+		server.announceCreated(channel)
+	}
+}
+
+// requestSync asks the other nodes for their records of the channel with
+// the given ID, or of every channel they run if it is empty. A node that
+// missed changes, because it was down or did not run the channel, catches
+// up from the answers.
+func (server *WsServer) requestSync(channelID string) {
+	server.publishEvent(channelTopic, &channelEvent{Node: server.nodeID, ChannelID: channelID, Sync: true})
+}
+
+// answerSync announces this node's records of the channels a sync request
+// asks for
+func (server *WsServer) answerSync(channelID string) {
+	if channelID == "" {
+		for _, channel := range server.channels.List() {
+			server.announceRecord(channel)
+		}
+	} else if channel := server.channels.GetByID(channelID); channel != nil {
+		server.announceRecord(channel)
+	}
+}
+
+// receiveSnapshot reconciles another node's record of an ephemeral channel
+// with this node's. A record of a channel this node does not run is stored
+// for when it is joined here, unless the stored one supersedes it.
+func (server *WsServer) receiveSnapshot(record *ChannelRecord) {
+	if channel := server.channels.GetByID(record.ChannelID); channel != nil {
+		server.reconcile(channel, record)
+		return
+	}
+	stored, err := server.metaStore.Get(record.ChannelID)
+	if err != nil {
+		log.Printf("[ERROR] unable to load channel %s: %v", record.ChannelID, err)
+		return
+	}
+	if stored == nil || (stored.Ephemeral && record.supersedes(stored)) {
+		if err := server.metaStore.Set(record); err != nil {
+			log.Printf("[ERROR] unable to store channel %s: %v", record.ChannelID, err)
+		}
+	}
+}
+
+// reconcile takes another node's record of a channel if it supersedes this
+// node's, see ChannelRecord.supersedes, or tells the other nodes this
+// node's record if it supersedes theirs. A renamed channel is renamed here
+// too, and kept once it is kept elsewhere.
+func (server *WsServer) reconcile(channel *Channel, record *ChannelRecord) {
+	local := channel.record()
+	if local.supersedes(record) {
+		server.announceRecord(channel)
+		return
+	}
+	if !record.supersedes(local) {
+		return
+	}
+
+	if record.Name != local.Name {
+		if err := server.channels.Rename(channel, record.Name); err != nil {
+			log.Printf("[WARN] unable to rename channel %s to %s: %v", record.ChannelID, record.Name, err)
+		}
+	}
+	channel.recordMu.Lock()
+	defer channel.recordMu.Unlock()
+	channel.mu.Lock()
+	channel.ephemeral = channel.ephemeral && record.Ephemeral
+	channel.mu.Unlock()
+	channel.restore(record)
+	channel.writeRecord()
+}
+
+// removeChannel unregisters a channel, stops it, forgets its record and
+// takes its members out of it and its threads. Nobody is told; callers
+// announce deletions.
+func (server *WsServer) removeChannel(channel *Channel) bool {
+	if !server.channels.Remove(channel) {
+		return false
+	}
+	channel.Stop()
+	channel.forget()
+
+	threads := channel.ListThreads()
+	for account := range channel.GetMembers() {
+		account.removeChannel(channel)
+		for _, thread := range threads {
+			account.unfollowThread(thread)
+		}
+	}
+	return true
+}
+
+// reapInterval is how often idle channels are looked for: often enough that
+// none outlives the TTL by much, but at most once a second
+func reapInterval(ttl time.Duration) time.Duration {
+	interval := ttl / 4
+	if interval < time.Second {
+		interval = time.Second
+	} else if interval > time.Minute {
+		interval = time.Minute
+	}
+	return interval
+}
+
+// reapChannels stops the ephemeral channels that have been empty for longer
+// than the channel TTL
+func (server *WsServer) reapChannels() {
+	for _, channel := range server.channels.Reap(time.Now(), server.channelTTL) {
+		channel.Stop()
+		log.Printf("[INFO] stopped idle channel %s", *channel.GetName())
+	}
+}
+
+// createChannel creates a channel on behalf of a connected account and makes
+// the account a member of it
+func (account *Account) createChannel(payload *CreateChannelPayload) (*Channel, error) {
+	channel, err := account.wsServer.CreateChannel(payload.Name, payload.Private, account.accountID)
+	if err == ErrChannelExists {
+		return nil, newFrameError(api_response.ERROR_EXIST_CHANNEL, "channel %s", payload.Name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := account.enter(channel, nil).err(payload.Name); err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
@@ -0,0 +1,138 @@
+package logic
+
+import (
+	"regexp"
+	"strings"
+	"wjjmjh/hermes/pkg/services/auth_service"
+)
+
+// MaxMentions is how many distinct usernames of a message are resolved
+const MaxMentions = 50
+
+// Kinds of mention a user is notified of
+const (
+	MentionUser    = "user"
+	MentionChannel = "channel"
+	MentionHere    = "here"
+)
+
+// Chat messages may mention users as @username, every member of the channel
+// as @channel, or the members currently online as @here. Mentions are
+// resolved when the message is posted and stored with it, so every node
+// routes the same notifications. Usernames only resolve to members of the
+// channel, on any node, so a mention never leaks a message.
+//
+// Besides the message itself, which is delivered to the channel as usual,
+// every session of a mentioned account is sent a mention frame, whichever
+// channels the account is in. Accounts that muted the channel, and the
+// sender, are not notified. Edits resolve the mentions again without
+// notifying anyone.
+
+// Mentions are the mentions resolved in a message
+type Mentions struct {
+	Users   []SenderInfo `json:"users,omitempty"`
+	Channel bool         `json:"channel,omitempty"`
+	Here    bool         `json:"here,omitempty"`
+}
+
+// mentionPattern matches an @ not preceded by a word character, and the name
+// following it
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_])@([\p{L}\p{N}_.-]+)`)
+
+// parseMentions returns the distinct names mentioned in text, in the order
+// they first appear. Trailing dots and dashes are punctuation, not part of
+// the name.
+func parseMentions(text string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		name := strings.TrimRight(match[1], ".-")
+		key := strings.ToLower(name)
+		if name == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// mentionsIn resolves the mentions of a message text, or returns nil if it
+// mentions nobody
+func (channel *Channel) mentionsIn(text string) *Mentions {
+	mentions := &Mentions{}
+	resolved := 0
+	for _, name := range parseMentions(text) {
+		switch strings.ToLower(name) {
+		case MentionChannel:
+			mentions.Channel = true
+			continue
+		case MentionHere:
+			mentions.Here = true
+			continue
+		}
+
+		if resolved == MaxMentions {
+			continue
+		}
+		resolved++
+		account, err := auth_service.GetAccountByUsername(name)
+		if err != nil || !channel.isMember(account.ID) {
+			continue
+		}
+		mentions.Users = append(mentions.Users, SenderInfo{ID: account.ID, Name: account.Username})
+	}
+
+	if len(mentions.Users) == 0 && !mentions.Channel && !mentions.Here {
+		return nil
+	}
+	return mentions
+}
+
+// notifyMentions sends a mention frame to every session, on this node, of
+// the accounts a message mentions. channel is this node's copy of the
+// message's channel, nil if it has none; @channel and @here then reach
+// nobody here.
+func (server *WsServer) notifyMentions(channel *Channel, message *Message) {
+	mentions := message.Mentions
+	if mentions == nil {
+		return
+	}
+
+	// Direct mentions win over @channel and @here
+	targets := make(map[string]string)
+	if channel != nil && (mentions.Channel || mentions.Here) {
+		for account := range channel.GetMembers() {
+			if mentions.Channel {
+				targets[account.accountID] = MentionChannel
+			} else if presence, ok := server.presence.Get(account.accountID); ok && presence.Status == StatusOnline {
+				targets[account.accountID] = MentionHere
+			}
+		}
+	}
+	for _, user := range mentions.Users {
+		targets[user.ID] = MentionUser
+	}
+	delete(targets, message.SenderID)
+
+	var channelName string
+	if channel != nil && !channel.Direct {
+		channelName = *channel.GetName()
+	}
+	for accountID, mention := range targets {
+		account := server.findAccountByID(accountID)
+		if account == nil || server.isChannelMuted(accountID, message.ChannelID) {
+			continue
+		}
+
+		frame := newFrame(MentionAction, message.ChannelID, MentionPayload{
+			MessageID:   message.ID,
+			ChannelName: channelName,
+			Text:        message.Text,
+			Mention:     mention,
+		})
+		frame.ThreadID = message.ThreadID
+		frame.Sender = &SenderInfo{ID: message.SenderID, Name: message.SenderName}
+		account.sendFrame(frame)
+	}
+}
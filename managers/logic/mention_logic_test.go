@@ -0,0 +1,187 @@
+package logic
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"wjjmjh/hermes/pkg/backplane"
+)
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"no mentions", nil},
+		{"@alice", []string{"alice"}},
+		{"hi @alice and @bob", []string{"alice", "bob"}},
+		{"@alice @Alice @ALICE", []string{"alice"}},
+		{"thanks @alice.", []string{"alice"}},
+		{"@alice... @bob-- @carol.-", []string{"alice", "bob", "carol"}},
+		{"@first.last and @with-dash", []string{"first.last", "with-dash"}},
+		{"(@alice) [@bob], @carol!", []string{"alice", "bob", "carol"}},
+		{"mail me at alice@example.com", nil},
+		{"a@b and x_@y", nil},
+		{"@ @. @- alone", nil},
+		{"@channel and @here", []string{"channel", "here"}},
+		{"@élodie and @山田", []string{"élodie", "山田"}},
+	}
+	for _, test := range tests {
+		t.Run(test.text, func(t *testing.T) {
+			if got := parseMentions(test.text); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("parseMentions(%q) = %q, want %q", test.text, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMentionsIn(t *testing.T) {
+	alice := newTestAccount(t, "alice")
+	bob := newTestAccount(t, "bob")
+	stranger := newTestAccount(t, "stranger")
+	banned := newTestAccount(t, "banned")
+	channel := newTestChannel(t, map[string]string{"owner": RoleOwner})
+
+	// Alice is a member on this node, Bob on another one. The banned
+	// account was a member until it was banned.
+	channel.members[channel.server.accounts.Attach(CreateUser(alice.ID, alice.Username, nil, channel.server))] = true
+	channel.applyMember("other", &memberChange{UserID: bob.ID, Joined: true})
+	channel.applyMember("other", &memberChange{UserID: banned.ID, Joined: true})
+	channel.applyModeration(&AuditEntry{Action: BanAction, Actor: SenderInfo{ID: "owner"}, Target: &SenderInfo{ID: banned.ID}})
+
+	tests := []struct {
+		name    string
+		text    string
+		users   []string
+		channel bool
+		here    bool
+	}{
+		{"nobody", "hello", nil, false, false},
+		{"a user", "hi @" + alice.Username, []string{alice.ID}, false, false},
+		{"case of the username", "hi @" + strings.ToUpper(alice.Username), []string{alice.ID}, false, false},
+		{"users in order", fmt.Sprintf("@%s @%s @%s", bob.Username, alice.Username, bob.Username), []string{bob.ID, alice.ID}, false, false},
+		{"unknown username", "hi @nobody-at-all", nil, false, false},
+		{"account not in the channel", "hi @" + stranger.Username, nil, false, false},
+		{"banned account", "hi @" + banned.Username, nil, false, false},
+		{"@channel", "@channel look", nil, true, false},
+		{"@here and a user", "@here @" + alice.Username, []string{alice.ID}, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mentions := channel.mentionsIn(test.text)
+			if test.users == nil && !test.channel && !test.here {
+				if mentions != nil {
+					t.Fatalf("mentions %+v, want none", mentions)
+				}
+				return
+			}
+			if mentions == nil {
+				t.Fatal("no mentions resolved")
+			}
+			var users []string
+			for _, user := range mentions.Users {
+				users = append(users, user.ID)
+			}
+			if !reflect.DeepEqual(users, test.users) || mentions.Channel != test.channel || mentions.Here != test.here {
+				t.Fatalf("mentions %+v, want users %v, channel %v, here %v", mentions, test.users, test.channel, test.here)
+			}
+		})
+	}
+}
+
+func TestMentionsInResolvesAtMostMaxMentions(t *testing.T) {
+	alice := newTestAccount(t, "alice")
+	channel := newTestChannel(t, nil)
+	channel.applyMember("other", &memberChange{UserID: alice.ID, Joined: true})
+
+	names := make([]string, 0, MaxMentions+1)
+	for i := 0; i < MaxMentions; i++ {
+		names = append(names, fmt.Sprintf("@unknown-%d", i))
+	}
+	names = append(names, "@"+alice.Username, "@channel")
+	mentions := channel.mentionsIn(strings.Join(names, " "))
+	if mentions == nil || len(mentions.Users) != 0 || !mentions.Channel {
+		t.Fatalf("mentions %+v, want @channel only", mentions)
+	}
+}
+
+func TestMentionNotifications(t *testing.T) {
+	node := newTestNode(t, backplane.NewMemory())
+	alice := node.connect(t, newTestAccount(t, "alice"))
+	online := node.connect(t, newTestAccount(t, "online"))
+	away := node.connect(t, newTestAccount(t, "away"))
+	muted := node.connect(t, newTestAccount(t, "muted"))
+	outsider := node.connect(t, newTestAccount(t, "outsider"))
+	stranger := node.connect(t, newTestAccount(t, "stranger"))
+
+	channelID := alice.join("mentions")
+	for _, client := range []*testClient{online, away, muted} {
+		client.join("mentions")
+	}
+	away.do(SetStatusAction, "", SetStatusPayload{Status: StatusAway})
+	muted.do(MuteNotificationsAction, channelID, nil)
+	outsider.join("elsewhere")
+	stranger.join("elsewhere")
+	for client, status := range map[*testClient]string{online: StatusOnline, away: StatusAway} {
+		eventually(t, "the presence of "+client.account.Username, func() bool {
+			presence, _ := node.server.presence.Get(client.account.ID)
+			return presence.Status == status
+		})
+	}
+
+	mentionOf := func(client *testClient) *MentionPayload {
+		client.t.Helper()
+		frame := client.expect(ofType(MentionAction))
+		var payload MentionPayload
+		if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		return &payload
+	}
+
+	// @here reaches the online members, @channel every member. Members
+	// who muted the channel, and the sender, hear of neither.
+	alice.send(SendMessageAction, channelID, TextPayload{Text: "@here first"})
+	alice.send(SendMessageAction, channelID, TextPayload{Text: "@channel second"})
+	if mention := mentionOf(online); mention.Mention != MentionHere || mention.Text != "@here first" {
+		t.Fatalf("online member got %+v first", mention)
+	}
+	if mention := mentionOf(online); mention.Mention != MentionChannel {
+		t.Fatalf("online member got %+v second", mention)
+	}
+	if mention := mentionOf(away); mention.Mention != MentionChannel {
+		t.Fatalf("away member got %+v, want the @channel mention only", mention)
+	}
+
+	// Members are notified whichever channel they are looking at, unless
+	// they muted the channel mentioning them. Accounts outside the channel
+	// are not mentioned.
+	outsider.join("mentions")
+	third := fmt.Sprintf("@%s @%s @%s third", outsider.account.Username, muted.account.Username, stranger.account.Username)
+	alice.send(SendMessageAction, channelID, TextPayload{Text: third})
+	if mention := mentionOf(outsider); mention.Mention != MentionUser || mention.ChannelName != "mentions" {
+		t.Fatalf("outsider got %+v", mention)
+	}
+	var content MessageContentPayload
+	if err := json.Unmarshal(alice.expect(withText(third)).Payload, &content); err != nil {
+		t.Fatal(err)
+	}
+	if content.Mentions == nil || len(content.Mentions.Users) != 2 {
+		t.Fatalf("message mentions %+v, want the outsider and the muted member", content.Mentions)
+	}
+	muted.do(UnmuteNotificationsAction, channelID, nil)
+	alice.send(SendMessageAction, channelID, TextPayload{Text: fmt.Sprintf("@%s fourth", muted.account.Username)})
+	if mention := mentionOf(muted); !strings.HasSuffix(mention.Text, " fourth") {
+		t.Fatalf("muted member got %+v, want the mention after unmuting only", mention)
+	}
+	alice.send(SendMessageAction, channelID, TextPayload{Text: "@" + alice.account.Username + " self"})
+	alice.expect(func(frame *testFrame) bool {
+		if frame.Type == MentionAction {
+			t.Fatalf("sender was notified of a mention: %s", frame.Payload)
+		}
+		return withText("@" + alice.account.Username + " self")(frame)
+	})
+}
@@ -2,47 +2,182 @@ package logic
 
 import (
 	"encoding/json"
+	"github.com/google/uuid"
 	"log"
+	"time"
 )
 
-// Message actions
+// Message types sent by clients
 const SendMessageAction = "send-message"
 const JoinChannelAction = "join-channel"
+const CreateChannelAction = "create-channel"
+const ArchiveChannelAction = "archive-channel"
+const UnarchiveChannelAction = "unarchive-channel"
+const DeleteChannelAction = "delete-channel"
+const UpdateChannelAction = "update-channel"
 const LeaveChannelAction = "leave-channel"
-const UserJoinAction = "user-join"
-const UserLeftAction = "user-left"
-const JoinPrivateChannelAction = "join-private-channel"
+const OpenConversationAction = "open-conversation"
+const ListConversationsAction = "list-conversations"
+const FetchHistoryAction = "fetch-history"
+const CreateThreadAction = "create-thread"
+const JoinThreadAction = "join-thread"
+const LeaveThreadAction = "leave-thread"
+const SendThreadMessageAction = "send-thread-message"
+const ListThreadsAction = "list-threads"
+const SetStatusAction = "set-status"
+const TypingStartAction = "typing-start"
+const TypingStopAction = "typing-stop"
+const MarkReadAction = "mark-read"
+const GetReadPositionsAction = "get-read-positions"
+const ResumeAction = "resume"
+const SetRoleAction = "set-role"
+const GetRolesAction = "get-roles"
+const InviteAction = "invite"
+const PinMessageAction = "pin-message"
+const UnpinMessageAction = "unpin-message"
+const KickAction = "kick"
+const BanAction = "ban"
+const UnbanAction = "unban"
+const MuteAction = "mute"
+const UnmuteAction = "unmute"
+const SlowModeAction = "set-slow-mode"
+const GetAuditLogAction = "get-audit-log"
+const EditMessageAction = "edit-message"
+const DeleteMessageAction = "delete-message"
+const GetEditHistoryAction = "get-edit-history"
+const AddReactionAction = "add-reaction"
+const RemoveReactionAction = "remove-reaction"
+const MuteNotificationsAction = "mute-notifications"
+const UnmuteNotificationsAction = "unmute-notifications"
+const GetNotificationSettingsAction = "get-notification-settings"
+
+// Message types sent by the server
+const PresenceAction = "presence"
+const SessionAction = "session"
+const ResumedAction = "resumed"
+const ReadPositionAction = "read-position"
+const ReadPositionsAction = "read-positions"
 const ChannelJoinedAction = "channel-joined"
+const ChannelArchivedAction = "channel-archived"
+const ChannelUnarchivedAction = "channel-unarchived"
+const ChannelDeletedAction = "channel-deleted"
+const ChannelUpdatedAction = "channel-updated"
+const UserJoinedChannelAction = "user-joined-channel"
+const UserLeftChannelAction = "user-left-channel"
+const HistoryAction = "history"
+const ThreadCreatedAction = "thread-created"
+const ThreadsAction = "threads"
+const ConversationsAction = "conversations"
+const RoleChangedAction = "role-changed"
+const RolesAction = "roles"
+const UserInvitedAction = "user-invited"
+const PinnedAction = "pinned"
+const SystemAction = "system"
+const AuditLogAction = "audit-log"
+const MessageEditedAction = "message-edited"
+const MessageDeletedAction = "message-deleted"
+const EditHistoryAction = "edit-history"
+const ReactionAddedAction = "reaction-added"
+const ReactionRemovedAction = "reaction-removed"
+const MentionAction = "mention"
+const NotificationSettingsAction = "notification-settings"
+const ErrorAction = "error"
+const AckAction = "ack"
 
+// Message is the server side model of a chat message or event. It is what the
+// MessageStore persists; clients only ever see it encoded as an OutboundFrame.
 type Message struct {
-	// Message request type
-	Action string `json:"action"`
+	// Server assigned message ID, used as the history cursor
+	ID string `json:"id,omitempty"`
+
+	// Server assigned time at which the message was accepted
+	Timestamp time.Time `json:"timestamp"`
+
+	// Message type, one of the action constants above
+	Type string `json:"type"`
+
+	// Message text
+	Text string `json:"text,omitempty"`
+
+	// Channel (and thread) the message belongs to
+	ChannelID string `json:"channel_id,omitempty"`
+	ThreadID  string `json:"thread_id,omitempty"`
+
+	// User sending the message, empty for server generated events
+	SenderID   string `json:"sender_id,omitempty"`
+	SenderName string `json:"sender_name,omitempty"`
 
-	// Actual Message
-	Message string `json:"message"`
+	// Users and groups the message mentions (see mention_logic.go)
+	Mentions *Mentions `json:"mentions,omitempty"`
 
-	// Message target (room or user)
-	Target *Channel `json:"target"`
+	// Set once the message was edited, along with its earlier versions,
+	// oldest first (see edit_logic.go)
+	EditedAt *time.Time    `json:"edited_at,omitempty"`
+	Edits    []MessageEdit `json:"edits,omitempty"`
 
-	// User sending the message
-	Sender *User `json:"sender"`
+	// Reactions to the message by emoji, in the order they were first made
+	// (see reaction_logic.go)
+	Reactions []Reaction `json:"reactions,omitempty"`
+
+	// Set once the message was deleted. Deleted messages stay in history as
+	// tombstones, without their text or edits.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
 }
 
-func MessageMarshal(msg Message) []byte {
-	_json, err := json.Marshal(msg)
-	if err != nil {
-		log.Println(err)
+// newUserMessage builds a message authored by sender
+func newUserMessage(messageType string, sender *SenderInfo, text string) *Message {
+	return &Message{
+		Type:       messageType,
+		Text:       text,
+		SenderID:   sender.ID,
+		SenderName: sender.Name,
 	}
-	return _json
 }
 
-func MessageUnmarshal(msg []byte) *Message {
-	var unmarshalledMessage Message
-	err := json.Unmarshal(msg, &unmarshalledMessage)
+// stamp assigns the server message ID and timestamp
+func (msg *Message) stamp() {
+	msg.ID = uuid.New().String()
+	msg.Timestamp = time.Now().UTC()
+}
+
+// Frame converts the message into its wire representation
+func (msg *Message) Frame() *OutboundFrame {
+	frame := &OutboundFrame{
+		Version:   ProtocolVersion,
+		Type:      msg.Type,
+		ID:        msg.ID,
+		ChannelID: msg.ChannelID,
+		ThreadID:  msg.ThreadID,
+		Timestamp: msg.Timestamp,
+	}
+	if frame.Timestamp.IsZero() {
+		frame.Timestamp = time.Now().UTC()
+	}
+	if msg.SenderID != "" {
+		frame.Sender = &SenderInfo{ID: msg.SenderID, Name: msg.SenderName}
+	}
+	switch {
+	case msg.DeletedAt != nil:
+		frame.Payload = MessageContentPayload{Deleted: true, DeletedAt: msg.DeletedAt}
+	case msg.EditedAt != nil || len(msg.Reactions) > 0 || msg.Mentions != nil:
+		frame.Payload = MessageContentPayload{Text: msg.Text, EditedAt: msg.EditedAt, Reactions: msg.Reactions, Mentions: msg.Mentions}
+	case msg.Text != "":
+		frame.Payload = TextPayload{Text: msg.Text}
+	}
+	return frame
+}
+
+// MessageMarshal encodes the message as an outbound frame
+func MessageMarshal(msg Message) []byte {
+	return FrameMarshal(msg.Frame())
+}
+
+// FrameMarshal encodes an outbound frame
+func FrameMarshal(frame *OutboundFrame) []byte {
+	_json, err := json.Marshal(frame)
 	if err != nil {
-		log.Println("Error with unmarshal", err)
-		return nil
-	} else {
-		return &unmarshalledMessage
+		log.Println(err)
 	}
+	return _json
 }
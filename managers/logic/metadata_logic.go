@@ -0,0 +1,544 @@
+package logic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+	"unicode/utf8"
+	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/setting"
+)
+
+// Bounds of channel metadata, lengths in characters
+const (
+	MaxTopicLength          = 250
+	MaxDescriptionLength    = 1000
+	MaxIconURLLength        = 2048
+	MaxAttributes           = 32
+	MaxAttributeKeyLength   = 64
+	MaxAttributeValueLength = 1024
+)
+
+// ChannelMetadata describes a channel beyond its name: what it is about, its
+// icon, who created it and when, and free-form attributes set by clients.
+// It is stored in the channel's record, so it outlives the channel being
+// stopped and started again, until the channel is deleted.
+type ChannelMetadata struct {
+	ChannelID   string            `json:"channel_id"`
+	Topic       string            `json:"topic,omitempty"`
+	Description string            `json:"description,omitempty"`
+	IconURL     string            `json:"icon_url,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	CreatedBy   string            `json:"created_by,omitempty"`
+	UpdatedAt   *time.Time        `json:"updated_at,omitempty"`
+	UpdatedBy   string            `json:"updated_by,omitempty"`
+}
+
+// copy returns a deep copy of the metadata
+func (metadata ChannelMetadata) copy() ChannelMetadata {
+	if metadata.Attributes != nil {
+		attributes := make(map[string]string, len(metadata.Attributes))
+		for key, value := range metadata.Attributes {
+			attributes[key] = value
+		}
+		metadata.Attributes = attributes
+	}
+	return metadata
+}
+
+// ChannelRecord is what is stored of a channel: its metadata, and what it
+// takes to register it again when the server starts. Channels created by
+// joining them are not registered again, their record is restored when they
+// are joined (see lifecycle_logic.go). The record of a conversation lists
+// its participants. Bans, mutes and the slow mode interval, in seconds, are
+// the moderation state of the channel, see moderation_logic.go. Revision
+// counts the changes of the record, so that nodes can tell which of their
+// records of a channel is the latest, see ChannelRecord.supersedes.
+type ChannelRecord struct {
+	ChannelMetadata
+	Name         string               `json:"name,omitempty"`
+	Private      bool                 `json:"private,omitempty"`
+	Ephemeral    bool                 `json:"ephemeral,omitempty"`
+	Archived     bool                 `json:"archived,omitempty"`
+	Roles        map[string]string    `json:"roles,omitempty"`
+	Participants []SenderInfo         `json:"participants,omitempty"`
+	Bans         []string             `json:"bans,omitempty"`
+	Mutes        map[string]time.Time `json:"mutes,omitempty"`
+	SlowMode     int                  `json:"slow_mode,omitempty"`
+	Revision     uint64               `json:"revision,omitempty"`
+}
+
+// copy returns a deep copy of the record
+func (record ChannelRecord) copy() ChannelRecord {
+	record.ChannelMetadata = record.ChannelMetadata.copy()
+	record.Roles = copyRoles(record.Roles)
+	record.Participants = append([]SenderInfo(nil), record.Participants...)
+	record.Bans = append([]string(nil), record.Bans...)
+	if record.Mutes != nil {
+		mutes := make(map[string]time.Time, len(record.Mutes))
+		for accountID, until := range record.Mutes {
+			mutes[accountID] = until
+		}
+		record.Mutes = mutes
+	}
+	return record
+}
+
+// createdBefore reports whether the record is of a channel created before
+// other's, or at the same time by an account with a smaller ID
+func (record *ChannelRecord) createdBefore(other *ChannelRecord) bool {
+	if !record.CreatedAt.Equal(other.CreatedAt) {
+		return record.CreatedAt.Before(other.CreatedAt)
+	}
+	return record.CreatedBy < other.CreatedBy
+}
+
+// supersedes reports whether the record replaces other, a record of a
+// channel with the same ID: the record of the channel created first wins,
+// and of the same channel the record with more changes.
+func (record *ChannelRecord) supersedes(other *ChannelRecord) bool {
+	if record.createdBefore(other) {
+		return true
+	}
+	if other.createdBefore(record) {
+		return false
+	}
+	return record.Revision > other.Revision
+}
+
+// apply merges a validated update into the metadata. Attributes set to null
+// are removed.
+func (metadata *ChannelMetadata) apply(update *UpdateChannelPayload) {
+	if update.Topic != nil {
+		metadata.Topic = *update.Topic
+	}
+	if update.Description != nil {
+		metadata.Description = *update.Description
+	}
+	if update.IconURL != nil {
+		metadata.IconURL = *update.IconURL
+	}
+	for key, value := range update.Attributes {
+		if value == nil {
+			delete(metadata.Attributes, key)
+			continue
+		}
+		if metadata.Attributes == nil {
+			metadata.Attributes = make(map[string]string)
+		}
+		metadata.Attributes[key] = *value
+	}
+}
+
+// validateChannelUpdate checks the bounds of a metadata update
+func validateChannelUpdate(update *UpdateChannelPayload) *FrameError {
+	if update.Topic == nil && update.Description == nil && update.IconURL == nil && len(update.Attributes) == 0 {
+		return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "nothing to update")
+	}
+	if update.Topic != nil && utf8.RuneCountInString(*update.Topic) > MaxTopicLength {
+		return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "topic exceeds %d characters", MaxTopicLength)
+	}
+	if update.Description != nil && utf8.RuneCountInString(*update.Description) > MaxDescriptionLength {
+		return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "description exceeds %d characters", MaxDescriptionLength)
+	}
+	if update.IconURL != nil && *update.IconURL != "" {
+		if len(*update.IconURL) > MaxIconURLLength {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "icon_url exceeds %d characters", MaxIconURLLength)
+		}
+		iconURL, err := url.Parse(*update.IconURL)
+		if err != nil || (iconURL.Scheme != "http" && iconURL.Scheme != "https") || iconURL.Host == "" {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "icon_url must be an http or https URL")
+		}
+	}
+	if len(update.Attributes) > MaxAttributes {
+		return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "more than %d attributes", MaxAttributes)
+	}
+	for key, value := range update.Attributes {
+		if key == "" || utf8.RuneCountInString(key) > MaxAttributeKeyLength {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD,
+				"attribute keys must be between 1 and %d characters", MaxAttributeKeyLength)
+		}
+		if value != nil && utf8.RuneCountInString(*value) > MaxAttributeValueLength {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD,
+				"attribute %s exceeds %d characters", key, MaxAttributeValueLength)
+		}
+	}
+	return nil
+}
+
+// Metadata returns a copy of the channel metadata
+func (channel *Channel) Metadata() ChannelMetadata {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	return channel.metadata.copy()
+}
+
+// UpdateMetadata changes the channel metadata on behalf of the actor, stores
+// it in the channel's record and announces it to the channel. Fields the
+// update leaves out are kept.
+func (channel *Channel) UpdateMetadata(actor *SenderInfo, update *UpdateChannelPayload) error {
+	if channel.Direct || !channel.Can(actor.ID, PermEditMetadata) {
+		return ErrPermissionDenied
+	}
+	if err := validateChannelUpdate(update); err != nil {
+		return err
+	}
+
+	// Updates are serialised with the other writes of the record, so
+	// concurrent ones do not drop each other's attributes, but the store is
+	// written without holding mu
+	channel.recordMu.Lock()
+	defer channel.recordMu.Unlock()
+
+	metadata := channel.Metadata()
+	metadata.apply(update)
+	if len(metadata.Attributes) > MaxAttributes {
+		return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "more than %d attributes", MaxAttributes)
+	}
+	now := time.Now().UTC()
+	metadata.UpdatedAt = &now
+	metadata.UpdatedBy = actor.ID
+	record := channel.record()
+	record.ChannelMetadata = metadata
+	record.Revision++
+	if channel.metaStore != nil && !channel.stopped() {
+		if err := channel.metaStore.Set(record); err != nil {
+			return err
+		}
+	}
+	channel.mu.Lock()
+	channel.metadata = metadata
+	channel.revision = record.Revision
+	channel.mu.Unlock()
+
+	frame := newFrame(ChannelUpdatedAction, *channel.GetID(), channel.Payload())
+	frame.Sender = actor
+	updated := metadata.copy()
+	channel.relay(&channelEvent{Actor: actor.ID, Metadata: &updated, Frame: FrameMarshal(frame)})
+	return nil
+}
+
+// applyMetadata replaces this node's copy of the channel metadata. Who
+// created the channel and when is kept: the nodes agree on it through
+// snapshots, see receiveSnapshot.
+func (channel *Channel) applyMetadata(metadata *ChannelMetadata) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	created := channel.metadata
+	channel.metadata = metadata.copy()
+	channel.metadata.ChannelID = created.ChannelID
+	channel.metadata.CreatedAt = created.CreatedAt
+	channel.metadata.CreatedBy = created.CreatedBy
+}
+
+// setCreator records who created the channel
+func (channel *Channel) setCreator(creatorID string) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	channel.metadata.CreatedBy = creatorID
+}
+
+// record returns what is stored of the channel. Mutes that ended are left
+// out.
+func (channel *Channel) record() *ChannelRecord {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	record := &ChannelRecord{
+		ChannelMetadata: channel.metadata.copy(),
+		Name:            *channel.channelName,
+		Private:         channel.Private,
+		Ephemeral:       channel.ephemeral,
+		Archived:        channel.archived,
+		Roles:           copyRoles(channel.roles),
+		Participants:    append([]SenderInfo(nil), channel.participants...),
+		SlowMode:        int(channel.slowMode / time.Second),
+		Revision:        channel.revision,
+	}
+	for accountID := range channel.bans {
+		record.Bans = append(record.Bans, accountID)
+	}
+	now := time.Now()
+	for accountID, until := range channel.mutes {
+		if until.After(now) {
+			if record.Mutes == nil {
+				record.Mutes = make(map[string]time.Time)
+			}
+			record.Mutes[accountID] = until
+		}
+	}
+	return record
+}
+
+// restore gives the channel the metadata, roles, archived state, moderation
+// state and revision of its record. Whether it is ephemeral depends on how
+// it was registered.
+func (channel *Channel) restore(record *ChannelRecord) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	channel.metadata = record.ChannelMetadata.copy()
+	channel.metadata.ChannelID = *channel.channelID
+	channel.archived = record.Archived
+	channel.roles = copyRoles(record.Roles)
+	channel.bans = make(map[string]bool, len(record.Bans))
+	for _, accountID := range record.Bans {
+		channel.bans[accountID] = true
+	}
+	channel.mutes = make(map[string]time.Time, len(record.Mutes))
+	for accountID, until := range record.Mutes {
+		channel.mutes[accountID] = until
+	}
+	channel.slowMode = time.Duration(record.SlowMode) * time.Second
+	channel.revision = record.Revision
+}
+
+// save records a change of the channel: its revision goes up and its
+// record is stored. Every node saves once for each change it applies, so
+// nodes that applied the same changes agree on the revision.
+func (channel *Channel) save() {
+	channel.recordMu.Lock()
+	defer channel.recordMu.Unlock()
+	channel.mu.Lock()
+	channel.revision++
+	channel.mu.Unlock()
+	channel.writeRecord()
+}
+
+// persist stores the channel's record as it is, for records taken from
+// another node
+func (channel *Channel) persist() {
+	channel.recordMu.Lock()
+	defer channel.recordMu.Unlock()
+	channel.writeRecord()
+}
+
+// writeRecord stores the channel's record; recordMu must be held. Records
+// are snapshotted and written one at a time, so the last change of the
+// channel is the one stored. A stopped channel is not stored, it may have
+// been deleted.
+func (channel *Channel) writeRecord() {
+	if channel.metaStore == nil || channel.stopped() {
+		return
+	}
+	if err := channel.metaStore.Set(channel.record()); err != nil {
+		log.Printf("[ERROR] unable to store channel %s: %v", *channel.GetID(), err)
+	}
+}
+
+// forget deletes the record of a stopped channel
+func (channel *Channel) forget() {
+	if channel.metaStore == nil {
+		return
+	}
+	channel.recordMu.Lock()
+	defer channel.recordMu.Unlock()
+	if err := channel.metaStore.Delete(*channel.GetID()); err != nil {
+		log.Printf("[ERROR] unable to delete channel %s: %v", *channel.GetID(), err)
+	}
+}
+
+// loadRecord gives a new channel its stored record. Returns false if none is
+// stored.
+func (server *WsServer) loadRecord(channel *Channel) bool {
+	record, err := server.metaStore.Get(*channel.GetID())
+	if err != nil {
+		log.Printf("[ERROR] unable to load channel %s: %v", *channel.GetID(), err)
+	}
+	if record == nil {
+		return false
+	}
+	channel.restore(record)
+	return true
+}
+
+// UpdateChannel changes the metadata of the channel with the given ID on
+// behalf of an account, see Channel.UpdateMetadata.
+func (server *WsServer) UpdateChannel(ID string, actorID string, update *UpdateChannelPayload) (*Channel, error) {
+	channel := server.GetChannel(ID)
+	if channel == nil {
+		return nil, ErrChannelNotFound
+	}
+	actor, err := server.lookupUser(actorID)
+	if err != nil {
+		return nil, err
+	}
+	if err := channel.UpdateMetadata(actor, update); err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+// ChannelStore persists the record of every channel by channel ID, see
+// ChannelRecord. Get returns nil when none is stored, List the record of
+// every channel in no particular order.
+type ChannelStore interface {
+	Set(record *ChannelRecord) error
+	Get(channelID string) (*ChannelRecord, error)
+	List() ([]ChannelRecord, error)
+	Delete(channelID string) error
+	Close() error
+}
+
+// NewChannelStore builds the ChannelStore configured in the storage settings.
+func NewChannelStore(storage *setting.Storage) (ChannelStore, error) {
+	switch storage.Type {
+	case "", MemoryStorage:
+		return NewMemoryChannelStore(), nil
+	case FileStorage:
+		return OpenFileChannelStore(storage.Path)
+	default:
+		return nil, fmt.Errorf("unknown channel storage type: %s", storage.Type)
+	}
+}
+
+/*
+	In-memory store
+*/
+
+// MemoryChannelStore keeps channel records in memory; they are lost on
+// restart.
+type MemoryChannelStore struct {
+	mu       sync.RWMutex
+	channels map[string]ChannelRecord
+}
+
+func NewMemoryChannelStore() *MemoryChannelStore {
+	return &MemoryChannelStore{channels: make(map[string]ChannelRecord)}
+}
+
+func (store *MemoryChannelStore) Set(record *ChannelRecord) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.channels[record.ChannelID] = record.copy()
+	return nil
+}
+
+func (store *MemoryChannelStore) Get(channelID string) (*ChannelRecord, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	record, ok := store.channels[channelID]
+	if !ok {
+		return nil, nil
+	}
+	c := record.copy()
+	return &c, nil
+}
+
+func (store *MemoryChannelStore) List() ([]ChannelRecord, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	list := make([]ChannelRecord, 0, len(store.channels))
+	for _, record := range store.channels {
+		list = append(list, record.copy())
+	}
+	return list, nil
+}
+
+func (store *MemoryChannelStore) Delete(channelID string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.channels, channelID)
+	return nil
+}
+
+func (store *MemoryChannelStore) Close() error {
+	return nil
+}
+
+/*
+	On-disk store
+*/
+
+// channelChange is a line of the channel log: the record of a channel, or
+// the deletion of a channel's record. Lines logged before channels had
+// records hold only their metadata.
+type channelChange struct {
+	*ChannelRecord
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// FileChannelStore appends every change to a journal, which is replayed into
+// memory on open; the last change of a channel wins.
+type FileChannelStore struct {
+	*MemoryChannelStore
+	mu      sync.Mutex
+	journal *journal
+}
+
+// OpenFileChannelStore opens (or creates) the channel log in directory dir.
+func OpenFileChannelStore(dir string) (*FileChannelStore, error) {
+	store := &FileChannelStore{MemoryChannelStore: NewMemoryChannelStore()}
+	journal, err := openJournal(dir, "channels.log", store.replay)
+	if err != nil {
+		return nil, err
+	}
+	store.journal = journal
+
+	store.MemoryChannelStore.mu.RLock()
+	live := len(store.channels)
+	store.MemoryChannelStore.mu.RUnlock()
+	if err := journal.compact(live, store.snapshot); err != nil {
+		_ = journal.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// snapshot writes the record of every channel not deleted.
+func (store *FileChannelStore) snapshot(write func(record interface{}) error) error {
+	store.MemoryChannelStore.mu.RLock()
+	defer store.MemoryChannelStore.mu.RUnlock()
+	for _, record := range store.channels {
+		record := record
+		if err := write(channelChange{ChannelRecord: &record}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replay loads a logged change of a channel's record back into memory.
+func (store *FileChannelStore) replay(line []byte) error {
+	var change channelChange
+	if err := json.Unmarshal(line, &change); err != nil {
+		return err
+	}
+	if change.ChannelRecord == nil {
+		return errors.New("no channel record")
+	}
+	if change.Deleted {
+		return store.MemoryChannelStore.Delete(change.ChannelID)
+	}
+	return store.MemoryChannelStore.Set(change.ChannelRecord)
+}
+
+func (store *FileChannelStore) Set(record *ChannelRecord) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.journal.Append(channelChange{ChannelRecord: record}); err != nil {
+		return err
+	}
+	return store.MemoryChannelStore.Set(record)
+}
+
+func (store *FileChannelStore) Delete(channelID string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	change := channelChange{ChannelRecord: &ChannelRecord{ChannelMetadata: ChannelMetadata{ChannelID: channelID}}, Deleted: true}
+	if err := store.journal.Append(change); err != nil {
+		return err
+	}
+	return store.MemoryChannelStore.Delete(channelID)
+}
+
+func (store *FileChannelStore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.journal.Close()
+}
@@ -0,0 +1,54 @@
+package logic
+
+import "sync/atomic"
+
+// Metrics counts server events for monitoring. All methods are safe for
+// concurrent use.
+type Metrics struct {
+	droppedFrames        uint64
+	evictedClients       uint64
+	rateLimitedFrames    uint64
+	rateLimitMutes       uint64
+	rateLimitDisconnects uint64
+}
+
+// MetricsSnapshot is a point in time copy of the Metrics counters
+type MetricsSnapshot struct {
+	DroppedFrames        uint64 `json:"dropped_frames"`
+	EvictedClients       uint64 `json:"evicted_clients"`
+	RateLimitedFrames    uint64 `json:"rate_limited_frames"`
+	RateLimitMutes       uint64 `json:"rate_limit_mutes"`
+	RateLimitDisconnects uint64 `json:"rate_limit_disconnects"`
+	BackplaneDropped     uint64 `json:"backplane_dropped"`
+}
+
+func (metrics *Metrics) frameDropped() {
+	atomic.AddUint64(&metrics.droppedFrames, 1)
+}
+
+func (metrics *Metrics) clientEvicted() {
+	atomic.AddUint64(&metrics.evictedClients, 1)
+}
+
+func (metrics *Metrics) frameRateLimited() {
+	atomic.AddUint64(&metrics.rateLimitedFrames, 1)
+}
+
+func (metrics *Metrics) rateLimitMute() {
+	atomic.AddUint64(&metrics.rateLimitMutes, 1)
+}
+
+func (metrics *Metrics) rateLimitDisconnect() {
+	atomic.AddUint64(&metrics.rateLimitDisconnects, 1)
+}
+
+// Snapshot returns the current value of every counter
+func (metrics *Metrics) Snapshot() MetricsSnapshot {
+	return MetricsSnapshot{
+		DroppedFrames:        atomic.LoadUint64(&metrics.droppedFrames),
+		EvictedClients:       atomic.LoadUint64(&metrics.evictedClients),
+		RateLimitedFrames:    atomic.LoadUint64(&metrics.rateLimitedFrames),
+		RateLimitMutes:       atomic.LoadUint64(&metrics.rateLimitMutes),
+		RateLimitDisconnects: atomic.LoadUint64(&metrics.rateLimitDisconnects),
+	}
+}
@@ -0,0 +1,313 @@
+package logic
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"time"
+	"wjjmjh/hermes/pkg/api_response"
+)
+
+// Bounds of mute durations and slow mode intervals
+const MaxMuteDuration = 365 * 24 * time.Hour
+const MaxSlowModeInterval = time.Hour
+
+// Moderation actions are taken on behalf of a moderator, announced to the
+// channel as a system frame and recorded in the audit log. Moderators can
+// only act on accounts ranked below them, owners on anyone but themselves.
+//
+// Kicking removes an account from the channel, which it may join again.
+// Banning also keeps it from joining until it is unbanned. Muted accounts
+// cannot post until the mute ends, and in slow mode accounts must wait the
+// slow mode interval between two posts; moderators are exempt from slow mode.
+// Bans, mutes and the slow mode interval are stored in the channel's record,
+// so they outlive restarts.
+
+// Kick removes the target account from the channel
+func (channel *Channel) Kick(actor *SenderInfo, target *SenderInfo, reason string) error {
+	if err := channel.checkModerator(actor, target.ID, PermKick); err != nil {
+		return err
+	}
+	return channel.moderate(&AuditEntry{Action: KickAction, Actor: *actor, Target: target, Reason: reason})
+}
+
+// Ban removes the target account from the channel and keeps it out
+func (channel *Channel) Ban(actor *SenderInfo, target *SenderInfo, reason string) error {
+	if err := channel.checkModerator(actor, target.ID, PermBan); err != nil {
+		return err
+	}
+	return channel.moderate(&AuditEntry{Action: BanAction, Actor: *actor, Target: target, Reason: reason})
+}
+
+// Unban lets a banned account join the channel again
+func (channel *Channel) Unban(actor *SenderInfo, target *SenderInfo) error {
+	if err := channel.checkModerator(actor, target.ID, PermBan); err != nil {
+		return err
+	}
+	if !channel.IsBanned(target.ID) {
+		return nil
+	}
+	return channel.moderate(&AuditEntry{Action: UnbanAction, Actor: *actor, Target: target})
+}
+
+// Mute keeps the target account from posting in the channel for duration
+func (channel *Channel) Mute(actor *SenderInfo, target *SenderInfo, duration time.Duration, reason string) error {
+	if err := channel.checkModerator(actor, target.ID, PermMute); err != nil {
+		return err
+	}
+	until := time.Now().UTC().Add(duration)
+	return channel.moderate(&AuditEntry{Action: MuteAction, Actor: *actor, Target: target, Reason: reason, Until: &until})
+}
+
+// Unmute lifts the mute of the target account
+func (channel *Channel) Unmute(actor *SenderInfo, target *SenderInfo) error {
+	if err := channel.checkModerator(actor, target.ID, PermMute); err != nil {
+		return err
+	}
+	if _, muted := channel.MutedUntil(target.ID); !muted {
+		return nil
+	}
+	return channel.moderate(&AuditEntry{Action: UnmuteAction, Actor: *actor, Target: target})
+}
+
+// SetSlowMode sets the minimum interval between two posts of an account,
+// zero turns slow mode off
+func (channel *Channel) SetSlowMode(actor *SenderInfo, interval time.Duration) error {
+	if channel.Direct || !channel.Can(actor.ID, PermSlowMode) {
+		return ErrPermissionDenied
+	}
+	return channel.moderate(&AuditEntry{Action: SlowModeAction, Actor: *actor, Interval: int(interval / time.Second)})
+}
+
+// checkModeration reports whether the actor of an audit entry may take its
+// action
+func (channel *Channel) checkModeration(entry *AuditEntry) error {
+	if entry.Target == nil && entry.Action != SlowModeAction {
+		return ErrPermissionDenied
+	}
+	switch entry.Action {
+	case KickAction:
+		return channel.checkModerator(&entry.Actor, entry.Target.ID, PermKick)
+	case BanAction, UnbanAction:
+		return channel.checkModerator(&entry.Actor, entry.Target.ID, PermBan)
+	case MuteAction, UnmuteAction:
+		if entry.Action == MuteAction && entry.Until == nil {
+			return ErrPermissionDenied
+		}
+		return channel.checkModerator(&entry.Actor, entry.Target.ID, PermMute)
+	case SlowModeAction:
+		if channel.Direct || !channel.Can(entry.Actor.ID, PermSlowMode) {
+			return ErrPermissionDenied
+		}
+		return nil
+	}
+	return ErrPermissionDenied
+}
+
+// checkModerator reports whether the actor may take a moderation action
+// needing permission against the target account
+func (channel *Channel) checkModerator(actor *SenderInfo, targetID string, permission string) error {
+	if channel.Direct || !channel.Can(actor.ID, permission) || actor.ID == targetID {
+		return ErrPermissionDenied
+	}
+
+	actorRole := channel.RoleOf(actor.ID)
+	if actorRole != RoleOwner && roleRank[channel.RoleOf(targetID)] >= roleRank[actorRole] {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// moderate records a moderation action, announces it to every node and
+// applies it. The announcement goes first so that kicked accounts see it.
+func (channel *Channel) moderate(entry *AuditEntry) error {
+	entry.ID = uuid.New().String()
+	entry.ChannelID = *channel.GetID()
+	entry.Timestamp = time.Now().UTC()
+
+	if channel.audit != nil {
+		if err := channel.audit.Append(entry); err != nil {
+			return err
+		}
+	}
+
+	frame := newFrame(SystemAction, entry.ChannelID, SystemPayload{Text: entry.describe(), Moderation: entry})
+	channel.relay(&channelEvent{Actor: entry.Actor.ID, Moderation: entry, Frame: FrameMarshal(frame)})
+	channel.applyModeration(entry)
+	return nil
+}
+
+// applyModeration applies a moderation action to this node's copy of the
+// channel, and stores the bans, mutes and slow mode it changes
+func (channel *Channel) applyModeration(entry *AuditEntry) {
+	switch entry.Action {
+	case KickAction:
+		channel.mu.Lock()
+		delete(channel.remoteMembers, entry.Target.ID)
+		channel.mu.Unlock()
+		channel.removeLocal(entry.Target.ID)
+
+	case BanAction:
+		channel.mu.Lock()
+		channel.bans[entry.Target.ID] = true
+		delete(channel.invited, entry.Target.ID)
+		delete(channel.remoteMembers, entry.Target.ID)
+		channel.mu.Unlock()
+		channel.removeLocal(entry.Target.ID)
+
+	case UnbanAction:
+		channel.mu.Lock()
+		delete(channel.bans, entry.Target.ID)
+		channel.mu.Unlock()
+
+	case MuteAction:
+		channel.mu.Lock()
+		channel.mutes[entry.Target.ID] = *entry.Until
+		channel.mu.Unlock()
+
+	case UnmuteAction:
+		channel.mu.Lock()
+		delete(channel.mutes, entry.Target.ID)
+		channel.mu.Unlock()
+
+	case SlowModeAction:
+		channel.mu.Lock()
+		channel.slowMode = time.Duration(entry.Interval) * time.Second
+		channel.lastPost = make(map[string]time.Time)
+		channel.mu.Unlock()
+	}
+	if entry.Action != KickAction {
+		channel.save()
+	}
+}
+
+// removeLocal takes the account out of the channel and its threads, if it is
+// connected to this node
+func (channel *Channel) removeLocal(accountID string) {
+	if channel.server == nil {
+		return
+	}
+	account := channel.server.findAccountByID(accountID)
+	if account == nil {
+		return
+	}
+
+	for _, thread := range channel.ListThreads() {
+		account.unfollowThread(thread)
+	}
+	if account.removeChannel(channel) {
+		channel.leave(account)
+	}
+}
+
+// IsBanned reports whether the account is banned from the channel
+func (channel *Channel) IsBanned(accountID string) bool {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	return channel.bans[accountID]
+}
+
+// MutedUntil returns when the mute of the account ends, or false if it is
+// not muted.
+func (channel *Channel) MutedUntil(accountID string) (time.Time, bool) {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	until, ok := channel.mutes[accountID]
+	if !ok || !time.Now().Before(until) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// GetSlowMode returns the slow mode interval, zero when it is off
+func (channel *Channel) GetSlowMode() time.Duration {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	return channel.slowMode
+}
+
+// checkPost reports whether the account may post in the channel now: it must
+// be in the channel, or take part in the conversation, and not be banned. In
+// slow mode a post that is allowed starts the account's next interval.
+func (channel *Channel) checkPost(account *Account) error {
+	accountID := account.accountID
+	if channel.Direct {
+		if !channel.IsParticipant(accountID) {
+			return newFrameError(api_response.ERROR_NOT_CHANNEL_MEMBER, "channel %s", *channel.GetID())
+		}
+	} else if channel.IsBanned(accountID) {
+		return newFrameError(api_response.ERROR_BANNED, "channel %s", *channel.GetID())
+	} else if !account.isInChannel(channel) {
+		return newFrameError(api_response.ERROR_NOT_CHANNEL_MEMBER, "channel %s", *channel.GetID())
+	}
+	if channel.IsArchived() {
+		return newFrameError(api_response.ERROR_ARCHIVED_CHANNEL, "channel %s", *channel.GetID())
+	}
+	if !channel.Can(accountID, PermPost) {
+		return ErrPermissionDenied
+	}
+	if until, muted := channel.MutedUntil(accountID); muted {
+		return newFrameError(api_response.ERROR_MUTED, "muted until %s", until.Format(time.RFC3339))
+	}
+	if channel.Can(accountID, PermSlowMode) {
+		return nil
+	}
+
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	if channel.slowMode <= 0 {
+		return nil
+	}
+	now := time.Now()
+	if wait := channel.lastPost[accountID].Add(channel.slowMode).Sub(now); wait > 0 {
+		return newFrameError(api_response.ERROR_SLOW_MODE, "wait %s", wait.Round(time.Second))
+	}
+	channel.lastPost[accountID] = now
+	return nil
+}
+
+// AuditLog returns the latest moderation actions of the channel, oldest first
+func (channel *Channel) AuditLog(limit int) ([]*AuditEntry, error) {
+	if channel.audit == nil {
+		return []*AuditEntry{}, nil
+	}
+	return channel.audit.ListChannel(*channel.GetID(), clampAuditLimit(limit))
+}
+
+// describe is the text of the system message announcing the entry
+func (entry *AuditEntry) describe() string {
+	var text string
+	switch entry.Action {
+	case KickAction:
+		text = fmt.Sprintf("%s was kicked by %s", entry.Target.Name, entry.Actor.Name)
+	case BanAction:
+		text = fmt.Sprintf("%s was banned by %s", entry.Target.Name, entry.Actor.Name)
+	case UnbanAction:
+		text = fmt.Sprintf("%s was unbanned by %s", entry.Target.Name, entry.Actor.Name)
+	case MuteAction:
+		text = fmt.Sprintf("%s was muted by %s until %s", entry.Target.Name, entry.Actor.Name, entry.Until.Format(time.RFC3339))
+	case UnmuteAction:
+		text = fmt.Sprintf("%s was unmuted by %s", entry.Target.Name, entry.Actor.Name)
+	case SlowModeAction:
+		if entry.Interval == 0 {
+			return fmt.Sprintf("%s turned slow mode off", entry.Actor.Name)
+		}
+		return fmt.Sprintf("%s set slow mode to one message every %s", entry.Actor.Name, time.Duration(entry.Interval)*time.Second)
+	}
+	if entry.Reason != "" {
+		text += ": " + entry.Reason
+	}
+	return text
+}
+
+// ChannelAuditLog returns the latest moderation actions of the channel with
+// the given ID, if the account may see them.
+func (server *WsServer) ChannelAuditLog(ID string, actorID string, limit int) ([]*AuditEntry, error) {
+	channel := server.GetChannel(ID)
+	if channel == nil {
+		return nil, ErrChannelNotFound
+	}
+	if !channel.Can(actorID, PermViewAudit) {
+		return nil, ErrPermissionDenied
+	}
+	return channel.AuditLog(limit)
+}
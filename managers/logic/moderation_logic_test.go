@@ -0,0 +1,217 @@
+package logic
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/backplane"
+)
+
+func TestModerationPermissions(t *testing.T) {
+	roles := map[string]string{
+		"owner": RoleOwner, "admin": RoleAdmin, "moderator": RoleModerator, "guest": RoleGuest,
+	}
+	actions := map[string]func(channel *Channel, actor *SenderInfo, target *SenderInfo) error{
+		"kick": func(channel *Channel, actor *SenderInfo, target *SenderInfo) error {
+			return channel.Kick(actor, target, "")
+		},
+		"ban": func(channel *Channel, actor *SenderInfo, target *SenderInfo) error {
+			return channel.Ban(actor, target, "")
+		},
+		"mute": func(channel *Channel, actor *SenderInfo, target *SenderInfo) error {
+			return channel.Mute(actor, target, time.Minute, "")
+		},
+	}
+
+	tests := []struct {
+		actor   string
+		target  string
+		allowed bool
+	}{
+		{"owner", "admin", true},
+		{"owner", "owner", true},
+		{"admin", "moderator", true},
+		{"admin", "admin", false},
+		{"moderator", "member", true},
+		{"moderator", "guest", true},
+		{"moderator", "moderator", false},
+		{"moderator", "admin", false},
+		{"member", "guest", false},
+		{"guest", "member", false},
+	}
+	for action, act := range actions {
+		for _, tt := range tests {
+			t.Run(action+" "+tt.target+" as "+tt.actor, func(t *testing.T) {
+				channel := newTestChannel(t, roles)
+				target := &SenderInfo{ID: tt.target, Name: tt.target}
+				if tt.actor == tt.target {
+					target.ID = "other " + tt.target
+					channel.setRole(target.ID, roles[tt.target])
+				}
+				err := act(channel, &SenderInfo{ID: tt.actor, Name: tt.actor}, target)
+				if tt.allowed && err != nil {
+					t.Fatalf("refused: %v", err)
+				}
+				if !tt.allowed && err != ErrPermissionDenied {
+					t.Fatalf("got %v, want permission denied", err)
+				}
+			})
+		}
+	}
+
+	// Nobody moderates themselves
+	channel := newTestChannel(t, roles)
+	owner := &SenderInfo{ID: "owner", Name: "owner"}
+	if err := channel.Ban(owner, owner, ""); err != ErrPermissionDenied {
+		t.Fatalf("banning oneself got %v", err)
+	}
+	if err := channel.SetSlowMode(&SenderInfo{ID: "member"}, time.Minute); err != ErrPermissionDenied {
+		t.Fatalf("slow mode by a member got %v", err)
+	}
+}
+
+// answerCode is the code of the error frame answering a request, SUCCESS
+// for an ack
+func answerCode(t *testing.T, frame *testFrame) int {
+	t.Helper()
+	if frame.Type == AckAction {
+		return api_response.SUCCESS
+	}
+	var answer ErrorPayload
+	if err := json.Unmarshal(frame.Payload, &answer); err != nil {
+		t.Fatal(err)
+	}
+	return answer.Code
+}
+
+func TestModerationActions(t *testing.T) {
+	node := newTestNode(t, backplane.NewMemory())
+	alice := node.connect(t, newTestAccount(t, "alice"))
+	bob := node.connect(t, newTestAccount(t, "bob"))
+	carol := node.connect(t, newTestAccount(t, "carol"))
+
+	// Joining the channel first makes alice its owner
+	channelID := alice.join("moderated")
+	bob.join("moderated")
+	carol.join("moderated")
+	post := func(client *testClient, text string) int {
+		return answerCode(t, client.request(SendMessageAction, channelID, TextPayload{Text: text}))
+	}
+
+	// Kicked accounts are out until they join again
+	alice.do(KickAction, channelID, ModerationPayload{UserID: bob.account.ID, Reason: "calm down"})
+	if code := post(bob, "still here"); code != api_response.ERROR_NOT_CHANNEL_MEMBER {
+		t.Fatalf("kicked account posting got %d", code)
+	}
+	bob.join("moderated")
+
+	// Banned accounts cannot join again until unbanned
+	alice.do(BanAction, channelID, ModerationPayload{UserID: carol.account.ID})
+	if code := answerCode(t, carol.request(JoinChannelAction, "", JoinChannelPayload{Name: "moderated"})); code != api_response.ERROR_BANNED {
+		t.Fatalf("banned account joining got %d", code)
+	}
+	alice.do(UnbanAction, channelID, ModerationPayload{UserID: carol.account.ID})
+	carol.join("moderated")
+
+	// Muted accounts cannot post until unmuted
+	alice.do(MuteAction, channelID, MutePayload{UserID: bob.account.ID, Duration: 60})
+	if code := post(bob, "muted"); code != api_response.ERROR_MUTED {
+		t.Fatalf("muted account posting got %d", code)
+	}
+	alice.do(UnmuteAction, channelID, ModerationPayload{UserID: bob.account.ID})
+	if code := post(bob, "unmuted"); code != api_response.SUCCESS {
+		t.Fatalf("unmuted account posting got %d", code)
+	}
+
+	// In slow mode members wait between posts, moderators do not
+	alice.do(SlowModeAction, channelID, SlowModePayload{Interval: 60})
+	if code := post(carol, "first"); code != api_response.SUCCESS {
+		t.Fatalf("first post in slow mode got %d", code)
+	}
+	if code := post(carol, "second"); code != api_response.ERROR_SLOW_MODE {
+		t.Fatalf("second post in slow mode got %d", code)
+	}
+	for _, text := range []string{"owner", "exempt"} {
+		if code := post(alice, text); code != api_response.SUCCESS {
+			t.Fatalf("owner posting in slow mode got %d", code)
+		}
+	}
+
+	// Every action was announced and recorded, oldest first
+	bob.expect(func(frame *testFrame) bool {
+		var payload SystemPayload
+		return frame.Type == SystemAction && json.Unmarshal(frame.Payload, &payload) == nil &&
+			payload.Moderation != nil && payload.Moderation.Action == SlowModeAction
+	})
+	if code := answerCode(t, bob.request(GetAuditLogAction, channelID, GetAuditLogPayload{})); code != api_response.ERROR_PERMISSION_DENIED {
+		t.Fatalf("member reading the audit log got %d", code)
+	}
+	alice.send(GetAuditLogAction, channelID, GetAuditLogPayload{})
+	var auditLog AuditLogPayload
+	if err := json.Unmarshal(alice.expect(ofType(AuditLogAction)).Payload, &auditLog); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{KickAction, BanAction, UnbanAction, MuteAction, UnmuteAction, SlowModeAction}
+	if len(auditLog.Entries) != len(want) {
+		t.Fatalf("audit log has %d entries, want %d", len(auditLog.Entries), len(want))
+	}
+	for i, entry := range auditLog.Entries {
+		if entry.Action != want[i] || entry.Actor.ID != alice.account.ID || entry.ChannelID != channelID {
+			t.Fatalf("audit log entry %d is %+v, want %s by alice", i, entry, want[i])
+		}
+	}
+}
+
+func TestModerationSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	alice := newTestAccount(t, "alice")
+	bob := &SenderInfo{ID: newTestAccount(t, "bob").ID, Name: "bob"}
+	carol := &SenderInfo{ID: newTestAccount(t, "carol").ID, Name: "carol"}
+	owner := &SenderInfo{ID: alice.ID, Name: alice.Username}
+
+	node := newFileTestNode(t, dir)
+	channel, err := node.server.CreateChannel("strict", false, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channelID := *channel.GetID()
+	if err := channel.Ban(owner, carol, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.Mute(owner, bob, time.Hour, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.SetSlowMode(owner, 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	node.stop(t)
+
+	node = newFileTestNode(t, dir)
+	channel = node.server.GetChannel(channelID)
+	if channel == nil {
+		t.Fatal("the channel was not restored")
+	}
+	if !channel.IsBanned(carol.ID) {
+		t.Fatal("the ban was lost on restart")
+	}
+	if _, muted := channel.MutedUntil(bob.ID); !muted {
+		t.Fatal("the mute was lost on restart")
+	}
+	if channel.GetSlowMode() != 30*time.Second {
+		t.Fatalf("slow mode is %s after a restart", channel.GetSlowMode())
+	}
+	entries, err := channel.AuditLog(0)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("audit log has %d entries after a restart: %v", len(entries), err)
+	}
+
+	// Lifting them is stored too
+	if err := channel.Unban(owner, carol); err != nil {
+		t.Fatal(err)
+	}
+	if record, _ := node.server.metaStore.Get(channelID); record == nil || len(record.Bans) != 0 || len(record.Mutes) != 1 {
+		t.Fatalf("stored record is %+v", record)
+	}
+}
@@ -0,0 +1,205 @@
+package logic
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+	"wjjmjh/hermes/pkg/setting"
+)
+
+// NotificationSetting is how a user wants to hear about a channel. No mention
+// notifications are sent for channels the user muted; their messages are
+// still delivered as usual.
+type NotificationSetting struct {
+	UserID    string    `json:"user_id"`
+	ChannelID string    `json:"channel_id"`
+	Muted     bool      `json:"muted"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// isChannelMuted reports whether the account muted the notifications of the
+// channel
+func (server *WsServer) isChannelMuted(accountID string, channelID string) bool {
+	setting, err := server.notifications.Get(accountID, channelID)
+	if err != nil {
+		log.Printf("[ERROR] unable to load notification settings of %s: %v", accountID, err)
+		return false
+	}
+	return setting != nil && setting.Muted
+}
+
+// SetChannelMuted mutes or unmutes the notifications of a channel for an
+// account, on every node
+func (server *WsServer) SetChannelMuted(accountID string, channelID string, muted bool) error {
+	setting := &NotificationSetting{
+		UserID:    accountID,
+		ChannelID: channelID,
+		Muted:     muted,
+		UpdatedAt: time.Now().UTC(),
+	}
+	if err := server.notifications.Set(setting); err != nil {
+		return err
+	}
+	server.publishEvent(channelTopic, &channelEvent{
+		Node:          server.nodeID,
+		ChannelID:     channelID,
+		Notifications: setting,
+	})
+	return nil
+}
+
+// NotificationSettings returns the notification settings an account changed
+func (server *WsServer) NotificationSettings(accountID string) ([]*NotificationSetting, error) {
+	return server.notifications.ListUser(accountID)
+}
+
+// NotificationStore persists the notification settings of every user by
+// channel. Get returns nil when the user never changed the settings of the
+// channel.
+type NotificationStore interface {
+	Set(setting *NotificationSetting) error
+	Get(userID string, channelID string) (*NotificationSetting, error)
+	ListUser(userID string) ([]*NotificationSetting, error)
+	Close() error
+}
+
+// NewNotificationStore builds the NotificationStore configured in the
+// storage settings.
+func NewNotificationStore(storage *setting.Storage) (NotificationStore, error) {
+	switch storage.Type {
+	case "", MemoryStorage:
+		return NewMemoryNotificationStore(), nil
+	case FileStorage:
+		return OpenFileNotificationStore(storage.Path)
+	default:
+		return nil, fmt.Errorf("unknown notification setting storage type: %s", storage.Type)
+	}
+}
+
+/*
+	In-memory store
+*/
+
+// MemoryNotificationStore keeps notification settings in memory; they are
+// lost on restart.
+type MemoryNotificationStore struct {
+	mu    sync.RWMutex
+	users map[string]map[string]NotificationSetting
+}
+
+func NewMemoryNotificationStore() *MemoryNotificationStore {
+	return &MemoryNotificationStore{users: make(map[string]map[string]NotificationSetting)}
+}
+
+func (store *MemoryNotificationStore) Set(setting *NotificationSetting) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	settings, ok := store.users[setting.UserID]
+	if !ok {
+		settings = make(map[string]NotificationSetting)
+		store.users[setting.UserID] = settings
+	}
+	settings[setting.ChannelID] = *setting
+	return nil
+}
+
+func (store *MemoryNotificationStore) Get(userID string, channelID string) (*NotificationSetting, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	setting, ok := store.users[userID][channelID]
+	if !ok {
+		return nil, nil
+	}
+	return &setting, nil
+}
+
+func (store *MemoryNotificationStore) ListUser(userID string) ([]*NotificationSetting, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	settings := make([]*NotificationSetting, 0, len(store.users[userID]))
+	for _, setting := range store.users[userID] {
+		c := setting
+		settings = append(settings, &c)
+	}
+	return settings, nil
+}
+
+func (store *MemoryNotificationStore) Close() error {
+	return nil
+}
+
+/*
+	On-disk store
+*/
+
+// FileNotificationStore appends every setting change to a journal, which is
+// replayed into memory on open; the last change wins.
+type FileNotificationStore struct {
+	*MemoryNotificationStore
+	mu      sync.Mutex
+	journal *journal
+}
+
+// OpenFileNotificationStore opens (or creates) the notification setting log
+// in directory dir.
+func OpenFileNotificationStore(dir string) (*FileNotificationStore, error) {
+	store := &FileNotificationStore{MemoryNotificationStore: NewMemoryNotificationStore()}
+	journal, err := openJournal(dir, "notifications.log", store.replay)
+	if err != nil {
+		return nil, err
+	}
+	store.journal = journal
+
+	store.MemoryNotificationStore.mu.RLock()
+	live := 0
+	for _, settings := range store.users {
+		live += len(settings)
+	}
+	store.MemoryNotificationStore.mu.RUnlock()
+	if err := journal.compact(live, store.snapshot); err != nil {
+		_ = journal.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// snapshot writes the last setting of every user in every channel.
+func (store *FileNotificationStore) snapshot(write func(record interface{}) error) error {
+	store.MemoryNotificationStore.mu.RLock()
+	defer store.MemoryNotificationStore.mu.RUnlock()
+	for _, settings := range store.users {
+		for _, setting := range settings {
+			if err := write(setting); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replay loads a logged setting back into memory.
+func (store *FileNotificationStore) replay(record []byte) error {
+	var setting NotificationSetting
+	if err := json.Unmarshal(record, &setting); err != nil {
+		return err
+	}
+	return store.MemoryNotificationStore.Set(&setting)
+}
+
+func (store *FileNotificationStore) Set(setting *NotificationSetting) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.journal.Append(setting); err != nil {
+		return err
+	}
+	return store.MemoryNotificationStore.Set(setting)
+}
+
+func (store *FileNotificationStore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.journal.Close()
+}
@@ -11,6 +11,58 @@ var (
 	space   = []byte{' '}
 )
 
+// What to do when a user's dataBuffer is full
+const (
+	DropOldestPolicy = "drop-oldest"
+	DropNewestPolicy = "drop-newest"
+	DisconnectPolicy = "disconnect"
+)
+
+// DefaultBufferSize is the dataBuffer size used when none is configured
+const DefaultBufferSize = 256
+
+// Graceful shutdown defaults, used when none are configured
+const (
+	DefaultShutdownTimeout = 30 * time.Second
+	DefaultReconnectDelay  = 5 * time.Second
+)
+
+// DefaultMaxConversationSize is how many participants a direct message
+// conversation may have, including the one who opens it, when none is
+// configured
+const DefaultMaxConversationSize = 8
+
+// DefaultChannelTTL is how long an ephemeral channel may stay empty before it
+// is stopped, when none is configured
+const DefaultChannelTTL = 5 * time.Minute
+
+// DefaultResumeWindow is how long a dropped session can be resumed when
+// none is configured
+const DefaultResumeWindow = 30 * time.Second
+
+// DefaultPresenceDebounce is how long status changes are held back, so that
+// flapping connections do not notify anyone, when none is configured
+const DefaultPresenceDebounce = 2 * time.Second
+
+// DefaultPresenceRetention is how long users offline on every node are
+// remembered, when none is configured
+const DefaultPresenceRetention = 24 * time.Hour
+
+// Rate limit escalation defaults, used when none are configured
+const (
+	DefaultRateLimitMuteDuration = 30 * time.Second
+	DefaultViolationWindow       = time.Minute
+)
+
+// TypingTimeout is how long a typing-start lasts without being renewed
+const TypingTimeout = 5 * time.Second
+
+// History page sizes
+const (
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 200
+)
+
 // Update channel name
 type UpdateName_ struct {
 	UpdatedName string
@@ -0,0 +1,376 @@
+package logic
+
+import (
+	"sync"
+	"time"
+)
+
+// Presence statuses. Each connection is online, away or dnd; a user with no
+// connection on any node is offline. A connection may also choose offline,
+// to stay invisible: it counts as no connection and its activity does not
+// change the last-seen time.
+const (
+	StatusOnline  = "online"
+	StatusAway    = "away"
+	StatusDND     = "dnd"
+	StatusOffline = "offline"
+)
+
+// statusRank orders statuses for multi-device aggregation: a user is as
+// available as their most available device, except that do-not-disturb set
+// on any device wins.
+var statusRank = map[string]int{
+	StatusOffline: 0,
+	StatusAway:    1,
+	StatusOnline:  2,
+	StatusDND:     3,
+}
+
+func aggregateStatus(status string, other string) string {
+	if statusRank[other] > statusRank[status] {
+		return other
+	}
+	return status
+}
+
+type presenceEntry struct {
+	username string
+
+	// Status chosen by each connection of the user to this node
+	connections map[*User]string
+
+	// Aggregated status of the user on each other node
+	remote map[string]string
+
+	// IDs of channels whose members must hear about the next change, kept
+	// for connections that closed since the last change was published
+	channels map[string]bool
+
+	// Last time the user was connected and active
+	lastSeen time.Time
+
+	// Local status last published to the other nodes, and overall status
+	// last delivered to the subscribers on this node
+	published string
+	delivered string
+
+	// Pending debounced flush
+	timer *time.Timer
+}
+
+// localStatus aggregates the status of the user's connections to this node
+func (entry *presenceEntry) localStatus() string {
+	status := StatusOffline
+	for _, connectionStatus := range entry.connections {
+		status = aggregateStatus(status, connectionStatus)
+	}
+	return status
+}
+
+// status aggregates the user's connections across every node
+func (entry *presenceEntry) status() string {
+	status := entry.localStatus()
+	for _, nodeStatus := range entry.remote {
+		status = aggregateStatus(status, nodeStatus)
+	}
+	return status
+}
+
+// PresenceRegistry tracks the status and last-seen time of every user known
+// to the node. Changes are debounced, so a connection that flaps within the
+// debounce window does not notify anyone, and are only delivered to users who
+// share a channel with the user. Users offline on every node are forgotten
+// once they have not been seen for the retention period. It is safe for
+// concurrent use.
+type PresenceRegistry struct {
+	mu        sync.Mutex
+	entries   map[string]*presenceEntry
+	debounce  time.Duration
+	retention time.Duration
+	server    *WsServer
+	stopped   bool
+}
+
+func NewPresenceRegistry(server *WsServer, debounce time.Duration, retention time.Duration) *PresenceRegistry {
+	return &PresenceRegistry{
+		entries:   make(map[string]*presenceEntry),
+		debounce:  debounce,
+		retention: retention,
+		server:    server,
+	}
+}
+
+// entry returns the entry of a user, creating it if needed. Must be called
+// with the lock held.
+func (presence *PresenceRegistry) entry(userID string, username string) *presenceEntry {
+	entry, ok := presence.entries[userID]
+	if !ok {
+		entry = &presenceEntry{
+			connections: make(map[*User]string),
+			remote:      make(map[string]string),
+			channels:    make(map[string]bool),
+			published:   StatusOffline,
+			delivered:   StatusOffline,
+		}
+		presence.entries[userID] = entry
+	}
+	if username != "" {
+		entry.username = username
+	}
+	return entry
+}
+
+// schedule flushes the entry once the debounce window has passed. Must be
+// called with the lock held.
+func (presence *PresenceRegistry) schedule(userID string, entry *presenceEntry) {
+	if entry.timer == nil && !presence.stopped {
+		entry.timer = time.AfterFunc(presence.debounce, func() { presence.flush(userID) })
+	}
+}
+
+func (presence *PresenceRegistry) connected(user *User) {
+	presence.mu.Lock()
+	defer presence.mu.Unlock()
+	entry := presence.entry(user.UserId, *user.GetUsername())
+	entry.connections[user] = StatusOnline
+	entry.lastSeen = time.Now().UTC()
+	presence.schedule(user.UserId, entry)
+}
+
+// disconnected forgets a connection. The members of the channels it was in
+// still hear about the change.
+func (presence *PresenceRegistry) disconnected(user *User, channels map[*Channel]bool) {
+	presence.mu.Lock()
+	defer presence.mu.Unlock()
+	entry := presence.entry(user.UserId, *user.GetUsername())
+	if _, ok := entry.connections[user]; !ok {
+		return
+	}
+	status := entry.connections[user]
+	delete(entry.connections, user)
+	for channel := range channels {
+		entry.channels[*channel.GetID()] = true
+	}
+	if status != StatusOffline {
+		entry.lastSeen = time.Now().UTC()
+	}
+	presence.schedule(user.UserId, entry)
+}
+
+// setStatus changes the status of one connection of the user
+func (presence *PresenceRegistry) setStatus(user *User, status string) {
+	presence.mu.Lock()
+	defer presence.mu.Unlock()
+	entry := presence.entry(user.UserId, *user.GetUsername())
+	if _, ok := entry.connections[user]; !ok {
+		return
+	}
+	entry.connections[user] = status
+	if status != StatusOffline {
+		entry.lastSeen = time.Now().UTC()
+	}
+	presence.schedule(user.UserId, entry)
+}
+
+// touch records activity of the user, unless the connection is invisible
+func (presence *PresenceRegistry) touch(user *User) {
+	presence.mu.Lock()
+	defer presence.mu.Unlock()
+	if entry, ok := presence.entries[user.UserId]; ok && entry.connections[user] != StatusOffline {
+		entry.lastSeen = time.Now().UTC()
+	}
+}
+
+// Get returns the status of a user, or false if the user was never seen by
+// this node. Like everything subscribers are told, the status is debounced.
+func (presence *PresenceRegistry) Get(userID string) (PresencePayload, bool) {
+	presence.mu.Lock()
+	defer presence.mu.Unlock()
+	entry, ok := presence.entries[userID]
+	if !ok {
+		return PresencePayload{}, false
+	}
+	return PresencePayload{UserID: userID, Status: entry.delivered, LastSeen: entry.lastSeen}, true
+}
+
+// frame describes the status of a user on the wire. ok is false while the
+// user is offline, which subscribers assume unless told otherwise.
+func (presence *PresenceRegistry) frame(userID string) (frame *OutboundFrame, ok bool) {
+	presence.mu.Lock()
+	defer presence.mu.Unlock()
+	entry, ok := presence.entries[userID]
+	if !ok || entry.delivered == StatusOffline {
+		return nil, false
+	}
+	return presence.frameLocked(userID, entry), true
+}
+
+func (presence *PresenceRegistry) frameLocked(userID string, entry *presenceEntry) *OutboundFrame {
+	frame := newFrame(PresenceAction, "", PresencePayload{
+		UserID:   userID,
+		Status:   entry.delivered,
+		LastSeen: entry.lastSeen,
+	})
+	frame.Sender = &SenderInfo{ID: userID, Name: entry.username}
+	return frame
+}
+
+// flush publishes a debounced change to the other nodes and the subscribers
+// on this node, unless the status ended up where it was.
+func (presence *PresenceRegistry) flush(userID string) {
+	presence.mu.Lock()
+	entry := presence.entries[userID]
+	entry.timer = nil
+	local := entry.localStatus()
+	publish := local != entry.published
+	entry.published = local
+
+	channelIDs := entry.channels
+	entry.channels = make(map[string]bool)
+	connections := make([]*User, 0, len(entry.connections))
+	for user := range entry.connections {
+		connections = append(connections, user)
+	}
+	event := &presenceEvent{
+		Node:     presence.server.nodeID,
+		UserID:   userID,
+		Username: entry.username,
+		Status:   local,
+		LastSeen: entry.lastSeen,
+	}
+	presence.mu.Unlock()
+
+	// Members of the channels the user is in follow the user as well
+	for _, user := range connections {
+		for channel := range user.account.GetChannels() {
+			channelIDs[*channel.GetID()] = true
+		}
+	}
+
+	if publish {
+		for channelID := range channelIDs {
+			event.ChannelIDs = append(event.ChannelIDs, channelID)
+		}
+		presence.server.publishEvent(presenceTopic, event)
+	}
+	presence.update(userID, channelIDs)
+}
+
+// receive records the status of a user on another node
+func (presence *PresenceRegistry) receive(event *presenceEvent) {
+	presence.mu.Lock()
+	entry := presence.entry(event.UserID, event.Username)
+	if event.Status == StatusOffline {
+		delete(entry.remote, event.Node)
+	} else {
+		entry.remote[event.Node] = event.Status
+	}
+	if event.LastSeen.After(entry.lastSeen) {
+		entry.lastSeen = event.LastSeen
+	}
+	presence.mu.Unlock()
+
+	channelIDs := make(map[string]bool, len(event.ChannelIDs))
+	for _, channelID := range event.ChannelIDs {
+		channelIDs[channelID] = true
+	}
+	presence.update(event.UserID, channelIDs)
+}
+
+// update delivers the overall status of a user to the local members of the
+// given channels and to the user's own connections, if it changed since it
+// was last delivered.
+func (presence *PresenceRegistry) update(userID string, channelIDs map[string]bool) {
+	presence.mu.Lock()
+	entry, ok := presence.entries[userID]
+	if !ok {
+		presence.mu.Unlock()
+		return
+	}
+	status := entry.status()
+	if status == entry.delivered {
+		presence.mu.Unlock()
+		return
+	}
+	entry.delivered = status
+	frame := FrameMarshal(presence.frameLocked(userID, entry))
+	presence.mu.Unlock()
+
+	recipients := make(map[*Account]bool)
+	for channelID := range channelIDs {
+		if channel := presence.server.findChannelByID(channelID); channel != nil {
+			for account := range channel.GetMembers() {
+				recipients[account] = true
+			}
+		}
+	}
+	if account := presence.server.accounts.Get(userID); account != nil {
+		recipients[account] = true
+	}
+
+	for account := range recipients {
+		account.send(frame)
+	}
+}
+
+// idle reports whether the entry holds nothing but the last-seen time of a
+// user offline on every node, who everyone was told about. Must be called
+// with the lock held.
+func (entry *presenceEntry) idle() bool {
+	return len(entry.connections) == 0 && len(entry.remote) == 0 && len(entry.channels) == 0 &&
+		entry.timer == nil && entry.published == StatusOffline && entry.delivered == StatusOffline
+}
+
+// Reap forgets the users offline on every node who have not been seen for
+// the retention period, and returns how many users are left
+func (presence *PresenceRegistry) Reap(now time.Time) int {
+	presence.mu.Lock()
+	defer presence.mu.Unlock()
+	for userID, entry := range presence.entries {
+		if entry.idle() && now.Sub(entry.lastSeen) > presence.retention {
+			delete(presence.entries, userID)
+		}
+	}
+	return len(presence.entries)
+}
+
+// sendMembers tells an account that just joined a channel the status of its
+// other members on this node.
+func (presence *PresenceRegistry) sendMembers(account *Account, channel *Channel) {
+	for member := range channel.GetMembers() {
+		if member == account {
+			continue
+		}
+		if frame, ok := presence.frame(member.accountID); ok {
+			account.sendFrame(frame)
+		}
+	}
+}
+
+// stop publishes every local user as gone from this node, without waiting
+// for the debounce window. Used when the node shuts down.
+func (presence *PresenceRegistry) stop() {
+	presence.mu.Lock()
+	presence.stopped = true
+	userIDs := make([]string, 0)
+	for userID, entry := range presence.entries {
+		if entry.timer != nil {
+			entry.timer.Stop()
+			entry.timer = nil
+		}
+		if len(entry.connections) > 0 || entry.published != StatusOffline {
+			for user := range entry.connections {
+				for channel := range user.account.GetChannels() {
+					entry.channels[*channel.GetID()] = true
+				}
+			}
+			entry.connections = make(map[*User]string)
+			userIDs = append(userIDs, userID)
+		}
+	}
+	presence.mu.Unlock()
+
+	for _, userID := range userIDs {
+		presence.flush(userID)
+	}
+}
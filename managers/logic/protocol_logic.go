@@ -0,0 +1,687 @@
+package logic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+	"wjjmjh/hermes/pkg/api_response"
+)
+
+// ProtocolVersion is the version of the wire protocol spoken by this server.
+// Clients must send it in every frame; it is echoed in every server frame.
+const ProtocolVersion = 1
+
+// MaxTextLength is the longest message text accepted, in characters
+const MaxTextLength = 4000
+
+// MaxChannelNameLength is the longest channel name accepted, in characters
+const MaxChannelNameLength = 100
+
+// MinMessageSize is the smallest read limit of a connection, in bytes, so a
+// frame within the text, name and metadata limits always fits, even with
+// every character escaped as \uXXXX. The largest such frame is a metadata
+// update setting every attribute. A larger MaxMessageSize setting is kept.
+const MinMessageSize = 256 * 1024
+
+/*
+	Frames
+*/
+
+// InboundFrame is a frame sent by a client. Type specific arguments are
+// carried in Payload, see the *Payload types below. A client generated
+// RequestID is echoed in the ack or error frame answering the frame.
+type InboundFrame struct {
+	Version   int             `json:"version"`
+	Type      string          `json:"type"`
+	RequestID string          `json:"request_id,omitempty"`
+	ChannelID string          `json:"channel_id,omitempty"`
+	ThreadID  string          `json:"thread_id,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+// OutboundFrame is a frame sent by the server. Frames are numbered per
+// session on delivery with an additional "seq" field, see User.send.
+type OutboundFrame struct {
+	Version   int         `json:"version"`
+	Type      string      `json:"type"`
+	ID        string      `json:"id,omitempty"`
+	ChannelID string      `json:"channel_id,omitempty"`
+	ThreadID  string      `json:"thread_id,omitempty"`
+	Sender    *SenderInfo `json:"sender,omitempty"`
+	Timestamp time.Time   `json:"timestamp"`
+	Payload   interface{} `json:"payload,omitempty"`
+}
+
+// SenderInfo identifies the author of an outbound frame
+type SenderInfo struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// newFrame builds a server frame of the given type stamped with the current time
+func newFrame(frameType string, channelID string, payload interface{}) *OutboundFrame {
+	return &OutboundFrame{
+		Version:   ProtocolVersion,
+		Type:      frameType,
+		ChannelID: channelID,
+		Timestamp: time.Now().UTC(),
+		Payload:   payload,
+	}
+}
+
+/*
+	Payloads
+*/
+
+// TextPayload carries message text, inbound for send-message and outbound
+// for chat messages and notices.
+type TextPayload struct {
+	Text string `json:"text"`
+}
+
+// MessageContentPayload is the content of a chat message that mentions
+// someone, was edited, reacted to or deleted. Deleted messages are
+// tombstones: they keep their place in history, but not their text,
+// reactions or mentions.
+type MessageContentPayload struct {
+	Text      string     `json:"text,omitempty"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	Reactions []Reaction `json:"reactions,omitempty"`
+	Mentions  *Mentions  `json:"mentions,omitempty"`
+	Deleted   bool       `json:"deleted,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// JoinChannelPayload names the channel to join
+type JoinChannelPayload struct {
+	Name string `json:"name"`
+}
+
+// CreateChannelPayload describes the channel to create
+type CreateChannelPayload struct {
+	Name    string `json:"name"`
+	Private bool   `json:"private,omitempty"`
+}
+
+// UpdateChannelPayload changes the metadata of a channel. Fields left out
+// are kept, an empty string clears them. Attributes are merged into the
+// existing ones; an attribute set to null is removed.
+type UpdateChannelPayload struct {
+	Topic       *string            `json:"topic,omitempty"`
+	Description *string            `json:"description,omitempty"`
+	IconURL     *string            `json:"icon_url,omitempty"`
+	Attributes  map[string]*string `json:"attributes,omitempty"`
+}
+
+// OpenConversationPayload names the other participants of a direct message
+// conversation
+type OpenConversationPayload struct {
+	UserIDs []string `json:"user_ids"`
+}
+
+// ConversationPayload describes a conversation and its latest message, if any
+type ConversationPayload struct {
+	ChannelPayload
+	Latest *OutboundFrame `json:"latest,omitempty"`
+}
+
+// ConversationsPayload lists the conversations of a user, the most recently
+// active first
+type ConversationsPayload struct {
+	Conversations []ConversationPayload `json:"conversations"`
+}
+
+// FetchHistoryPayload selects a page of history, see MessageStore
+type FetchHistoryPayload struct {
+	Before string `json:"before,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+// CreateThreadPayload names the channel message a new thread replies to
+type CreateThreadPayload struct {
+	ParentMessageID string `json:"parent_message_id"`
+}
+
+// ThreadPayload describes a thread
+type ThreadPayload struct {
+	ID              string `json:"id"`
+	ChannelID       string `json:"channel_id"`
+	ParentMessageID string `json:"parent_message_id"`
+	Members         int    `json:"members"`
+}
+
+// ThreadsPayload lists the threads of a channel
+type ThreadsPayload struct {
+	Threads []ThreadPayload `json:"threads"`
+}
+
+// SetStatusPayload is the status a connection chooses for itself
+type SetStatusPayload struct {
+	Status string `json:"status"`
+}
+
+// PresencePayload describes the status of a user across all their devices
+type PresencePayload struct {
+	UserID   string    `json:"user_id"`
+	Status   string    `json:"status"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// SessionPayload is sent on connect. The token resumes the session on a new
+// connection if this one drops, for up to ResumeWindow seconds.
+type SessionPayload struct {
+	SessionToken string `json:"session_token"`
+	ResumeWindow int    `json:"resume_window"`
+}
+
+// ResumePayload asks to resume a dropped session, replaying the frames
+// numbered after LastSeq. It must be the first frame of the connection,
+// which would otherwise have numbered frames of its own. Frames received
+// before the resumed frame are outside the session and may repeat replayed
+// ones.
+type ResumePayload struct {
+	SessionToken string `json:"session_token"`
+	LastSeq      uint64 `json:"last_seq"`
+}
+
+// ResumedPayload follows the replayed frames. Gap is set when some of the
+// missed frames were no longer available, history must then be fetched again.
+type ResumedPayload struct {
+	SessionToken string `json:"session_token"`
+	Replayed     int    `json:"replayed"`
+	Gap          bool   `json:"gap,omitempty"`
+}
+
+// MarkReadPayload names the last message the user has read
+type MarkReadPayload struct {
+	MessageID string `json:"message_id"`
+}
+
+// ReadPositionsPayload answers get-read-positions with the read position of
+// every member and the requesting user's unread count
+type ReadPositionsPayload struct {
+	Positions []*ReadPosition `json:"positions"`
+	Unread    int             `json:"unread"`
+}
+
+// ChannelPayload describes a channel, or a conversation with its
+// participants, along with its metadata
+type ChannelPayload struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	Private      bool              `json:"private"`
+	Direct       bool              `json:"direct,omitempty"`
+	Participants []SenderInfo      `json:"participants,omitempty"`
+	Pinned       []string          `json:"pinned,omitempty"`
+	SlowMode     int               `json:"slow_mode,omitempty"`
+	Archived     bool              `json:"archived,omitempty"`
+	Ephemeral    bool              `json:"ephemeral,omitempty"`
+	Topic        string            `json:"topic,omitempty"`
+	Description  string            `json:"description,omitempty"`
+	IconURL      string            `json:"icon_url,omitempty"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+	CreatedBy    string            `json:"created_by,omitempty"`
+}
+
+// RolePayload is the role of a user in a channel, inbound for set-role and
+// outbound for role-changed
+type RolePayload struct {
+	UserID string `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+// RolesPayload lists the users holding a role other than member
+type RolesPayload struct {
+	Roles []RolePayload `json:"roles"`
+}
+
+// MessagePayload names a message of the channel, for pin-message and
+// unpin-message
+type MessagePayload struct {
+	MessageID string `json:"message_id"`
+}
+
+// EditMessagePayload replaces the text of a message
+type EditMessagePayload struct {
+	MessageID string `json:"message_id"`
+	Text      string `json:"text"`
+}
+
+// MessageEditedPayload announces the new text of a message
+type MessageEditedPayload struct {
+	MessageID string    `json:"message_id"`
+	Text      string    `json:"text"`
+	EditedAt  time.Time `json:"edited_at"`
+	Mentions  *Mentions `json:"mentions,omitempty"`
+}
+
+// MessageDeletedPayload announces that a message was deleted
+type MessageDeletedPayload struct {
+	MessageID string    `json:"message_id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// EditHistoryPayload lists the earlier versions of a message, oldest first
+type EditHistoryPayload struct {
+	MessageID string        `json:"message_id"`
+	Edits     []MessageEdit `json:"edits"`
+}
+
+// ReactionPayload names a message and the emoji to add or remove as a
+// reaction to it
+type ReactionPayload struct {
+	MessageID string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+}
+
+// ReactionChangedPayload announces that the sender reacted to a message with
+// an emoji, or took the reaction back. Count is how many users reacted with
+// the emoji now.
+type ReactionChangedPayload struct {
+	MessageID string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+	Count     int    `json:"count"`
+}
+
+// MentionPayload tells a user that the sender mentioned them in a message,
+// by username (user), or through @channel or @here. ChannelName is left out
+// for conversations.
+type MentionPayload struct {
+	MessageID   string `json:"message_id"`
+	ChannelName string `json:"channel_name,omitempty"`
+	Text        string `json:"text"`
+	Mention     string `json:"mention"`
+}
+
+// NotificationSettingsPayload lists the notification settings the user
+// changed, by channel
+type NotificationSettingsPayload struct {
+	Settings []*NotificationSetting `json:"settings"`
+}
+
+// PinPayload announces that a message was pinned or unpinned
+type PinPayload struct {
+	MessageID string `json:"message_id"`
+	Pinned    bool   `json:"pinned"`
+}
+
+// InvitePayload names the user to invite
+type InvitePayload struct {
+	UserID string `json:"user_id"`
+}
+
+// ModerationPayload names the user a moderation action is taken against, for
+// kick, ban, unban and unmute. Reason is optional.
+type ModerationPayload struct {
+	UserID string `json:"user_id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// MutePayload mutes a user for Duration seconds
+type MutePayload struct {
+	UserID   string `json:"user_id"`
+	Duration int    `json:"duration"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// SlowModePayload sets the slow mode interval in seconds, 0 turns it off
+type SlowModePayload struct {
+	Interval int `json:"interval"`
+}
+
+// GetAuditLogPayload selects how many of the latest audit log entries to send
+type GetAuditLogPayload struct {
+	Limit int `json:"limit,omitempty"`
+}
+
+// AuditLogPayload lists audit log entries, oldest first
+type AuditLogPayload struct {
+	Entries []*AuditEntry `json:"entries"`
+}
+
+// SystemPayload is a notice from the server to a channel. Moderation is set
+// when it announces a moderation action.
+type SystemPayload struct {
+	Text       string      `json:"text"`
+	Moderation *AuditEntry `json:"moderation,omitempty"`
+}
+
+// HistoryPayload is a page of history, oldest first. Before is the cursor
+// for the next (older) page.
+type HistoryPayload struct {
+	Messages []*OutboundFrame `json:"messages"`
+	Before   string           `json:"before,omitempty"`
+}
+
+// NewHistoryPayload encodes a page of stored messages
+func NewHistoryPayload(messages []*Message) HistoryPayload {
+	payload := HistoryPayload{Messages: make([]*OutboundFrame, 0, len(messages))}
+	for _, message := range messages {
+		payload.Messages = append(payload.Messages, message.Frame())
+	}
+	if len(messages) > 0 {
+		payload.Before = messages[0].ID
+	}
+	return payload
+}
+
+// AckPayload confirms that a client frame was accepted. MessageID is set when
+// the frame produced a stored message, ThreadID when it created a thread and
+// ChannelID when it opened a conversation.
+type AckPayload struct {
+	RequestID string `json:"request_id"`
+	MessageID string `json:"message_id,omitempty"`
+	ThreadID  string `json:"thread_id,omitempty"`
+	ChannelID string `json:"channel_id,omitempty"`
+}
+
+// ErrorPayload reports why a client frame was rejected
+type ErrorPayload struct {
+	RequestID string `json:"request_id,omitempty"`
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+/*
+	Validation
+*/
+
+// FrameError is a typed protocol error sent back to the client as an error frame
+type FrameError struct {
+	RequestID string
+	Code      int
+	Detail    string
+}
+
+func newFrameError(code int, format string, a ...interface{}) *FrameError {
+	return &FrameError{Code: code, Detail: fmt.Sprintf(format, a...)}
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("%s: %s", api_response.GetMsg(e.Code), e.Detail)
+}
+
+// Frame converts the error into an error frame
+func (e *FrameError) Frame() *OutboundFrame {
+	return newFrame(ErrorAction, "", ErrorPayload{
+		RequestID: e.RequestID,
+		Code:      e.Code,
+		Message:   api_response.GetMsg(e.Code),
+		Detail:    e.Detail,
+	})
+}
+
+// frameRule lists what an inbound frame type requires
+type frameRule struct {
+	needsChannel bool
+	needsThread  bool
+	payload      func() interface{}
+}
+
+var inboundFrameRules = map[string]frameRule{
+	SendMessageAction:             {true, false, func() interface{} { return &TextPayload{} }},
+	JoinChannelAction:             {false, false, func() interface{} { return &JoinChannelPayload{} }},
+	LeaveChannelAction:            {true, false, nil},
+	CreateChannelAction:           {false, false, func() interface{} { return &CreateChannelPayload{} }},
+	ArchiveChannelAction:          {true, false, nil},
+	UnarchiveChannelAction:        {true, false, nil},
+	DeleteChannelAction:           {true, false, nil},
+	UpdateChannelAction:           {true, false, func() interface{} { return &UpdateChannelPayload{} }},
+	OpenConversationAction:        {false, false, func() interface{} { return &OpenConversationPayload{} }},
+	ListConversationsAction:       {false, false, nil},
+	FetchHistoryAction:            {true, false, func() interface{} { return &FetchHistoryPayload{} }},
+	CreateThreadAction:            {true, false, func() interface{} { return &CreateThreadPayload{} }},
+	JoinThreadAction:              {true, true, nil},
+	LeaveThreadAction:             {true, true, nil},
+	SendThreadMessageAction:       {true, true, func() interface{} { return &TextPayload{} }},
+	ListThreadsAction:             {true, false, nil},
+	SetStatusAction:               {false, false, func() interface{} { return &SetStatusPayload{} }},
+	TypingStartAction:             {true, false, nil},
+	TypingStopAction:              {true, false, nil},
+	MarkReadAction:                {true, false, func() interface{} { return &MarkReadPayload{} }},
+	GetReadPositionsAction:        {true, false, nil},
+	ResumeAction:                  {false, false, func() interface{} { return &ResumePayload{} }},
+	SetRoleAction:                 {true, false, func() interface{} { return &RolePayload{} }},
+	GetRolesAction:                {true, false, nil},
+	InviteAction:                  {true, false, func() interface{} { return &InvitePayload{} }},
+	PinMessageAction:              {true, false, func() interface{} { return &MessagePayload{} }},
+	UnpinMessageAction:            {true, false, func() interface{} { return &MessagePayload{} }},
+	EditMessageAction:             {true, false, func() interface{} { return &EditMessagePayload{} }},
+	DeleteMessageAction:           {true, false, func() interface{} { return &MessagePayload{} }},
+	GetEditHistoryAction:          {true, false, func() interface{} { return &MessagePayload{} }},
+	AddReactionAction:             {true, false, func() interface{} { return &ReactionPayload{} }},
+	RemoveReactionAction:          {true, false, func() interface{} { return &ReactionPayload{} }},
+	MuteNotificationsAction:       {true, false, nil},
+	UnmuteNotificationsAction:     {true, false, nil},
+	GetNotificationSettingsAction: {false, false, nil},
+	KickAction:                    {true, false, func() interface{} { return &ModerationPayload{} }},
+	BanAction:                     {true, false, func() interface{} { return &ModerationPayload{} }},
+	UnbanAction:                   {true, false, func() interface{} { return &ModerationPayload{} }},
+	MuteAction:                    {true, false, func() interface{} { return &MutePayload{} }},
+	UnmuteAction:                  {true, false, func() interface{} { return &ModerationPayload{} }},
+	SlowModeAction:                {true, false, func() interface{} { return &SlowModePayload{} }},
+	GetAuditLogAction:             {true, false, func() interface{} { return &GetAuditLogPayload{} }},
+}
+
+// DecodeFrame parses and validates a client frame. The returned payload is a
+// pointer to the payload type registered for the frame type, or nil. Errors
+// carry the request ID of the frame whenever it could be read.
+func DecodeFrame(data []byte) (*InboundFrame, interface{}, *FrameError) {
+	frame, payload, err := decodeFrame(data)
+	if err != nil {
+		var probe struct {
+			RequestID string `json:"request_id"`
+		}
+		if json.Unmarshal(data, &probe) == nil {
+			err.RequestID = probe.RequestID
+		}
+	}
+	return frame, payload, err
+}
+
+func decodeFrame(data []byte) (*InboundFrame, interface{}, *FrameError) {
+	var frame InboundFrame
+	if err := strictUnmarshal(data, &frame); err != nil {
+		return nil, nil, newFrameError(api_response.ERROR_INVALID_FRAME, "%v", err)
+	}
+
+	if frame.Version != ProtocolVersion {
+		return nil, nil, newFrameError(api_response.ERROR_UNSUPPORTED_VERSION,
+			"expected version %d, got %d", ProtocolVersion, frame.Version)
+	}
+
+	rule, ok := inboundFrameRules[frame.Type]
+	if !ok {
+		return nil, nil, newFrameError(api_response.ERROR_UNKNOWN_FRAME_TYPE, "unknown type %q", frame.Type)
+	}
+
+	if rule.needsChannel && frame.ChannelID == "" {
+		return nil, nil, newFrameError(api_response.ERROR_INVALID_FRAME, "%s requires channel_id", frame.Type)
+	}
+	if rule.needsThread && frame.ThreadID == "" {
+		return nil, nil, newFrameError(api_response.ERROR_INVALID_FRAME, "%s requires thread_id", frame.Type)
+	}
+
+	if rule.payload == nil {
+		return &frame, nil, nil
+	}
+
+	payload := rule.payload()
+	if len(frame.Payload) == 0 {
+		return nil, nil, newFrameError(api_response.ERROR_INVALID_PAYLOAD, "%s requires a payload", frame.Type)
+	}
+	if err := strictUnmarshal(frame.Payload, payload); err != nil {
+		return nil, nil, newFrameError(api_response.ERROR_INVALID_PAYLOAD, "%v", err)
+	}
+	if err := validatePayload(payload); err != nil {
+		return nil, nil, err
+	}
+
+	return &frame, payload, nil
+}
+
+// toFrameError converts a handler error into a FrameError for the request
+func toFrameError(err error, requestID string) *FrameError {
+	frameErr, ok := err.(*FrameError)
+	if !ok {
+		switch err {
+		case ErrPermissionDenied:
+			frameErr = newFrameError(api_response.ERROR_PERMISSION_DENIED, "%v", err)
+		case ErrInvalidRole:
+			frameErr = newFrameError(api_response.ERROR_INVALID_PAYLOAD, "%v", err)
+		case ErrUserNotFound:
+			frameErr = newFrameError(api_response.ERROR_NOT_EXIST_USER, "%v", err)
+		case ErrChannelNotFound:
+			frameErr = newFrameError(api_response.ERROR_NOT_EXIST_CHANNEL, "%v", err)
+		case ErrChannelExists:
+			frameErr = newFrameError(api_response.ERROR_EXIST_CHANNEL, "%v", err)
+		default:
+			frameErr = newFrameError(api_response.ERROR, "%v", err)
+		}
+	}
+	frameErr.RequestID = requestID
+	return frameErr
+}
+
+// strictUnmarshal decodes a single JSON value, rejecting unknown fields
+func strictUnmarshal(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("unexpected data after JSON value")
+	}
+	return nil
+}
+
+// validatePayload checks the semantic constraints of a decoded payload
+func validatePayload(payload interface{}) *FrameError {
+	switch p := payload.(type) {
+	case *TextPayload:
+		if strings.TrimSpace(p.Text) == "" {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "text must not be empty")
+		}
+		if utf8.RuneCountInString(p.Text) > MaxTextLength {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "text exceeds %d characters", MaxTextLength)
+		}
+	case *EditMessagePayload:
+		if p.MessageID == "" {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "message_id must not be empty")
+		}
+		if strings.TrimSpace(p.Text) == "" {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "text must not be empty")
+		}
+		if utf8.RuneCountInString(p.Text) > MaxTextLength {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "text exceeds %d characters", MaxTextLength)
+		}
+	case *ReactionPayload:
+		if p.MessageID == "" {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "message_id must not be empty")
+		}
+		if p.Emoji == "" || strings.IndexFunc(p.Emoji, unicode.IsSpace) >= 0 {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "emoji must not be empty or contain spaces")
+		}
+		if utf8.RuneCountInString(p.Emoji) > MaxEmojiLength {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "emoji exceeds %d characters", MaxEmojiLength)
+		}
+	case *JoinChannelPayload:
+		if strings.TrimSpace(p.Name) == "" {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "name must not be empty")
+		}
+		if utf8.RuneCountInString(p.Name) > MaxChannelNameLength {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "name exceeds %d characters", MaxChannelNameLength)
+		}
+	case *CreateChannelPayload:
+		if strings.TrimSpace(p.Name) == "" {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "name must not be empty")
+		}
+		if utf8.RuneCountInString(p.Name) > MaxChannelNameLength {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "name exceeds %d characters", MaxChannelNameLength)
+		}
+	case *UpdateChannelPayload:
+		return validateChannelUpdate(p)
+	case *CreateThreadPayload:
+		if p.ParentMessageID == "" {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "parent_message_id must not be empty")
+		}
+	case *OpenConversationPayload:
+		if len(p.UserIDs) == 0 {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "user_ids must not be empty")
+		}
+		for _, userID := range p.UserIDs {
+			if userID == "" {
+				return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "user_ids must not contain empty IDs")
+			}
+		}
+	case *RolePayload:
+		if p.UserID == "" {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "user_id must not be empty")
+		}
+		if !validRole(p.Role) {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "unknown role %q", p.Role)
+		}
+	case *InvitePayload:
+		if p.UserID == "" {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "user_id must not be empty")
+		}
+	case *ModerationPayload:
+		if p.UserID == "" {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "user_id must not be empty")
+		}
+		if utf8.RuneCountInString(p.Reason) > MaxTextLength {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "reason exceeds %d characters", MaxTextLength)
+		}
+	case *MutePayload:
+		if p.UserID == "" {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "user_id must not be empty")
+		}
+		if p.Duration <= 0 || p.Duration > int(MaxMuteDuration/time.Second) {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD,
+				"duration must be between 1 and %d seconds", int(MaxMuteDuration/time.Second))
+		}
+		if utf8.RuneCountInString(p.Reason) > MaxTextLength {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "reason exceeds %d characters", MaxTextLength)
+		}
+	case *SlowModePayload:
+		if p.Interval < 0 || p.Interval > int(MaxSlowModeInterval/time.Second) {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD,
+				"interval must be between 0 and %d seconds", int(MaxSlowModeInterval/time.Second))
+		}
+	case *GetAuditLogPayload:
+		if p.Limit < 0 || p.Limit > MaxAuditLogLimit {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "limit must be between 0 and %d", MaxAuditLogLimit)
+		}
+	case *ResumePayload:
+		if p.SessionToken == "" {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "session_token must not be empty")
+		}
+	case *MarkReadPayload:
+		if p.MessageID == "" {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "message_id must not be empty")
+		}
+	case *MessagePayload:
+		if p.MessageID == "" {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "message_id must not be empty")
+		}
+	case *SetStatusPayload:
+		switch p.Status {
+		case StatusOnline, StatusAway, StatusDND, StatusOffline:
+		default:
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD,
+				"status must be %s, %s, %s or %s", StatusOnline, StatusAway, StatusDND, StatusOffline)
+		}
+	case *FetchHistoryPayload:
+		if p.Limit < 0 || p.Limit > MaxHistoryLimit {
+			return newFrameError(api_response.ERROR_INVALID_PAYLOAD, "limit must be between 0 and %d", MaxHistoryLimit)
+		}
+	}
+	return nil
+}
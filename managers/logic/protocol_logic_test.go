@@ -0,0 +1,136 @@
+package logic
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"wjjmjh/hermes/pkg/api_response"
+)
+
+func TestValidatePayload(t *testing.T) {
+	text := func(n int) string { return strings.Repeat("é", n) }
+	ptr := func(s string) *string { return &s }
+	attributes := func(n int) map[string]*string {
+		a := make(map[string]*string)
+		for i := 0; i < n; i++ {
+			a[fmt.Sprintf("key-%d", i)] = ptr("value")
+		}
+		return a
+	}
+
+	tests := []struct {
+		name    string
+		payload interface{}
+		valid   bool
+	}{
+		{"text", &TextPayload{Text: "hello"}, true},
+		{"blank text", &TextPayload{Text: " \n\t"}, false},
+		{"longest text", &TextPayload{Text: text(MaxTextLength)}, true},
+		{"text too long", &TextPayload{Text: text(MaxTextLength + 1)}, false},
+		{"edit", &EditMessagePayload{MessageID: "m", Text: "hello"}, true},
+		{"edit without message", &EditMessagePayload{Text: "hello"}, false},
+		{"edit to blank", &EditMessagePayload{MessageID: "m", Text: " "}, false},
+		{"edit too long", &EditMessagePayload{MessageID: "m", Text: text(MaxTextLength + 1)}, false},
+		{"reaction", &ReactionPayload{MessageID: "m", Emoji: "👍"}, true},
+		{"reaction without message", &ReactionPayload{Emoji: "👍"}, false},
+		{"reaction with spaces", &ReactionPayload{MessageID: "m", Emoji: "thumbs up"}, false},
+		{"reaction too long", &ReactionPayload{MessageID: "m", Emoji: text(MaxEmojiLength + 1)}, false},
+		{"join", &JoinChannelPayload{Name: "lobby"}, true},
+		{"join blank name", &JoinChannelPayload{Name: " "}, false},
+		{"join longest name", &JoinChannelPayload{Name: text(MaxChannelNameLength)}, true},
+		{"join name too long", &JoinChannelPayload{Name: text(MaxChannelNameLength + 1)}, false},
+		{"create", &CreateChannelPayload{Name: "lobby", Private: true}, true},
+		{"create blank name", &CreateChannelPayload{Name: ""}, false},
+		{"create name too long", &CreateChannelPayload{Name: text(MaxChannelNameLength + 1)}, false},
+		{"update topic", &UpdateChannelPayload{Topic: ptr("news")}, true},
+		{"update nothing", &UpdateChannelPayload{}, false},
+		{"update topic too long", &UpdateChannelPayload{Topic: ptr(text(MaxTopicLength + 1))}, false},
+		{"update description too long", &UpdateChannelPayload{Description: ptr(text(MaxDescriptionLength + 1))}, false},
+		{"update icon", &UpdateChannelPayload{IconURL: ptr("https://example.com/icon.png")}, true},
+		{"clear icon", &UpdateChannelPayload{IconURL: ptr("")}, true},
+		{"update icon not http", &UpdateChannelPayload{IconURL: ptr("javascript:alert(1)")}, false},
+		{"update most attributes", &UpdateChannelPayload{Attributes: attributes(MaxAttributes)}, true},
+		{"update too many attributes", &UpdateChannelPayload{Attributes: attributes(MaxAttributes + 1)}, false},
+		{"update blank attribute key", &UpdateChannelPayload{Attributes: map[string]*string{"": ptr("v")}}, false},
+		{"update attribute too long", &UpdateChannelPayload{Attributes: map[string]*string{"k": ptr(text(MaxAttributeValueLength + 1))}}, false},
+		{"remove attribute", &UpdateChannelPayload{Attributes: map[string]*string{"k": nil}}, true},
+		{"thread", &CreateThreadPayload{ParentMessageID: "m"}, true},
+		{"thread without parent", &CreateThreadPayload{}, false},
+		{"conversation", &OpenConversationPayload{UserIDs: []string{"a"}}, true},
+		{"conversation with nobody", &OpenConversationPayload{}, false},
+		{"conversation with a blank ID", &OpenConversationPayload{UserIDs: []string{"a", ""}}, false},
+		{"role", &RolePayload{UserID: "a", Role: RoleModerator}, true},
+		{"role without user", &RolePayload{Role: RoleModerator}, false},
+		{"unknown role", &RolePayload{UserID: "a", Role: "king"}, false},
+		{"invite", &InvitePayload{UserID: "a"}, true},
+		{"invite nobody", &InvitePayload{}, false},
+		{"kick", &ModerationPayload{UserID: "a", Reason: "spam"}, true},
+		{"kick nobody", &ModerationPayload{}, false},
+		{"kick reason too long", &ModerationPayload{UserID: "a", Reason: text(MaxTextLength + 1)}, false},
+		{"mute", &MutePayload{UserID: "a", Duration: 60}, true},
+		{"mute without duration", &MutePayload{UserID: "a"}, false},
+		{"mute too long", &MutePayload{UserID: "a", Duration: int(MaxMuteDuration/time.Second) + 1}, false},
+		{"mute nobody", &MutePayload{Duration: 60}, false},
+		{"slow mode off", &SlowModePayload{Interval: 0}, true},
+		{"slow mode negative", &SlowModePayload{Interval: -1}, false},
+		{"slow mode too slow", &SlowModePayload{Interval: int(MaxSlowModeInterval/time.Second) + 1}, false},
+		{"audit log", &GetAuditLogPayload{Limit: MaxAuditLogLimit}, true},
+		{"audit log limit too high", &GetAuditLogPayload{Limit: MaxAuditLogLimit + 1}, false},
+		{"resume", &ResumePayload{SessionToken: "token", LastSeq: 3}, true},
+		{"resume without token", &ResumePayload{LastSeq: 3}, false},
+		{"mark read", &MarkReadPayload{MessageID: "m"}, true},
+		{"mark read nothing", &MarkReadPayload{}, false},
+		{"pin", &MessagePayload{MessageID: "m"}, true},
+		{"pin nothing", &MessagePayload{}, false},
+		{"status", &SetStatusPayload{Status: StatusAway}, true},
+		{"invisible", &SetStatusPayload{Status: StatusOffline}, true},
+		{"unknown status", &SetStatusPayload{Status: "busy"}, false},
+		{"history", &FetchHistoryPayload{Limit: MaxHistoryLimit}, true},
+		{"history limit too high", &FetchHistoryPayload{Limit: MaxHistoryLimit + 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePayload(tt.payload)
+			if tt.valid && err != nil {
+				t.Fatalf("rejected: %v", err)
+			}
+			if !tt.valid && (err == nil || err.Code != api_response.ERROR_INVALID_PAYLOAD) {
+				t.Fatalf("got %v, want an invalid payload error", err)
+			}
+		})
+	}
+}
+
+// escaped is n characters, each escaped in JSON as \uXXXX
+func escaped(n int) string {
+	return strings.Repeat(`\u0061`, n)
+}
+
+func TestMinMessageSizeFitsValidFrames(t *testing.T) {
+	var attributes []string
+	for i := 0; i < MaxAttributes; i++ {
+		key := fmt.Sprintf("%02d", i) + escaped(MaxAttributeKeyLength-2)
+		attributes = append(attributes, fmt.Sprintf(`"%s":"%s"`, key, escaped(MaxAttributeValueLength)))
+	}
+	envelope := `{"version":%d,"request_id":"00000000-0000-0000-0000-000000000000","type":"%s","channel_id":"00000000-0000-0000-0000-000000000000","payload":%s}`
+
+	frames := map[string]string{
+		"longest text": fmt.Sprintf(envelope, ProtocolVersion, SendMessageAction,
+			fmt.Sprintf(`{"text":"%s"}`, escaped(MaxTextLength))),
+		"longest metadata update": fmt.Sprintf(envelope, ProtocolVersion, UpdateChannelAction,
+			fmt.Sprintf(`{"topic":"%s","description":"%s","icon_url":"https://example.com/%s","attributes":{%s}}`,
+				escaped(MaxTopicLength), escaped(MaxDescriptionLength), escaped(MaxIconURLLength-len("https://example.com/")),
+				strings.Join(attributes, ","))),
+	}
+	for name, frame := range frames {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := decodeFrame([]byte(frame)); err != nil {
+				t.Fatalf("frame rejected: %v", err)
+			}
+			if len(frame) > MinMessageSize {
+				t.Fatalf("valid frame of %d bytes exceeds MinMessageSize %d", len(frame), MinMessageSize)
+			}
+		})
+	}
+}
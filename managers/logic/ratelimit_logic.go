@@ -0,0 +1,302 @@
+package logic
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"log"
+	"sync"
+	"time"
+	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/setting"
+)
+
+// RateLimits configures the token buckets of every account and how repeated
+// violations escalate. The buckets are shared by all connections of an
+// account to this node, so opening more connections does not raise its
+// limits. A limit of zero is no limit; MuteAfter and DisconnectAfter of zero
+// never escalate that far. Each account is sent at most one notice of its
+// violations per ViolationWindow, and one more when it is muted.
+type RateLimits struct {
+	// Frames of any type per second, checked before a frame is even decoded
+	FramesPerSecond int
+
+	// Chat messages, channel and thread, edits and reactions per second
+	MessagesPerSecond int
+
+	// Channel joins per minute
+	JoinsPerMinute int
+
+	// Joins creating a channel that did not exist per hour
+	ChannelCreationsPerHour int
+
+	// Violations within ViolationWindow of each other before the account is
+	// muted for MuteDuration, then before the violating connection is
+	// disconnected
+	MuteAfter       int
+	MuteDuration    time.Duration
+	DisconnectAfter int
+	ViolationWindow time.Duration
+}
+
+// rateLimitsFromSettings reads the rate limits of the rateLimit settings
+func rateLimitsFromSettings(config *setting.RateLimit) RateLimits {
+	limits := RateLimits{
+		FramesPerSecond:         config.FramesPerSecond,
+		MessagesPerSecond:       config.MessagesPerSecond,
+		JoinsPerMinute:          config.JoinsPerMinute,
+		ChannelCreationsPerHour: config.ChannelCreationsPerHour,
+		MuteAfter:               config.MuteAfter,
+		MuteDuration:            config.MuteDuration,
+		DisconnectAfter:         config.DisconnectAfter,
+		ViolationWindow:         config.ViolationWindow,
+	}
+	if limits.MuteDuration <= 0 {
+		limits.MuteDuration = DefaultRateLimitMuteDuration
+	}
+	if limits.ViolationWindow <= 0 {
+		limits.ViolationWindow = DefaultViolationWindow
+	}
+	return limits
+}
+
+// tokenBucket allows count events per period, in bursts of up to count. A
+// nil bucket allows everything.
+type tokenBucket struct {
+	capacity float64
+	tokens   float64
+	perSec   float64
+	last     time.Time
+}
+
+func newTokenBucket(count int, period time.Duration) *tokenBucket {
+	if count <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		capacity: float64(count),
+		tokens:   float64(count),
+		perSec:   float64(count) / period.Seconds(),
+		last:     time.Now(),
+	}
+}
+
+// full reports whether the bucket has refilled by now
+func (bucket *tokenBucket) full(now time.Time) bool {
+	return bucket == nil || bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.perSec >= bucket.capacity
+}
+
+// take uses up a token, or returns false if there is none left
+func (bucket *tokenBucket) take(now time.Time) bool {
+	if bucket == nil {
+		return true
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.perSec
+	if bucket.tokens > bucket.capacity {
+		bucket.tokens = bucket.capacity
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Escalation steps of a rate limit violation
+const (
+	rateLimitWarn = iota
+	rateLimitMute
+	rateLimitDisconnect
+)
+
+// rateLimiter holds the token buckets and violations of one account. The
+// read goroutines of its connections hold mu while using it.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limits RateLimits
+
+	frames    *tokenBucket
+	messages  *tokenBucket
+	joins     *tokenBucket
+	creations *tokenBucket
+
+	violations    int
+	lastViolation time.Time
+	lastNotice    time.Time
+	mutedUntil    time.Time
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	return &rateLimiter{
+		limits:    limits,
+		frames:    newTokenBucket(limits.FramesPerSecond, time.Second),
+		messages:  newTokenBucket(limits.MessagesPerSecond, time.Second),
+		joins:     newTokenBucket(limits.JoinsPerMinute, time.Minute),
+		creations: newTokenBucket(limits.ChannelCreationsPerHour, time.Hour),
+	}
+}
+
+// idle reports whether the limiter is back to its initial state: a new one
+// would allow and escalate exactly the same. The caller holds mu.
+func (limiter *rateLimiter) idle(now time.Time) bool {
+	return limiter.frames.full(now) && limiter.messages.full(now) && limiter.joins.full(now) &&
+		limiter.creations.full(now) && !now.Before(limiter.mutedUntil) &&
+		now.Sub(limiter.lastViolation) > limiter.limits.ViolationWindow
+}
+
+// RateLimiterRegistry holds the rate limiter of every account connected to
+// this node
+type RateLimiterRegistry struct {
+	mu       sync.Mutex
+	limits   RateLimits
+	limiters map[string]*rateLimiter
+}
+
+func NewRateLimiterRegistry(limits RateLimits) *RateLimiterRegistry {
+	return &RateLimiterRegistry{limits: limits, limiters: make(map[string]*rateLimiter)}
+}
+
+// get returns the rate limiter of an account, creating it on first use
+func (registry *RateLimiterRegistry) get(accountID string) *rateLimiter {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	limiter, ok := registry.limiters[accountID]
+	if !ok {
+		limiter = newRateLimiter(registry.limits)
+		registry.limiters[accountID] = limiter
+	}
+	return limiter
+}
+
+// Reap forgets the limiters that are idle by now, and returns how many are
+// left. Forgetting them loses nothing, since a new one behaves the same.
+func (registry *RateLimiterRegistry) Reap(now time.Time) int {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for accountID, limiter := range registry.limiters {
+		limiter.mu.Lock()
+		idle := limiter.idle(now)
+		limiter.mu.Unlock()
+		if idle {
+			delete(registry.limiters, accountID)
+		}
+	}
+	return len(registry.limiters)
+}
+
+// violate records a violation and returns how far it escalates, and whether
+// the account should be told: the first violation of a window and the one
+// muting the account are. Violations while muted do not extend the mute.
+// The caller holds mu.
+func (limiter *rateLimiter) violate(now time.Time) (escalation int, notify bool) {
+	escalation = limiter.escalate(now)
+	if escalation == rateLimitMute || now.Sub(limiter.lastNotice) > limiter.limits.ViolationWindow {
+		limiter.lastNotice = now
+		return escalation, true
+	}
+	return escalation, false
+}
+
+// escalate counts a violation and returns how far it escalates. The caller
+// holds mu.
+func (limiter *rateLimiter) escalate(now time.Time) int {
+	if now.Sub(limiter.lastViolation) > limiter.limits.ViolationWindow {
+		limiter.violations = 0
+	}
+	limiter.violations++
+	limiter.lastViolation = now
+
+	if limiter.limits.DisconnectAfter > 0 && limiter.violations >= limiter.limits.DisconnectAfter {
+		return rateLimitDisconnect
+	}
+	if limiter.limits.MuteAfter > 0 && limiter.violations >= limiter.limits.MuteAfter && !now.Before(limiter.mutedUntil) {
+		limiter.mutedUntil = now.Add(limiter.limits.MuteDuration)
+		return rateLimitMute
+	}
+	return rateLimitWarn
+}
+
+// limitRead reports why a frame just read exceeds the frame rate, or "" if
+// it may be decoded
+func (user *User) limitRead() string {
+	limiter := user.wsServer.rateLimiters.get(user.UserId)
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if !limiter.frames.take(time.Now()) {
+		return fmt.Sprintf("more than %d frames per second", limiter.limits.FramesPerSecond)
+	}
+	return ""
+}
+
+// limitFrame reports why a decoded frame exceeds its limits, or "" if it may
+// be handled. Chat messages, edits and reactions are also refused while the
+// account is muted.
+func (user *User) limitFrame(frame *InboundFrame, payload interface{}) string {
+	limiter := user.wsServer.rateLimiters.get(user.UserId)
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	now := time.Now()
+
+	switch frame.Type {
+	case SendMessageAction, SendThreadMessageAction, EditMessageAction, AddReactionAction, RemoveReactionAction:
+		if now.Before(limiter.mutedUntil) {
+			return fmt.Sprintf("muted for %s", limiter.mutedUntil.Sub(now).Round(time.Second))
+		}
+		if !limiter.messages.take(now) {
+			return fmt.Sprintf("more than %d messages per second", limiter.limits.MessagesPerSecond)
+		}
+
+	case JoinChannelAction:
+		if !limiter.joins.take(now) {
+			return fmt.Sprintf("more than %d joins per minute", limiter.limits.JoinsPerMinute)
+		}
+		name := payload.(*JoinChannelPayload).Name
+		if user.wsServer.implicitChannelCreate && user.wsServer.findChannelByName(name) == nil && !limiter.creations.take(now) {
+			return fmt.Sprintf("more than %d new channels per hour", limiter.limits.ChannelCreationsPerHour)
+		}
+
+	case CreateChannelAction:
+		if !limiter.creations.take(now) {
+			return fmt.Sprintf("more than %d new channels per hour", limiter.limits.ChannelCreationsPerHour)
+		}
+	}
+	return ""
+}
+
+// rateLimited answers a frame over its limits. Depending on how often the
+// account exceeded them lately the connection is sent an error frame, the
+// account muted, or the connection disconnected with a policy violation.
+// Floods are not answered frame by frame: beyond the first notice of a
+// window, frames over the limits are dropped silently.
+func (user *User) rateLimited(requestID string, reason string) {
+	metrics := user.wsServer.metrics
+	metrics.frameRateLimited()
+
+	limiter := user.wsServer.rateLimiters.get(user.UserId)
+	limiter.mu.Lock()
+	escalation, notify := limiter.violate(time.Now())
+	limiter.mu.Unlock()
+
+	switch escalation {
+	case rateLimitDisconnect:
+		if user.closeWith(websocket.ClosePolicyViolation, "rate limit exceeded") {
+			metrics.rateLimitDisconnect()
+			log.Printf("[WARN] disconnecting %s for exceeding rate limits", user.UserId)
+		}
+		return
+
+	case rateLimitMute:
+		metrics.rateLimitMute()
+		reason = fmt.Sprintf("%s, muted for %s", reason, limiter.limits.MuteDuration)
+	}
+	if !notify {
+		return
+	}
+
+	frameErr := newFrameError(api_response.ERROR_RATE_LIMITED, "%s", reason)
+	frameErr.RequestID = requestID
+	user.sendFrame(frameErr.Frame())
+}
@@ -0,0 +1,170 @@
+package logic
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/backplane"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	bucket := newTokenBucket(4, time.Second)
+	bucket.last = start
+
+	// A full bucket allows a burst of its capacity
+	for i := 0; i < 4; i++ {
+		if !bucket.take(start) {
+			t.Fatalf("token %d refused from a full bucket", i+1)
+		}
+	}
+	if bucket.take(start) {
+		t.Fatal("token taken from an empty bucket")
+	}
+	if bucket.full(start) {
+		t.Fatal("empty bucket reported full")
+	}
+
+	// Tokens come back at count per period, and no more than capacity
+	if !bucket.take(start.Add(time.Second / 4)) {
+		t.Fatal("refilled token refused")
+	}
+	if bucket.take(start.Add(time.Second / 4)) {
+		t.Fatal("token taken before it refilled")
+	}
+	later := start.Add(time.Hour)
+	if !bucket.full(later) {
+		t.Fatal("bucket not full after an hour")
+	}
+	for i := 0; i < 4; i++ {
+		if !bucket.take(later) {
+			t.Fatalf("token %d refused after refilling", i+1)
+		}
+	}
+	if bucket.take(later) {
+		t.Fatal("bucket refilled beyond its capacity")
+	}
+
+	// No limit is a nil bucket, which allows everything
+	unlimited := newTokenBucket(0, time.Second)
+	if unlimited != nil || !unlimited.take(start) || !unlimited.full(start) {
+		t.Fatal("a limit of zero must allow everything")
+	}
+}
+
+func TestRateLimitEscalation(t *testing.T) {
+	limits := RateLimits{MuteAfter: 3, MuteDuration: time.Minute, DisconnectAfter: 5, ViolationWindow: 10 * time.Second}
+	limiter := newRateLimiter(limits)
+	now := time.Now()
+
+	steps := []struct {
+		after      time.Duration
+		escalation int
+		notify     bool
+	}{
+		{0, rateLimitWarn, true},
+		{time.Second, rateLimitWarn, false},
+		{2 * time.Second, rateLimitMute, true},
+		// Violations while muted neither extend the mute nor notify
+		{3 * time.Second, rateLimitWarn, false},
+		{4 * time.Second, rateLimitDisconnect, false},
+		// Once the window passed without violations, counting starts over
+		{20 * time.Second, rateLimitWarn, true},
+		{21 * time.Second, rateLimitWarn, false},
+		// A violation a window after the last notice is told again
+		{31 * time.Second, rateLimitWarn, true},
+	}
+	for i, step := range steps {
+		escalation, notify := limiter.violate(now.Add(step.after))
+		if escalation != step.escalation || notify != step.notify {
+			t.Fatalf("violation %d: got %d notify %v, want %d notify %v", i+1, escalation, notify, step.escalation, step.notify)
+		}
+	}
+	if want := now.Add(2 * time.Second).Add(limits.MuteDuration); !limiter.mutedUntil.Equal(want) {
+		t.Fatalf("muted until %v, want %v", limiter.mutedUntil, want)
+	}
+	if limiter.idle(now.Add(31 * time.Second)) {
+		t.Fatal("muted limiter reported idle")
+	}
+	if !limiter.idle(now.Add(2 * time.Minute)) {
+		t.Fatal("limiter not idle once the mute and window passed")
+	}
+}
+
+func TestRateLimitedFloodIsAnsweredOnce(t *testing.T) {
+	server := newTestServer(t, backplane.NewMemory())
+	server.rateLimiters = NewRateLimiterRegistry(RateLimits{MessagesPerSecond: 1, ViolationWindow: time.Minute})
+	node := startTestNode(t, server)
+	client := node.connect(t, newTestAccount(t, "flooder"))
+	channelID := client.join("flood")
+
+	for i := 0; i < 20; i++ {
+		client.write(SendMessageAction, channelID, "flood", TextPayload{Text: "spam"})
+	}
+	client.write(SetStatusAction, "", "done", SetStatusPayload{Status: StatusAway})
+
+	// Frames are answered in order, so every flood frame was handled once the
+	// last one is acknowledged
+	notices := 0
+	for {
+		frame := client.expect(func(frame *testFrame) bool { return frame.Type == ErrorAction || frame.Type == AckAction })
+		var answer ErrorPayload
+		if err := json.Unmarshal(frame.Payload, &answer); err != nil {
+			t.Fatal(err)
+		}
+		if answer.RequestID == "done" {
+			break
+		}
+		if answer.Code == api_response.ERROR_RATE_LIMITED {
+			notices++
+		}
+	}
+	if notices != 1 {
+		t.Fatalf("flood answered with %d rate limit notices, want 1", notices)
+	}
+	if n := node.server.Metrics().RateLimitedFrames; n < 18 {
+		t.Fatalf("%d frames counted as rate limited, want at least 18", n)
+	}
+}
+
+func TestRateLimitsSharedByConnections(t *testing.T) {
+	setupTestSettings()
+	registry := NewRateLimiterRegistry(RateLimits{MessagesPerSecond: 10, ViolationWindow: time.Minute})
+
+	// Every connection of the account takes from the same bucket
+	var wg sync.WaitGroup
+	allowed := make(chan bool, 40)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 10; n++ {
+				limiter := registry.get("account")
+				limiter.mu.Lock()
+				allowed <- limiter.messages.take(time.Now())
+				limiter.mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	close(allowed)
+	count := 0
+	for ok := range allowed {
+		if ok {
+			count++
+		}
+	}
+	if count < 10 || count > 12 {
+		t.Fatalf("%d of 40 messages allowed, want about 10", count)
+	}
+
+	if n := registry.Reap(time.Now()); n != 1 {
+		t.Fatalf("%d limiters left, the busy one must be kept", n)
+	}
+	if n := registry.Reap(time.Now().Add(time.Hour)); n != 0 {
+		t.Fatalf("%d limiters left once idle", n)
+	}
+}
@@ -0,0 +1,122 @@
+package logic
+
+import (
+	"time"
+	"wjjmjh/hermes/pkg/api_response"
+)
+
+// MaxEmojiLength is the longest emoji accepted, in characters, so that
+// custom emoji can be named with shortcodes. MaxReactionsPerMessage is how
+// many different emoji a message can carry.
+const MaxEmojiLength = 64
+const MaxReactionsPerMessage = 50
+
+// Reaction aggregates the reactions to a message with one emoji: how many
+// users reacted with it, and who, in the order they reacted. A user reacts
+// with an emoji at most once, reacting again changes nothing.
+type Reaction struct {
+	Emoji string       `json:"emoji"`
+	Count int          `json:"count"`
+	Users []SenderInfo `json:"users"`
+}
+
+// React adds or removes the actor's reaction with emoji to a chat message of
+// the channel, and announces the change. Adding a reaction the actor already
+// made, or removing one it did not, changes nothing.
+func (channel *Channel) React(actor *SenderInfo, messageID string, emoji string, add bool) error {
+	if channel.IsArchived() {
+		return newFrameError(api_response.ERROR_ARCHIVED_CHANNEL, "channel %s", *channel.GetID())
+	}
+	if !channel.Can(actor.ID, PermReact) {
+		return ErrPermissionDenied
+	}
+	if until, muted := channel.MutedUntil(actor.ID); muted {
+		return newFrameError(api_response.ERROR_MUTED, "muted until %s", until.Format(time.RFC3339))
+	}
+
+	channel.editMu.Lock()
+	defer channel.editMu.Unlock()
+
+	message, err := channel.GetMessage(messageID)
+	if err != nil {
+		return err
+	}
+	if message == nil || message.DeletedAt != nil ||
+		(message.Type != SendMessageAction && message.Type != SendThreadMessageAction) {
+		return newFrameError(api_response.ERROR_NOT_EXIST_MESSAGE, "message %s", messageID)
+	}
+
+	count, changed, err := message.react(actor, emoji, add)
+	if err != nil || !changed {
+		return err
+	}
+	if err := channel.store.Update(message); err != nil {
+		return err
+	}
+
+	action := ReactionAddedAction
+	if !add {
+		action = ReactionRemovedAction
+	}
+	frame := newFrame(action, message.ChannelID, ReactionChangedPayload{MessageID: message.ID, Emoji: emoji, Count: count})
+	frame.ThreadID = message.ThreadID
+	frame.Sender = actor
+	channel.relay(&channelEvent{Actor: actor.ID, ThreadID: message.ThreadID, Changed: message, Frame: FrameMarshal(frame)})
+	return nil
+}
+
+// react adds or removes the user's reaction with emoji. Returns how many
+// users reacted with emoji afterwards, and false if nothing changed.
+func (msg *Message) react(user *SenderInfo, emoji string, add bool) (int, bool, error) {
+	// The reactions of a stored message are shared with the store's copy
+	reactions := make([]Reaction, 0, len(msg.Reactions)+1)
+	position := -1
+	for i, reaction := range msg.Reactions {
+		reaction.Users = append([]SenderInfo(nil), reaction.Users...)
+		reactions = append(reactions, reaction)
+		if reaction.Emoji == emoji {
+			position = i
+		}
+	}
+
+	if position < 0 {
+		if !add {
+			return 0, false, nil
+		}
+		if len(reactions) >= MaxReactionsPerMessage {
+			return 0, false, newFrameError(api_response.ERROR_INVALID_PAYLOAD,
+				"message has %d different reactions already", MaxReactionsPerMessage)
+		}
+		reactions = append(reactions, Reaction{Emoji: emoji})
+		position = len(reactions) - 1
+	}
+
+	reaction := &reactions[position]
+	reacted := -1
+	for i, reactor := range reaction.Users {
+		if reactor.ID == user.ID {
+			reacted = i
+			break
+		}
+	}
+	if (reacted >= 0) == add {
+		return reaction.Count, false, nil
+	}
+
+	if add {
+		reaction.Users = append(reaction.Users, *user)
+	} else {
+		reaction.Users = append(reaction.Users[:reacted], reaction.Users[reacted+1:]...)
+	}
+	reaction.Count = len(reaction.Users)
+	count := reaction.Count
+	if count == 0 {
+		reactions = append(reactions[:position], reactions[position+1:]...)
+	}
+
+	msg.Reactions = reactions
+	if len(msg.Reactions) == 0 {
+		msg.Reactions = nil
+	}
+	return count, true, nil
+}
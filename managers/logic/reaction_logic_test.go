@@ -0,0 +1,122 @@
+package logic
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"wjjmjh/hermes/pkg/api_response"
+)
+
+func TestMessageReact(t *testing.T) {
+	type step struct {
+		user    string
+		emoji   string
+		add     bool
+		count   int
+		changed bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		want  map[string][]string
+	}{
+		{"first reaction", []step{{"alice", "👍", true, 1, true}}, map[string][]string{"👍": {"alice"}}},
+		{"duplicate reaction", []step{
+			{"alice", "👍", true, 1, true},
+			{"alice", "👍", true, 1, false},
+		}, map[string][]string{"👍": {"alice"}}},
+		{"users in reaction order", []step{
+			{"bob", "👍", true, 1, true},
+			{"alice", "👍", true, 2, true},
+			{"alice", "🎉", true, 1, true},
+		}, map[string][]string{"👍": {"bob", "alice"}, "🎉": {"alice"}}},
+		{"remove one of two", []step{
+			{"alice", "👍", true, 1, true},
+			{"bob", "👍", true, 2, true},
+			{"alice", "👍", false, 1, true},
+		}, map[string][]string{"👍": {"bob"}}},
+		{"remove the last", []step{
+			{"alice", "👍", true, 1, true},
+			{"alice", "👍", false, 0, true},
+		}, map[string][]string{}},
+		{"remove a reaction never made", []step{
+			{"alice", "👍", true, 1, true},
+			{"bob", "👍", false, 1, false},
+			{"bob", "🎉", false, 0, false},
+		}, map[string][]string{"👍": {"alice"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := &Message{ID: "message"}
+			for i, step := range test.steps {
+				count, changed, err := message.react(&SenderInfo{ID: step.user}, step.emoji, step.add)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count != step.count || changed != step.changed {
+					t.Fatalf("step %d: count %d, changed %v, want %d, %v", i, count, changed, step.count, step.changed)
+				}
+			}
+
+			got := make(map[string][]string)
+			for _, reaction := range message.Reactions {
+				if reaction.Count != len(reaction.Users) {
+					t.Fatalf("%s counts %d of %d users", reaction.Emoji, reaction.Count, len(reaction.Users))
+				}
+				for _, user := range reaction.Users {
+					got[reaction.Emoji] = append(got[reaction.Emoji], user.ID)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("reactions are %v, want %v", got, test.want)
+			}
+			if len(test.want) == 0 && message.Reactions != nil {
+				t.Fatal("no reactions left, but the list is not cleared")
+			}
+		})
+	}
+}
+
+func TestMessageReactLimit(t *testing.T) {
+	message := &Message{ID: "message"}
+	for i := 0; i < MaxReactionsPerMessage; i++ {
+		if _, _, err := message.react(&SenderInfo{ID: "alice"}, fmt.Sprintf(":emoji-%d:", i), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := message.react(&SenderInfo{ID: "alice"}, ":one-too-many:", true); errorCode(err) != api_response.ERROR_INVALID_PAYLOAD {
+		t.Fatalf("reaction over the limit answered %v", err)
+	}
+
+	// Existing emoji can still be used
+	if _, changed, err := message.react(&SenderInfo{ID: "bob"}, ":emoji-0:", true); err != nil || !changed {
+		t.Fatalf("reaction with an existing emoji: changed %v, %v", changed, err)
+	}
+}
+
+func TestReact(t *testing.T) {
+	channel := newTestChannel(t, map[string]string{"guest": RoleGuest})
+	message := postTestMessage(t, channel, "alice", "hello")
+
+	if err := channel.React(&SenderInfo{ID: "bob"}, message.ID, "👍", true); err != nil {
+		t.Fatal(err)
+	}
+	if code := errorCode(channel.React(&SenderInfo{ID: "guest"}, message.ID, "👍", true)); code != api_response.ERROR_PERMISSION_DENIED {
+		t.Fatalf("guest reaction answered %d", code)
+	}
+
+	// Reactions are part of the stored history
+	history, _ := channel.FetchHistory("", DefaultHistoryLimit)
+	if len(history) != 1 || len(history[0].Reactions) != 1 || history[0].Reactions[0].Users[0].ID != "bob" {
+		t.Fatalf("history is %+v", history)
+	}
+
+	// Tombstones take no reactions
+	if err := channel.DeleteMessage(&SenderInfo{ID: "alice"}, message.ID); err != nil {
+		t.Fatal(err)
+	}
+	if code := errorCode(channel.React(&SenderInfo{ID: "bob"}, message.ID, "🎉", true)); code != api_response.ERROR_NOT_EXIST_MESSAGE {
+		t.Fatalf("reaction to a tombstone answered %d", code)
+	}
+}
@@ -0,0 +1,163 @@
+package logic
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+	"wjjmjh/hermes/pkg/setting"
+)
+
+// ReadPosition is the last message a user has read in a channel
+type ReadPosition struct {
+	UserID    string    `json:"user_id"`
+	ChannelID string    `json:"channel_id"`
+	MessageID string    `json:"message_id"`
+	ReadAt    time.Time `json:"read_at"`
+}
+
+// ReadStore persists read positions by user ID rather than by connection, so
+// that they and the unread counts derived from them survive reconnects. Get
+// returns nil when the user has not read anything in the channel.
+type ReadStore interface {
+	Set(position *ReadPosition) error
+	Get(userID string, channelID string) (*ReadPosition, error)
+	ListChannel(channelID string) ([]*ReadPosition, error)
+	Close() error
+}
+
+// NewReadStore builds the ReadStore configured in the storage settings.
+func NewReadStore(storage *setting.Storage) (ReadStore, error) {
+	switch storage.Type {
+	case "", MemoryStorage:
+		return NewMemoryReadStore(), nil
+	case FileStorage:
+		return OpenFileReadStore(storage.Path)
+	default:
+		return nil, fmt.Errorf("unknown read position storage type: %s", storage.Type)
+	}
+}
+
+/*
+	In-memory store
+*/
+
+// MemoryReadStore keeps read positions in memory; they are lost on restart.
+type MemoryReadStore struct {
+	mu       sync.RWMutex
+	channels map[string]map[string]ReadPosition
+}
+
+func NewMemoryReadStore() *MemoryReadStore {
+	return &MemoryReadStore{channels: make(map[string]map[string]ReadPosition)}
+}
+
+func (store *MemoryReadStore) Set(position *ReadPosition) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	positions, ok := store.channels[position.ChannelID]
+	if !ok {
+		positions = make(map[string]ReadPosition)
+		store.channels[position.ChannelID] = positions
+	}
+	positions[position.UserID] = *position
+	return nil
+}
+
+func (store *MemoryReadStore) Get(userID string, channelID string) (*ReadPosition, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	position, ok := store.channels[channelID][userID]
+	if !ok {
+		return nil, nil
+	}
+	return &position, nil
+}
+
+func (store *MemoryReadStore) ListChannel(channelID string) ([]*ReadPosition, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	positions := make([]*ReadPosition, 0, len(store.channels[channelID]))
+	for _, position := range store.channels[channelID] {
+		c := position
+		positions = append(positions, &c)
+	}
+	return positions, nil
+}
+
+func (store *MemoryReadStore) Close() error {
+	return nil
+}
+
+/*
+	On-disk store
+*/
+
+// FileReadStore appends every position update to a journal, which is
+// replayed into memory on open; the last update of a user wins.
+type FileReadStore struct {
+	*MemoryReadStore
+	mu      sync.Mutex
+	journal *journal
+}
+
+// OpenFileReadStore opens (or creates) the read position log in directory dir.
+func OpenFileReadStore(dir string) (*FileReadStore, error) {
+	store := &FileReadStore{MemoryReadStore: NewMemoryReadStore()}
+	journal, err := openJournal(dir, "reads.log", store.replay)
+	if err != nil {
+		return nil, err
+	}
+	store.journal = journal
+
+	store.MemoryReadStore.mu.RLock()
+	live := 0
+	for _, positions := range store.channels {
+		live += len(positions)
+	}
+	store.MemoryReadStore.mu.RUnlock()
+	if err := journal.compact(live, store.snapshot); err != nil {
+		_ = journal.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// snapshot writes the last position of every user in every channel.
+func (store *FileReadStore) snapshot(write func(record interface{}) error) error {
+	store.MemoryReadStore.mu.RLock()
+	defer store.MemoryReadStore.mu.RUnlock()
+	for _, positions := range store.channels {
+		for _, position := range positions {
+			if err := write(position); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replay loads a logged position back into memory.
+func (store *FileReadStore) replay(record []byte) error {
+	var position ReadPosition
+	if err := json.Unmarshal(record, &position); err != nil {
+		return err
+	}
+	return store.MemoryReadStore.Set(&position)
+}
+
+func (store *FileReadStore) Set(position *ReadPosition) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.journal.Append(position); err != nil {
+		return err
+	}
+	return store.MemoryReadStore.Set(position)
+}
+
+func (store *FileReadStore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.journal.Close()
+}
@@ -0,0 +1,252 @@
+package logic
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// normaliseChannelName folds case and whitespace so that "General" and
+// " general " name the same channel.
+func normaliseChannelName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// ChannelRegistry indexes channels by ID and by normalised name. Channel
+// names are unique. It is safe for concurrent use.
+type ChannelRegistry struct {
+	mu     sync.RWMutex
+	byID   map[string]*Channel
+	byName map[string]*Channel
+}
+
+func NewChannelRegistry() *ChannelRegistry {
+	return &ChannelRegistry{
+		byID:   make(map[string]*Channel),
+		byName: make(map[string]*Channel),
+	}
+}
+
+// Add registers a channel, failing with ErrChannelExists if its name or ID is
+// taken.
+func (registry *ChannelRegistry) Add(channel *Channel) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	name := normaliseChannelName(*channel.GetName())
+	if _, ok := registry.byName[name]; ok {
+		return ErrChannelExists
+	}
+	if _, ok := registry.byID[*channel.GetID()]; ok {
+		return ErrChannelExists
+	}
+
+	registry.byID[*channel.GetID()] = channel
+	registry.byName[name] = channel
+	return nil
+}
+
+// GetOrCreate returns the channel with the given name, registering the one
+// built by create if there is none. create is given the ID derived from the
+// name, or the next one derived from it that is free if a channel renamed
+// since holds it (see nextChannelIDFor). created reports whether create was
+// used.
+func (registry *ChannelRegistry) GetOrCreate(name string, create func(channelID string) *Channel) (channel *Channel, created bool) {
+	key := normaliseChannelName(name)
+
+	registry.mu.RLock()
+	channel, ok := registry.byName[key]
+	registry.mu.RUnlock()
+	if ok {
+		return channel, false
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	// Another goroutine may have registered it in the meantime
+	if channel, ok := registry.byName[key]; ok {
+		return channel, false
+	}
+
+	channelID := channelIDFor(name)
+	for n := 1; registry.byID[channelID] != nil; n++ {
+		channelID = nextChannelIDFor(name, n)
+	}
+	channel = create(channelID)
+	registry.byID[*channel.GetID()] = channel
+	registry.byName[key] = channel
+	return channel, true
+}
+
+// Rename changes the name of a registered channel, keeping the name index
+// consistent. Fails with ErrChannelExists if another channel has the name.
+func (registry *ChannelRegistry) Rename(channel *Channel, name string) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	oldKey := normaliseChannelName(*channel.GetName())
+	newKey := normaliseChannelName(name)
+	if existing, ok := registry.byName[newKey]; ok && existing != channel {
+		return ErrChannelExists
+	}
+
+	delete(registry.byName, oldKey)
+	registry.byName[newKey] = channel
+	channel.UpdateName(UpdateName_{name})
+	return nil
+}
+
+// Remove unregisters a channel. Returns false if it was not registered.
+func (registry *ChannelRegistry) Remove(channel *Channel) bool {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	id := *channel.GetID()
+	if registry.byID[id] != channel {
+		return false
+	}
+
+	delete(registry.byID, id)
+	delete(registry.byName, normaliseChannelName(*channel.GetName()))
+	return true
+}
+
+// Reap unregisters the ephemeral channels that have been empty for longer
+// than ttl and returns them, for the caller to stop.
+func (registry *ChannelRegistry) Reap(now time.Time, ttl time.Duration) []*Channel {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	var reaped []*Channel
+	for id, channel := range registry.byID {
+		if channel.idleFor(now) <= ttl {
+			continue
+		}
+		delete(registry.byID, id)
+		delete(registry.byName, normaliseChannelName(*channel.GetName()))
+		reaped = append(reaped, channel)
+	}
+	return reaped
+}
+
+// GetByID returns the channel with the given ID, or nil.
+func (registry *ChannelRegistry) GetByID(id string) *Channel {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	return registry.byID[id]
+}
+
+// GetByName returns the channel with the given name, or nil.
+func (registry *ChannelRegistry) GetByName(name string) *Channel {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	return registry.byName[normaliseChannelName(name)]
+}
+
+// List returns a snapshot of every registered channel.
+func (registry *ChannelRegistry) List() []*Channel {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	channels := make([]*Channel, 0, len(registry.byID))
+	for _, channel := range registry.byID {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// Len returns the number of registered channels.
+func (registry *ChannelRegistry) Len() int {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	return len(registry.byID)
+}
+
+// AccountRegistry indexes the accounts connected to this node by ID. It is
+// safe for concurrent use.
+type AccountRegistry struct {
+	mu       sync.RWMutex
+	byID     map[string]*Account
+	sessions int
+}
+
+func NewAccountRegistry() *AccountRegistry {
+	return &AccountRegistry{byID: make(map[string]*Account)}
+}
+
+// Attach adds a connection to the account with the user's ID, creating the
+// account for the first connection.
+func (registry *AccountRegistry) Attach(user *User) *Account {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	account, ok := registry.byID[user.UserId]
+	if !ok {
+		account = newAccount(user.UserId, *user.GetUsername(), user.wsServer)
+		registry.byID[user.UserId] = account
+	}
+	account.addSession(user)
+	registry.sessions++
+	return account
+}
+
+// Detach removes a connection from its account. When it was the account's
+// last connection the account is unregistered, and the memberships it held
+// are returned for the caller to leave.
+func (registry *AccountRegistry) Detach(user *User) (last bool, channels map[*Channel]bool, threads map[*Thread]bool) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	account, ok := registry.byID[user.UserId]
+	if !ok || account != user.account {
+		return false, nil, nil
+	}
+	registry.sessions--
+
+	last, channels, threads = account.removeSession(user)
+	if last {
+		delete(registry.byID, user.UserId)
+	}
+	return last, channels, threads
+}
+
+// Get returns the account with the given ID, or nil.
+func (registry *AccountRegistry) Get(id string) *Account {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	return registry.byID[id]
+}
+
+// List returns a snapshot of every connected account.
+func (registry *AccountRegistry) List() []*Account {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	accounts := make([]*Account, 0, len(registry.byID))
+	for _, account := range registry.byID {
+		accounts = append(accounts, account)
+	}
+	return accounts
+}
+
+// Sessions returns a snapshot of every connection of every account.
+func (registry *AccountRegistry) Sessions() []*User {
+	sessions := make([]*User, 0, registry.SessionCount())
+	for _, account := range registry.List() {
+		sessions = append(sessions, account.Sessions()...)
+	}
+	return sessions
+}
+
+// Len returns the number of connected accounts.
+func (registry *AccountRegistry) Len() int {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	return len(registry.byID)
+}
+
+// SessionCount returns the number of connections.
+func (registry *AccountRegistry) SessionCount() int {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	return registry.sessions
+}
@@ -0,0 +1,200 @@
+package logic
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"wjjmjh/hermes/pkg/backplane"
+)
+
+// createNamed builds the channel GetOrCreate registers for name
+func createNamed(name string) func(channelID string) *Channel {
+	return func(channelID string) *Channel {
+		channel := CreateChannel(name, false)
+		channel.setID(channelID)
+		return channel
+	}
+}
+
+func TestChannelRegistryGetOrCreateOnce(t *testing.T) {
+	registry := NewChannelRegistry()
+	var created int32
+	channels := make([]*Channel, 16)
+
+	var wg sync.WaitGroup
+	for i := range channels {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := "Lobby"
+			if i%2 == 1 {
+				name = " lobby "
+			}
+			channel, ok := registry.GetOrCreate(name, createNamed(name))
+			if ok {
+				atomic.AddInt32(&created, 1)
+			}
+			channels[i] = channel
+		}(i)
+	}
+	wg.Wait()
+
+	if created != 1 {
+		t.Fatalf("channel created %d times", created)
+	}
+	for _, channel := range channels {
+		if channel != channels[0] {
+			t.Fatal("concurrent callers got different channels")
+		}
+	}
+}
+
+func TestChannelRegistryGetOrCreateAfterRename(t *testing.T) {
+	registry := NewChannelRegistry()
+	first, _ := registry.GetOrCreate("lobby", createNamed("lobby"))
+	if *first.GetID() != channelIDFor("lobby") {
+		t.Fatalf("got ID %s, want the one derived from the name", *first.GetID())
+	}
+	if err := registry.Rename(first, "hall"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The renamed channel keeps its ID, the name gets the next one
+	for n := 1; n <= 2; n++ {
+		channel, created := registry.GetOrCreate("lobby", createNamed("lobby"))
+		if !created || channel == first {
+			t.Fatalf("joining the old name got the renamed channel")
+		}
+		if want := nextChannelIDFor("lobby", n); *channel.GetID() != want {
+			t.Fatalf("got ID %s, want %s", *channel.GetID(), want)
+		}
+		if err := registry.Rename(channel, fmt.Sprintf("hall %d", n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if registry.GetByID(channelIDFor("lobby")) != first || registry.GetByName("hall") != first {
+		t.Fatal("the renamed channel is not indexed by its ID and new name")
+	}
+}
+
+func TestChannelRegistryConcurrentUse(t *testing.T) {
+	registry := NewChannelRegistry()
+	const workers = 8
+	var removed int32
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				channel := CreateChannel(fmt.Sprintf("channel-%d-%d", w, n), false)
+				if err := registry.Add(channel); err != nil {
+					t.Error(err)
+					return
+				}
+				switch n % 3 {
+				case 0:
+					_ = registry.Rename(channel, fmt.Sprintf("renamed-%d-%d", w, n))
+				case 1:
+					if registry.Remove(channel) {
+						atomic.AddInt32(&removed, 1)
+					}
+				}
+				registry.GetByName(fmt.Sprintf("channel-%d-%d", w, n-1))
+				registry.List()
+				registry.Reap(time.Now(), time.Hour)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// Both indexes agree
+	channels := registry.List()
+	if len(channels) != registry.Len() {
+		t.Fatalf("List returned %d channels, Len %d", len(channels), registry.Len())
+	}
+	for _, channel := range channels {
+		if registry.GetByID(*channel.GetID()) != channel || registry.GetByName(*channel.GetName()) != channel {
+			t.Fatalf("channel %s is not indexed by both ID and name", *channel.GetName())
+		}
+	}
+	if want := workers*50 - int(removed); len(channels) != want {
+		t.Fatalf("%d channels registered, want %d", len(channels), want)
+	}
+}
+
+// registrySize is about the number of channels and users of a busy server
+const registrySize = 50000
+
+func newFullChannelRegistry(b *testing.B) *ChannelRegistry {
+	registry := NewChannelRegistry()
+	for i := 0; i < registrySize; i++ {
+		if err := registry.Add(CreateChannel(fmt.Sprintf("Channel %d", i), false)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return registry
+}
+
+func BenchmarkChannelRegistryGetByName(b *testing.B) {
+	registry := newFullChannelRegistry(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if registry.GetByName(fmt.Sprintf(" channel  %d", i%registrySize)) == nil {
+			b.Fatal("channel not found")
+		}
+	}
+}
+
+func BenchmarkChannelRegistryGetByID(b *testing.B) {
+	registry := newFullChannelRegistry(b)
+	ids := make([]string, 0, registrySize)
+	for _, channel := range registry.List() {
+		ids = append(ids, *channel.GetID())
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if registry.GetByID(ids[i%len(ids)]) == nil {
+			b.Fatal("channel not found")
+		}
+	}
+}
+
+// BenchmarkChannelRegistryGetOrCreate joins existing channels from many
+// goroutines at once, as concurrent join-channel frames do
+func BenchmarkChannelRegistryGetOrCreate(b *testing.B) {
+	registry := newFullChannelRegistry(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			name := fmt.Sprintf("channel %d", i%registrySize)
+			if _, created := registry.GetOrCreate(name, createNamed(name)); created {
+				b.Fatal("existing channel created again")
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkAccountRegistryGet(b *testing.B) {
+	server := newTestServer(b, backplane.NewMemory())
+	registry := NewAccountRegistry()
+	for i := 0; i < registrySize; i++ {
+		registry.Attach(CreateUser(fmt.Sprintf("user-%d", i), fmt.Sprintf("user %d", i), nil, server))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if registry.Get(fmt.Sprintf("user-%d", i%registrySize)) == nil {
+			b.Fatal("account not found")
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package logic
+
+import "errors"
+
+var (
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrInvalidRole      = errors.New("invalid role")
+)
+
+// Channel roles, from most to least privileged. Accounts without an explicit
+// role in a channel are members.
+const (
+	RoleOwner     = "owner"
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+	RoleGuest     = "guest"
+)
+
+// roleRank orders roles: an account can only manage the roles of accounts
+// ranked below it.
+var roleRank = map[string]int{
+	RoleGuest:     0,
+	RoleMember:    1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+	RoleOwner:     4,
+}
+
+// Permissions checked before acting on a channel
+const (
+	PermPost           = "post"
+	PermReact          = "react"
+	PermInvite         = "invite"
+	PermKick           = "kick"
+	PermBan            = "ban"
+	PermMute           = "mute"
+	PermSlowMode       = "slow-mode"
+	PermViewAudit      = "view-audit"
+	PermRename         = "rename"
+	PermEditMetadata   = "edit-metadata"
+	PermArchive        = "archive"
+	PermDelete         = "delete"
+	PermPin            = "pin"
+	PermManageMessages = "manage-messages"
+	PermManageThreads  = "manage-threads"
+	PermManageRoles    = "manage-roles"
+)
+
+// rolePermissions is the permission matrix. Guests can only read.
+var rolePermissions = map[string]map[string]bool{
+	RoleOwner: {
+		PermPost: true, PermReact: true, PermInvite: true, PermKick: true, PermBan: true, PermMute: true,
+		PermSlowMode: true, PermViewAudit: true, PermRename: true, PermEditMetadata: true, PermArchive: true,
+		PermDelete: true, PermPin: true, PermManageMessages: true, PermManageThreads: true, PermManageRoles: true,
+	},
+	RoleAdmin: {
+		PermPost: true, PermReact: true, PermInvite: true, PermKick: true, PermBan: true, PermMute: true,
+		PermSlowMode: true, PermViewAudit: true, PermRename: true, PermEditMetadata: true, PermArchive: true,
+		PermPin: true, PermManageMessages: true, PermManageThreads: true, PermManageRoles: true,
+	},
+	RoleModerator: {
+		PermPost: true, PermReact: true, PermInvite: true, PermKick: true, PermBan: true, PermMute: true,
+		PermSlowMode: true, PermViewAudit: true, PermEditMetadata: true, PermPin: true, PermManageMessages: true,
+		PermManageThreads: true,
+	},
+	RoleMember: {
+		PermPost: true, PermReact: true, PermManageThreads: true,
+	},
+	RoleGuest: {},
+}
+
+func validRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+// RoleOf returns the role of an account in the channel. Conversation
+// participants are all members.
+func (channel *Channel) RoleOf(accountID string) string {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	if role, ok := channel.roles[accountID]; ok {
+		return role
+	}
+	return RoleMember
+}
+
+// Can reports whether the account's role in the channel grants the
+// permission. Banned accounts have no permissions, whatever their role.
+func (channel *Channel) Can(accountID string, permission string) bool {
+	if channel.IsBanned(accountID) {
+		return false
+	}
+	return rolePermissions[channel.RoleOf(accountID)][permission]
+}
+
+// Roles returns every explicitly assigned role of the channel
+func (channel *Channel) Roles() []RolePayload {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	roles := make([]RolePayload, 0, len(channel.roles))
+	for accountID, role := range channel.roles {
+		roles = append(roles, RolePayload{UserID: accountID, Role: role})
+	}
+	return roles
+}
+
+// copyRoles returns a copy of roles by account ID
+func copyRoles(roles map[string]string) map[string]string {
+	copied := make(map[string]string, len(roles))
+	for accountID, role := range roles {
+		copied[accountID] = role
+	}
+	return copied
+}
+
+// setRole records the role of an account. Members are not recorded.
+func (channel *Channel) setRole(accountID string, role string) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	if role == RoleMember {
+		delete(channel.roles, accountID)
+	} else {
+		channel.roles[accountID] = role
+	}
+}
+
+// ChangeRole gives the target account a role in the channel on behalf of the
+// actor, and announces it to the channel. Only owners and admins manage
+// roles, admins only below their own rank. An owner handing over ownership
+// becomes an admin.
+func (channel *Channel) ChangeRole(actor *SenderInfo, targetID string, role string) error {
+	if err := channel.checkRoleChange(actor.ID, targetID, role); err != nil {
+		return err
+	}
+
+	channel.applyRole(actor, targetID, role)
+	if role == RoleOwner {
+		channel.applyRole(actor, actor.ID, RoleAdmin)
+	}
+	return nil
+}
+
+// checkRoleChange reports whether the actor may give the target account role
+func (channel *Channel) checkRoleChange(actorID string, targetID string, role string) error {
+	if !validRole(role) {
+		return ErrInvalidRole
+	}
+	if channel.Direct || !channel.Can(actorID, PermManageRoles) || actorID == targetID {
+		return ErrPermissionDenied
+	}
+
+	actorRole := channel.RoleOf(actorID)
+	if actorRole != RoleOwner {
+		rank := roleRank[actorRole]
+		if roleRank[channel.RoleOf(targetID)] >= rank || roleRank[role] >= rank {
+			return ErrPermissionDenied
+		}
+	}
+	return nil
+}
+
+// owners returns how many accounts own the channel
+func (channel *Channel) owners() int {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	owners := 0
+	for _, role := range channel.roles {
+		if role == RoleOwner {
+			owners++
+		}
+	}
+	return owners
+}
+
+// applyRole records and stores a role change, and relays it to every node
+func (channel *Channel) applyRole(actor *SenderInfo, accountID string, role string) {
+	channel.setRole(accountID, role)
+	channel.save()
+
+	change := &RolePayload{UserID: accountID, Role: role}
+	frame := newFrame(RoleChangedAction, *channel.GetID(), change)
+	frame.Sender = actor
+	channel.relay(&channelEvent{Actor: actor.ID, Role: change, Frame: FrameMarshal(frame)})
+}
@@ -0,0 +1,113 @@
+package logic
+
+import "testing"
+
+func TestPermissionMatrix(t *testing.T) {
+	// The lowest role holding each permission
+	lowest := map[string]string{
+		PermPost:           RoleMember,
+		PermReact:          RoleMember,
+		PermManageThreads:  RoleMember,
+		PermInvite:         RoleModerator,
+		PermKick:           RoleModerator,
+		PermBan:            RoleModerator,
+		PermMute:           RoleModerator,
+		PermSlowMode:       RoleModerator,
+		PermViewAudit:      RoleModerator,
+		PermEditMetadata:   RoleModerator,
+		PermPin:            RoleModerator,
+		PermManageMessages: RoleModerator,
+		PermRename:         RoleAdmin,
+		PermArchive:        RoleAdmin,
+		PermManageRoles:    RoleAdmin,
+		PermDelete:         RoleOwner,
+	}
+	channel := newTestChannel(t, map[string]string{
+		RoleOwner: RoleOwner, RoleAdmin: RoleAdmin, RoleModerator: RoleModerator, RoleGuest: RoleGuest,
+	})
+	for role := range roleRank {
+		for permission, minimum := range lowest {
+			want := roleRank[role] >= roleRank[minimum]
+			if got := channel.Can(role, permission); got != want {
+				t.Errorf("%s can %s: %v, want %v", role, permission, got, want)
+			}
+		}
+	}
+	for role, permissions := range rolePermissions {
+		for permission := range permissions {
+			if _, ok := lowest[permission]; !ok {
+				t.Errorf("%s has permission %s the test does not know", role, permission)
+			}
+		}
+	}
+
+	// Banned accounts have no permissions, whatever their role
+	channel.applyModeration(&AuditEntry{Action: BanAction, Target: &SenderInfo{ID: RoleAdmin}})
+	if channel.Can(RoleAdmin, PermPost) {
+		t.Fatal("a banned admin may post")
+	}
+}
+
+func TestChangeRole(t *testing.T) {
+	roles := map[string]string{
+		"owner": RoleOwner, "admin": RoleAdmin, "other admin": RoleAdmin, "moderator": RoleModerator, "guest": RoleGuest,
+	}
+	tests := []struct {
+		name   string
+		actor  string
+		target string
+		role   string
+		want   error
+	}{
+		{"owner promotes a member", "owner", "member", RoleAdmin, nil},
+		{"owner demotes an admin", "owner", "admin", RoleGuest, nil},
+		{"admin promotes a member to moderator", "admin", "member", RoleModerator, nil},
+		{"admin demotes a moderator", "admin", "moderator", RoleMember, nil},
+		{"admin makes an admin", "admin", "member", RoleAdmin, ErrPermissionDenied},
+		{"admin demotes an admin", "admin", "other admin", RoleMember, ErrPermissionDenied},
+		{"admin demotes the owner", "admin", "owner", RoleMember, ErrPermissionDenied},
+		{"moderator promotes a guest", "moderator", "guest", RoleMember, ErrPermissionDenied},
+		{"member promotes itself", "member", "member", RoleModerator, ErrPermissionDenied},
+		{"owner demotes itself", "owner", "owner", RoleAdmin, ErrPermissionDenied},
+		{"unknown role", "owner", "member", "king", ErrInvalidRole},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			channel := newTestChannel(t, roles)
+			err := channel.ChangeRole(&SenderInfo{ID: tt.actor, Name: tt.actor}, tt.target, tt.role)
+			if err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			want := roles[tt.target]
+			if want == "" {
+				want = RoleMember
+			}
+			if err == nil {
+				want = tt.role
+			}
+			if got := channel.RoleOf(tt.target); got != want {
+				t.Fatalf("target is %s, want %s", got, want)
+			}
+		})
+	}
+
+	// Handing over ownership makes the owner an admin, and is stored
+	channel := newTestChannel(t, roles)
+	if err := channel.ChangeRole(&SenderInfo{ID: "owner"}, "moderator", RoleOwner); err != nil {
+		t.Fatal(err)
+	}
+	if channel.RoleOf("moderator") != RoleOwner || channel.RoleOf("owner") != RoleAdmin {
+		t.Fatalf("roles after a handover are %+v", channel.Roles())
+	}
+	record, err := channel.metaStore.Get(*channel.GetID())
+	if err != nil || record == nil || record.Roles["moderator"] != RoleOwner || record.Roles["owner"] != RoleAdmin {
+		t.Fatalf("stored record is %+v", record)
+	}
+
+	// Nobody has roles in conversations
+	conversation := CreateConversation([]SenderInfo{{ID: "owner"}, {ID: "member"}})
+	conversation.setRole("owner", RoleOwner)
+	if err := conversation.checkRoleChange("owner", "member", RoleAdmin); err != ErrPermissionDenied {
+		t.Fatalf("role change in a conversation got %v", err)
+	}
+}
@@ -1,200 +1,677 @@
 package logic
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"log"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/app"
+	"wjjmjh/hermes/pkg/backplane"
+	"wjjmjh/hermes/pkg/services/auth_service"
 	"wjjmjh/hermes/pkg/setting"
 	"wjjmjh/hermes/pkg/util/connection"
+	"wjjmjh/hermes/pkg/util/jwt_"
+)
+
+var (
+	ErrChannelNotFound = errors.New("channel not found")
+	ErrChannelExists   = errors.New("channel name already in use")
+	ErrUserNotFound    = errors.New("user not found")
 )
 
 // Websocket server data struct
 type WsServer struct {
 
-	// Registered users (clients)
-	users map[*User]bool
+	// Connected accounts, indexed by account ID, and their connections
+	accounts *AccountRegistry
+
+	// Channels associated with server, indexed by ID and name
+	channels *ChannelRegistry
 
-	// Channels associated with server
-	channels map[*Channel]bool
+	// Whether joining an unknown channel name creates it, and how long such
+	// channels are kept once empty
+	implicitChannelCreate bool
+	channelTTL            time.Duration
+
+	// Direct message conversations, and how many participants they may have
+	conversations       *ConversationRegistry
+	maxConversationSize int
 
 	// Incoming user messages
 	broadcast chan []byte
 
-	// User register requests
-	register chan *User
+	// Message history, read positions, moderation audit log and metadata of
+	// every channel, and the notification settings of every user
+	store         MessageStore
+	reads         ReadStore
+	audit         AuditStore
+	metaStore     ChannelStore
+	notifications NotificationStore
+
+	// Carries broadcasts to and from the other nodes; nodeID tells this
+	// node's own events apart
+	backplane backplane.Backplane
+	nodeID    string
+
+	// Size of each user's dataBuffer and what to do when it is full
+	bufferSize         int
+	slowConsumerPolicy string
+
+	// Largest frame read from a connection, in bytes
+	maxMessageSize int64
+
+	// Dropped sessions held for resuming, and how many frames each session
+	// keeps for replay
+	sessions         *SessionRegistry
+	resumeWindow     time.Duration
+	replayBufferSize int
+
+	// Token buckets of every account connected to this node
+	rateLimiters *RateLimiterRegistry
+
+	// Counters exposed for monitoring
+	metrics *Metrics
 
-	// User unregister requests
-	unregister chan *User
+	// Status and last-seen time of every user
+	presence *PresenceRegistry
+
+	// Who is typing where
+	typing *TypingRegistry
+
+	// How long clients are told to wait before reconnecting after a shutdown
+	reconnectDelay time.Duration
+
+	// Set to 1 once Shutdown started; new upgrades are refused from then on
+	draining int32
+
+	// Closed by Shutdown to stop the Run loop
+	quit     chan struct{}
+	stopOnce sync.Once
+
+	// The Run loops of the server and its channels. Shutdown waits for them
+	// to return before closing the stores; once loopsClosed is set no new
+	// loop starts.
+	loops       sync.WaitGroup
+	loopsMu     sync.Mutex
+	loopsClosed bool
 }
 
 // NewWsServer creates a new websocket server struct and returns it's address.
-// Requires no parameters and returns empty channels/maps.
-func NewWsServer() *WsServer {
-	return &WsServer{
-		broadcast:  make(chan []byte),
-		register:   make(chan *User),
-		unregister: make(chan *User),
-		users:      make(map[*User]bool),
-		channels:   make(map[*Channel]bool),
+// Channels record their history in store, read positions in reads,
+// moderation actions in audit and their records in metaStore, users'
+// notification settings live in notifications. Channels and conversations
+// are restored from metaStore.
+// Broadcasts reach the users of other nodes through bp.
+// Buffering and slow consumer handling come from the wsServer settings, the
+// limits of each account from the rateLimit settings.
+func NewWsServer(store MessageStore, reads ReadStore, audit AuditStore, metaStore ChannelStore, notifications NotificationStore, bp backplane.Backplane) (*WsServer, error) {
+	bufferSize := setting.WsServerSetting.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+
+	policy := setting.WsServerSetting.SlowConsumerPolicy
+	switch policy {
+	case DropOldestPolicy, DropNewestPolicy, DisconnectPolicy:
+	default:
+		log.Printf("[WARN] unknown SlowConsumerPolicy %q, using %s", policy, DropOldestPolicy)
+		policy = DropOldestPolicy
+	}
+
+	// Connections reading less would drop valid frames
+	maxMessageSize := setting.WsServerSetting.MaxMessageSize
+	if maxMessageSize < MinMessageSize {
+		log.Printf("[WARN] MaxMessageSize %d is too small for the longest valid frame, using %d",
+			maxMessageSize, MinMessageSize)
+		maxMessageSize = MinMessageSize
+	}
+
+	reconnectDelay := setting.WsServerSetting.ReconnectDelay
+	if reconnectDelay <= 0 {
+		reconnectDelay = DefaultReconnectDelay
+	}
+
+	maxConversationSize := setting.WsServerSetting.MaxConversationSize
+	if maxConversationSize < 2 {
+		maxConversationSize = DefaultMaxConversationSize
+	}
+
+	channelTTL := setting.WsServerSetting.ChannelTTL
+	if channelTTL <= 0 {
+		channelTTL = DefaultChannelTTL
+	}
+
+	resumeWindow := setting.WsServerSetting.ResumeWindow
+	if resumeWindow <= 0 {
+		resumeWindow = DefaultResumeWindow
+	}
+
+	// A resumed session is replayed into a fresh dataBuffer, so more than
+	// that could never be replayed
+	replayBufferSize := setting.WsServerSetting.ReplayBufferSize
+	if replayBufferSize <= 0 || replayBufferSize > bufferSize {
+		replayBufferSize = bufferSize
+	}
+
+	server := &WsServer{
+		store:                 store,
+		reads:                 reads,
+		audit:                 audit,
+		metaStore:             metaStore,
+		notifications:         notifications,
+		typing:                NewTypingRegistry(TypingTimeout),
+		backplane:             bp,
+		nodeID:                uuid.New().String(),
+		bufferSize:            bufferSize,
+		slowConsumerPolicy:    policy,
+		maxMessageSize:        maxMessageSize,
+		sessions:              NewSessionRegistry(resumeWindow),
+		resumeWindow:          resumeWindow,
+		replayBufferSize:      replayBufferSize,
+		rateLimiters:          NewRateLimiterRegistry(rateLimitsFromSettings(setting.RateLimitSetting)),
+		metrics:               &Metrics{},
+		reconnectDelay:        reconnectDelay,
+		broadcast:             make(chan []byte),
+		quit:                  make(chan struct{}),
+		accounts:              NewAccountRegistry(),
+		channels:              NewChannelRegistry(),
+		implicitChannelCreate: setting.WsServerSetting.ImplicitChannelCreate,
+		channelTTL:            channelTTL,
+		conversations:         NewConversationRegistry(),
+		maxConversationSize:   maxConversationSize,
+	}
+	presenceDebounce := setting.WsServerSetting.PresenceDebounce
+	if presenceDebounce <= 0 {
+		presenceDebounce = DefaultPresenceDebounce
+	}
+	presenceRetention := setting.WsServerSetting.PresenceRetention
+	if presenceRetention <= 0 {
+		presenceRetention = DefaultPresenceRetention
+	}
+	server.presence = NewPresenceRegistry(server, presenceDebounce, presenceRetention)
+
+	stored, err := metaStore.List()
+	if err != nil {
+		return nil, err
+	}
+	server.restoreChannels(stored)
+	server.restoreConversations(stored)
+
+	if err := server.subscribeBackplane(); err != nil {
+		return nil, err
 	}
+
+	// Catch up with the changes made while this node was down
+	server.requestSync("")
+	return server, nil
 }
 
 // broadcastToUsers will send the message/messages stored in databuffer to
-// all users currently registered on the server.
+// every connection currently registered on the server.
 func (server *WsServer) broadcastToUsers(message []byte) {
-	for user := range server.users {
-		user.dataBuffer <- message
+	for _, user := range server.accounts.Sessions() {
+		user.send(message)
 	}
 }
 
-// FindChannel searches through the servers channel array
-// and returns
+// FindChannel looks a channel up by name, or by ID when no name is given.
 func (server *WsServer) FindChannel(p FindChannelParams) (*Channel, error) {
 	var res *Channel
-	for channel := range server.channels {
-		if p.name != nil {
-			if channel.GetName() == p.name {
-				res = channel
-			}
-		} else if p.id != nil {
-			if channel.GetID() == p.name {
-				res = channel
-			}
-		}
+	if p.name != nil {
+		res = server.findChannelByName(*p.name)
+	} else if p.id != nil {
+		res = server.findChannelByID(*p.id)
 	}
 	if res != nil {
 		return res, nil
 	} else {
-		return nil, errors.New("Unable to find channel")
+		return nil, ErrChannelNotFound
 	}
 }
 
 func (server *WsServer) findChannelByName(channelName string) *Channel {
-	var res *Channel
-	for channel := range server.channels {
-		if *channel.GetName() == channelName {
-			res = channel
-			break
-		}
-	}
-
-	return res
+	return server.channels.GetByName(channelName)
 }
 
+// findChannelByID looks up channels and conversations alike
 func (server *WsServer) findChannelByID(ID string) *Channel {
-	var res *Channel
-	for channel := range server.channels {
-		if *channel.GetID() == ID {
-			res = channel
-			break
-		}
+	if channel := server.channels.GetByID(ID); channel != nil {
+		return channel
 	}
+	return server.conversations.Get(ID)
+}
 
-	return res
+func (server *WsServer) findAccountByID(ID string) *Account {
+	return server.accounts.Get(ID)
 }
 
-func (server *WsServer) findUserByID(ID string) *User {
-	var res *User
-	for user := range server.users {
-		if user.UserId == ID {
-			res = user
-			break
-		}
+// Creates a new channel owned by the given account and adds it to the
+// channels registered on the websocket server. Fails with ErrChannelExists if
+// the name is taken.
+func (server *WsServer) NewWsChannel(channelName string, private bool, ownerID string) (*Channel, error) {
+	channel := server.newChannel(channelName, private)
+
+	// Explicitly created channels are announced with their ID, so it need not
+	// be derived from the name. A fresh one keeps a channel created with the
+	// name of a deleted channel from inheriting its history.
+	channel.setID(uuid.New().String())
+	channel.setRole(ownerID, RoleOwner)
+	channel.setCreator(ownerID)
+	if err := server.channels.Add(channel); err != nil {
+		return nil, err
 	}
+	channel.save()
+	server.runChannel(channel)
+	return channel, nil
+}
 
-	return res
+// getOrCreateChannel returns the channel with the given name, creating and
+// starting it first if it does not exist yet. A new channel is ephemeral. It
+// is given its stored record if it was created before, and catches up with
+// the other nodes running it. Otherwise creatorID owns it and the other
+// nodes are told, see lifecycle_logic.go.
+func (server *WsServer) getOrCreateChannel(channelName string, creatorID string) *Channel {
+	channel, created := server.channels.GetOrCreate(channelName, func(channelID string) *Channel {
+		channel := server.newChannel(channelName, false)
+		channel.setID(channelID)
+		channel.ephemeral = true
+		return channel
+	})
+	if created {
+		if server.loadRecord(channel) {
+			server.requestSync(*channel.GetID())
+		} else {
+			channel.setRole(creatorID, RoleOwner)
+			channel.setCreator(creatorID)
+			channel.save()
+			server.announceSnapshot(channel)
+		}
+		server.runChannel(channel)
+	}
+	return channel
 }
 
-// Creates a new channel and appends it to the map of
-// channels stored in the websocket server.
-func (server *WsServer) NewWsChannel(channelName string, private bool) *Channel {
+// newChannel builds a channel wired to the server's stores.
+func (server *WsServer) newChannel(channelName string, private bool) *Channel {
 	channel := CreateChannel(channelName, private)
-	go channel.Run()
-	server.channels[channel] = true
+	channel.store = server.store
+	channel.reads = server.reads
+	channel.audit = server.audit
+	channel.metaStore = server.metaStore
+	channel.server = server
 	return channel
 }
 
-func (server *WsServer) notifyUserJoined(user *User) {
-	message := &Message{
-		Action: UserJoinAction,
-		Sender: user,
+/*
+	Methods used by the REST API
+*/
+
+// GetChannel returns the channel with the given ID, or nil. Conversations
+// are not exposed to the REST API.
+func (server *WsServer) GetChannel(ID string) *Channel {
+	return server.channels.GetByID(ID)
+}
+
+// ListChannels returns every channel on the server.
+func (server *WsServer) ListChannels() []*Channel {
+	return server.channels.List()
+}
+
+// CreateChannel creates a new channel unless one with that name already
+// exists, and tells the other nodes about it. The account creating it owns it.
+func (server *WsServer) CreateChannel(channelName string, private bool, ownerID string) (*Channel, error) {
+	channel, err := server.NewWsChannel(channelName, private, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	server.announceCreated(channel)
+	return channel, nil
+}
+
+// RenameChannel renames the channel with the given ID on behalf of an account
+// and announces it to every node. A channel created by joining it is kept once
+// renamed, see lifecycle_logic.go.
+func (server *WsServer) RenameChannel(ID string, channelName string, actorID string) (*Channel, error) {
+	channel := server.GetChannel(ID)
+	if channel == nil {
+		return nil, ErrChannelNotFound
+	}
+	if !channel.Can(actorID, PermRename) {
+		return nil, ErrPermissionDenied
+	}
+	actor, err := server.lookupUser(actorID)
+	if err != nil {
+		return nil, err
+	}
+	kept, err := server.renameChannel(channel, channelName)
+	if err != nil {
+		return nil, err
 	}
 
-	server.broadcastToUsers(MessageMarshal(*message))
+	// Nodes the channel was not joined on register it now that it is kept
+	if kept {
+		server.announceCreated(channel)
+	}
+	frame := newFrame(ChannelUpdatedAction, ID, channel.Payload())
+	frame.Sender = actor
+	channel.relay(&channelEvent{Actor: actor.ID, Renamed: channelName, Frame: FrameMarshal(frame)})
+	return channel, nil
 }
 
-func (server *WsServer) notifyUserLeft(user *User) {
-	message := &Message{
-		Action: UserLeftAction,
-		Sender: user,
+// DeleteChannel removes the channel with the given ID from every node on
+// behalf of an account, telling its members.
+func (server *WsServer) DeleteChannel(ID string, actorID string) error {
+	channel := server.GetChannel(ID)
+	if channel == nil {
+		return ErrChannelNotFound
+	}
+	if !channel.Can(actorID, PermDelete) {
+		return ErrPermissionDenied
+	}
+	actor, err := server.lookupUser(actorID)
+	if err != nil {
+		return err
 	}
 
-	server.broadcastToUsers(MessageMarshal(*message))
+	frame := newFrame(ChannelDeletedAction, ID, channel.Payload())
+	frame.Sender = actor
+	channel.relay(&channelEvent{Actor: actor.ID, Deleted: true, Frame: FrameMarshal(frame)})
+	if !server.removeChannel(channel) {
+		return ErrChannelNotFound
+	}
+	return nil
 }
 
-func (server *WsServer) listOnlineClients(user *User) {
-	for existingUser := range server.users {
-		message := &Message{
-			Action: UserJoinAction,
-			Sender: existingUser,
-		}
-		user.dataBuffer <- MessageMarshal(*message)
+// SetChannelArchived archives or unarchives the channel with the given ID on
+// behalf of an account, see Channel.SetArchived.
+func (server *WsServer) SetChannelArchived(ID string, actorID string, archived bool) (*Channel, error) {
+	channel := server.GetChannel(ID)
+	if channel == nil {
+		return nil, ErrChannelNotFound
+	}
+	actor, err := server.lookupUser(actorID)
+	if err != nil {
+		return nil, err
 	}
+	if err := channel.SetArchived(actor, archived); err != nil {
+		return nil, err
+	}
+	return channel, nil
 }
 
-func (server *WsServer) addUser(user *User) {
-	server.notifyUserJoined(user)
-	server.listOnlineClients(user)
-	server.users[user] = true
+// SetChannelRole gives a user a role in the channel with the given ID on
+// behalf of an account, see Channel.ChangeRole.
+func (server *WsServer) SetChannelRole(ID string, actorID string, targetID string, role string) error {
+	channel := server.GetChannel(ID)
+	if channel == nil {
+		return ErrChannelNotFound
+	}
+	actor, err := server.lookupUser(actorID)
+	if err != nil {
+		return err
+	}
+	if _, err := server.lookupUser(targetID); err != nil {
+		return err
+	}
+	return channel.ChangeRole(actor, targetID, role)
 }
 
-func (server *WsServer) removeUser(user *User) {
-	if _, ok := server.users[user]; ok {
-		delete(server.users, user)
-		server.notifyUserLeft(user)
+// lookupUser identifies an account, whether or not it is connected to this node
+func (server *WsServer) lookupUser(ID string) (*SenderInfo, error) {
+	if account := server.findAccountByID(ID); account != nil {
+		return account.Info(), nil
+	}
+	account, err := auth_service.GetAccount(ID)
+	if err != nil {
+		return nil, ErrUserNotFound
 	}
+	return &SenderInfo{ID: account.ID, Name: account.Username}, nil
 }
 
-// ServeWs receives a http upgrade request from a client, completes this request
-// and establishes the websocket connection. It then opens up concurent read/write
+// FindAccount returns the online account with the given ID, or nil.
+func (server *WsServer) FindAccount(ID string) *Account {
+	return server.findAccountByID(ID)
+}
+
+// Metrics returns the server's monitoring counters.
+func (server *WsServer) Metrics() MetricsSnapshot {
+	snapshot := server.metrics.Snapshot()
+	snapshot.BackplaneDropped = server.backplane.Dropped()
+	return snapshot
+}
+
+// ListOnlineAccounts returns every account with a connection to the server.
+func (server *WsServer) ListOnlineAccounts() []*Account {
+	return server.accounts.List()
+}
+
+// GetPresence returns the status and last-seen time of a user, or false if
+// the user has not been seen lately, see PresenceRegistry.
+func (server *WsServer) GetPresence(ID string) (PresencePayload, bool) {
+	return server.presence.Get(ID)
+}
+
+// ServeWs receives a http upgrade request from a client, authenticates its token,
+// completes this request and establishes the websocket connection. It then opens up concurent read/write
 // listener for the user.
 func (server *WsServer) ServeWs(w http.ResponseWriter, r *http.Request) {
 
-	name, ok := r.URL.Query()["name"]
+	// Once shutting down, clients should try another node or come back later
+	if server.isDraining() {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(server.reconnectDelay/time.Second)))
+		app.WriteResponse(w, http.StatusServiceUnavailable, api_response.ERROR, nil)
+		return
+	}
 
-	if !ok || len(name[0]) < 1 {
-		log.Println("Url Param 'name' is missing")
+	// Reject the handshake before upgrading unless a valid token is presented
+	claims, code := jwt_.CheckToken(jwt_.TokenFromRequest(r))
+	if code != api_response.SUCCESS {
+		log.Printf("[WARN] rejected websocket upgrade: %s", api_response.GetMsg(code))
+		app.WriteResponse(w, http.StatusUnauthorized, code, nil)
 		return
 	}
 
-	wsConnection, err := connection.UpgradeHTTPToWS(w, r)
+	// The token only carries the account ID, the display name comes from the store
+	account, err := auth_service.Authorize(claims)
 	if err != nil {
-		fmt.Println("Error in establishing websocket connection: ", err)
+		log.Printf("[WARN] rejected websocket upgrade for account %s: %v", claims.Subject, err)
+		app.WriteResponse(w, http.StatusUnauthorized, api_response.ERROR_AUTH, nil)
+		return
 	}
-	user := CreateUser(uuid.NewString(), wsConnection, server)
+
+	// A token offered as a subprotocol must be acknowledged in the handshake
+	var responseHeader http.Header
+	if jwt_.OffersBearerProtocol(r) {
+		responseHeader = http.Header{"Sec-Websocket-Protocol": {jwt_.BearerProtocol}}
+	}
+
+	wsConnection, err := connection.UpgradeHTTPToWS(w, r, responseHeader)
+	if err != nil {
+		log.Printf("[ERROR] unable to establish websocket connection: %v", err)
+		return
+	}
+	user := CreateUser(account.ID, account.Username, wsConnection, server)
 	log.Printf("[INFO] new client connected")
 
+	// Attached to the account and tracked before any frame of the user is
+	// handled. A shutdown that started meanwhile may have missed the session.
+	user.account = server.accounts.Attach(user)
+	server.presence.connected(user)
+	user.sendFrame(newFrame(SessionAction, "", SessionPayload{
+		SessionToken: user.sessionToken,
+		ResumeWindow: int(server.resumeWindow / time.Second),
+	}))
+	if server.isDraining() {
+		user.closeWith(websocket.CloseGoingAway, server.reconnectHint())
+	}
+
 	go user.CircularWrite(setting.WsServerSetting.Ping, setting.WsServerSetting.MaxWriteWaitTime)
-	go user.CircularRead(setting.WsServerSetting.MaxMessageSize, setting.WsServerSetting.Pong)
+	go user.CircularRead(server.maxMessageSize, setting.WsServerSetting.Pong)
 
-	server.register <- user
+	// Conversations need no joining, participants are members once connected
+	server.joinConversations(user.account)
 }
 
-// Run the websocket server and listen for register/unregister requests.
+// Run the websocket server and listen for server wide broadcasts. Idle
+// ephemeral channels are stopped, and idle rate limiters and users long
+// offline forgotten, along the way.
 // Will run continuously.
 func (server *WsServer) Run() {
-	fmt.Println("WebSocket Server Initialised and Running")
+	if !server.startLoop() {
+		return
+	}
+	defer server.loops.Done()
+
+	log.Printf("[INFO] websocket server running")
+	reaper := time.NewTicker(reapInterval(server.channelTTL))
+	defer reaper.Stop()
 	for {
 		select {
-		// Register user
-		case user := <-server.register:
-			server.addUser(user)
-		case user := <-server.unregister:
-			server.removeUser(user)
 		case message := <-server.broadcast:
 			server.broadcastToUsers(message)
+		case <-reaper.C:
+			server.reapChannels()
+			server.rateLimiters.Reap(time.Now())
+			server.presence.Reap(time.Now())
+		case <-server.quit:
+			return
+		}
+	}
+}
+
+// startLoop counts a loop that Shutdown waits for; the loop calls
+// server.loops.Done when it returns. Returns false, and the loop must not
+// run, once Shutdown has stopped the loops.
+func (server *WsServer) startLoop() bool {
+	server.loopsMu.Lock()
+	defer server.loopsMu.Unlock()
+	if server.loopsClosed {
+		return false
+	}
+	server.loops.Add(1)
+	return true
+}
+
+// runChannel starts the Run loop of a channel of the server
+func (server *WsServer) runChannel(channel *Channel) {
+	if !server.startLoop() {
+		channel.Stop()
+		return
+	}
+	go func() {
+		defer server.loops.Done()
+		channel.Run()
+	}()
+}
+
+func (server *WsServer) isDraining() bool {
+	return atomic.LoadInt32(&server.draining) == 1
+}
+
+// reconnectHint is the close reason sent to clients on shutdown, telling
+// them how many seconds to wait before reconnecting.
+func (server *WsServer) reconnectHint() string {
+	return fmt.Sprintf(`{"reason":"shutdown","retry_after":%d}`, int(server.reconnectDelay/time.Second))
+}
+
+// Shutdown stops accepting websocket upgrades and closes every connection
+// with CloseGoingAway and a reconnect hint, after the frames already queued
+// for it have been written. Connections still draining when ctx is done are
+// cut off. The server, channel and conversation loops are stopped, and the
+// backplane and stores closed once they have returned. If ctx is done first,
+// they are closed anyway and ctx's error returned.
+func (server *WsServer) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&server.draining, 0, 1) {
+		return nil
+	}
+
+	users := server.accounts.Sessions()
+	log.Printf("[INFO] draining %d websocket connections", len(users))
+	for _, user := range users {
+		user.closeWith(websocket.CloseGoingAway, server.reconnectHint())
+	}
+
+	var err error
+	for _, user := range users {
+		select {
+		case <-user.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+			_ = user.conn.Close()
 		}
 	}
+
+	// Their sessions are released by the read goroutines, once they see the
+	// connections closed
+	for _, user := range users {
+		select {
+		case <-user.released:
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+		}
+	}
+
+	// Dropped sessions cannot be resumed on a node that is going away
+	server.sessions.stop()
+
+	// Other nodes hear that this node's users are gone without waiting for
+	// the debounce window
+	server.presence.stop()
+
+	server.loopsMu.Lock()
+	server.loopsClosed = true
+	server.loopsMu.Unlock()
+
+	server.stopOnce.Do(func() { close(server.quit) })
+	for _, channel := range server.channels.List() {
+		channel.Stop()
+	}
+	for _, channel := range server.conversations.List() {
+		channel.Stop()
+	}
+
+	// A loop may be storing a message, wait for it before closing the stores
+	stopped := make(chan struct{})
+	go func() {
+		server.loops.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Printf("[WARN] closing stores before every channel loop returned")
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+
+	if bpErr := server.backplane.Close(); bpErr != nil && err == nil {
+		err = bpErr
+	}
+
+	if storeErr := server.store.Close(); storeErr != nil && err == nil {
+		err = storeErr
+	}
+	if readsErr := server.reads.Close(); readsErr != nil && err == nil {
+		err = readsErr
+	}
+	if auditErr := server.audit.Close(); auditErr != nil && err == nil {
+		err = auditErr
+	}
+	if metaErr := server.metaStore.Close(); metaErr != nil && err == nil {
+		err = metaErr
+	}
+	if notificationsErr := server.notifications.Close(); notificationsErr != nil && err == nil {
+		err = notificationsErr
+	}
+	return err
 }
@@ -0,0 +1,796 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/backplane"
+	"wjjmjh/hermes/pkg/services/auth_service"
+	"wjjmjh/hermes/pkg/setting"
+	"wjjmjh/hermes/pkg/util/jwt_"
+)
+
+/*
+	Test servers and clients
+*/
+
+var setupOnce sync.Once
+
+// testAccounts backs the auth service in tests; accounts are created
+// directly, without hashing a password
+var testAccounts = auth_service.NewMemoryStore()
+
+func setupTestSettings() {
+	setupOnce.Do(func() {
+		setting.AppSetting.JwtSecret = "test-secret"
+		jwt_.Setup()
+		auth_service.SetStore(testAccounts)
+
+		setting.WsServerSetting.Ping = time.Minute
+		setting.WsServerSetting.Pong = time.Minute
+		setting.WsServerSetting.MaxWriteWaitTime = 10 * time.Second
+		setting.WsServerSetting.MaxMessageSize = MinMessageSize
+		setting.WsServerSetting.ImplicitChannelCreate = true
+		setting.WsServerSetting.PresenceDebounce = 100 * time.Millisecond
+		setting.WsServerSetting.SlowConsumerPolicy = DropOldestPolicy
+	})
+}
+
+// testNode is a server listening on a test HTTP server
+type testNode struct {
+	server *WsServer
+	url    string
+}
+
+// newTestServer builds a server with memory stores on the given backplane
+func newTestServer(t testing.TB, bp backplane.Backplane) *WsServer {
+	t.Helper()
+	setupTestSettings()
+
+	server, err := NewWsServer(NewMemoryMessageStore(), NewMemoryReadStore(), NewMemoryAuditStore(),
+		NewMemoryChannelStore(), NewMemoryNotificationStore(), bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// newTestNode starts a server on the given backplane. It is shut down when
+// the test ends.
+func newTestNode(t testing.TB, bp backplane.Backplane) *testNode {
+	t.Helper()
+	return startTestNode(t, newTestServer(t, bp))
+}
+
+// newFileTestNode starts a server keeping everything in dir, as a server
+// restarted on the storage of a previous one would. It is shut down when the
+// test ends.
+func newFileTestNode(t testing.TB, dir string) *testNode {
+	t.Helper()
+	setupTestSettings()
+
+	store, err := OpenFileMessageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reads, err := OpenFileReadStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := OpenFileAuditStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaStore, err := OpenFileChannelStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifications, err := OpenFileNotificationStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewWsServer(store, reads, audit, metaStore, notifications, backplane.NewMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startTestNode(t, server)
+}
+
+func startTestNode(t testing.TB, server *WsServer) *testNode {
+	t.Helper()
+	go server.Run()
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.ServeWs))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+		httpServer.Close()
+	})
+	return &testNode{server: server, url: "ws" + strings.TrimPrefix(httpServer.URL, "http")}
+}
+
+// stop shuts the server down, closing its stores
+func (node *testNode) stop(t testing.TB) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := node.server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testAccount is an account and a token to connect with
+type testAccount struct {
+	ID       string
+	Username string
+	token    string
+}
+
+func newTestAccount(t testing.TB, name string) *testAccount {
+	t.Helper()
+	setupTestSettings()
+
+	account := &auth_service.Account{
+		ID:        uuid.New().String(),
+		Username:  fmt.Sprintf("%s-%s", name, uuid.New().String()[:8]),
+		Roles:     []string{auth_service.DefaultRole},
+		CreatedAt: time.Now(),
+	}
+	if err := testAccounts.Create(account); err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt_.GenerateToken(account.ID, account.Roles, account.TokenGeneration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAccount{ID: account.ID, Username: account.Username, token: token}
+}
+
+// testFrame is an outbound frame as a client decodes it
+type testFrame struct {
+	Seq       uint64          `json:"seq"`
+	Type      string          `json:"type"`
+	ID        string          `json:"id"`
+	ChannelID string          `json:"channel_id"`
+	Sender    *SenderInfo     `json:"sender"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// testClient is a websocket connection of an account. Frames are read on
+// their own goroutine until the connection closes.
+type testClient struct {
+	t       testing.TB
+	account *testAccount
+	conn    *websocket.Conn
+	frames  chan *testFrame
+
+	// Set once the connection closed, with the close error
+	closed chan struct{}
+	err    error
+
+	// Serialises writes
+	mu sync.Mutex
+}
+
+func (node *testNode) connect(t testing.TB, account *testAccount) *testClient {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(node.url+"?token="+account.token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &testClient{
+		t:       t,
+		account: account,
+		conn:    conn,
+		frames:  make(chan *testFrame, 4096),
+		closed:  make(chan struct{}),
+	}
+	go client.read()
+	t.Cleanup(func() { _ = conn.Close() })
+	return client
+}
+
+func (client *testClient) read() {
+	defer close(client.closed)
+	for {
+		_, data, err := client.conn.ReadMessage()
+		if err != nil {
+			client.err = err
+			return
+		}
+
+		// Queued frames are written together, a line each
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		for decoder.More() {
+			var frame testFrame
+			if err := decoder.Decode(&frame); err != nil {
+				client.err = err
+				return
+			}
+			select {
+			case client.frames <- &frame:
+			default:
+				client.err = fmt.Errorf("client %s fell behind", client.account.Username)
+				return
+			}
+		}
+	}
+}
+
+// send writes an inbound frame. Errors are ignored, the connection may be
+// closing under the test.
+func (client *testClient) send(frameType string, channelID string, payload interface{}) {
+	client.write(frameType, channelID, "", payload)
+}
+
+// request writes an inbound frame with a request ID and returns the ack or
+// error frame answering it
+func (client *testClient) request(frameType string, channelID string, payload interface{}) *testFrame {
+	client.t.Helper()
+	requestID := uuid.New().String()
+	client.write(frameType, channelID, requestID, payload)
+	return client.expect(func(frame *testFrame) bool {
+		if frame.Type != AckAction && frame.Type != ErrorAction {
+			return false
+		}
+		var answer struct {
+			RequestID string `json:"request_id"`
+		}
+		return json.Unmarshal(frame.Payload, &answer) == nil && answer.RequestID == requestID
+	})
+}
+
+// do sends a request and fails the test unless it is acknowledged
+func (client *testClient) do(frameType string, channelID string, payload interface{}) *testFrame {
+	client.t.Helper()
+	frame := client.request(frameType, channelID, payload)
+	if frame.Type != AckAction {
+		client.t.Fatalf("%s: %s was answered with %s", client.account.Username, frameType, frame.Payload)
+	}
+	return frame
+}
+
+func (client *testClient) write(frameType string, channelID string, requestID string, payload interface{}) {
+	var raw json.RawMessage
+	if payload != nil {
+		raw, _ = json.Marshal(payload)
+	}
+	frame := InboundFrame{Version: ProtocolVersion, RequestID: requestID, Type: frameType, ChannelID: channelID, Payload: raw}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	_ = client.conn.WriteJSON(frame)
+}
+
+// expect returns the first frame matching, skipping the others, or fails the
+// test after a few seconds
+func (client *testClient) expect(match func(frame *testFrame) bool) *testFrame {
+	client.t.Helper()
+	timeout := time.After(10 * time.Second)
+	var skipped []string
+	for {
+		select {
+		case frame := <-client.frames:
+			if match(frame) {
+				return frame
+			}
+			skipped = append(skipped, fmt.Sprintf("%s %s", frame.Type, frame.Payload))
+		case <-client.closed:
+			client.t.Fatalf("%s: connection closed while waiting: %v", client.account.Username, client.err)
+		case <-timeout:
+			client.t.Fatalf("%s: timed out waiting for a frame, skipped %s", client.account.Username, strings.Join(skipped, "\n"))
+		}
+	}
+}
+
+func ofType(frameType string) func(frame *testFrame) bool {
+	return func(frame *testFrame) bool { return frame.Type == frameType }
+}
+
+// withText matches chat messages of the given text
+func withText(text string) func(frame *testFrame) bool {
+	return func(frame *testFrame) bool {
+		if frame.Type != SendMessageAction {
+			return false
+		}
+		var payload TextPayload
+		return json.Unmarshal(frame.Payload, &payload) == nil && payload.Text == text
+	}
+}
+
+// join joins a channel by name and returns its ID
+func (client *testClient) join(name string) string {
+	client.t.Helper()
+	client.send(JoinChannelAction, "", JoinChannelPayload{Name: name})
+	return client.expect(ofType(ChannelJoinedAction)).ChannelID
+}
+
+// eventually fails the test unless condition holds within a few seconds
+func eventually(t testing.TB, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/*
+	Concurrency
+*/
+
+func TestConcurrentJoinLeaveBroadcast(t *testing.T) {
+	node := newTestNode(t, backplane.NewMemory())
+	const clients = 8
+
+	// Everyone joins at once, then chats while half of them leave and join
+	// again
+	members := make([]*testClient, clients)
+	for i := range members {
+		members[i] = node.connect(t, newTestAccount(t, "member"))
+	}
+	channelIDs := make([]string, clients)
+	var wg sync.WaitGroup
+	for i, client := range members {
+		wg.Add(1)
+		go func(i int, client *testClient) {
+			defer wg.Done()
+			client.send(JoinChannelAction, "", JoinChannelPayload{Name: "lobby"})
+		}(i, client)
+	}
+	wg.Wait()
+	for i, client := range members {
+		channelIDs[i] = client.expect(ofType(ChannelJoinedAction)).ChannelID
+	}
+	channelID := channelIDs[0]
+	for _, id := range channelIDs {
+		if id != channelID {
+			t.Fatalf("concurrent joins ended up in channels %s and %s", channelID, id)
+		}
+	}
+	channel := node.server.findChannelByID(channelID)
+	eventually(t, "every member to be registered", func() bool { return len(channel.GetMembers()) == clients })
+
+	for i, client := range members {
+		wg.Add(1)
+		go func(i int, client *testClient) {
+			defer wg.Done()
+			for n := 0; n < 20; n++ {
+				client.send(SendMessageAction, channelID, TextPayload{Text: fmt.Sprintf("%d-%d", i, n)})
+				if i%2 == 1 && n%5 == 0 {
+					client.send(LeaveChannelAction, channelID, nil)
+					client.send(JoinChannelAction, "", JoinChannelPayload{Name: "lobby"})
+				}
+			}
+			client.send(SendMessageAction, channelID, TextPayload{Text: fmt.Sprintf("done-%d", i)})
+		}(i, client)
+	}
+	wg.Wait()
+
+	// Frames of a connection are handled in order, so every leave and join
+	// was handled once the last message of each member arrived
+	done := make(map[string]bool)
+	for len(done) < clients {
+		frame := members[0].expect(func(frame *testFrame) bool {
+			var payload TextPayload
+			_ = json.Unmarshal(frame.Payload, &payload)
+			return frame.Type == SendMessageAction && strings.HasPrefix(payload.Text, "done-")
+		})
+		done[string(frame.Payload)] = true
+	}
+	if n := len(channel.GetMembers()); n != clients {
+		t.Fatalf("%d members after leaving and joining again, want %d", n, clients)
+	}
+
+	// Once things settle, a broadcast reaches everyone
+	members[0].send(SendMessageAction, channelID, TextPayload{Text: "settled"})
+	for _, client := range members {
+		client.expect(withText("settled"))
+	}
+}
+
+// closeCheckingStore is a message store counting the messages appended
+// after it was closed
+type closeCheckingStore struct {
+	*MemoryMessageStore
+	closed int32
+	late   int32
+}
+
+func (store *closeCheckingStore) Append(message *Message) error {
+	if atomic.LoadInt32(&store.closed) == 1 {
+		atomic.AddInt32(&store.late, 1)
+	}
+	return store.MemoryMessageStore.Append(message)
+}
+
+func (store *closeCheckingStore) Close() error {
+	atomic.StoreInt32(&store.closed, 1)
+	return nil
+}
+
+func TestConcurrentSendsDuringShutdown(t *testing.T) {
+	node := newTestNode(t, backplane.NewMemory())
+	store := &closeCheckingStore{MemoryMessageStore: NewMemoryMessageStore()}
+	node.server.store = store
+
+	clients := make([]*testClient, 6)
+	for i := range clients {
+		clients[i] = node.connect(t, newTestAccount(t, "sender"))
+	}
+	channelID := clients[0].join("busy")
+	for _, client := range clients[1:] {
+		client.join("busy")
+	}
+
+	// Two of them also talk in a conversation
+	clients[0].send(OpenConversationAction, "", OpenConversationPayload{UserIDs: []string{clients[1].account.ID}})
+	conversationID := clients[0].expect(ofType(ChannelJoinedAction)).ChannelID
+	clients[1].expect(ofType(ChannelJoinedAction))
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *testClient) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					client.send(SendMessageAction, channelID, TextPayload{Text: "busy"})
+					if client == clients[0] || client == clients[1] {
+						client.send(SendMessageAction, conversationID, TextPayload{Text: "busy"})
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}(client)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := node.server.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	close(stop)
+	wg.Wait()
+
+	// Every client is told to go away, after the frames queued for it
+	for _, client := range clients {
+		select {
+		case <-client.closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s was not disconnected", client.account.Username)
+		}
+		if !websocket.IsCloseError(client.err, websocket.CloseGoingAway) {
+			t.Fatalf("%s: got %v, want a going away close", client.account.Username, client.err)
+		}
+	}
+	if n := node.server.accounts.SessionCount(); n != 0 {
+		t.Fatalf("%d sessions left after shutdown", n)
+	}
+
+	// Conversations stop with the channels, before the stores close
+	select {
+	case <-node.server.conversations.Get(conversationID).quit:
+	default:
+		t.Fatal("the conversation loop is still running")
+	}
+	if late := atomic.LoadInt32(&store.late); late != 0 {
+		t.Fatalf("%d messages were stored after the store closed", late)
+	}
+}
+
+func TestResumeWhileMessagesArrive(t *testing.T) {
+	node := newTestNode(t, backplane.NewMemory())
+	reader := newTestAccount(t, "reader")
+	writer := node.connect(t, newTestAccount(t, "writer"))
+
+	client := node.connect(t, reader)
+	session := client.expect(ofType(SessionAction))
+	var payload SessionPayload
+	if err := json.Unmarshal(session.Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	channelID := client.join("resume")
+	writer.join("resume")
+	writer.send(SendMessageAction, channelID, TextPayload{Text: "before"})
+	lastSeq := client.expect(withText("before")).Seq
+
+	// The connection drops without a close handshake while the writer keeps
+	// posting
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 0; n < 20; n++ {
+			writer.send(SendMessageAction, channelID, TextPayload{Text: fmt.Sprintf("missed-%d", n)})
+		}
+	}()
+	_ = client.conn.UnderlyingConn().Close()
+	<-done
+	eventually(t, "the session to be suspended", func() bool { return node.server.sessions.Len() == 1 })
+	writer.send(SendMessageAction, channelID, TextPayload{Text: "last"})
+	writer.expect(withText("last"))
+
+	resumed := node.connect(t, reader)
+	resumed.send(ResumeAction, "", ResumePayload{SessionToken: payload.SessionToken, LastSeq: lastSeq})
+
+	// Every missed message is replayed in order, then the resumed frame
+	// tells how many there were
+	next := 0
+	for {
+		frame := resumed.expect(func(frame *testFrame) bool {
+			return frame.Type == SendMessageAction || frame.Type == ResumedAction
+		})
+		if frame.Type == ResumedAction {
+			var resumedPayload ResumedPayload
+			_ = json.Unmarshal(frame.Payload, &resumedPayload)
+			if resumedPayload.Gap {
+				t.Fatal("resume reported a gap")
+			}
+			break
+		}
+		if frame.Seq <= lastSeq {
+			t.Fatalf("frame %d replayed after %d", frame.Seq, lastSeq)
+		}
+		lastSeq = frame.Seq
+		var text TextPayload
+		_ = json.Unmarshal(frame.Payload, &text)
+		if text.Text == "last" {
+			if next != 20 {
+				t.Fatalf("last message replayed after %d of 20 missed ones", next)
+			}
+			continue
+		}
+		if want := fmt.Sprintf("missed-%d", next); text.Text != want {
+			t.Fatalf("replayed %q, want %q", text.Text, want)
+		}
+		next++
+	}
+
+	// The resumed session is still in the channel
+	writer.send(SendMessageAction, channelID, TextPayload{Text: "after"})
+	resumed.expect(withText("after"))
+}
+
+func TestConversationsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	alice := newTestAccount(t, "alice")
+	bob := newTestAccount(t, "bob")
+
+	node := newFileTestNode(t, dir)
+	client := node.connect(t, alice)
+	client.send(OpenConversationAction, "", OpenConversationPayload{UserIDs: []string{bob.ID}})
+	conversationID := client.expect(ofType(ChannelJoinedAction)).ChannelID
+	client.send(SendMessageAction, conversationID, TextPayload{Text: "still there?"})
+	client.expect(withText("still there?"))
+	node.stop(t)
+
+	node = newFileTestNode(t, dir)
+	for _, account := range []*testAccount{alice, bob} {
+		client := node.connect(t, account)
+		client.send(ListConversationsAction, "", nil)
+		var payload ConversationsPayload
+		if err := json.Unmarshal(client.expect(ofType(ConversationsAction)).Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if len(payload.Conversations) != 1 || payload.Conversations[0].ID != conversationID ||
+			len(payload.Conversations[0].Participants) != 2 {
+			t.Fatalf("%s lists %+v after a restart", account.Username, payload.Conversations)
+		}
+
+		// Participants are members again once connected
+		client.send(SendMessageAction, conversationID, TextPayload{Text: "yes, " + account.Username})
+		client.expect(withText("yes, " + account.Username))
+	}
+}
+
+func TestResumeOnlyAsFirstFrame(t *testing.T) {
+	node := newTestNode(t, backplane.NewMemory())
+	account := newTestAccount(t, "resumer")
+
+	client := node.connect(t, account)
+	var session SessionPayload
+	if err := json.Unmarshal(client.expect(ofType(SessionAction)).Payload, &session); err != nil {
+		t.Fatal(err)
+	}
+	client.join("first-frame")
+	_ = client.conn.UnderlyingConn().Close()
+	eventually(t, "the session to be suspended", func() bool { return node.server.sessions.Len() == 1 })
+
+	// A connection that already sent frames has numbered frames of its own
+	late := node.connect(t, account)
+	late.do(SetStatusAction, "", SetStatusPayload{Status: StatusAway})
+	frame := late.request(ResumeAction, "", ResumePayload{SessionToken: session.SessionToken})
+	var answer ErrorPayload
+	if err := json.Unmarshal(frame.Payload, &answer); err != nil || frame.Type != ErrorAction || answer.Code != api_response.ERROR_INVALID_FRAME {
+		t.Fatalf("late resume answered with %s %s", frame.Type, frame.Payload)
+	}
+
+	// The session is still there to resume
+	resumed := node.connect(t, account)
+	resumed.send(ResumeAction, "", ResumePayload{SessionToken: session.SessionToken})
+	resumed.expect(ofType(ResumedAction))
+}
+
+func TestInvisibleStatus(t *testing.T) {
+	node := newTestNode(t, backplane.NewMemory())
+	account := newTestAccount(t, "ghost")
+	watcher := node.connect(t, newTestAccount(t, "watcher"))
+	channelID := watcher.join("invisible")
+	client := node.connect(t, account)
+	client.join("invisible")
+
+	statusOf := func(status string) func(frame *testFrame) bool {
+		return func(frame *testFrame) bool {
+			var payload PresencePayload
+			return frame.Type == PresenceAction && json.Unmarshal(frame.Payload, &payload) == nil &&
+				payload.UserID == account.ID && payload.Status == status
+		}
+	}
+	watcher.expect(statusOf(StatusOnline))
+
+	// An invisible user looks offline and its activity goes unseen
+	client.do(SetStatusAction, "", SetStatusPayload{Status: StatusOffline})
+	watcher.expect(statusOf(StatusOffline))
+	presence, _ := node.server.presence.Get(account.ID)
+	client.send(SendMessageAction, channelID, TextPayload{Text: "boo"})
+	watcher.expect(withText("boo"))
+	if after, _ := node.server.presence.Get(account.ID); after.Status != StatusOffline || !after.LastSeen.Equal(presence.LastSeen) {
+		t.Fatalf("invisible user shows as %s, last seen %v then %v", after.Status, presence.LastSeen, after.LastSeen)
+	}
+
+	// Another device of the user still shows
+	node.connect(t, account)
+	watcher.expect(statusOf(StatusOnline))
+}
+
+func TestPresenceOfFlappingConnections(t *testing.T) {
+	node := newTestNode(t, backplane.NewMemory())
+	account := newTestAccount(t, "flapper")
+	watcher := node.connect(t, newTestAccount(t, "watcher"))
+	watcher.join("presence")
+
+	// Several devices join, change status and disconnect at once
+	devices := make([]*testClient, 6)
+	for i := range devices {
+		devices[i] = node.connect(t, account)
+	}
+	var wg sync.WaitGroup
+	for _, client := range devices {
+		wg.Add(1)
+		go func(client *testClient) {
+			defer wg.Done()
+			client.send(JoinChannelAction, "", JoinChannelPayload{Name: "presence"})
+			client.send(SetStatusAction, "", SetStatusPayload{Status: StatusAway})
+			client.send(SetStatusAction, "", SetStatusPayload{Status: StatusOnline})
+			_ = client.conn.Close()
+		}(client)
+	}
+	wg.Wait()
+
+	eventually(t, "the user to go offline", func() bool {
+		presence, ok := node.server.presence.Get(account.ID)
+		return ok && presence.Status == StatusOffline
+	})
+
+	// Offline users are forgotten once the retention period passed
+	if n := node.server.presence.Reap(time.Now()); n == 0 {
+		t.Fatal("the watcher was reaped while online")
+	}
+	if _, ok := node.server.presence.Get(account.ID); !ok {
+		t.Fatal("offline user was reaped before the retention period")
+	}
+	eventually(t, "the offline user to be reaped after the retention period", func() bool {
+		node.server.presence.Reap(time.Now().Add(DefaultPresenceRetention + time.Minute))
+		_, ok := node.server.presence.Get(account.ID)
+		return !ok
+	})
+	if _, ok := node.server.presence.Get(watcher.account.ID); !ok {
+		t.Fatal("online user was reaped")
+	}
+}
+
+func TestChannelsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	alice := newTestAccount(t, "alice")
+
+	node := newFileTestNode(t, dir)
+	news, err := node.server.CreateChannel("news", true, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newsID := *news.GetID()
+	if _, err := node.server.SetChannelArchived(newsID, alice.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// A channel created by joining it is kept once renamed
+	client := node.connect(t, alice)
+	lobbyID := client.join("lobby")
+	if _, err := node.server.RenameChannel(lobbyID, "hall", alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	client.join("idle")
+	node.stop(t)
+
+	node = newFileTestNode(t, dir)
+	news = node.server.GetChannel(newsID)
+	if news == nil || !news.Private || !news.IsArchived() || news.RoleOf(alice.ID) != RoleOwner {
+		t.Fatalf("news is %+v after a restart", news)
+	}
+	hall := node.server.GetChannel(lobbyID)
+	if hall == nil || *hall.GetName() != "hall" || hall.IsEphemeral() || hall.RoleOf(alice.ID) != RoleOwner {
+		t.Fatalf("hall is %+v after a restart", hall)
+	}
+	if node.server.findChannelByName("idle") != nil {
+		t.Fatal("an ephemeral channel was started again before being joined")
+	}
+
+	// The old name is a new channel, an ephemeral one restored when joined
+	client = node.connect(t, alice)
+	if channelID := client.join("lobby"); channelID != nextChannelIDFor("lobby", 1) {
+		t.Fatalf("joining the old name got channel %s", channelID)
+	}
+	client.join("idle")
+	if idle := node.server.findChannelByName("idle"); idle.RoleOf(alice.ID) != RoleOwner {
+		t.Fatalf("idle was not restored with its owner: %+v", idle.Roles())
+	}
+}
+
+func TestChannelMetadataSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	alice := newTestAccount(t, "alice")
+	topic, color := "launch day", "orange"
+
+	node := newFileTestNode(t, dir)
+	channel, err := node.server.CreateChannel("launch", false, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channelID := *channel.GetID()
+	update := &UpdateChannelPayload{Topic: &topic, Attributes: map[string]*string{"color": &color}}
+	if _, err := node.server.UpdateChannel(channelID, alice.ID, update); err != nil {
+		t.Fatal(err)
+	}
+	want := channel.Metadata()
+	node.stop(t)
+
+	node = newFileTestNode(t, dir)
+	channel = node.server.GetChannel(channelID)
+	if channel == nil {
+		t.Fatal("the channel was not restored")
+	}
+	got := channel.Metadata()
+	if got.Topic != topic || got.Attributes["color"] != color || got.CreatedBy != alice.ID ||
+		got.UpdatedBy != alice.ID || !got.CreatedAt.Equal(want.CreatedAt) || !got.UpdatedAt.Equal(*want.UpdatedAt) {
+		t.Fatalf("metadata is %+v after a restart, want %+v", got, want)
+	}
+
+	// Updates go on from the restored metadata
+	description := "what ships when"
+	if _, err := node.server.UpdateChannel(channelID, alice.ID, &UpdateChannelPayload{Description: &description}); err != nil {
+		t.Fatal(err)
+	}
+	if got := channel.Metadata(); got.Topic != topic || got.Description != description {
+		t.Fatalf("metadata is %+v after an update", got)
+	}
+}
@@ -0,0 +1,159 @@
+package logic
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// replayEntry is a frame delivered to a session, as numbered on the wire
+type replayEntry struct {
+	seq   uint64
+	frame []byte
+}
+
+// replayBuffer keeps the last frames delivered to a session, so that a client
+// resuming the session can be sent what it missed. It is not safe for
+// concurrent use, its session guards it.
+type replayBuffer struct {
+	entries []replayEntry
+	next    int
+	full    bool
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{entries: make([]replayEntry, size)}
+}
+
+func (buffer *replayBuffer) add(seq uint64, frame []byte) {
+	if len(buffer.entries) == 0 {
+		return
+	}
+	buffer.entries[buffer.next] = replayEntry{seq, frame}
+	buffer.next = (buffer.next + 1) % len(buffer.entries)
+	if buffer.next == 0 {
+		buffer.full = true
+	}
+}
+
+// since returns the frames numbered after lastSeq, oldest first. gap is true
+// when some of them are no longer buffered.
+func (buffer *replayBuffer) since(lastSeq uint64) (frames [][]byte, gap bool) {
+	entries := buffer.entries[:buffer.next]
+	if buffer.full {
+		entries = append(buffer.entries[buffer.next:len(buffer.entries):len(buffer.entries)], entries...)
+	}
+
+	for i, entry := range entries {
+		if entry.seq <= lastSeq {
+			continue
+		}
+		if i == 0 && entry.seq > lastSeq+1 {
+			gap = true
+		}
+		frames = append(frames, entry.frame)
+	}
+	return frames, gap
+}
+
+// withSeq numbers an encoded frame by adding a "seq" field to it
+func withSeq(frame []byte, seq uint64) []byte {
+	if len(frame) < 2 || frame[0] != '{' {
+		return frame
+	}
+	stamped := make([]byte, 0, len(frame)+24)
+	stamped = append(stamped, `{"seq":`...)
+	stamped = strconv.AppendUint(stamped, seq, 10)
+	if len(frame) > 2 {
+		stamped = append(stamped, ',')
+	}
+	return append(stamped, frame[1:]...)
+}
+
+// SessionRegistry holds the sessions whose connection dropped, by session
+// token, for the resume window. A session still held when the window ends
+// is released. It is safe for concurrent use.
+type SessionRegistry struct {
+	mu        sync.Mutex
+	suspended map[string]*suspendedSession
+	window    time.Duration
+	stopped   bool
+}
+
+type suspendedSession struct {
+	user  *User
+	timer *time.Timer
+}
+
+func NewSessionRegistry(window time.Duration) *SessionRegistry {
+	return &SessionRegistry{
+		suspended: make(map[string]*suspendedSession),
+		window:    window,
+	}
+}
+
+// suspend holds a session until it is resumed or the window ends. Returns
+// false if sessions are no longer held, the caller must then release it.
+func (registry *SessionRegistry) suspend(user *User) bool {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.stopped {
+		return false
+	}
+
+	token := user.sessionToken
+	registry.suspended[token] = &suspendedSession{
+		user: user,
+		timer: time.AfterFunc(registry.window, func() {
+			if registry.remove(token, user) {
+				user.release()
+			}
+		}),
+	}
+	return true
+}
+
+// take hands a suspended session of the given account over to the caller,
+// or returns nil if there is none.
+func (registry *SessionRegistry) take(token string, accountID string) *User {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	session, ok := registry.suspended[token]
+	if !ok || session.user.UserId != accountID {
+		return nil
+	}
+	session.timer.Stop()
+	delete(registry.suspended, token)
+	return session.user
+}
+
+// remove forgets a session if it is still suspended. Returns false if it was
+// resumed in the meantime.
+func (registry *SessionRegistry) remove(token string, user *User) bool {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if session, ok := registry.suspended[token]; !ok || session.user != user {
+		return false
+	}
+	delete(registry.suspended, token)
+	return true
+}
+
+// Len returns the number of suspended sessions.
+func (registry *SessionRegistry) Len() int {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	return len(registry.suspended)
+}
+
+// stop drops every suspended session without releasing it and holds no more.
+// Used when the node shuts down.
+func (registry *SessionRegistry) stop() {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.stopped = true
+	for token, session := range registry.suspended {
+		session.timer.Stop()
+		delete(registry.suspended, token)
+	}
+}
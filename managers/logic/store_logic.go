@@ -0,0 +1,290 @@
+package logic
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"wjjmjh/hermes/pkg/setting"
+)
+
+// Storage types selectable through the [storage] section of conf/app.ini
+const MemoryStorage = "memory"
+const FileStorage = "file"
+
+// MessageStore persists channel and thread messages. Get returns nil when
+// the message does not exist. Update replaces a stored message, keeping its
+// place in history, and ignores messages it does not have.
+//
+// Fetch methods page backwards through history: they return at most limit
+// messages older than the message ID given as the before cursor (or the most
+// recent ones when before is empty), ordered oldest first.
+//
+// CountAfter counts the channel messages newer than the message ID given as
+// the after cursor (all of them when after is empty or unknown), leaving out
+// those sent by excludeSenderID and deleted ones.
+type MessageStore interface {
+	Append(message *Message) error
+	Update(message *Message) error
+	Get(messageID string) (*Message, error)
+	FetchChannel(channelID string, before string, limit int) ([]*Message, error)
+	FetchThread(threadID string, before string, limit int) ([]*Message, error)
+	CountAfter(channelID string, after string, excludeSenderID string) (int, error)
+	Close() error
+}
+
+// NewMessageStore builds the MessageStore configured in the storage settings.
+func NewMessageStore(storage *setting.Storage) (MessageStore, error) {
+	switch storage.Type {
+	case "", MemoryStorage:
+		return NewMemoryMessageStore(), nil
+	case FileStorage:
+		return OpenFileMessageStore(storage.Path)
+	default:
+		return nil, fmt.Errorf("unknown message storage type: %s", storage.Type)
+	}
+}
+
+/*
+	In-memory store
+*/
+
+// messageTimeline is a list of messages in the order they were appended,
+// with an index by ID.
+type messageTimeline struct {
+	messages []*Message
+	index    map[string]int
+}
+
+// MemoryMessageStore keeps all history in memory; it is lost on restart.
+type MemoryMessageStore struct {
+	mu       sync.RWMutex
+	messages map[string]*Message
+	channels map[string]*messageTimeline
+	threads  map[string]*messageTimeline
+}
+
+func NewMemoryMessageStore() *MemoryMessageStore {
+	return &MemoryMessageStore{
+		messages: make(map[string]*Message),
+		channels: make(map[string]*messageTimeline),
+		threads:  make(map[string]*messageTimeline),
+	}
+}
+
+func (store *MemoryMessageStore) Append(message *Message) error {
+	stored := *message
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.messages[stored.ID] = &stored
+	if stored.ThreadID != "" {
+		appendToTimeline(store.threads, stored.ThreadID, &stored)
+	} else {
+		appendToTimeline(store.channels, stored.ChannelID, &stored)
+	}
+	return nil
+}
+
+func (store *MemoryMessageStore) Update(message *Message) error {
+	stored := *message
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.messages[stored.ID]; !ok {
+		return nil
+	}
+	store.messages[stored.ID] = &stored
+	if stored.ThreadID != "" {
+		replaceInTimeline(store.threads[stored.ThreadID], &stored)
+	} else {
+		replaceInTimeline(store.channels[stored.ChannelID], &stored)
+	}
+	return nil
+}
+
+func (store *MemoryMessageStore) Get(messageID string) (*Message, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	message, ok := store.messages[messageID]
+	if !ok {
+		return nil, nil
+	}
+	c := *message
+	return &c, nil
+}
+
+func (store *MemoryMessageStore) FetchChannel(channelID string, before string, limit int) ([]*Message, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return fetchFromTimeline(store.channels[channelID], before, limit), nil
+}
+
+func (store *MemoryMessageStore) FetchThread(threadID string, before string, limit int) ([]*Message, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return fetchFromTimeline(store.threads[threadID], before, limit), nil
+}
+
+func (store *MemoryMessageStore) CountAfter(channelID string, after string, excludeSenderID string) (int, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	timeline, ok := store.channels[channelID]
+	if !ok {
+		return 0, nil
+	}
+
+	start := 0
+	if position, ok := timeline.index[after]; ok {
+		start = position + 1
+	}
+
+	count := 0
+	for _, message := range timeline.messages[start:] {
+		if message.SenderID != excludeSenderID && message.DeletedAt == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (store *MemoryMessageStore) Close() error {
+	return nil
+}
+
+func appendToTimeline(timelines map[string]*messageTimeline, key string, message *Message) {
+	timeline, ok := timelines[key]
+	if !ok {
+		timeline = &messageTimeline{index: make(map[string]int)}
+		timelines[key] = timeline
+	}
+	timeline.index[message.ID] = len(timeline.messages)
+	timeline.messages = append(timeline.messages, message)
+}
+
+func replaceInTimeline(timeline *messageTimeline, message *Message) {
+	if timeline == nil {
+		return
+	}
+	if position, ok := timeline.index[message.ID]; ok {
+		timeline.messages[position] = message
+	}
+}
+
+// fetchFromTimeline returns copies of up to limit messages preceding before.
+func fetchFromTimeline(timeline *messageTimeline, before string, limit int) []*Message {
+	if timeline == nil {
+		return []*Message{}
+	}
+
+	end := len(timeline.messages)
+	if before != "" {
+		position, ok := timeline.index[before]
+		if !ok {
+			return []*Message{}
+		}
+		end = position
+	}
+
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+
+	page := make([]*Message, 0, end-start)
+	for _, message := range timeline.messages[start:end] {
+		c := *message
+		page = append(page, &c)
+	}
+	return page
+}
+
+/*
+	On-disk store
+*/
+
+// FileMessageStore is an embedded on-disk store: every message, and every
+// later version of it, is appended to a journal (see journal_logic.go),
+// which is replayed into memory on open; the last version of a message wins.
+type FileMessageStore struct {
+	*MemoryMessageStore
+	mu      sync.Mutex
+	journal *journal
+}
+
+// OpenFileMessageStore opens (or creates) the message log in directory dir.
+func OpenFileMessageStore(dir string) (*FileMessageStore, error) {
+	store := &FileMessageStore{MemoryMessageStore: NewMemoryMessageStore()}
+	journal, err := openJournal(dir, "messages.log", store.replay)
+	if err != nil {
+		return nil, err
+	}
+	store.journal = journal
+
+	store.MemoryMessageStore.mu.RLock()
+	live := len(store.messages)
+	store.MemoryMessageStore.mu.RUnlock()
+	if err := journal.compact(live, store.snapshot); err != nil {
+		_ = journal.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// snapshot writes the last version of every message, each timeline in order.
+func (store *FileMessageStore) snapshot(write func(record interface{}) error) error {
+	store.MemoryMessageStore.mu.RLock()
+	defer store.MemoryMessageStore.mu.RUnlock()
+	for _, timelines := range []map[string]*messageTimeline{store.channels, store.threads} {
+		for _, timeline := range timelines {
+			for _, message := range timeline.messages {
+				if err := write(message); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// replay loads a logged version of a message back into memory.
+func (store *FileMessageStore) replay(record []byte) error {
+	var message Message
+	if err := json.Unmarshal(record, &message); err != nil {
+		return err
+	}
+	if known, _ := store.MemoryMessageStore.Get(message.ID); known != nil {
+		return store.MemoryMessageStore.Update(&message)
+	}
+	return store.MemoryMessageStore.Append(&message)
+}
+
+func (store *FileMessageStore) Append(message *Message) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.journal.Append(message); err != nil {
+		return err
+	}
+	return store.MemoryMessageStore.Append(message)
+}
+
+func (store *FileMessageStore) Update(message *Message) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if known, _ := store.MemoryMessageStore.Get(message.ID); known == nil {
+		return nil
+	}
+	if err := store.journal.Append(message); err != nil {
+		return err
+	}
+	return store.MemoryMessageStore.Update(message)
+}
+
+func (store *FileMessageStore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.journal.Close()
+}
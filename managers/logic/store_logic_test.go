@@ -0,0 +1,51 @@
+package logic
+
+import (
+	"fmt"
+	"testing"
+)
+
+// historyStore returns a memory store holding count messages of one channel
+func historyStore(b *testing.B, count int) *MemoryMessageStore {
+	store := NewMemoryMessageStore()
+	for i := 0; i < count; i++ {
+		message := &Message{Type: SendMessageAction, ChannelID: "channel", Text: fmt.Sprintf("message %d", i)}
+		message.stamp()
+		if err := store.Append(message); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return store
+}
+
+// BenchmarkFetchLatest fetches the most recent page of a channel's history
+func BenchmarkFetchLatest(b *testing.B) {
+	store := historyStore(b, 100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.FetchChannel("channel", "", DefaultHistoryLimit); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPageHistory pages backwards through a channel's whole history,
+// one page per iteration
+func BenchmarkPageHistory(b *testing.B) {
+	store := historyStore(b, 100000)
+	before := ""
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		page, err := store.FetchChannel("channel", before, MaxHistoryLimit)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(page) == 0 {
+			before = ""
+			continue
+		}
+		before = page[0].ID
+	}
+}
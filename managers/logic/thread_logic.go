@@ -3,24 +3,40 @@ package logic
 import (
 	"errors"
 	"fmt"
+	"sync"
 )
 
 type Thread struct {
-	threadID *string
-	users    map[*User]bool
-	channel  *Channel
+	// Guards members
+	mu              sync.RWMutex
+	threadID        *string
+	parentMessageID string
+	members         map[*Account]bool
+	channel         *Channel
 }
 
 func (thread *Thread) GetID() *string {
 	return thread.threadID
 }
 
+// GetParentMessageID returns the ID of the channel message the thread replies to.
+func (thread *Thread) GetParentMessageID() string {
+	return thread.parentMessageID
+}
+
 func (thread *Thread) GetParentChannel() *Channel {
 	return thread.channel
 }
 
-func (thread *Thread) GetUsers() map[*User]bool {
-	return thread.users
+// GetMembers returns a snapshot of the accounts following the thread.
+func (thread *Thread) GetMembers() map[*Account]bool {
+	thread.mu.RLock()
+	defer thread.mu.RUnlock()
+	members := make(map[*Account]bool, len(thread.members))
+	for account, value := range thread.members {
+		members[account] = value
+	}
+	return members
 }
 
 // Description:    Gets all users in a specific Thread.
@@ -30,8 +46,11 @@ func (thread *Thread) GetAllUsers(p GetUsersParams_) ([]*string, error) {
 	var users []*string
 	var errorMsg error = nil
 
+	thread.mu.RLock()
+	defer thread.mu.RUnlock()
+
 	// Loop through and append to return array all users satisfying users: True
-	for User, value := range thread.users {
+	for User, value := range thread.members {
 		if value {
 			if p.ReturnType == "username" {
 				users = append(users, User.GetUsername())
@@ -48,3 +67,50 @@ func (thread *Thread) GetAllUsers(p GetUsersParams_) ([]*string, error) {
 	}
 	return users, errorMsg
 }
+
+// hasMember reports whether account follows the thread.
+func (thread *Thread) hasMember(account *Account) bool {
+	thread.mu.RLock()
+	defer thread.mu.RUnlock()
+	return thread.members[account]
+}
+
+// addMember makes account follow the thread. Returns false if it already did.
+func (thread *Thread) addMember(account *Account) bool {
+	thread.mu.Lock()
+	defer thread.mu.Unlock()
+	if thread.members[account] {
+		return false
+	}
+	thread.members[account] = true
+	return true
+}
+
+// removeMember stops account following the thread. Returns false if it did not.
+func (thread *Thread) removeMember(account *Account) bool {
+	thread.mu.Lock()
+	defer thread.mu.Unlock()
+	if !thread.members[account] {
+		return false
+	}
+	delete(thread.members, account)
+	return true
+}
+
+// broadcastToUsers delivers a message to every connection of everyone
+// following the thread, whether or not they are members of the parent channel.
+func (thread *Thread) broadcastToUsers(message []byte) {
+	for account := range thread.GetMembers() {
+		account.send(message)
+	}
+}
+
+// Payload describes the thread on the wire
+func (thread *Thread) Payload() ThreadPayload {
+	return ThreadPayload{
+		ID:              *thread.threadID,
+		ChannelID:       *thread.channel.GetID(),
+		ParentMessageID: thread.parentMessageID,
+		Members:         len(thread.GetMembers()),
+	}
+}
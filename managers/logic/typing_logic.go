@@ -0,0 +1,66 @@
+package logic
+
+import (
+	"sync"
+	"time"
+)
+
+type typingKey struct {
+	channelID string
+	threadID  string
+	userID    string
+}
+
+// TypingRegistry tracks who is typing in which channel or thread. A user who
+// does not send typing-stop, or a message, within the timeout is stopped by
+// the server. Repeated typing-start frames only extend the timeout. It is
+// safe for concurrent use.
+type TypingRegistry struct {
+	mu      sync.Mutex
+	timers  map[typingKey]*time.Timer
+	timeout time.Duration
+}
+
+func NewTypingRegistry(timeout time.Duration) *TypingRegistry {
+	return &TypingRegistry{timers: make(map[typingKey]*time.Timer), timeout: timeout}
+}
+
+func (typing *TypingRegistry) start(user *User, channel *Channel, threadID string) {
+	key := typingKey{*channel.GetID(), threadID, user.UserId}
+
+	typing.mu.Lock()
+	if timer, ok := typing.timers[key]; ok {
+		timer.Reset(typing.timeout)
+		typing.mu.Unlock()
+		return
+	}
+	typing.timers[key] = time.AfterFunc(typing.timeout, func() { typing.stop(user, channel, threadID) })
+	typing.mu.Unlock()
+
+	typing.announce(TypingStartAction, user, channel, threadID)
+}
+
+func (typing *TypingRegistry) stop(user *User, channel *Channel, threadID string) {
+	key := typingKey{*channel.GetID(), threadID, user.UserId}
+
+	typing.mu.Lock()
+	timer, ok := typing.timers[key]
+	if !ok {
+		typing.mu.Unlock()
+		return
+	}
+	timer.Stop()
+	delete(typing.timers, key)
+	typing.mu.Unlock()
+
+	typing.announce(TypingStopAction, user, channel, threadID)
+}
+
+// announce tells the channel members, or the thread followers, that the user
+// started or stopped typing
+func (typing *TypingRegistry) announce(action string, user *User, channel *Channel, threadID string) {
+	frame := newFrame(action, *channel.GetID(), nil)
+	frame.ThreadID = threadID
+	frame.Sender = user.Info()
+	channel.relay(&channelEvent{ThreadID: threadID, Frame: FrameMarshal(frame)})
+}
@@ -1,29 +1,88 @@
 package logic
 
 import (
-	"errors"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"log"
+	"sort"
+	"sync"
 	"time"
+	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/services/auth_service"
+	"wjjmjh/hermes/pkg/setting"
 )
 
+// User is a single websocket connection, one session of an Account. Its read
+// goroutine (CircularRead) handles client frames, its write goroutine
+// (CircularWrite) drains dataBuffer, and any other goroutine may deliver to it
+// through send.
+//
+// Every frame delivered to the session is numbered and kept for replay, so a
+// client whose connection dropped can resume the session on a new
+// connection within the resume window, see handleResumeMessage.
 type User struct {
 	UserId     string  `json:"UserId"` // encoded to be parsed with messages
 	username   *string // name to be displayed around the server
-	channels   map[*Channel]bool
-	threads    map[*Thread]bool
+	account    *Account
 	conn       *websocket.Conn
 	wsServer   *WsServer
 	dataBuffer chan []byte
+
+	// Identifies the session to resume it
+	sessionToken string
+
+	// Guards closed, suspended, serverClosed, seq, replay and closeMessage
+	mu sync.Mutex
+
+	// Set once the user disconnected; dataBuffer is closed from then on
+	closed bool
+
+	// Set while the connection is gone but the session may still be resumed;
+	// deliveries are only kept for replay
+	suspended bool
+
+	// Set when the server ended the connection, which is never resumed
+	serverClosed bool
+
+	// Set by the read goroutine when the connection dropped without a close
+	// handshake
+	dropped bool
+
+	// Set by the read goroutine once the client sent a frame; only the first
+	// may resume a session
+	framed bool
+
+	// Number of the last frame delivered and the frames kept for replay
+	seq    uint64
+	replay *replayBuffer
+
+	// Ensures a slow consumer is only evicted once
+	evictOnce sync.Once
+
+	// Close frame written once dataBuffer is drained, set by closeWith
+	closeMessage []byte
+
+	// Closed when the write goroutine has exited
+	done chan struct{}
+
+	// Closed when the read goroutine has disconnected the user
+	released chan struct{}
 }
 
 // Create user method -> Used by user_manager.go
-func CreateUser(userName string, conn *websocket.Conn, wsServer *WsServer) *User {
-	userID := uuid.New().String()
-	channels := make(map[*Channel]bool)
-	threads := make(map[*Thread]bool)
-	return &User{userID, &userName, channels, threads, conn, wsServer, make(chan []byte, 256)}
+// userID is the stable identity taken from the authenticated token.
+func CreateUser(userID string, userName string, conn *websocket.Conn, wsServer *WsServer) *User {
+	return &User{
+		UserId:       userID,
+		username:     &userName,
+		conn:         conn,
+		wsServer:     wsServer,
+		dataBuffer:   make(chan []byte, wsServer.bufferSize),
+		sessionToken: uuid.New().String(),
+		replay:       newReplayBuffer(wsServer.replayBufferSize),
+		done:         make(chan struct{}),
+		released:     make(chan struct{}),
+	}
 }
 
 func (user *User) GetID() string {
@@ -34,12 +93,9 @@ func (user *User) GetUsername() *string {
 	return user.username
 }
 
-func (user *User) GetChannels() map[*Channel]bool {
-	return user.channels
-}
-
-func (user *User) GetThreads() map[*Thread]bool {
-	return user.threads
+// GetAccount returns the account the connection belongs to
+func (user *User) GetAccount() *Account {
+	return user.account
 }
 
 func (user *User) GetConn() *websocket.Conn {
@@ -68,6 +124,7 @@ func (user *User) CircularRead(maxMessageSize int64, pong time.Duration) {
 
 	// Disconnect websocket server
 	defer func() {
+		defer close(user.released)
 		err := user.DisconnectWithWsServer()
 		if err != nil {
 			log.Printf(
@@ -84,6 +141,10 @@ func (user *User) CircularRead(maxMessageSize int64, pong time.Duration) {
 	for {
 		_, jsonMessage, err := user.conn.ReadMessage()
 		if err != nil {
+			// Clients that closed the connection themselves, or sent a frame
+			// over the size limit, are done
+			user.dropped = !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) &&
+				err != websocket.ErrReadLimit
 			if websocket.IsUnexpectedCloseError(
 				err,
 				websocket.CloseGoingAway,
@@ -93,7 +154,15 @@ func (user *User) CircularRead(maxMessageSize int64, pong time.Duration) {
 			}
 			break
 		}
-		user.HandleNewMessage(jsonMessage)
+
+		// Flooding clients are answered without even decoding their frames
+		if reason := user.limitRead(); reason != "" {
+			user.rateLimited("", reason)
+			continue
+		}
+
+		// Rejected frames have already been answered with an error frame
+		_ = user.HandleNewMessage(jsonMessage)
 	}
 }
 
@@ -106,6 +175,7 @@ func (user *User) CircularWrite(ping time.Duration, maxWriteWaitTime time.Durati
 	// close the ws connection from the server side and log the error.
 	defer func() {
 		ticker.Stop()
+		close(user.done)
 		err := user.conn.Close()
 		if err != nil {
 			log.Printf("[ERROR] unexpected user connection close error: %v", err)
@@ -125,8 +195,9 @@ func (user *User) CircularWrite(ping time.Duration, maxWriteWaitTime time.Durati
 				log.Printf("[ERROR] unexpected error for setting : %v", err)
 			}
 			if !ok {
-				// The WsServer closed the channel.
-				err := user.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				// The WsServer closed the channel and everything queued
+				// before that has been written.
+				err := user.conn.WriteMessage(websocket.CloseMessage, user.getCloseMessage())
 				if err != nil {
 					log.Printf(
 						"[ERROR] unexpected error when user connection writing messages: %v",
@@ -181,19 +252,36 @@ func (user *User) CircularWrite(ping time.Duration, maxWriteWaitTime time.Durati
 
 // DisconnectWithWsServer unregisters user from server
 // closes the buffer channel and closes the websocket connection.
+// A session whose connection dropped is held for the resume window instead,
+// keeping the account and its memberships, and released once the window ends.
 func (user *User) DisconnectWithWsServer() error {
-	// Unregister user from websocket
-	user.wsServer.unregister <- user
-
-	// Unregister the user from the channels
-	for channel := range user.channels {
-		channel.unregister <- user
+	// Close msg buffer channel, no send can reach it any more. A server
+	// shutdown may already have closed it.
+	user.mu.Lock()
+	if !user.closed {
+		user.closed = true
+		close(user.dataBuffer)
 	}
+	user.suspended = user.dropped && !user.serverClosed && !user.wsServer.isDraining()
+	suspended := user.suspended
+	user.mu.Unlock()
 
-	// Close msg buffer channel
-	close(user.dataBuffer)
+	if suspended {
+		// Other users see the session go offline until it is resumed
+		user.wsServer.presence.disconnected(user, user.account.GetChannels())
+		if !user.wsServer.sessions.suspend(user) {
+			user.release()
+		}
+	} else {
+		user.release()
+	}
 
-	// Close websocket connection
+	// Close websocket connection, unless the write goroutine already did
+	select {
+	case <-user.done:
+		return nil
+	default:
+	}
 	err := user.conn.Close()
 	if err != nil {
 		return err
@@ -201,109 +289,885 @@ func (user *User) DisconnectWithWsServer() error {
 	return nil
 }
 
+// release detaches the session from its account for good. The memberships
+// belong to the account and only go away with its last session.
+func (user *User) release() {
+	user.mu.Lock()
+	user.suspended = false
+	user.mu.Unlock()
+
+	last, channels, threads := user.wsServer.accounts.Detach(user)
+	user.wsServer.presence.disconnected(user, channels)
+
+	if last {
+		for channel := range channels {
+			channel.leave(user.account)
+		}
+		for thread := range threads {
+			thread.removeMember(user.account)
+		}
+	}
+}
+
+// closeWith stops deliveries to the user. The write goroutine flushes the
+// frames already queued, then sends a close frame with the given code and
+// reason. Returns false if the user was already closed.
+func (user *User) closeWith(code int, reason string) bool {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	if user.closed {
+		return false
+	}
+	user.closed = true
+	user.serverClosed = true
+	user.closeMessage = websocket.FormatCloseMessage(code, reason)
+	close(user.dataBuffer)
+	return true
+}
+
+func (user *User) getCloseMessage() []byte {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	if user.closeMessage == nil {
+		return []byte{}
+	}
+	return user.closeMessage
+}
+
+// HandleNewMessage decodes a client frame and dispatches it to its handler.
+// Rejected frames are always answered with an error frame; accepted frames are
+// answered with an ack frame when they carry a request ID.
 func (user *User) HandleNewMessage(jsonMsg []byte) error {
 
+	first := !user.framed
+	user.framed = true
+
 	// Convert msg to the correct format
-	msg := MessageUnmarshal(jsonMsg)
-	if msg == nil {
-		return errors.New("Unable to handle new message")
+	frame, payload, frameErr := DecodeFrame(jsonMsg)
+	if frameErr != nil {
+		user.sendFrame(frameErr.Frame())
+		return frameErr
 	}
 
-	// User is the sender of the message
-	msg.Sender = user
+	if reason := user.limitFrame(frame, payload); reason != "" {
+		user.rateLimited(frame.RequestID, reason)
+		return newFrameError(api_response.ERROR_RATE_LIMITED, "%s", reason)
+	}
 
-	switch msg.Action {
-	case SendMessageAction:
-		// Room to send message to
-		channelName := msg.Target.GetName()
+	user.wsServer.presence.touch(user)
 
-		// If channel exists, send the message to the channel's broadcast method
-		if channel, _ := user.wsServer.FindChannel(FindChannelParams{channelName, nil}); channel != nil {
-			channel.broadcast <- msg
-		}
+	var ack AckPayload
+	var err error
+
+	switch frame.Type {
+	case SendMessageAction:
+		ack.MessageID, err = user.handleSendMessage(frame, payload.(*TextPayload))
 
 	case JoinChannelAction:
-		user.HandleJoinChannelMessage(msg)
+		err = user.HandleJoinChannelMessage(payload.(*JoinChannelPayload))
 
 	case LeaveChannelAction:
-		user.handleLeaveChannelMessage(msg)
+		err = user.handleLeaveChannelMessage(frame)
+
+	case CreateChannelAction:
+		ack.ChannelID, err = user.handleCreateChannelMessage(payload.(*CreateChannelPayload))
+
+	case ArchiveChannelAction:
+		_, err = user.wsServer.SetChannelArchived(frame.ChannelID, user.UserId, true)
+
+	case UnarchiveChannelAction:
+		_, err = user.wsServer.SetChannelArchived(frame.ChannelID, user.UserId, false)
+
+	case DeleteChannelAction:
+		err = user.wsServer.DeleteChannel(frame.ChannelID, user.UserId)
+
+	case UpdateChannelAction:
+		_, err = user.wsServer.UpdateChannel(frame.ChannelID, user.UserId, payload.(*UpdateChannelPayload))
+
+	case OpenConversationAction:
+		ack.ChannelID, err = user.handleOpenConversationMessage(payload.(*OpenConversationPayload))
+
+	case ListConversationsAction:
+		err = user.handleListConversationsMessage()
+
+	case FetchHistoryAction:
+		err = user.handleFetchHistoryMessage(frame, payload.(*FetchHistoryPayload))
+
+	case CreateThreadAction:
+		ack.ThreadID, err = user.handleCreateThreadMessage(frame, payload.(*CreateThreadPayload))
+
+	case JoinThreadAction:
+		err = user.handleJoinThreadMessage(frame)
+
+	case LeaveThreadAction:
+		err = user.handleLeaveThreadMessage(frame)
+
+	case SendThreadMessageAction:
+		ack.MessageID, err = user.handleSendThreadMessage(frame, payload.(*TextPayload))
+
+	case ListThreadsAction:
+		err = user.handleListThreadsMessage(frame)
+
+	case SetStatusAction:
+		user.wsServer.presence.setStatus(user, payload.(*SetStatusPayload).Status)
+
+	case TypingStartAction:
+		err = user.handleTypingMessage(frame, true)
+
+	case TypingStopAction:
+		err = user.handleTypingMessage(frame, false)
+
+	case MarkReadAction:
+		err = user.handleMarkReadMessage(frame, payload.(*MarkReadPayload))
+
+	case GetReadPositionsAction:
+		err = user.handleGetReadPositionsMessage(frame)
+
+	case ResumeAction:
+		err = user.handleResumeMessage(payload.(*ResumePayload), first)
+
+	case SetRoleAction:
+		role := payload.(*RolePayload)
+		err = user.wsServer.SetChannelRole(frame.ChannelID, user.UserId, role.UserID, role.Role)
+
+	case GetRolesAction:
+		err = user.handleGetRolesMessage(frame)
+
+	case InviteAction:
+		err = user.handleInviteMessage(frame, payload.(*InvitePayload))
+
+	case PinMessageAction:
+		err = user.handlePinMessage(frame, payload.(*MessagePayload), true)
+
+	case UnpinMessageAction:
+		err = user.handlePinMessage(frame, payload.(*MessagePayload), false)
+
+	case KickAction, BanAction, UnbanAction, UnmuteAction:
+		err = user.handleModerationMessage(frame, payload.(*ModerationPayload))
+
+	case MuteAction:
+		err = user.handleMuteMessage(frame, payload.(*MutePayload))
+
+	case SlowModeAction:
+		err = user.handleSlowModeMessage(frame, payload.(*SlowModePayload))
+
+	case GetAuditLogAction:
+		err = user.handleGetAuditLogMessage(frame, payload.(*GetAuditLogPayload))
+
+	case EditMessageAction:
+		ack.MessageID, err = user.handleEditMessage(frame, payload.(*EditMessagePayload))
+
+	case DeleteMessageAction:
+		ack.MessageID, err = user.handleDeleteMessage(frame, payload.(*MessagePayload))
+
+	case GetEditHistoryAction:
+		err = user.handleGetEditHistoryMessage(frame, payload.(*MessagePayload))
+
+	case AddReactionAction:
+		err = user.handleReactionMessage(frame, payload.(*ReactionPayload), true)
+
+	case RemoveReactionAction:
+		err = user.handleReactionMessage(frame, payload.(*ReactionPayload), false)
+
+	case MuteNotificationsAction:
+		err = user.handleMuteNotificationsMessage(frame, true)
+
+	case UnmuteNotificationsAction:
+		err = user.handleMuteNotificationsMessage(frame, false)
+
+	case GetNotificationSettingsAction:
+		err = user.handleGetNotificationSettingsMessage()
+	}
+
+	if err != nil {
+		frameErr = toFrameError(err, frame.RequestID)
+		user.sendFrame(frameErr.Frame())
+		return frameErr
+	}
+
+	if frame.RequestID != "" {
+		ack.RequestID = frame.RequestID
+		user.sendFrame(newFrame(AckAction, frame.ChannelID, ack))
+	}
+	return nil
+}
+
+// handleSendMessage stamps the message so its ID can be acknowledged, then
+// hands it to the channel for storage and broadcast.
+func (user *User) handleSendMessage(frame *InboundFrame, payload *TextPayload) (string, error) {
+	channel, err := user.visibleChannel(frame.ChannelID)
+	if err != nil {
+		return "", err
+	}
+	if err := channel.checkPost(user.account); err != nil {
+		return "", err
+	}
+
+	message := newUserMessage(SendMessageAction, user.Info(), payload.Text)
+	message.Mentions = channel.mentionsIn(payload.Text)
+	message.stamp()
+	if !channel.post(message) {
+		return "", newFrameError(api_response.ERROR_NOT_EXIST_CHANNEL, "channel %s", frame.ChannelID)
+	}
+	user.wsServer.typing.stop(user, channel, "")
+	return message.ID, nil
+}
+
+func (user *User) HandleJoinChannelMessage(payload *JoinChannelPayload) error {
+	_, err := user.account.joinChannel(payload.Name)
+	return err
+}
 
-	case JoinPrivateChannelAction:
-		user.handleJoinChannelPrivateMessage(msg)
+func (user *User) handleCreateChannelMessage(payload *CreateChannelPayload) (string, error) {
+	channel, err := user.account.createChannel(payload)
+	if err != nil {
+		return "", err
+	}
+	return *channel.GetID(), nil
+}
+
+func (user *User) handleLeaveChannelMessage(frame *InboundFrame) error {
+	channel := user.wsServer.findChannelByID(frame.ChannelID)
+	if channel == nil {
+		return newFrameError(api_response.ERROR_NOT_EXIST_CHANNEL, "channel %s", frame.ChannelID)
 	}
 
+	// Leaving is done on behalf of every session of the account
+	if !user.account.removeChannel(channel) {
+		return newFrameError(api_response.ERROR_NOT_CHANNEL_MEMBER, "channel %s", frame.ChannelID)
+	}
+
+	channel.leave(user.account)
 	return nil
 }
 
-func (user *User) HandleJoinChannelMessage(message *Message) {
-	channelName := message.Message
-	user.joinChannel(channelName, nil)
+// handleFetchHistoryMessage sends the user a page of channel history, or of
+// thread history when the frame names a thread. Private channel history is
+// only available to members.
+func (user *User) handleFetchHistoryMessage(frame *InboundFrame, payload *FetchHistoryPayload) error {
+	channel, err := user.visibleChannel(frame.ChannelID)
+	if err != nil {
+		return err
+	}
+
+	var messages []*Message
+	if frame.ThreadID != "" {
+		if channel.FindThread(frame.ThreadID) == nil {
+			return newFrameError(api_response.ERROR_NOT_EXIST_THREAD, "thread %s", frame.ThreadID)
+		}
+		messages, err = channel.FetchThreadHistory(frame.ThreadID, payload.Before, payload.Limit)
+	} else {
+		messages, err = channel.FetchHistory(payload.Before, payload.Limit)
+	}
+	if err != nil {
+		log.Printf("[ERROR] unable to fetch history of channel %s: %v", frame.ChannelID, err)
+		return err
+	}
+
+	history := newFrame(HistoryAction, frame.ChannelID, NewHistoryPayload(messages))
+	history.ThreadID = frame.ThreadID
+	user.sendFrame(history)
+	return nil
 }
 
-func (user *User) handleLeaveChannelMessage(message *Message) {
-	channel := user.wsServer.findChannelByID(message.Message)
+// visibleChannel returns the channel if the user may read and post in it: it
+// must exist and the user must be in it, not banned from it. Conversations
+// are visible to their participants.
+func (user *User) visibleChannel(channelID string) (*Channel, error) {
+	channel := user.wsServer.findChannelByID(channelID)
 	if channel == nil {
-		return
+		return nil, newFrameError(api_response.ERROR_NOT_EXIST_CHANNEL, "channel %s", channelID)
+	}
+
+	if channel.Direct {
+		if !channel.IsParticipant(user.UserId) {
+			return nil, newFrameError(api_response.ERROR_NOT_CHANNEL_MEMBER, "channel %s", channelID)
+		}
+	} else if channel.IsBanned(user.UserId) {
+		return nil, newFrameError(api_response.ERROR_BANNED, "channel %s", channelID)
+	} else if !user.account.isInChannel(channel) {
+		return nil, newFrameError(api_response.ERROR_NOT_CHANNEL_MEMBER, "channel %s", channelID)
+	}
+	return channel, nil
+}
+
+// memberChannel returns the channel with the given ID if the user is in it
+func (user *User) memberChannel(channelID string) (*Channel, error) {
+	channel := user.wsServer.findChannelByID(channelID)
+	if channel == nil {
+		return nil, newFrameError(api_response.ERROR_NOT_EXIST_CHANNEL, "channel %s", channelID)
+	}
+
+	if !user.account.isInChannel(channel) {
+		return nil, newFrameError(api_response.ERROR_NOT_CHANNEL_MEMBER, "channel %s", channelID)
+	}
+	return channel, nil
+}
+
+/*
+	Sessions
+*/
+
+// handleResumeMessage makes this connection take over a dropped session of
+// the same account: it adopts the session's token and numbering, is sent the
+// frames the client missed, then a resumed frame. Memberships are held by the
+// account, which the dropped session kept alive, so nothing needs rejoining.
+// Only the first frame of a connection may resume a session.
+func (user *User) handleResumeMessage(payload *ResumePayload, first bool) error {
+	if !first {
+		return newFrameError(api_response.ERROR_INVALID_FRAME, "resume must be the first frame of the connection")
+	}
+
+	previous := user.wsServer.sessions.take(payload.SessionToken, user.UserId)
+	if previous == nil {
+		return newFrameError(api_response.ERROR_NOT_EXIST_SESSION, "session %s", payload.SessionToken)
 	}
 
-	if _, ok := user.channels[channel]; ok {
-		delete(user.channels, channel)
+	replayed, gap := user.adopt(previous, payload.LastSeq)
+	previous.release()
+
+	user.sendFrame(newFrame(ResumedAction, "", ResumedPayload{
+		SessionToken: payload.SessionToken,
+		Replayed:     replayed,
+		Gap:          gap,
+	}))
+	return nil
+}
+
+// adopt moves the numbering and replay buffer of a suspended session to this
+// one and queues the frames numbered after lastSeq. Returns how many were
+// queued, and whether any missed frame could not be.
+func (user *User) adopt(previous *User, lastSeq uint64) (replayed int, gap bool) {
+	previous.mu.Lock()
+	defer previous.mu.Unlock()
+	user.mu.Lock()
+	defer user.mu.Unlock()
+
+	// The previous session stops recording deliveries from here on
+	previous.suspended = false
+
+	user.sessionToken = previous.sessionToken
+	user.seq = previous.seq
+	user.replay = previous.replay
+	if user.closed {
+		return 0, false
 	}
 
-	channel.unregister <- user
+	frames, gap := user.replay.since(lastSeq)
+	for _, frame := range frames {
+		select {
+		case user.dataBuffer <- frame:
+			replayed++
+		default:
+			return replayed, true
+		}
+	}
+	return replayed, gap
 }
 
-func (user *User) handleJoinChannelPrivateMessage(message *Message) {
+/*
+	Roles, invitations and pins
+*/
+
+func (user *User) handleGetRolesMessage(frame *InboundFrame) error {
+	channel, err := user.visibleChannel(frame.ChannelID)
+	if err != nil {
+		return err
+	}
 
-	target := user.wsServer.findUserByID(message.Message)
+	user.sendFrame(newFrame(RolesAction, frame.ChannelID, RolesPayload{channel.Roles()}))
+	return nil
+}
 
-	if target == nil {
-		return
+// handleInviteMessage lets another user into a channel, private channels
+// included, see Channel.Invite.
+func (user *User) handleInviteMessage(frame *InboundFrame, payload *InvitePayload) error {
+	channel, err := user.visibleChannel(frame.ChannelID)
+	if err != nil {
+		return err
 	}
 
-	// create unique room name combined to the two IDs
-	channelName := message.Message + user.UserId
+	target, err := user.wsServer.lookupUser(payload.UserID)
+	if err != nil {
+		return err
+	}
+	return channel.Invite(user.Info(), target)
+}
 
-	user.joinChannel(channelName, target)
-	target.joinChannel(channelName, user)
+func (user *User) handlePinMessage(frame *InboundFrame, payload *MessagePayload, pinned bool) error {
+	channel, err := user.visibleChannel(frame.ChannelID)
+	if err != nil {
+		return err
+	}
 
+	return channel.SetPinned(user.Info(), payload.MessageID, pinned)
 }
 
-func (user *User) joinChannel(channelName string, sender *User) {
+/*
+	Moderation
+*/
 
-	channel := user.wsServer.findChannelByName(channelName)
-	if channel == nil {
-		channel = user.wsServer.NewWsChannel(channelName, sender != nil)
+// handleModerationMessage kicks, bans, unbans or unmutes a user, see
+// moderation_logic.go
+func (user *User) handleModerationMessage(frame *InboundFrame, payload *ModerationPayload) error {
+	channel, err := user.visibleChannel(frame.ChannelID)
+	if err != nil {
+		return err
+	}
+	target, err := user.wsServer.lookupUser(payload.UserID)
+	if err != nil {
+		return err
 	}
 
-	if sender == nil && channel.Private {
-		return
+	switch frame.Type {
+	case KickAction:
+		return channel.Kick(user.Info(), target, payload.Reason)
+	case BanAction:
+		return channel.Ban(user.Info(), target, payload.Reason)
+	case UnbanAction:
+		return channel.Unban(user.Info(), target)
+	default:
+		return channel.Unmute(user.Info(), target)
 	}
+}
 
-	if !user.isInChannel(channel) {
+func (user *User) handleMuteMessage(frame *InboundFrame, payload *MutePayload) error {
+	channel, err := user.visibleChannel(frame.ChannelID)
+	if err != nil {
+		return err
+	}
+	target, err := user.wsServer.lookupUser(payload.UserID)
+	if err != nil {
+		return err
+	}
 
-		user.channels[channel] = true
-		channel.register <- user
+	return channel.Mute(user.Info(), target, time.Duration(payload.Duration)*time.Second, payload.Reason)
+}
 
-		user.notifyChannelJoined(channel, sender)
+func (user *User) handleSlowModeMessage(frame *InboundFrame, payload *SlowModePayload) error {
+	channel, err := user.visibleChannel(frame.ChannelID)
+	if err != nil {
+		return err
 	}
 
+	return channel.SetSlowMode(user.Info(), time.Duration(payload.Interval)*time.Second)
 }
 
-func (user *User) isInChannel(channel *Channel) bool {
-	if _, ok := user.channels[channel]; ok {
-		return true
+func (user *User) handleGetAuditLogMessage(frame *InboundFrame, payload *GetAuditLogPayload) error {
+	channel, err := user.visibleChannel(frame.ChannelID)
+	if err != nil {
+		return err
+	}
+	if !channel.Can(user.UserId, PermViewAudit) {
+		return ErrPermissionDenied
+	}
+
+	entries, err := channel.AuditLog(payload.Limit)
+	if err != nil {
+		return err
+	}
+	user.sendFrame(newFrame(AuditLogAction, frame.ChannelID, AuditLogPayload{entries}))
+	return nil
+}
+
+/*
+	Editing, deleting and reacting to messages
+*/
+
+// handleEditMessage replaces the text of a message, see edit_logic.go
+func (user *User) handleEditMessage(frame *InboundFrame, payload *EditMessagePayload) (string, error) {
+	channel, err := user.visibleChannel(frame.ChannelID)
+	if err != nil {
+		return "", err
+	}
+	if err := channel.EditMessage(user.Info(), payload.MessageID, payload.Text); err != nil {
+		return "", err
+	}
+	return payload.MessageID, nil
+}
+
+// handleDeleteMessage leaves a tombstone in place of a message
+func (user *User) handleDeleteMessage(frame *InboundFrame, payload *MessagePayload) (string, error) {
+	channel, err := user.visibleChannel(frame.ChannelID)
+	if err != nil {
+		return "", err
+	}
+	if err := channel.DeleteMessage(user.Info(), payload.MessageID); err != nil {
+		return "", err
+	}
+	return payload.MessageID, nil
+}
+
+func (user *User) handleGetEditHistoryMessage(frame *InboundFrame, payload *MessagePayload) error {
+	channel, err := user.visibleChannel(frame.ChannelID)
+	if err != nil {
+		return err
+	}
+
+	edits, err := channel.EditHistory(payload.MessageID)
+	if err != nil {
+		return err
+	}
+	user.sendFrame(newFrame(EditHistoryAction, frame.ChannelID, EditHistoryPayload{payload.MessageID, edits}))
+	return nil
+}
+
+// handleReactionMessage adds or removes a reaction, see reaction_logic.go
+func (user *User) handleReactionMessage(frame *InboundFrame, payload *ReactionPayload, add bool) error {
+	channel, err := user.visibleChannel(frame.ChannelID)
+	if err != nil {
+		return err
+	}
+
+	return channel.React(user.Info(), payload.MessageID, payload.Emoji, add)
+}
+
+/*
+	Notification settings
+*/
+
+// handleMuteNotificationsMessage stops or resumes mention notifications of a
+// channel for every session of the user
+func (user *User) handleMuteNotificationsMessage(frame *InboundFrame, muted bool) error {
+	if _, err := user.visibleChannel(frame.ChannelID); err != nil {
+		return err
+	}
+	return user.wsServer.SetChannelMuted(user.UserId, frame.ChannelID, muted)
+}
+
+func (user *User) handleGetNotificationSettingsMessage() error {
+	settings, err := user.wsServer.NotificationSettings(user.UserId)
+	if err != nil {
+		return err
+	}
+	user.sendFrame(newFrame(NotificationSettingsAction, "", NotificationSettingsPayload{settings}))
+	return nil
+}
+
+/*
+	Typing indicators and read receipts
+*/
+
+// handleTypingMessage starts or stops the typing indicator of the user in a
+// channel, or in one of its threads when the frame names a thread.
+func (user *User) handleTypingMessage(frame *InboundFrame, typing bool) error {
+	channel, err := user.memberChannel(frame.ChannelID)
+	if err != nil {
+		return err
+	}
+	if frame.ThreadID != "" && channel.FindThread(frame.ThreadID) == nil {
+		return newFrameError(api_response.ERROR_NOT_EXIST_THREAD, "thread %s", frame.ThreadID)
+	}
+
+	if typing {
+		user.wsServer.typing.start(user, channel, frame.ThreadID)
+	} else {
+		user.wsServer.typing.stop(user, channel, frame.ThreadID)
+	}
+	return nil
+}
+
+// handleMarkReadMessage moves the user's read position in a channel forward.
+// Only channel messages have read positions, thread replies do not.
+func (user *User) handleMarkReadMessage(frame *InboundFrame, payload *MarkReadPayload) error {
+	channel, err := user.memberChannel(frame.ChannelID)
+	if err != nil {
+		return err
+	}
+
+	message, err := channel.GetMessage(payload.MessageID)
+	if err != nil {
+		return err
+	}
+	if message == nil || message.ThreadID != "" {
+		return newFrameError(api_response.ERROR_NOT_EXIST_MESSAGE, "message %s", payload.MessageID)
+	}
+
+	_, err = channel.markRead(user, message)
+	return err
+}
+
+// handleGetReadPositionsMessage sends the user the read positions of the
+// channel members, along with the user's own unread count.
+func (user *User) handleGetReadPositionsMessage(frame *InboundFrame) error {
+	channel, err := user.visibleChannel(frame.ChannelID)
+	if err != nil {
+		return err
+	}
+
+	positions, err := channel.ReadPositions()
+	if err != nil {
+		return err
+	}
+	unread, err := channel.UnreadCount(user.UserId)
+	if err != nil {
+		return err
+	}
+
+	user.sendFrame(newFrame(ReadPositionsAction, frame.ChannelID, ReadPositionsPayload{positions, unread}))
+	return nil
+}
+
+/*
+	Threads
+*/
+
+// handleCreateThreadMessage opens a thread on a channel message, makes the
+// user follow it and announces it to the channel.
+func (user *User) handleCreateThreadMessage(frame *InboundFrame, payload *CreateThreadPayload) (string, error) {
+	channel, err := user.visibleChannel(frame.ChannelID)
+	if err != nil {
+		return "", err
+	}
+	if channel.IsArchived() {
+		return "", newFrameError(api_response.ERROR_ARCHIVED_CHANNEL, "channel %s", frame.ChannelID)
+	}
+	if !channel.Can(user.UserId, PermManageThreads) {
+		return "", ErrPermissionDenied
+	}
+
+	parent, err := channel.GetMessage(payload.ParentMessageID)
+	if err != nil {
+		return "", err
+	}
+	if parent == nil || parent.ThreadID != "" {
+		return "", newFrameError(api_response.ERROR_NOT_EXIST_MESSAGE, "message %s", payload.ParentMessageID)
+	}
+
+	thread := channel.CreateThread(parent.ID)
+	user.account.followThread(thread)
+
+	channel.relay(&channelEvent{
+		ParentMessageID: parent.ID,
+		Frame:           FrameMarshal(newFrame(ThreadCreatedAction, frame.ChannelID, thread.Payload())),
+	})
+	return *thread.GetID(), nil
+}
+
+func (user *User) handleJoinThreadMessage(frame *InboundFrame) error {
+	thread, err := user.findThread(frame)
+	if err != nil {
+		return err
+	}
+
+	user.account.followThread(thread)
+	return nil
+}
+
+func (user *User) handleLeaveThreadMessage(frame *InboundFrame) error {
+	thread, err := user.findThread(frame)
+	if err != nil {
+		return err
+	}
+
+	if !user.account.unfollowThread(thread) {
+		return newFrameError(api_response.ERROR_NOT_THREAD_MEMBER, "thread %s", frame.ThreadID)
+	}
+	return nil
+}
+
+// handleSendThreadMessage posts a reply into a thread. Posting makes the user
+// follow the thread.
+func (user *User) handleSendThreadMessage(frame *InboundFrame, payload *TextPayload) (string, error) {
+	thread, err := user.findThread(frame)
+	if err != nil {
+		return "", err
+	}
+	if err := thread.GetParentChannel().checkPost(user.account); err != nil {
+		return "", err
+	}
+	user.account.followThread(thread)
+
+	message := newUserMessage(SendThreadMessageAction, user.Info(), payload.Text)
+	message.ThreadID = frame.ThreadID
+	message.Mentions = thread.GetParentChannel().mentionsIn(payload.Text)
+	message.stamp()
+	if !thread.GetParentChannel().post(message) {
+		return "", newFrameError(api_response.ERROR_NOT_EXIST_CHANNEL, "channel %s", frame.ChannelID)
+	}
+	user.wsServer.typing.stop(user, thread.GetParentChannel(), frame.ThreadID)
+	return message.ID, nil
+}
+
+func (user *User) handleListThreadsMessage(frame *InboundFrame) error {
+	channel, err := user.visibleChannel(frame.ChannelID)
+	if err != nil {
+		return err
+	}
+
+	threads := ThreadsPayload{Threads: []ThreadPayload{}}
+	for _, thread := range channel.ListThreads() {
+		threads.Threads = append(threads.Threads, thread.Payload())
+	}
+
+	user.sendFrame(newFrame(ThreadsAction, frame.ChannelID, threads))
+	return nil
+}
+
+// findThread resolves the thread named by a frame within a channel visible to the user.
+func (user *User) findThread(frame *InboundFrame) (*Thread, error) {
+	channel, err := user.visibleChannel(frame.ChannelID)
+	if err != nil {
+		return nil, err
+	}
+
+	thread := channel.FindThread(frame.ThreadID)
+	if thread == nil {
+		return nil, newFrameError(api_response.ERROR_NOT_EXIST_THREAD, "thread %s", frame.ThreadID)
+	}
+	return thread, nil
+}
+
+/*
+	Direct messages
+*/
+
+// handleOpenConversationMessage opens the conversation between the user and
+// the given users, on any node, and returns its ID. The other participants
+// may be connected to another node or not at all.
+func (user *User) handleOpenConversationMessage(payload *OpenConversationPayload) (string, error) {
+	participants := []SenderInfo{*user.Info()}
+	seen := map[string]bool{user.UserId: true}
+	for _, userID := range payload.UserIDs {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+
+		if account := user.wsServer.findAccountByID(userID); account != nil {
+			participants = append(participants, *account.Info())
+		} else if account, err := auth_service.GetAccount(userID); err == nil {
+			participants = append(participants, SenderInfo{ID: account.ID, Name: account.Username})
+		} else {
+			return "", newFrameError(api_response.ERROR_NOT_EXIST_USER, "user %s", userID)
+		}
+	}
+
+	if len(participants) < 2 {
+		return "", newFrameError(api_response.ERROR_INVALID_PAYLOAD, "user_ids must name another user")
+	}
+	if len(participants) > user.wsServer.maxConversationSize {
+		return "", newFrameError(api_response.ERROR_INVALID_PAYLOAD,
+			"conversations have at most %d participants", user.wsServer.maxConversationSize)
 	}
 
-	return false
+	channel := user.wsServer.openConversation(participants, user.Info())
+
+	user.wsServer.publishEvent(directTopic, &directEvent{
+		Node:         user.wsServer.nodeID,
+		Participants: participants,
+		Sender:       *user.Info(),
+	})
+	return *channel.GetID(), nil
 }
 
-func (user *User) notifyChannelJoined(channel *Channel, sender *User) {
-	message := Message{
-		Action: ChannelJoinedAction,
-		Target: channel,
-		Sender: sender,
+// handleListConversationsMessage sends the user every conversation they take
+// part in with its latest message, the most recently active first.
+func (user *User) handleListConversationsMessage() error {
+	list := []ConversationPayload{}
+	for _, channel := range user.wsServer.conversations.ForParticipant(user.UserId) {
+		messages, err := channel.FetchHistory("", 1)
+		if err != nil {
+			return err
+		}
+
+		conversation := ConversationPayload{ChannelPayload: channel.Payload()}
+		if len(messages) > 0 {
+			conversation.Latest = messages[0].Frame()
+		}
+		list = append(list, conversation)
 	}
 
-	user.dataBuffer <- MessageMarshal(message)
+	// Conversations without messages come last
+	activity := func(conversation ConversationPayload) time.Time {
+		if conversation.Latest == nil {
+			return time.Time{}
+		}
+		return conversation.Latest.Timestamp
+	}
+	sort.SliceStable(list, func(i, j int) bool { return activity(list[i]).After(activity(list[j])) })
+
+	user.sendFrame(newFrame(ConversationsAction, "", ConversationsPayload{list}))
+	return nil
+}
+
+// Info identifies the user on the wire
+func (user *User) Info() *SenderInfo {
+	return &SenderInfo{ID: user.UserId, Name: *user.GetUsername()}
+}
+
+// sendFrame queues a frame for delivery to this user only
+func (user *User) sendFrame(frame *OutboundFrame) {
+	user.send(FrameMarshal(frame))
+}
+
+// send numbers an encoded frame, keeps it for replay and queues it for the
+// write goroutine without ever blocking. It is safe to call from any
+// goroutine. When dataBuffer is full the server's slow consumer policy
+// decides what happens; false is returned whenever the frame was not queued,
+// including after the user disconnected. Frames sent to a suspended session
+// are only kept for replay.
+func (user *User) send(message []byte) bool {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	if user.closed && !user.suspended {
+		return false
+	}
+
+	user.seq++
+	message = withSeq(message, user.seq)
+	user.replay.add(user.seq, message)
+	if user.suspended {
+		return false
+	}
+
+	select {
+	case user.dataBuffer <- message:
+		return true
+	default:
+	}
+
+	metrics := user.wsServer.metrics
+	switch user.wsServer.slowConsumerPolicy {
+	case DropNewestPolicy:
+		metrics.frameDropped()
+		return false
+
+	case DisconnectPolicy:
+		metrics.frameDropped()
+		user.evict()
+		return false
+
+	default:
+		// Make room by discarding the oldest queued frame
+		select {
+		case <-user.dataBuffer:
+			metrics.frameDropped()
+		default:
+		}
+		select {
+		case user.dataBuffer <- message:
+			return true
+		default:
+			metrics.frameDropped()
+			return false
+		}
+	}
+}
+
+// evict disconnects a user that cannot keep up, telling the client to try
+// again later. The read goroutine then fails and runs the usual disconnect.
+func (user *User) evict() {
+	user.evictOnce.Do(func() {
+		user.serverClosed = true
+		user.wsServer.metrics.clientEvicted()
+		log.Printf("[WARN] evicting slow consumer %s", user.UserId)
+
+		go func() {
+			deadline := time.Now().Add(setting.WsServerSetting.MaxWriteWaitTime)
+			closeMessage := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "slow consumer")
+			_ = user.conn.WriteControl(websocket.CloseMessage, closeMessage, deadline)
+			_ = user.conn.Close()
+		}()
+	})
 }
@@ -11,6 +11,7 @@ type CreateChannel_ struct {
 }
 
 type CreateUser_ struct {
+	UserID   string
 	UserName string
 	conn     *websocket.Conn
 	wsServer *logic.WsServer
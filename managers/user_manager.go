@@ -6,5 +6,5 @@ import (
 
 // Create new User using CreateUser_ parameters
 func CreateUser(p CreateUser_) *logic.User {
-	return logic.CreateUser(p.UserName, p.conn, p.wsServer)
+	return logic.CreateUser(p.UserID, p.UserName, p.conn, p.wsServer)
 }
@@ -3,32 +3,26 @@ package jwt
 import (
 	"net/http"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 
 	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/services/auth_service"
 	"wjjmjh/hermes/pkg/util/jwt_"
 )
 
+// ClaimsKey is the gin context key holding the parsed *jwt_.Claims
+const ClaimsKey = "claims"
+
 // JWT is jwt_ middleware
 func JWT() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var code int
 		var data interface{}
 
-		code = api_response.SUCCESS
-		token := c.Query("token")
-		if token == "" {
-			code = api_response.INVALID_PARAMS
-		} else {
-			_, err := jwt_.ParseToken(token)
-			if err != nil {
-				switch err.(*jwt.ValidationError).Errors {
-				case jwt.ValidationErrorExpired:
-					code = api_response.ERROR_AUTH_CHECK_TOKEN_TIMEOUT
-				default:
-					code = api_response.ERROR_AUTH_CHECK_TOKEN_FAIL
-				}
+		claims, code := jwt_.CheckToken(jwt_.TokenFromRequest(c.Request))
+		if code == api_response.SUCCESS {
+			// Tokens of deleted accounts or from before a password change are revoked
+			if _, err := auth_service.Authorize(claims); err != nil {
+				code = api_response.ERROR_AUTH_CHECK_TOKEN_FAIL
 			}
 		}
 
@@ -43,6 +37,7 @@ func JWT() gin.HandlerFunc {
 			return
 		}
 
+		c.Set(ClaimsKey, claims)
 		c.Next()
 	}
 }
@@ -9,4 +9,28 @@ const (
 	ERROR_AUTH_CHECK_TOKEN_TIMEOUT = 20002
 	ERROR_AUTH_TOKEN               = 20003
 	ERROR_AUTH                     = 20004
+	ERROR_EXIST_ACCOUNT            = 20005
+	ERROR_WEAK_PASSWORD            = 20006
+	ERROR_INVALID_USERNAME         = 20007
+
+	ERROR_NOT_EXIST_CHANNEL  = 30001
+	ERROR_EXIST_CHANNEL      = 30002
+	ERROR_NOT_EXIST_USER     = 30003
+	ERROR_NOT_CHANNEL_MEMBER = 30004
+	ERROR_PRIVATE_CHANNEL    = 30005
+	ERROR_NOT_EXIST_MESSAGE  = 30006
+	ERROR_NOT_EXIST_THREAD   = 30007
+	ERROR_NOT_THREAD_MEMBER  = 30008
+	ERROR_NOT_EXIST_SESSION  = 30009
+	ERROR_PERMISSION_DENIED  = 30010
+	ERROR_BANNED             = 30011
+	ERROR_MUTED              = 30012
+	ERROR_SLOW_MODE          = 30013
+	ERROR_ARCHIVED_CHANNEL   = 30014
+
+	ERROR_INVALID_FRAME       = 40001
+	ERROR_UNSUPPORTED_VERSION = 40002
+	ERROR_UNKNOWN_FRAME_TYPE  = 40003
+	ERROR_INVALID_PAYLOAD     = 40004
+	ERROR_RATE_LIMITED        = 40005
 )
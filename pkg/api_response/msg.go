@@ -8,6 +8,28 @@ var MsgFlags = map[int]string{
 	ERROR_AUTH_CHECK_TOKEN_TIMEOUT: "auth check token timeout",
 	ERROR_AUTH_TOKEN:               "error auth token",
 	ERROR_AUTH:                     "error auth",
+	ERROR_EXIST_ACCOUNT:            "account already exists",
+	ERROR_WEAK_PASSWORD:            "password is too short",
+	ERROR_INVALID_USERNAME:         "username is invalid",
+	ERROR_NOT_EXIST_CHANNEL:        "channel does not exist",
+	ERROR_EXIST_CHANNEL:            "channel already exists",
+	ERROR_NOT_EXIST_USER:           "user does not exist",
+	ERROR_NOT_CHANNEL_MEMBER:       "not a member of the channel",
+	ERROR_PRIVATE_CHANNEL:          "channel is private",
+	ERROR_NOT_EXIST_MESSAGE:        "message does not exist",
+	ERROR_NOT_EXIST_THREAD:         "thread does not exist",
+	ERROR_NOT_THREAD_MEMBER:        "not following the thread",
+	ERROR_NOT_EXIST_SESSION:        "session does not exist or expired",
+	ERROR_PERMISSION_DENIED:        "permission denied",
+	ERROR_BANNED:                   "banned from the channel",
+	ERROR_MUTED:                    "muted in the channel",
+	ERROR_SLOW_MODE:                "slow mode is on, wait before posting again",
+	ERROR_ARCHIVED_CHANNEL:         "channel is archived",
+	ERROR_INVALID_FRAME:            "malformed frame",
+	ERROR_UNSUPPORTED_VERSION:      "unsupported protocol version",
+	ERROR_UNKNOWN_FRAME_TYPE:       "unknown frame type",
+	ERROR_INVALID_PAYLOAD:          "invalid frame payload",
+	ERROR_RATE_LIMITED:             "rate limit exceeded",
 }
 
 // GetMsg get error information based on Code
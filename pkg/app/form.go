@@ -0,0 +1,30 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/astaxie/beego/validation"
+	"github.com/gin-gonic/gin"
+
+	"wjjmjh/hermes/pkg/api_response"
+)
+
+// BindAndValid binds and validates data
+func BindAndValid(c *gin.Context, form interface{}) (int, int) {
+	err := c.ShouldBind(form)
+	if err != nil {
+		return http.StatusBadRequest, api_response.INVALID_PARAMS
+	}
+
+	valid := validation.Validation{}
+	check, err := valid.Valid(form)
+	if err != nil {
+		return http.StatusInternalServerError, api_response.ERROR
+	}
+	if !check {
+		MarkErrors(valid.Errors)
+		return http.StatusBadRequest, api_response.INVALID_PARAMS
+	}
+
+	return http.StatusOK, api_response.SUCCESS
+}
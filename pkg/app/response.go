@@ -1,6 +1,9 @@
 package app
 
 import (
+	"encoding/json"
+	"net/http"
+
 	"github.com/gin-gonic/gin"
 
 	"wjjmjh/hermes/pkg/api_response"
@@ -25,3 +28,15 @@ func (g *Gin) Response(httpCode, errCode int, data interface{}) {
 	})
 	return
 }
+
+// WriteResponse writes the Response envelope to a plain http.ResponseWriter,
+// for handlers that run outside of gin such as the websocket upgrade.
+func WriteResponse(w http.ResponseWriter, httpCode, errCode int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(httpCode)
+	_ = json.NewEncoder(w).Encode(Response{
+		Code: errCode,
+		Msg:  api_response.GetMsg(errCode),
+		Data: data,
+	})
+}
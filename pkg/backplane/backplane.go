@@ -0,0 +1,45 @@
+package backplane
+
+import (
+	"errors"
+	"fmt"
+	"wjjmjh/hermes/pkg/setting"
+)
+
+// Backplane types selectable in conf/app.ini
+const (
+	MemoryBackplane = "memory"
+	RedisBackplane  = "redis"
+)
+
+var ErrClosed = errors.New("backplane closed")
+
+// Handler receives the payloads published to a topic. Handlers run on the
+// backplane's delivery goroutine and must not block for long.
+type Handler func(payload []byte)
+
+// Backplane carries events between hermes nodes, so that users connected to
+// different nodes behind a load balancer can reach each other. Delivery is
+// at most once and every subscriber, including the publishing node, receives
+// each payload. Publish must not wait for slow subscribers or servers: it
+// drops payloads instead, and Dropped counts them. Implementations must be
+// safe for concurrent use.
+type Backplane interface {
+	Publish(topic string, payload []byte) error
+	Subscribe(topic string, handler Handler) error
+	Dropped() uint64
+	Close() error
+}
+
+// New returns the backplane selected by config. The redis backplane connects
+// using the [redis] section.
+func New(config *setting.Backplane, redis *setting.Redis) (Backplane, error) {
+	switch config.Type {
+	case "", MemoryBackplane:
+		return NewMemory(), nil
+	case RedisBackplane:
+		return NewRedis(redis.Host, redis.Password, redis.PublishQueue)
+	default:
+		return nil, fmt.Errorf("unknown backplane type %q", config.Type)
+	}
+}
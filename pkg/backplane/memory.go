@@ -0,0 +1,87 @@
+package backplane
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// memoryQueueSize is how many payloads may wait for a slow subscriber before
+// new ones are dropped.
+const memoryQueueSize = 1024
+
+// Memory is an in-process backplane. It connects the servers of a single
+// process, which is all a single node deployment needs.
+type Memory struct {
+	mu          sync.RWMutex
+	subscribers map[string][]*memorySubscriber
+	closed      bool
+	dropped     uint64
+}
+
+// memorySubscriber hands payloads to its handler on its own goroutine, so a
+// publisher never waits for, or deadlocks with, a subscriber.
+type memorySubscriber struct {
+	handler Handler
+	queue   chan []byte
+}
+
+func NewMemory() *Memory {
+	return &Memory{subscribers: make(map[string][]*memorySubscriber)}
+}
+
+func (memory *Memory) Publish(topic string, payload []byte) error {
+	memory.mu.RLock()
+	defer memory.mu.RUnlock()
+	if memory.closed {
+		return ErrClosed
+	}
+
+	for _, subscriber := range memory.subscribers[topic] {
+		select {
+		case subscriber.queue <- payload:
+		default:
+			atomic.AddUint64(&memory.dropped, 1)
+			log.Printf("[WARN] backplane subscriber of %s is full, dropping payload", topic)
+		}
+	}
+	return nil
+}
+
+// Dropped returns how many payloads were dropped for full subscribers
+func (memory *Memory) Dropped() uint64 {
+	return atomic.LoadUint64(&memory.dropped)
+}
+
+func (memory *Memory) Subscribe(topic string, handler Handler) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+	if memory.closed {
+		return ErrClosed
+	}
+
+	subscriber := &memorySubscriber{handler: handler, queue: make(chan []byte, memoryQueueSize)}
+	memory.subscribers[topic] = append(memory.subscribers[topic], subscriber)
+	go func() {
+		for payload := range subscriber.queue {
+			subscriber.handler(payload)
+		}
+	}()
+	return nil
+}
+
+func (memory *Memory) Close() error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+	if memory.closed {
+		return nil
+	}
+
+	memory.closed = true
+	for _, subscribers := range memory.subscribers {
+		for _, subscriber := range subscribers {
+			close(subscriber.queue)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+package backplane
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	redisDialTimeout  = 5 * time.Second
+	redisRetryDelay   = time.Second
+	redisFlushTimeout = time.Second
+)
+
+// DefaultPublishQueue is how many payloads wait to be sent to Redis before new
+// ones are dropped, unless configured otherwise
+const DefaultPublishQueue = 1024
+
+var errNotConnected = errors.New("redis backplane not connected")
+
+// Redis is a backplane on Redis pub/sub, letting several hermes nodes share
+// one Redis server. It keeps one connection for publishing and one for
+// subscriptions, and reconnects either when it breaks.
+//
+// Payloads are published from a queue by a goroutine of their own, so a slow
+// or unreachable Redis never holds up publishers: while Redis cannot be
+// reached, or the queue is full, payloads are dropped and counted.
+type Redis struct {
+	address  string
+	password string
+
+	// Payloads waiting for the publishing goroutine, which closes published
+	// when it returns
+	queue     chan redisPayload
+	published chan struct{}
+	dropped   uint64
+
+	// The publishing connection, only changed by the publishing goroutine.
+	// mu guards it against Close.
+	mu  sync.Mutex
+	pub *redisConn
+
+	// Guards handlers and the subscription connection
+	subMu    sync.Mutex
+	handlers map[string][]Handler
+	sub      *redisConn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type redisPayload struct {
+	topic   string
+	payload []byte
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// NewRedis connects to the Redis server at address, authenticating with
+// password unless it is empty. Up to queueSize payloads wait to be published,
+// DefaultPublishQueue if it is not positive.
+func NewRedis(address string, password string, queueSize int) (*Redis, error) {
+	if queueSize <= 0 {
+		queueSize = DefaultPublishQueue
+	}
+	redis := &Redis{
+		address:   address,
+		password:  password,
+		queue:     make(chan redisPayload, queueSize),
+		published: make(chan struct{}),
+		handlers:  make(map[string][]Handler),
+		closed:    make(chan struct{}),
+	}
+
+	// Fail early when Redis is unreachable
+	pub, err := redis.dial()
+	if err != nil {
+		return nil, err
+	}
+	redis.pub = pub
+
+	go redis.publish()
+	go redis.listen()
+	return redis, nil
+}
+
+func (redis *Redis) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", redis.address, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+
+	if redis.password != "" {
+		if _, err := c.do([]byte("AUTH"), []byte(redis.password)); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do sends a command and waits for its reply
+func (c *redisConn) do(args ...[]byte) (interface{}, error) {
+	if err := writeCommand(c.writer, args...); err != nil {
+		return nil, err
+	}
+	reply, err := readReply(c.reader)
+	if err != nil {
+		return nil, err
+	}
+	if replyErr, ok := reply.(redisError); ok {
+		return nil, replyErr
+	}
+	return reply, nil
+}
+
+// Publish queues payload to be sent on topic, without waiting for Redis. It
+// is dropped if the queue is full.
+func (redis *Redis) Publish(topic string, payload []byte) error {
+	select {
+	case <-redis.closed:
+		return ErrClosed
+	default:
+	}
+
+	select {
+	case redis.queue <- redisPayload{topic, payload}:
+	default:
+		atomic.AddUint64(&redis.dropped, 1)
+	}
+	return nil
+}
+
+// Dropped returns how many payloads were dropped, because the queue was full
+// or Redis could not be reached
+func (redis *Redis) Dropped() uint64 {
+	return atomic.LoadUint64(&redis.dropped)
+}
+
+// publish sends the queued payloads until the backplane is closed, then
+// those still queued while the connection holds. After Redis could not be
+// reached, payloads are dropped for redisRetryDelay before dialling again.
+func (redis *Redis) publish() {
+	defer close(redis.published)
+
+	var retryAt time.Time
+	for {
+		select {
+		case queued := <-redis.queue:
+			if time.Now().Before(retryAt) {
+				atomic.AddUint64(&redis.dropped, 1)
+				continue
+			}
+			err := redis.send(queued, true)
+			if err == nil {
+				if !retryAt.IsZero() {
+					log.Printf("[INFO] redis backplane publishing again")
+					retryAt = time.Time{}
+				}
+				continue
+			}
+
+			atomic.AddUint64(&redis.dropped, 1)
+			if _, ok := err.(redisError); ok {
+				log.Printf("[WARN] redis backplane refused a payload of %s: %v", queued.topic, err)
+				continue
+			}
+			if retryAt.IsZero() {
+				log.Printf("[WARN] redis backplane unreachable, dropping payloads: %v", err)
+			}
+			retryAt = time.Now().Add(redisRetryDelay)
+
+		case <-redis.closed:
+			redis.flush()
+			return
+		}
+	}
+}
+
+// flush sends the payloads still queued on the open connection, if any, and
+// drops them once it fails
+func (redis *Redis) flush() {
+	for {
+		select {
+		case queued := <-redis.queue:
+			if redis.send(queued, false) != nil {
+				atomic.AddUint64(&redis.dropped, 1)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// send publishes a payload, reconnecting once if the connection broke.
+// Unless redial is set, or once closed, a connection that is down stays down.
+func (redis *Redis) send(queued redisPayload, redial bool) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if redis.pub == nil {
+			select {
+			case <-redis.closed:
+				redial = false
+			default:
+			}
+			if !redial {
+				return errNotConnected
+			}
+			pub, err := redis.dial()
+			if err != nil {
+				return err
+			}
+			redis.setPub(pub)
+		}
+
+		if _, err = redis.pub.do([]byte("PUBLISH"), []byte(queued.topic), queued.payload); err == nil {
+			return nil
+		}
+		if _, ok := err.(redisError); ok {
+			return err
+		}
+		_ = redis.pub.conn.Close()
+		redis.setPub(nil)
+	}
+	return err
+}
+
+func (redis *Redis) setPub(pub *redisConn) {
+	redis.mu.Lock()
+	defer redis.mu.Unlock()
+	redis.pub = pub
+}
+
+// Subscribe registers handler for topic. Topics are subscribed again
+// whenever the subscription connection is re-established.
+func (redis *Redis) Subscribe(topic string, handler Handler) error {
+	redis.subMu.Lock()
+	defer redis.subMu.Unlock()
+
+	select {
+	case <-redis.closed:
+		return ErrClosed
+	default:
+	}
+
+	_, subscribed := redis.handlers[topic]
+	redis.handlers[topic] = append(redis.handlers[topic], handler)
+	if subscribed || redis.sub == nil {
+		return nil
+	}
+
+	// The reply arrives on the listen goroutine, which ignores it
+	return writeCommand(redis.sub.writer, []byte("SUBSCRIBE"), []byte(topic))
+}
+
+// listen keeps the subscription connection open and dispatches messages to
+// the handlers of their topic until the backplane is closed.
+func (redis *Redis) listen() {
+	for {
+		sub, err := redis.dial()
+		if err == nil {
+			err = redis.resubscribe(sub)
+		}
+		if err == nil {
+			err = redis.receive(sub)
+		}
+
+		select {
+		case <-redis.closed:
+			return
+		default:
+		}
+
+		log.Printf("[WARN] redis backplane subscription lost, retrying: %v", err)
+		time.Sleep(redisRetryDelay)
+	}
+}
+
+// resubscribe subscribes sub to every topic with handlers, and makes it the
+// connection later subscriptions are sent on.
+func (redis *Redis) resubscribe(sub *redisConn) error {
+	redis.subMu.Lock()
+	defer redis.subMu.Unlock()
+
+	select {
+	case <-redis.closed:
+		_ = sub.conn.Close()
+		return ErrClosed
+	default:
+	}
+
+	if len(redis.handlers) > 0 {
+		args := [][]byte{[]byte("SUBSCRIBE")}
+		for topic := range redis.handlers {
+			args = append(args, []byte(topic))
+		}
+		if err := writeCommand(sub.writer, args...); err != nil {
+			_ = sub.conn.Close()
+			return err
+		}
+	}
+	redis.sub = sub
+	return nil
+}
+
+func (redis *Redis) receive(sub *redisConn) error {
+	defer func() {
+		redis.subMu.Lock()
+		if redis.sub == sub {
+			redis.sub = nil
+		}
+		redis.subMu.Unlock()
+		_ = sub.conn.Close()
+	}()
+
+	for {
+		reply, err := readReply(sub.reader)
+		if err != nil {
+			return err
+		}
+
+		// Pushed messages are ["message", topic, payload]; subscription
+		// confirmations are skipped
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 3 {
+			continue
+		}
+		kind, _ := items[0].([]byte)
+		topic, _ := items[1].([]byte)
+		payload, _ := items[2].([]byte)
+		if string(kind) != "message" {
+			continue
+		}
+
+		redis.subMu.Lock()
+		handlers := redis.handlers[string(topic)]
+		redis.subMu.Unlock()
+		for _, handler := range handlers {
+			handler(payload)
+		}
+	}
+}
+
+// Close stops the backplane. Queued payloads are still published if Redis
+// answers within redisFlushTimeout, and dropped otherwise.
+func (redis *Redis) Close() error {
+	redis.closeOnce.Do(func() {
+		close(redis.closed)
+
+		select {
+		case <-redis.published:
+		case <-time.After(redisFlushTimeout):
+			// Unblock the publishing goroutine
+			redis.mu.Lock()
+			if redis.pub != nil {
+				_ = redis.pub.conn.Close()
+			}
+			redis.mu.Unlock()
+			<-redis.published
+		}
+
+		redis.mu.Lock()
+		if redis.pub != nil {
+			_ = redis.pub.conn.Close()
+			redis.pub = nil
+		}
+		redis.mu.Unlock()
+
+		redis.subMu.Lock()
+		if redis.sub != nil {
+			_ = redis.sub.conn.Close()
+		}
+		redis.subMu.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,450 @@
+package backplane
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+	RESP framing
+*/
+
+func TestWriteCommand(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := writeCommand(w, []byte("PUBLISH"), []byte("topic"), []byte("a\r\nb")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "*3\r\n$7\r\nPUBLISH\r\n$5\r\ntopic\r\n$4\r\na\r\nb\r\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+
+	// Commands read back as arrays of bulk strings
+	reply, err := readReply(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := reply.([]interface{})
+	if string(got[0].([]byte)) != "PUBLISH" || string(got[2].([]byte)) != "a\r\nb" {
+		t.Fatalf("unexpected round trip %q", got)
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  interface{}
+	}{
+		{"simple string", "+OK\r\n", "OK"},
+		{"error", "-ERR wrong\r\n", redisError("ERR wrong")},
+		{"integer", ":42\r\n", int64(42)},
+		{"bulk string", "$5\r\nhello\r\n", []byte("hello")},
+		{"empty bulk string", "$0\r\n\r\n", []byte{}},
+		{"null bulk string", "$-1\r\n", nil},
+		{"null array", "*-1\r\n", nil},
+		{"nested array", "*2\r\n:1\r\n*1\r\n$1\r\nx\r\n", []interface{}{int64(1), []interface{}{[]byte("x")}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readReply(bufio.NewReader(strings.NewReader(test.input)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.want == nil {
+				if got != nil && !reflect.ValueOf(got).IsNil() {
+					t.Fatalf("got %#v, want nil", got)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadReplyMalformed(t *testing.T) {
+	for _, input := range []string{"\r\n", "?what\r\n", "+OK\n", "$x\r\n", "*y\r\n", "$5\r\nhel"} {
+		if _, err := readReply(bufio.NewReader(strings.NewReader(input))); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+/*
+	Redis backplane against a stand-in server
+*/
+
+// fakeRedis is just enough of a Redis server for pub/sub: AUTH, PUBLISH and
+// SUBSCRIBE. dropAll cuts every client connection, like a restarting server.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu    sync.Mutex
+	conns map[*fakeConn]bool
+	subs  map[string]map[*fakeConn]bool
+}
+
+type fakeConn struct {
+	conn net.Conn
+
+	// Serialises replies and pushed messages
+	mu sync.Mutex
+}
+
+func (c *fakeConn) write(format string, a ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, _ = fmt.Fprintf(c.conn, format, a...)
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeRedis{
+		listener: listener,
+		password: password,
+		conns:    make(map[*fakeConn]bool),
+		subs:     make(map[string]map[*fakeConn]bool),
+	}
+	go fake.accept()
+	t.Cleanup(func() {
+		_ = listener.Close()
+		fake.dropAll()
+	})
+	return fake
+}
+
+func (fake *fakeRedis) addr() string {
+	return fake.listener.Addr().String()
+}
+
+func (fake *fakeRedis) accept() {
+	for {
+		conn, err := fake.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &fakeConn{conn: conn}
+		fake.mu.Lock()
+		fake.conns[c] = true
+		fake.mu.Unlock()
+		go fake.serve(c)
+	}
+}
+
+func (fake *fakeRedis) serve(c *fakeConn) {
+	defer fake.forget(c)
+
+	reader := bufio.NewReader(c.conn)
+	authed := fake.password == ""
+	for {
+		reply, err := readReply(reader)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]interface{})
+		if len(items) == 0 {
+			return
+		}
+		args := make([]string, len(items))
+		for i, item := range items {
+			b, _ := item.([]byte)
+			args[i] = string(b)
+		}
+
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			if len(args) == 2 && args[1] == fake.password {
+				authed = true
+				c.write("+OK\r\n")
+			} else {
+				c.write("-ERR invalid password\r\n")
+			}
+
+		case !authed:
+			c.write("-NOAUTH Authentication required.\r\n")
+
+		case cmd == "PUBLISH" && len(args) == 3:
+			c.write(":%d\r\n", fake.publish(args[1], args[2]))
+
+		case cmd == "SUBSCRIBE":
+			for i, topic := range args[1:] {
+				fake.mu.Lock()
+				if fake.subs[topic] == nil {
+					fake.subs[topic] = make(map[*fakeConn]bool)
+				}
+				fake.subs[topic][c] = true
+				fake.mu.Unlock()
+				c.write("*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:%d\r\n", len(topic), topic, i+1)
+			}
+
+		default:
+			c.write("-ERR unknown command\r\n")
+		}
+	}
+}
+
+// publish pushes payload to the subscribers of topic and returns how many
+// there were
+func (fake *fakeRedis) publish(topic string, payload string) int {
+	fake.mu.Lock()
+	subscribers := make([]*fakeConn, 0, len(fake.subs[topic]))
+	for c := range fake.subs[topic] {
+		subscribers = append(subscribers, c)
+	}
+	fake.mu.Unlock()
+
+	for _, c := range subscribers {
+		c.write("*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(topic), topic, len(payload), payload)
+	}
+	return len(subscribers)
+}
+
+func (fake *fakeRedis) forget(c *fakeConn) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	delete(fake.conns, c)
+	for _, subscribers := range fake.subs {
+		delete(subscribers, c)
+	}
+	_ = c.conn.Close()
+}
+
+// dropAll closes every client connection
+func (fake *fakeRedis) dropAll() {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for c := range fake.conns {
+		_ = c.conn.Close()
+	}
+}
+
+func (fake *fakeRedis) connCount() int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return len(fake.conns)
+}
+
+func (fake *fakeRedis) subscriberCount(topic string) int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return len(fake.subs[topic])
+}
+
+// eventually fails the test unless condition holds within a few seconds
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// receiver collects the payloads a handler is given
+func receiver() (Handler, <-chan string) {
+	received := make(chan string, 16)
+	return func(payload []byte) { received <- string(payload) }, received
+}
+
+func expectPayload(t *testing.T, received <-chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-received:
+		if got != want {
+			t.Fatalf("got payload %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("payload %q never arrived", want)
+	}
+}
+
+func TestRedisPublishSubscribe(t *testing.T) {
+	fake := newFakeRedis(t, "secret")
+	redis, err := NewRedis(fake.addr(), "secret", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer redis.Close()
+
+	handler, received := receiver()
+	if err := redis.Subscribe("topic", handler); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the subscription", func() bool { return fake.subscriberCount("topic") == 1 })
+
+	if err := redis.Publish("topic", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	expectPayload(t, received, "hello")
+}
+
+func TestRedisWrongPassword(t *testing.T) {
+	fake := newFakeRedis(t, "secret")
+	if _, err := NewRedis(fake.addr(), "wrong", 0); err == nil {
+		t.Fatal("expected the wrong password to be refused")
+	}
+}
+
+func TestRedisResubscribeAfterConnectionLoss(t *testing.T) {
+	fake := newFakeRedis(t, "")
+	redis, err := NewRedis(fake.addr(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer redis.Close()
+
+	handler, received := receiver()
+	if err := redis.Subscribe("topic", handler); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the subscription", func() bool { return fake.subscriberCount("topic") == 1 })
+
+	fake.dropAll()
+	eventually(t, "the subscription to be lost", func() bool { return fake.subscriberCount("topic") == 0 })
+	eventually(t, "the subscription to be restored", func() bool { return fake.subscriberCount("topic") == 1 })
+
+	if err := redis.Publish("topic", []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	expectPayload(t, received, "after")
+}
+
+func TestRedisPublishRetriesOnBrokenConnection(t *testing.T) {
+	fake := newFakeRedis(t, "")
+	redis, err := NewRedis(fake.addr(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer redis.Close()
+
+	handler, received := receiver()
+	if err := redis.Subscribe("topic", handler); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the subscription", func() bool { return fake.subscriberCount("topic") == 1 })
+
+	// Break the publishing connection without the client noticing: the next
+	// publish fails to write or read, reconnects and is sent again
+	fake.dropAll()
+	eventually(t, "the subscription to be lost", func() bool { return fake.subscriberCount("topic") == 0 })
+	eventually(t, "the subscription to be restored", func() bool { return fake.subscriberCount("topic") == 1 })
+
+	if err := redis.Publish("topic", []byte("retried")); err != nil {
+		t.Fatal(err)
+	}
+	expectPayload(t, received, "retried")
+	if n := redis.Dropped(); n != 0 {
+		t.Fatalf("%d payloads dropped, want the publish retried", n)
+	}
+}
+
+func TestRedisPublishDoesNotWaitForStalledServer(t *testing.T) {
+	// A server that accepts connections but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var conns []net.Conn
+	var mu sync.Mutex
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+
+	redis, err := NewRedis(listener.Addr().String(), "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := redis.Publish("topic", []byte("stalled")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("publishing took %v", elapsed)
+	}
+	// One payload is being sent and one is queued
+	if n := redis.Dropped(); n < 8 {
+		t.Fatalf("%d payloads dropped, want at least 8", n)
+	}
+
+	closed := make(chan error)
+	go func() { closed <- redis.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(redisFlushTimeout + 5*time.Second):
+		t.Fatal("Close waited for the stalled server")
+	}
+}
+
+func TestRedisCloseDuringListen(t *testing.T) {
+	fake := newFakeRedis(t, "")
+	redis, err := NewRedis(fake.addr(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, _ := receiver()
+	if err := redis.Subscribe("topic", handler); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the subscription", func() bool { return fake.subscriberCount("topic") == 1 })
+
+	// listen is blocked reading the subscription connection
+	if err := redis.Close(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the connections to close", func() bool { return fake.connCount() == 0 })
+
+	// listen must not reconnect once closed
+	time.Sleep(redisRetryDelay + 200*time.Millisecond)
+	if n := fake.connCount(); n != 0 {
+		t.Fatalf("%d connections reopened after Close", n)
+	}
+
+	if err := redis.Publish("topic", []byte("late")); err != ErrClosed {
+		t.Fatalf("Publish after Close: got %v, want ErrClosed", err)
+	}
+	if err := redis.Subscribe("other", handler); err != ErrClosed {
+		t.Fatalf("Subscribe after Close: got %v, want ErrClosed", err)
+	}
+	if err := redis.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
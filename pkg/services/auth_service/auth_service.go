@@ -1,5 +1,41 @@
 package auth_service
 
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"wjjmjh/hermes/pkg/util/encryption"
+	"wjjmjh/hermes/pkg/util/jwt_"
+)
+
+// DefaultRole is granted to every newly registered account
+const DefaultRole = "user"
+
+// MinPasswordLength is the shortest password Register and ChangePassword accept
+const MinPasswordLength = 8
+
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrInvalidUsername    = errors.New("username must not be empty")
+	ErrWeakPassword       = errors.New("password is too short")
+	ErrTokenRevoked       = errors.New("token has been revoked")
+)
+
+// store backs every function in this package, see SetStore
+var store UserStore = NewMemoryStore()
+
+// dummyHash is compared against when a username is unknown, so failed logins
+// take the same time whether or not the account exists.
+var dummyHash, _ = encryption.HashPassword("hermes-dummy-password")
+
+// SetStore replaces the UserStore used by the auth service
+func SetStore(s UserStore) {
+	store = s
+}
+
 type Auth struct {
 	Username string
 	Password string
@@ -7,10 +43,139 @@ type Auth struct {
 
 // CheckAuth checks if authentication information exists
 func CheckAuth(username, password string) (bool, error) {
-	// todo
-	return false, nil
+	_, err := authenticate(username, password)
+	if err == ErrInvalidCredentials {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 func (a *Auth) Check() (bool, error) {
 	return CheckAuth(a.Username, a.Password)
 }
+
+// Register creates a new account with a salted password hash
+func Register(username, password string) (*Account, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, ErrInvalidUsername
+	}
+	if len(password) < MinPasswordLength {
+		return nil, ErrWeakPassword
+	}
+
+	hash, err := encryption.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	account := &Account{
+		ID:           uuid.New().String(),
+		Username:     username,
+		PasswordHash: hash,
+		Roles:        []string{DefaultRole},
+		CreatedAt:    time.Now(),
+	}
+	if err := store.Create(account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// Login checks the credentials and issues a token carrying the account ID and roles
+func Login(username, password string) (string, *Account, error) {
+	account, err := authenticate(username, password)
+	if err != nil {
+		return "", nil, err
+	}
+
+	token, err := jwt_.GenerateToken(account.ID, account.Roles, account.TokenGeneration)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, account, nil
+}
+
+// Authorize returns the account a token was issued to. Tokens of deleted
+// accounts and tokens issued before the last password change are rejected.
+func Authorize(claims *jwt_.Claims) (*Account, error) {
+	account, err := store.GetByID(claims.Subject)
+	if err == ErrAccountNotFound {
+		return nil, ErrTokenRevoked
+	}
+	if err != nil {
+		return nil, err
+	}
+	if claims.Generation != account.TokenGeneration {
+		return nil, ErrTokenRevoked
+	}
+	return account, nil
+}
+
+// ChangePassword replaces the password of account id after checking the old
+// one. Every token issued so far is revoked and a fresh one is returned.
+func ChangePassword(id, oldPassword, newPassword string) (string, error) {
+	account, err := store.GetByID(id)
+	if err != nil {
+		return "", err
+	}
+	if !encryption.ComparePassword(account.PasswordHash, oldPassword) {
+		return "", ErrInvalidCredentials
+	}
+	if len(newPassword) < MinPasswordLength {
+		return "", ErrWeakPassword
+	}
+
+	hash, err := encryption.HashPassword(newPassword)
+	if err != nil {
+		return "", err
+	}
+	account.PasswordHash = hash
+	account.TokenGeneration++
+	if err := store.Update(account); err != nil {
+		return "", err
+	}
+	return jwt_.GenerateToken(account.ID, account.Roles, account.TokenGeneration)
+}
+
+// DeleteAccount removes account id after confirming its password
+func DeleteAccount(id, password string) error {
+	account, err := store.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if !encryption.ComparePassword(account.PasswordHash, password) {
+		return ErrInvalidCredentials
+	}
+	return store.Delete(id)
+}
+
+// GetAccount looks an account up by its ID
+func GetAccount(id string) (*Account, error) {
+	return store.GetByID(id)
+}
+
+// GetAccountByUsername looks an account up by its username, ignoring case
+func GetAccountByUsername(username string) (*Account, error) {
+	return store.GetByUsername(username)
+}
+
+// authenticate returns the account matching username and password
+func authenticate(username, password string) (*Account, error) {
+	account, err := store.GetByUsername(username)
+	if err == ErrAccountNotFound {
+		encryption.ComparePassword(dummyHash, password)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !encryption.ComparePassword(account.PasswordHash, password) {
+		return nil, ErrInvalidCredentials
+	}
+	return account, nil
+}
@@ -0,0 +1,188 @@
+package auth_service
+
+import (
+	"testing"
+
+	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/setting"
+	"wjjmjh/hermes/pkg/util/jwt_"
+)
+
+// useTestStore gives the test a fresh MemoryStore and signing secret
+func useTestStore(t *testing.T) {
+	t.Helper()
+	setting.AppSetting.JwtSecret = "test-secret"
+	jwt_.Setup()
+
+	previous := store
+	SetStore(NewMemoryStore())
+	t.Cleanup(func() { SetStore(previous) })
+}
+
+// authorize parses token and authorizes it against the store
+func authorize(t *testing.T, token string) error {
+	t.Helper()
+	claims, code := jwt_.CheckToken(token)
+	if code != api_response.SUCCESS {
+		t.Fatalf("token rejected with code %d", code)
+	}
+	_, err := Authorize(claims)
+	return err
+}
+
+func TestRegister(t *testing.T) {
+	useTestStore(t)
+	if _, err := Register("alice", "correct-horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     error
+	}{
+		{"valid", "bob", "correct-horse", nil},
+		{"blank username", "   ", "correct-horse", ErrInvalidUsername},
+		{"short password", "carol", "short", ErrWeakPassword},
+		{"taken username", "alice", "correct-horse", ErrUsernameTaken},
+		{"taken ignoring case", " ALICE ", "correct-horse", ErrUsernameTaken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			account, err := Register(tt.username, tt.password)
+			if err != tt.want {
+				t.Fatalf("Register = %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			if account.PasswordHash == tt.password {
+				t.Fatal("password stored in plain text")
+			}
+			if len(account.Roles) != 1 || account.Roles[0] != DefaultRole {
+				t.Fatalf("roles = %v, want [%s]", account.Roles, DefaultRole)
+			}
+		})
+	}
+}
+
+func TestLogin(t *testing.T) {
+	useTestStore(t)
+	registered, err := Register("alice", "correct-horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     error
+	}{
+		{"valid", "alice", "correct-horse", nil},
+		{"username ignores case", "Alice", "correct-horse", nil},
+		{"wrong password", "alice", "wrong-horse", ErrInvalidCredentials},
+		{"unknown username", "mallory", "correct-horse", ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, account, err := Login(tt.username, tt.password)
+			if err != tt.want {
+				t.Fatalf("Login = %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			if account.ID != registered.ID {
+				t.Fatalf("logged into %s, want %s", account.ID, registered.ID)
+			}
+			if err := authorize(t, token); err != nil {
+				t.Fatalf("fresh token rejected: %v", err)
+			}
+		})
+	}
+
+	if ok, err := CheckAuth("alice", "wrong-horse"); ok || err != nil {
+		t.Fatalf("CheckAuth with a wrong password = %v, %v", ok, err)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	useTestStore(t)
+	account, err := Register("alice", "correct-horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, _, err := Login("alice", "correct-horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ChangePassword(account.ID, "wrong-horse", "battery-staple"); err != ErrInvalidCredentials {
+		t.Fatalf("wrong old password = %v, want %v", err, ErrInvalidCredentials)
+	}
+	if _, err := ChangePassword(account.ID, "correct-horse", "short"); err != ErrWeakPassword {
+		t.Fatalf("short new password = %v, want %v", err, ErrWeakPassword)
+	}
+	if _, err := ChangePassword("missing", "correct-horse", "battery-staple"); err != ErrAccountNotFound {
+		t.Fatalf("unknown account = %v, want %v", err, ErrAccountNotFound)
+	}
+	if err := authorize(t, oldToken); err != nil {
+		t.Fatalf("failed changes revoked the token: %v", err)
+	}
+
+	newToken, err := ChangePassword(account.ID, "correct-horse", "battery-staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authorize(t, oldToken); err != ErrTokenRevoked {
+		t.Fatalf("token from before the change = %v, want %v", err, ErrTokenRevoked)
+	}
+	if err := authorize(t, newToken); err != nil {
+		t.Fatalf("token returned by the change rejected: %v", err)
+	}
+	if _, _, err := Login("alice", "correct-horse"); err != ErrInvalidCredentials {
+		t.Fatalf("login with the old password = %v, want %v", err, ErrInvalidCredentials)
+	}
+	loginToken, _, err := Login("alice", "battery-staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authorize(t, loginToken); err != nil {
+		t.Fatalf("token from a later login rejected: %v", err)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	useTestStore(t)
+	account, err := Register("alice", "correct-horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := Login("alice", "correct-horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteAccount(account.ID, "wrong-horse"); err != ErrInvalidCredentials {
+		t.Fatalf("wrong password = %v, want %v", err, ErrInvalidCredentials)
+	}
+	if err := DeleteAccount(account.ID, "correct-horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteAccount(account.ID, "correct-horse"); err != ErrAccountNotFound {
+		t.Fatalf("second delete = %v, want %v", err, ErrAccountNotFound)
+	}
+	if err := authorize(t, token); err != ErrTokenRevoked {
+		t.Fatalf("token of a deleted account = %v, want %v", err, ErrTokenRevoked)
+	}
+
+	// The username is free again, and the old token does not carry over
+	if _, err := Register("alice", "battery-staple"); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorize(t, token); err != ErrTokenRevoked {
+		t.Fatalf("token of a deleted account after re-registering = %v, want %v", err, ErrTokenRevoked)
+	}
+}
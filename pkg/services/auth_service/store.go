@@ -0,0 +1,134 @@
+package auth_service
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAccountNotFound = errors.New("account not found")
+	ErrUsernameTaken   = errors.New("username already taken")
+)
+
+// Account is a registered user. PasswordHash is never handed to clients.
+// TokenGeneration is bumped whenever the tokens issued so far must stop working.
+type Account struct {
+	ID              string
+	Username        string
+	PasswordHash    string
+	Roles           []string
+	TokenGeneration int
+	CreatedAt       time.Time
+}
+
+// UserStore persists accounts. Implementations must be safe for concurrent use
+// and must hand out copies, so callers cannot mutate stored accounts in place.
+type UserStore interface {
+	Create(account *Account) error
+	GetByID(id string) (*Account, error)
+	GetByUsername(username string) (*Account, error)
+	Update(account *Account) error
+	Delete(id string) error
+}
+
+// MemoryStore is a UserStore kept entirely in memory
+type MemoryStore struct {
+	mu         sync.RWMutex
+	byID       map[string]*Account
+	byUsername map[string]string
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		byID:       make(map[string]*Account),
+		byUsername: make(map[string]string),
+	}
+}
+
+// normaliseUsername makes username lookups case-insensitive
+func normaliseUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// copyAccount returns a copy that shares no mutable state with account
+func copyAccount(account *Account) *Account {
+	c := *account
+	c.Roles = append([]string(nil), account.Roles...)
+	return &c
+}
+
+func (s *MemoryStore) Create(account *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := normaliseUsername(account.Username)
+	if _, ok := s.byUsername[key]; ok {
+		return ErrUsernameTaken
+	}
+
+	s.byID[account.ID] = copyAccount(account)
+	s.byUsername[key] = account.ID
+	return nil
+}
+
+func (s *MemoryStore) GetByID(id string) (*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	account, ok := s.byID[id]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	return copyAccount(account), nil
+}
+
+func (s *MemoryStore) GetByUsername(username string) (*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, ok := s.byUsername[normaliseUsername(username)]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	return copyAccount(s.byID[id]), nil
+}
+
+func (s *MemoryStore) Update(account *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.byID[account.ID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+
+	oldKey := normaliseUsername(existing.Username)
+	newKey := normaliseUsername(account.Username)
+	if oldKey != newKey {
+		if _, taken := s.byUsername[newKey]; taken {
+			return ErrUsernameTaken
+		}
+		delete(s.byUsername, oldKey)
+		s.byUsername[newKey] = account.ID
+	}
+
+	s.byID[account.ID] = copyAccount(account)
+	return nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok := s.byID[id]
+	if !ok {
+		return ErrAccountNotFound
+	}
+
+	delete(s.byUsername, normaliseUsername(account.Username))
+	delete(s.byID, id)
+	return nil
+}
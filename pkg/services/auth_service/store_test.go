@@ -0,0 +1,63 @@
+package auth_service
+
+import "testing"
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	alice := &Account{ID: "a", Username: "Alice", Roles: []string{"user"}}
+	if err := s.Create(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Create(&Account{ID: "b", Username: "alice "}); err != ErrUsernameTaken {
+		t.Fatalf("duplicate username = %v, want %v", err, ErrUsernameTaken)
+	}
+	if err := s.Create(&Account{ID: "b", Username: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Callers get copies and cannot mutate stored accounts in place
+	alice.Roles[0] = "admin"
+	got, err := s.GetByUsername("ALICE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != "a" || got.Roles[0] != "user" {
+		t.Fatalf("GetByUsername = %+v", got)
+	}
+	got.Roles[0] = "admin"
+	if again, _ := s.GetByID("a"); again.Roles[0] != "user" {
+		t.Fatalf("stored roles changed through a returned copy: %v", again.Roles)
+	}
+
+	// Renaming moves the username index and refuses taken names
+	got.Username = "bob"
+	if err := s.Update(got); err != ErrUsernameTaken {
+		t.Fatalf("rename onto a taken username = %v, want %v", err, ErrUsernameTaken)
+	}
+	got.Username = "carol"
+	if err := s.Update(got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetByUsername("alice"); err != ErrAccountNotFound {
+		t.Fatalf("old username = %v, want %v", err, ErrAccountNotFound)
+	}
+	if renamed, err := s.GetByUsername("carol"); err != nil || renamed.ID != "a" {
+		t.Fatalf("new username = %+v, %v", renamed, err)
+	}
+	if err := s.Update(&Account{ID: "missing", Username: "dave"}); err != ErrAccountNotFound {
+		t.Fatalf("update of a missing account = %v, want %v", err, ErrAccountNotFound)
+	}
+
+	if err := s.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetByID("a"); err != ErrAccountNotFound {
+		t.Fatalf("deleted account = %v, want %v", err, ErrAccountNotFound)
+	}
+	if _, err := s.GetByUsername("carol"); err != ErrAccountNotFound {
+		t.Fatalf("username of a deleted account = %v, want %v", err, ErrAccountNotFound)
+	}
+	if err := s.Delete("a"); err != ErrAccountNotFound {
+		t.Fatalf("second delete = %v, want %v", err, ErrAccountNotFound)
+	}
+}
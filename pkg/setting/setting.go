@@ -51,25 +51,61 @@ type MongoDB struct {
 var MongoDBDatabaseSetting = &MongoDB{}
 
 type Redis struct {
-	Host        string
-	Password    string
-	MaxIdle     int
-	MaxActive   int
-	IdleTimeout time.Duration
+	Host         string
+	Password     string
+	PublishQueue int
 }
 
 var RedisSetting = &Redis{}
 
 type WsServer struct {
-	Port             string
-	Ping             time.Duration
-	Pong             time.Duration
-	MaxWriteWaitTime time.Duration
-	MaxMessageSize   int64
+	Port                  string
+	Ping                  time.Duration
+	Pong                  time.Duration
+	MaxWriteWaitTime      time.Duration
+	MaxMessageSize        int64
+	BufferSize            int
+	SlowConsumerPolicy    string
+	ShutdownTimeout       time.Duration
+	ReconnectDelay        time.Duration
+	PresenceDebounce      time.Duration
+	PresenceRetention     time.Duration
+	ResumeWindow          time.Duration
+	ReplayBufferSize      int
+	MaxConversationSize   int
+	ImplicitChannelCreate bool
+	ChannelTTL            time.Duration
 }
 
 var WsServerSetting = &WsServer{}
 
+type RateLimit struct {
+	FramesPerSecond         int
+	MessagesPerSecond       int
+	JoinsPerMinute          int
+	ChannelCreationsPerHour int
+	MuteAfter               int
+	MuteDuration            time.Duration
+	DisconnectAfter         int
+	ViolationWindow         time.Duration
+}
+
+var RateLimitSetting = &RateLimit{}
+
+type Storage struct {
+	Type         string
+	Path         string
+	SyncInterval time.Duration
+}
+
+var StorageSetting = &Storage{}
+
+type Backplane struct {
+	Type string
+}
+
+var BackplaneSetting = &Backplane{}
+
 var cfg *ini.File
 
 // Setup initialize the configuration instance
@@ -86,14 +122,26 @@ func Setup() {
 	mapTo("mongodb", MongoDBDatabaseSetting)
 	mapTo("redis", RedisSetting)
 	mapTo("wsServer", WsServerSetting)
+	mapTo("rateLimit", RateLimitSetting)
+	mapTo("storage", StorageSetting)
+	mapTo("backplane", BackplaneSetting)
 
 	ServerSetting.ReadTimeout = ServerSetting.ReadTimeout * time.Second
 	ServerSetting.WriteTimeout = ServerSetting.WriteTimeout * time.Second
-	RedisSetting.IdleTimeout = RedisSetting.IdleTimeout * time.Second
+	StorageSetting.SyncInterval = StorageSetting.SyncInterval * time.Second
 
 	WsServerSetting.Ping = (WsServerSetting.Ping * time.Second * 9) / 10
 	WsServerSetting.Pong = WsServerSetting.Pong * time.Second
 	WsServerSetting.MaxWriteWaitTime = WsServerSetting.MaxWriteWaitTime * time.Second
+	WsServerSetting.ShutdownTimeout = WsServerSetting.ShutdownTimeout * time.Second
+	WsServerSetting.ReconnectDelay = WsServerSetting.ReconnectDelay * time.Second
+	WsServerSetting.PresenceDebounce = WsServerSetting.PresenceDebounce * time.Second
+	WsServerSetting.PresenceRetention = WsServerSetting.PresenceRetention * time.Second
+	WsServerSetting.ResumeWindow = WsServerSetting.ResumeWindow * time.Second
+	WsServerSetting.ChannelTTL = WsServerSetting.ChannelTTL * time.Second
+
+	RateLimitSetting.MuteDuration = RateLimitSetting.MuteDuration * time.Second
+	RateLimitSetting.ViolationWindow = RateLimitSetting.ViolationWindow * time.Second
 }
 
 // mapTo map section
@@ -44,9 +44,10 @@ func makeUpgrader(bufferSizes *BufferSizes) websocket.Upgrader {
 }
 
 // UpgradeHTTPToWS upgrades the HTTP server connection to the WebSocket protocol.
-func UpgradeHTTPToWS(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+// responseHeader may be nil, or carry headers such as the selected subprotocol.
+func UpgradeHTTPToWS(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*websocket.Conn, error) {
 	upgrader := makeUpgrader(createDefaultBuffer())
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		return nil, err
 	}
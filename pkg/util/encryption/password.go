@@ -0,0 +1,20 @@
+package encryption
+
+import (
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashPassword derives a salted bcrypt hash of the password
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// ComparePassword reports whether password matches the bcrypt hash
+func ComparePassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
@@ -1,31 +1,49 @@
 package jwt_
 
 import (
+	"fmt"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
-	"wjjmjh/hermes/pkg/util/encryption"
+	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/setting"
 )
 
+// BearerProtocol is the Sec-WebSocket-Protocol marker that precedes a token
+// offered during a websocket handshake, e.g. "bearer, <token>".
+const BearerProtocol = "bearer"
+
 var jwtSecret []byte
 
+// Claims identify an account by its ID (the standard "sub" claim) and roles.
+// Generation is the account's token generation when the token was issued, so
+// tokens can be revoked by bumping it. They must never carry password material.
 type Claims struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Roles      []string `json:"roles"`
+	Generation int      `json:"gen"`
 	jwt.StandardClaims
 }
 
+// Setup initialize the signing secret from the app settings
+func Setup() {
+	jwtSecret = []byte(setting.AppSetting.JwtSecret)
+}
+
 // GenerateToken generate tokens used for auth
-func GenerateToken(username, password string) (string, error) {
+func GenerateToken(subject string, roles []string, generation int) (string, error) {
 	nowTime := time.Now()
 	expireTime := nowTime.Add(3 * time.Hour)
 
 	claims := Claims{
-		encryption.EncodeMD5(username),
-		encryption.EncodeMD5(password),
+		roles,
+		generation,
 		jwt.StandardClaims{
 			ExpiresAt: expireTime.Unix(),
-			Issuer:    "gin-blog",
+			IssuedAt:  nowTime.Unix(),
+			Issuer:    "hermes",
+			Subject:   subject,
 		},
 	}
 
@@ -41,6 +59,10 @@ func ParseToken(token string) (*Claims, error) {
 		token,
 		&Claims{},
 		func(token *jwt.Token) (interface{}, error) {
+			// Tokens are only ever signed with the HMAC secret
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+			}
 			return jwtSecret, nil
 		},
 	)
@@ -53,3 +75,74 @@ func ParseToken(token string) (*Claims, error) {
 
 	return nil, err
 }
+
+// CheckToken parses the token and maps any failure onto an api_response code,
+// so every entry point rejects tokens the same way.
+func CheckToken(token string) (*Claims, int) {
+	if token == "" {
+		return nil, api_response.INVALID_PARAMS
+	}
+
+	claims, err := ParseToken(token)
+	if err != nil {
+		if validationErr, ok := err.(*jwt.ValidationError); ok &&
+			validationErr.Errors&jwt.ValidationErrorExpired != 0 {
+			return nil, api_response.ERROR_AUTH_CHECK_TOKEN_TIMEOUT
+		}
+		return nil, api_response.ERROR_AUTH_CHECK_TOKEN_FAIL
+	}
+	if claims == nil || claims.Subject == "" {
+		return nil, api_response.ERROR_AUTH_TOKEN
+	}
+
+	return claims, api_response.SUCCESS
+}
+
+// TokenFromRequest extracts a token from the "token" query parameter, an
+// "Authorization: Bearer" header or a "bearer, <token>" websocket subprotocol,
+// in that order.
+func TokenFromRequest(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+
+	if header := r.Header.Get("Authorization"); header != "" {
+		parts := strings.SplitN(header, " ", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], "Bearer") {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+
+	protocols := websocketProtocols(r)
+	for i := 0; i+1 < len(protocols); i++ {
+		if strings.EqualFold(protocols[i], BearerProtocol) {
+			return protocols[i+1]
+		}
+	}
+
+	return ""
+}
+
+// OffersBearerProtocol reports whether the token was offered as a websocket
+// subprotocol, in which case the handshake must echo BearerProtocol back.
+func OffersBearerProtocol(r *http.Request) bool {
+	for _, protocol := range websocketProtocols(r) {
+		if strings.EqualFold(protocol, BearerProtocol) {
+			return true
+		}
+	}
+	return false
+}
+
+// websocketProtocols splits the Sec-WebSocket-Protocol header into its values
+func websocketProtocols(r *http.Request) []string {
+	var protocols []string
+	for _, header := range r.Header["Sec-Websocket-Protocol"] {
+		for _, protocol := range strings.Split(header, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
@@ -0,0 +1,119 @@
+package jwt_
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/setting"
+)
+
+func setupSecret(t *testing.T) {
+	t.Helper()
+	setting.AppSetting.JwtSecret = "test-secret"
+	Setup()
+}
+
+// signed returns a token of the claims signed with method and key
+func signed(t *testing.T, method jwt.SigningMethod, key interface{}, claims Claims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestCheckToken(t *testing.T) {
+	setupSecret(t)
+	valid, err := GenerateToken("account", []string{"user"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := func(subject string, expiresIn time.Duration) Claims {
+		return Claims{StandardClaims: jwt.StandardClaims{Subject: subject, ExpiresAt: time.Now().Add(expiresIn).Unix()}}
+	}
+	parts := strings.Split(valid, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		code  int
+	}{
+		{"valid", valid, api_response.SUCCESS},
+		{"missing", "", api_response.INVALID_PARAMS},
+		{"garbage", "not-a-token", api_response.ERROR_AUTH_CHECK_TOKEN_FAIL},
+		{"expired", signed(t, jwt.SigningMethodHS256, jwtSecret, claims("account", -time.Minute)), api_response.ERROR_AUTH_CHECK_TOKEN_TIMEOUT},
+		{"other secret", signed(t, jwt.SigningMethodHS256, []byte("other-secret"), claims("account", time.Hour)), api_response.ERROR_AUTH_CHECK_TOKEN_FAIL},
+		{"tampered claims", parts[0] + "." + strings.TrimRight(parts[1], "=") + "x." + parts[2], api_response.ERROR_AUTH_CHECK_TOKEN_FAIL},
+		{"RSA signed", signed(t, jwt.SigningMethodRS256, rsaKey, claims("account", time.Hour)), api_response.ERROR_AUTH_CHECK_TOKEN_FAIL},
+		{"unsigned", signed(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, claims("account", time.Hour)), api_response.ERROR_AUTH_CHECK_TOKEN_FAIL},
+		{"no subject", signed(t, jwt.SigningMethodHS256, jwtSecret, claims("", time.Hour)), api_response.ERROR_AUTH_TOKEN},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, code := CheckToken(test.token)
+			if code != test.code {
+				t.Fatalf("CheckToken answered %d, want %d", code, test.code)
+			}
+			if (parsed != nil) != (code == api_response.SUCCESS) {
+				t.Fatalf("CheckToken returned claims %+v with code %d", parsed, code)
+			}
+		})
+	}
+
+	parsed, _ := CheckToken(valid)
+	if parsed.Subject != "account" || len(parsed.Roles) != 1 || parsed.Roles[0] != "user" {
+		t.Fatalf("claims are %+v", parsed)
+	}
+}
+
+func TestTokenFromRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		headers  map[string]string
+		token    string
+		protocol bool
+	}{
+		{"none", "/ws", nil, "", false},
+		{"query", "/ws?token=query-token", nil, "query-token", false},
+		{"authorization header", "/ws", map[string]string{"Authorization": "Bearer header-token"}, "header-token", false},
+		{"lower case scheme", "/ws", map[string]string{"Authorization": "bearer header-token"}, "header-token", false},
+		{"other scheme", "/ws", map[string]string{"Authorization": "Basic dXNlcjpwYXNz"}, "", false},
+		{"subprotocol", "/ws", map[string]string{"Sec-WebSocket-Protocol": "bearer, protocol-token"}, "protocol-token", true},
+		{"subprotocol among others", "/ws", map[string]string{"Sec-WebSocket-Protocol": "chat, Bearer,protocol-token"}, "protocol-token", true},
+		{"subprotocol without token", "/ws", map[string]string{"Sec-WebSocket-Protocol": "chat, bearer"}, "", true},
+		{"query first", "/ws?token=query-token", map[string]string{
+			"Authorization":          "Bearer header-token",
+			"Sec-WebSocket-Protocol": "bearer, protocol-token",
+		}, "query-token", true},
+		{"header before subprotocol", "/ws", map[string]string{
+			"Authorization":          "Bearer header-token",
+			"Sec-WebSocket-Protocol": "bearer, protocol-token",
+		}, "header-token", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", test.url, nil)
+			for name, value := range test.headers {
+				r.Header.Set(name, value)
+			}
+			if token := TokenFromRequest(r); token != test.token {
+				t.Fatalf("TokenFromRequest = %q, want %q", token, test.token)
+			}
+			if offered := OffersBearerProtocol(r); offered != test.protocol {
+				t.Fatalf("OffersBearerProtocol = %v, want %v", offered, test.protocol)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package routers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"wjjmjh/hermes/middleware/jwt"
+	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/app"
+	"wjjmjh/hermes/pkg/services/auth_service"
+	"wjjmjh/hermes/pkg/util/jwt_"
+)
+
+type credentialsForm struct {
+	Username string `json:"username" form:"username" valid:"Required;MaxSize(50)"`
+	Password string `json:"password" form:"password" valid:"Required;MaxSize(72)"`
+}
+
+type changePasswordForm struct {
+	OldPassword string `json:"old_password" form:"old_password" valid:"Required"`
+	NewPassword string `json:"new_password" form:"new_password" valid:"Required;MaxSize(72)"`
+}
+
+type deleteAccountForm struct {
+	Password string `json:"password" form:"password" valid:"Required"`
+}
+
+type accountView struct {
+	ID       string   `json:"id"`
+	Username string   `json:"username"`
+	Roles    []string `json:"roles"`
+}
+
+func newAccountView(account *auth_service.Account) accountView {
+	return accountView{account.ID, account.Username, account.Roles}
+}
+
+// currentClaims returns the claims stored by the jwt middleware
+func currentClaims(c *gin.Context) *jwt_.Claims {
+	return c.MustGet(jwt.ClaimsKey).(*jwt_.Claims)
+}
+
+// authErrorCode maps auth_service errors onto api_response codes
+func authErrorCode(err error) (int, int) {
+	switch err {
+	case auth_service.ErrUsernameTaken:
+		return http.StatusConflict, api_response.ERROR_EXIST_ACCOUNT
+	case auth_service.ErrWeakPassword:
+		return http.StatusBadRequest, api_response.ERROR_WEAK_PASSWORD
+	case auth_service.ErrInvalidUsername:
+		return http.StatusBadRequest, api_response.ERROR_INVALID_USERNAME
+	case auth_service.ErrInvalidCredentials:
+		return http.StatusUnauthorized, api_response.ERROR_AUTH
+	case auth_service.ErrAccountNotFound:
+		return http.StatusNotFound, api_response.ERROR_NOT_EXIST_USER
+	default:
+		return http.StatusInternalServerError, api_response.ERROR
+	}
+}
+
+// Register creates a new account
+func Register(c *gin.Context) {
+	appG := app.Gin{C: c}
+	var form credentialsForm
+
+	httpCode, errCode := app.BindAndValid(c, &form)
+	if errCode != api_response.SUCCESS {
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	account, err := auth_service.Register(form.Username, form.Password)
+	if err != nil {
+		httpCode, errCode = authErrorCode(err)
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	appG.Response(http.StatusCreated, api_response.SUCCESS, newAccountView(account))
+}
+
+// Login issues a token for valid credentials
+func Login(c *gin.Context) {
+	appG := app.Gin{C: c}
+	var form credentialsForm
+
+	httpCode, errCode := app.BindAndValid(c, &form)
+	if errCode != api_response.SUCCESS {
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	token, account, err := auth_service.Login(form.Username, form.Password)
+	if err != nil {
+		httpCode, errCode = authErrorCode(err)
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, gin.H{
+		"token":   token,
+		"account": newAccountView(account),
+	})
+}
+
+// ChangePassword replaces the password of the calling account and returns a
+// fresh token, since every token issued before the change is revoked
+func ChangePassword(c *gin.Context) {
+	appG := app.Gin{C: c}
+	var form changePasswordForm
+
+	httpCode, errCode := app.BindAndValid(c, &form)
+	if errCode != api_response.SUCCESS {
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	token, err := auth_service.ChangePassword(currentClaims(c).Subject, form.OldPassword, form.NewPassword)
+	if err != nil {
+		httpCode, errCode = authErrorCode(err)
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, gin.H{"token": token})
+}
+
+// DeleteAccount removes the calling account
+func DeleteAccount(c *gin.Context) {
+	appG := app.Gin{C: c}
+	var form deleteAccountForm
+
+	httpCode, errCode := app.BindAndValid(c, &form)
+	if errCode != api_response.SUCCESS {
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	err := auth_service.DeleteAccount(currentClaims(c).Subject, form.Password)
+	if err != nil {
+		httpCode, errCode = authErrorCode(err)
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, nil)
+}
@@ -0,0 +1,369 @@
+package routers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"wjjmjh/hermes/managers/logic"
+	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/app"
+)
+
+type channelApi struct {
+	server *logic.WsServer
+}
+
+type createChannelForm struct {
+	Name    string `json:"name" form:"name" valid:"Required;MaxSize(100)"`
+	Private bool   `json:"private" form:"private"`
+}
+
+type renameChannelForm struct {
+	Name string `json:"name" form:"name" valid:"Required;MaxSize(100)"`
+}
+
+type setRoleForm struct {
+	Role string `json:"role" form:"role" valid:"Required"`
+}
+
+type channelView struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Private     bool              `json:"private"`
+	Archived    bool              `json:"archived"`
+	Ephemeral   bool              `json:"ephemeral"`
+	Members     int               `json:"members"`
+	Topic       string            `json:"topic"`
+	Description string            `json:"description"`
+	IconURL     string            `json:"icon_url"`
+	Attributes  map[string]string `json:"attributes"`
+	CreatedAt   time.Time         `json:"created_at"`
+	CreatedBy   string            `json:"created_by"`
+}
+
+func newChannelView(channel *logic.Channel) channelView {
+	metadata := channel.Metadata()
+	if metadata.Attributes == nil {
+		metadata.Attributes = map[string]string{}
+	}
+	return channelView{
+		ID:          *channel.GetID(),
+		Name:        *channel.GetName(),
+		Private:     channel.Private,
+		Archived:    channel.IsArchived(),
+		Ephemeral:   channel.IsEphemeral(),
+		Members:     len(channel.GetMembers()),
+		Topic:       metadata.Topic,
+		Description: metadata.Description,
+		IconURL:     metadata.IconURL,
+		Attributes:  metadata.Attributes,
+		CreatedAt:   metadata.CreatedAt,
+		CreatedBy:   metadata.CreatedBy,
+	}
+}
+
+// channelErrorCode maps logic errors onto api_response codes. Rejected
+// input carries its own code.
+func channelErrorCode(err error) (int, int) {
+	if frameErr, ok := err.(*logic.FrameError); ok {
+		return http.StatusBadRequest, frameErr.Code
+	}
+
+	switch err {
+	case logic.ErrChannelNotFound:
+		return http.StatusNotFound, api_response.ERROR_NOT_EXIST_CHANNEL
+	case logic.ErrChannelExists:
+		return http.StatusConflict, api_response.ERROR_EXIST_CHANNEL
+	case logic.ErrPermissionDenied:
+		return http.StatusForbidden, api_response.ERROR_PERMISSION_DENIED
+	case logic.ErrInvalidRole:
+		return http.StatusBadRequest, api_response.INVALID_PARAMS
+	case logic.ErrUserNotFound:
+		return http.StatusNotFound, api_response.ERROR_NOT_EXIST_USER
+	default:
+		return http.StatusInternalServerError, api_response.ERROR
+	}
+}
+
+// readable reports whether the caller may see the channel: private channels
+// are only visible to their members
+func readable(c *gin.Context, channel *logic.Channel) bool {
+	return !channel.Private || channel.HasMember(currentClaims(c).Subject)
+}
+
+// List returns every channel on the server the caller may see
+func (api *channelApi) List(c *gin.Context) {
+	appG := app.Gin{C: c}
+
+	views := []channelView{}
+	for _, channel := range api.server.ListChannels() {
+		if readable(c, channel) {
+			views = append(views, newChannelView(channel))
+		}
+	}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, views)
+}
+
+// Get returns a single channel. Private channels are only available to
+// members, like their history.
+func (api *channelApi) Get(c *gin.Context) {
+	appG := app.Gin{C: c}
+
+	channel := api.server.GetChannel(c.Param("id"))
+	if channel == nil {
+		appG.Response(http.StatusNotFound, api_response.ERROR_NOT_EXIST_CHANNEL, nil)
+		return
+	}
+	if !readable(c, channel) {
+		appG.Response(http.StatusForbidden, api_response.ERROR_AUTH, nil)
+		return
+	}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, newChannelView(channel))
+}
+
+// Create adds a new channel
+func (api *channelApi) Create(c *gin.Context) {
+	appG := app.Gin{C: c}
+	var form createChannelForm
+
+	httpCode, errCode := app.BindAndValid(c, &form)
+	if errCode != api_response.SUCCESS {
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	channel, err := api.server.CreateChannel(form.Name, form.Private, currentClaims(c).Subject)
+	if err != nil {
+		httpCode, errCode = channelErrorCode(err)
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	appG.Response(http.StatusCreated, api_response.SUCCESS, newChannelView(channel))
+}
+
+// Rename changes the name of a channel, if the caller's role allows it
+func (api *channelApi) Rename(c *gin.Context) {
+	appG := app.Gin{C: c}
+	var form renameChannelForm
+
+	httpCode, errCode := app.BindAndValid(c, &form)
+	if errCode != api_response.SUCCESS {
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	channel, err := api.server.RenameChannel(c.Param("id"), form.Name, currentClaims(c).Subject)
+	if err != nil {
+		httpCode, errCode = channelErrorCode(err)
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, newChannelView(channel))
+}
+
+// Update changes the topic, description, icon or attributes of a channel, if
+// the caller's role allows it. Fields left out of the body are kept.
+func (api *channelApi) Update(c *gin.Context) {
+	appG := app.Gin{C: c}
+	var form logic.UpdateChannelPayload
+
+	httpCode, errCode := app.BindAndValid(c, &form)
+	if errCode != api_response.SUCCESS {
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	channel, err := api.server.UpdateChannel(c.Param("id"), currentClaims(c).Subject, &form)
+	if err != nil {
+		httpCode, errCode = channelErrorCode(err)
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, newChannelView(channel))
+}
+
+// Delete removes a channel, if the caller's role allows it
+func (api *channelApi) Delete(c *gin.Context) {
+	appG := app.Gin{C: c}
+
+	if err := api.server.DeleteChannel(c.Param("id"), currentClaims(c).Subject); err != nil {
+		httpCode, errCode := channelErrorCode(err)
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, nil)
+}
+
+// Archive stops posts to a channel, if the caller's role allows it
+func (api *channelApi) Archive(c *gin.Context) {
+	api.setArchived(c, true)
+}
+
+// Unarchive allows posts to an archived channel again, if the caller's role
+// allows it
+func (api *channelApi) Unarchive(c *gin.Context) {
+	api.setArchived(c, false)
+}
+
+func (api *channelApi) setArchived(c *gin.Context, archived bool) {
+	appG := app.Gin{C: c}
+
+	channel, err := api.server.SetChannelArchived(c.Param("id"), currentClaims(c).Subject, archived)
+	if err != nil {
+		httpCode, errCode := channelErrorCode(err)
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, newChannelView(channel))
+}
+
+// ListUsers returns the members of a channel, as usernames by default or as
+// IDs with ?return=userId
+func (api *channelApi) ListUsers(c *gin.Context) {
+	appG := app.Gin{C: c}
+
+	channel := api.server.GetChannel(c.Param("id"))
+	if channel == nil {
+		appG.Response(http.StatusNotFound, api_response.ERROR_NOT_EXIST_CHANNEL, nil)
+		return
+	}
+	if !readable(c, channel) {
+		appG.Response(http.StatusForbidden, api_response.ERROR_AUTH, nil)
+		return
+	}
+
+	users, err := channel.GetUsers(logic.GetUsersParams_{ReturnType: c.DefaultQuery("return", "username")})
+	if err != nil {
+		appG.Response(http.StatusBadRequest, api_response.INVALID_PARAMS, nil)
+		return
+	}
+
+	values := []string{}
+	for _, user := range users {
+		values = append(values, *user)
+	}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, values)
+}
+
+// ListThreads returns the threads of a channel
+func (api *channelApi) ListThreads(c *gin.Context) {
+	appG := app.Gin{C: c}
+
+	channel := api.server.GetChannel(c.Param("id"))
+	if channel == nil {
+		appG.Response(http.StatusNotFound, api_response.ERROR_NOT_EXIST_CHANNEL, nil)
+		return
+	}
+	if !readable(c, channel) {
+		appG.Response(http.StatusForbidden, api_response.ERROR_AUTH, nil)
+		return
+	}
+
+	views := []logic.ThreadPayload{}
+	for _, thread := range channel.ListThreads() {
+		views = append(views, thread.Payload())
+	}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, views)
+}
+
+// ListMessages returns a page of channel history. ?before=<message id> pages
+// backwards and ?limit= caps the page size. Private channel history is only
+// available to members.
+func (api *channelApi) ListMessages(c *gin.Context) {
+	appG := app.Gin{C: c}
+
+	channel := api.server.GetChannel(c.Param("id"))
+	if channel == nil {
+		appG.Response(http.StatusNotFound, api_response.ERROR_NOT_EXIST_CHANNEL, nil)
+		return
+	}
+	if !readable(c, channel) {
+		appG.Response(http.StatusForbidden, api_response.ERROR_AUTH, nil)
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "0"))
+	if err != nil {
+		appG.Response(http.StatusBadRequest, api_response.INVALID_PARAMS, nil)
+		return
+	}
+
+	messages, err := channel.FetchHistory(c.Query("before"), limit)
+	if err != nil {
+		appG.Response(http.StatusInternalServerError, api_response.ERROR, nil)
+		return
+	}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, logic.NewHistoryPayload(messages))
+}
+
+// ListRoles returns the users holding a role other than member in a channel
+func (api *channelApi) ListRoles(c *gin.Context) {
+	appG := app.Gin{C: c}
+
+	channel := api.server.GetChannel(c.Param("id"))
+	if channel == nil {
+		appG.Response(http.StatusNotFound, api_response.ERROR_NOT_EXIST_CHANNEL, nil)
+		return
+	}
+	if !readable(c, channel) {
+		appG.Response(http.StatusForbidden, api_response.ERROR_AUTH, nil)
+		return
+	}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, channel.Roles())
+}
+
+// SetRole gives a user a role in a channel, if the caller's role allows it
+func (api *channelApi) SetRole(c *gin.Context) {
+	appG := app.Gin{C: c}
+	var form setRoleForm
+
+	httpCode, errCode := app.BindAndValid(c, &form)
+	if errCode != api_response.SUCCESS {
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	err := api.server.SetChannelRole(c.Param("id"), currentClaims(c).Subject, c.Param("user_id"), form.Role)
+	if err != nil {
+		httpCode, errCode = channelErrorCode(err)
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, logic.RolePayload{UserID: c.Param("user_id"), Role: form.Role})
+}
+
+// ListAudit returns the latest moderation actions taken in a channel, oldest
+// first, if the caller's role allows it. ?limit= caps the number returned.
+func (api *channelApi) ListAudit(c *gin.Context) {
+	appG := app.Gin{C: c}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "0"))
+	if err != nil {
+		appG.Response(http.StatusBadRequest, api_response.INVALID_PARAMS, nil)
+		return
+	}
+
+	entries, err := api.server.ChannelAuditLog(c.Param("id"), currentClaims(c).Subject, limit)
+	if err != nil {
+		httpCode, errCode := channelErrorCode(err)
+		appG.Response(httpCode, errCode, nil)
+		return
+	}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, entries)
+}
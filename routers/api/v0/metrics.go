@@ -0,0 +1,22 @@
+package routers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"wjjmjh/hermes/managers/logic"
+	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/app"
+)
+
+type metricsApi struct {
+	server *logic.WsServer
+}
+
+// Get returns the websocket server's monitoring counters
+func (api *metricsApi) Get(c *gin.Context) {
+	appG := app.Gin{C: c}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, api.server.Metrics())
+}
@@ -3,17 +3,62 @@ package routers
 import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+
+	"wjjmjh/hermes/managers/logic"
+	"wjjmjh/hermes/middleware/jwt"
+	"wjjmjh/hermes/pkg/setting"
 )
 
-func InitRouter() *gin.Engine {
+func InitRouter(server *logic.WsServer) *gin.Engine {
+	gin.SetMode(setting.ServerSetting.RunMode)
+
 	r := gin.New()
 	r.Use(gin.Logger())
 	r.Use(gin.Recovery())
 	r.Use(cors.Default())
 
 	// Initialise api router group
-	// apiGroup := r.Group("/api")
-	//api.InitApiGroup(apiGroup) // this will be implemented later depending on plans
+	apiGroup := r.Group("/api/v0")
+	InitApiGroup(apiGroup, server)
 
 	return r
 }
+
+// InitApiGroup registers the v0 REST endpoints. Everything except
+// registration and login requires a valid token.
+func InitApiGroup(apiGroup *gin.RouterGroup, server *logic.WsServer) {
+	channels := &channelApi{server}
+	users := &userApi{server}
+	metrics := &metricsApi{server}
+
+	apiGroup.POST("/auth/register", Register)
+	apiGroup.POST("/auth/login", Login)
+
+	protected := apiGroup.Group("")
+	protected.Use(jwt.JWT())
+	{
+		protected.PUT("/auth/password", ChangePassword)
+		protected.DELETE("/auth/account", DeleteAccount)
+
+		protected.GET("/channels", channels.List)
+		protected.POST("/channels", channels.Create)
+		protected.GET("/channels/:id", channels.Get)
+		protected.PUT("/channels/:id", channels.Rename)
+		protected.PATCH("/channels/:id", channels.Update)
+		protected.DELETE("/channels/:id", channels.Delete)
+		protected.PUT("/channels/:id/archive", channels.Archive)
+		protected.DELETE("/channels/:id/archive", channels.Unarchive)
+		protected.GET("/channels/:id/users", channels.ListUsers)
+		protected.GET("/channels/:id/threads", channels.ListThreads)
+		protected.GET("/channels/:id/messages", channels.ListMessages)
+		protected.GET("/channels/:id/roles", channels.ListRoles)
+		protected.PUT("/channels/:id/roles/:user_id", channels.SetRole)
+		protected.GET("/channels/:id/audit", channels.ListAudit)
+
+		protected.GET("/users/online", users.ListOnline)
+		protected.GET("/users/online/:id", users.GetOnline)
+		protected.GET("/users/presence/:id", users.GetPresence)
+
+		protected.GET("/metrics", metrics.Get)
+	}
+}
@@ -0,0 +1,253 @@
+package routers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"wjjmjh/hermes/managers/logic"
+	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/backplane"
+	"wjjmjh/hermes/pkg/services/auth_service"
+	"wjjmjh/hermes/pkg/setting"
+	"wjjmjh/hermes/pkg/util/jwt_"
+)
+
+var setupOnce sync.Once
+
+func setupTestSettings() {
+	setupOnce.Do(func() {
+		gin.SetMode(gin.TestMode)
+		setting.AppSetting.JwtSecret = "test-secret"
+		jwt_.Setup()
+		auth_service.SetStore(auth_service.NewMemoryStore())
+
+		setting.WsServerSetting.Ping = time.Minute
+		setting.WsServerSetting.Pong = time.Minute
+		setting.WsServerSetting.MaxWriteWaitTime = 10 * time.Second
+		setting.WsServerSetting.MaxMessageSize = logic.MinMessageSize
+	})
+}
+
+// testApi serves the v0 API and the websocket endpoint of one server
+type testApi struct {
+	t      *testing.T
+	router *gin.Engine
+	wsURL  string
+}
+
+func newTestApi(t *testing.T) *testApi {
+	t.Helper()
+	setupTestSettings()
+
+	server, err := logic.NewWsServer(logic.NewMemoryMessageStore(), logic.NewMemoryReadStore(), logic.NewMemoryAuditStore(),
+		logic.NewMemoryChannelStore(), logic.NewMemoryNotificationStore(), backplane.NewMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Run()
+
+	wsServer := httptest.NewServer(http.HandlerFunc(server.ServeWs))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+		wsServer.Close()
+	})
+
+	router := gin.New()
+	InitApiGroup(router.Group("/api/v0"), server)
+	return &testApi{t: t, router: router, wsURL: "ws" + strings.TrimPrefix(wsServer.URL, "http")}
+}
+
+// testResponse is the envelope every endpoint answers with
+type testResponse struct {
+	status int
+	Code   int             `json:"code"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// call sends a request with an optional bearer token and JSON body
+func (api *testApi) call(method, path, token string, body interface{}) *testResponse {
+	api.t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	request := httptest.NewRequest(method, "/api/v0"+path, reader)
+	request.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	recorder := httptest.NewRecorder()
+	api.router.ServeHTTP(recorder, request)
+
+	response := &testResponse{status: recorder.Code}
+	if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil {
+		api.t.Fatalf("%s %s: %v in %s", method, path, err, recorder.Body.String())
+	}
+	return response
+}
+
+// signUp registers an account through the API and logs it in
+func (api *testApi) signUp(username string) (string, string) {
+	api.t.Helper()
+	credentials := credentialsForm{Username: username, Password: "correct-horse"}
+	if response := api.call(http.MethodPost, "/auth/register", "", credentials); response.status != http.StatusCreated {
+		api.t.Fatalf("register %s: %d %d", username, response.status, response.Code)
+	}
+	response := api.call(http.MethodPost, "/auth/login", "", credentials)
+	var login struct {
+		Token   string      `json:"token"`
+		Account accountView `json:"account"`
+	}
+	if err := json.Unmarshal(response.Data, &login); err != nil || login.Token == "" {
+		api.t.Fatalf("login %s: %d %s", username, response.Code, response.Data)
+	}
+	return login.Account.ID, login.Token
+}
+
+// join connects with token and joins the named channel over the websocket
+func (api *testApi) join(token, name string) {
+	api.t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(api.wsURL+"?token="+token, nil)
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	api.t.Cleanup(func() { _ = conn.Close() })
+
+	payload, _ := json.Marshal(logic.JoinChannelPayload{Name: name})
+	frame := logic.InboundFrame{Version: logic.ProtocolVersion, Type: logic.JoinChannelAction, Payload: payload}
+	if err := conn.WriteJSON(frame); err != nil {
+		api.t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			api.t.Fatalf("waiting to join %s: %v", name, err)
+		}
+		// Queued frames are written together, a line each
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			var frame struct {
+				Type string `json:"type"`
+			}
+			if json.Unmarshal(line, &frame) == nil && frame.Type == logic.ChannelJoinedAction {
+				return
+			}
+		}
+	}
+}
+
+func TestAuthFailures(t *testing.T) {
+	api := newTestApi(t)
+	_, token := api.signUp("alice")
+	changedID, changedToken := api.signUp("bob")
+	deletedID, deletedToken := api.signUp("carol")
+
+	if _, err := auth_service.ChangePassword(changedID, "correct-horse", "battery-staple"); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth_service.DeleteAccount(deletedID, "correct-horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		body       interface{}
+		wantStatus int
+		wantCode   int
+	}{
+		{"no token", http.MethodGet, "/channels", "", nil, http.StatusUnauthorized, api_response.INVALID_PARAMS},
+		{"garbage token", http.MethodGet, "/channels", "not-a-token", nil, http.StatusUnauthorized, api_response.ERROR_AUTH_CHECK_TOKEN_FAIL},
+		{"token from before a password change", http.MethodGet, "/channels", changedToken, nil, http.StatusUnauthorized, api_response.ERROR_AUTH_CHECK_TOKEN_FAIL},
+		{"token of a deleted account", http.MethodGet, "/channels", deletedToken, nil, http.StatusUnauthorized, api_response.ERROR_AUTH_CHECK_TOKEN_FAIL},
+		{"wrong password", http.MethodPost, "/auth/login", "", credentialsForm{"alice", "wrong-horse"}, http.StatusUnauthorized, api_response.ERROR_AUTH},
+		{"unknown username", http.MethodPost, "/auth/login", "", credentialsForm{"mallory", "correct-horse"}, http.StatusUnauthorized, api_response.ERROR_AUTH},
+		{"wrong password to delete", http.MethodDelete, "/auth/account", token, deleteAccountForm{"wrong-horse"}, http.StatusUnauthorized, api_response.ERROR_AUTH},
+		{"taken username", http.MethodPost, "/auth/register", "", credentialsForm{"Alice", "correct-horse"}, http.StatusConflict, api_response.ERROR_EXIST_ACCOUNT},
+		{"valid token", http.MethodGet, "/channels", token, nil, http.StatusOK, api_response.SUCCESS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := api.call(tt.method, tt.path, tt.token, tt.body)
+			if response.status != tt.wantStatus || response.Code != tt.wantCode {
+				t.Fatalf("got %d %d, want %d %d", response.status, response.Code, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestPrivateChannelsHiddenFromNonMembers(t *testing.T) {
+	api := newTestApi(t)
+	_, ownerToken := api.signUp("dave")
+	_, strangerToken := api.signUp("erin")
+
+	create := func(name string, private bool) string {
+		response := api.call(http.MethodPost, "/channels", ownerToken, createChannelForm{name, private})
+		var view channelView
+		if response.status != http.StatusCreated || json.Unmarshal(response.Data, &view) != nil {
+			t.Fatalf("create %s: %d %d", name, response.status, response.Code)
+		}
+		return view.ID
+	}
+	privateID := create("secret", true)
+	publicID := create("lobby", false)
+	api.join(ownerToken, "secret")
+
+	// listed reports which of the channels the token may see
+	listed := func(token string) map[string]bool {
+		var views []channelView
+		if err := json.Unmarshal(api.call(http.MethodGet, "/channels", token, nil).Data, &views); err != nil {
+			t.Fatal(err)
+		}
+		ids := make(map[string]bool)
+		for _, view := range views {
+			ids[view.ID] = true
+		}
+		return ids
+	}
+
+	// Membership is registered by the channel loop, after the join is answered
+	deadline := time.Now().Add(10 * time.Second)
+	for !listed(ownerToken)[privateID] {
+		if time.Now().After(deadline) {
+			t.Fatal("a member cannot see the private channel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if seen := listed(strangerToken); seen[privateID] || !seen[publicID] {
+		t.Fatalf("a non-member sees %v, want only the public channel", seen)
+	}
+
+	for _, path := range []string{"", "/users", "/threads", "/messages", "/roles"} {
+		t.Run("private"+path, func(t *testing.T) {
+			if response := api.call(http.MethodGet, "/channels/"+privateID+path, strangerToken, nil); response.status != http.StatusForbidden {
+				t.Fatalf("non-member got %d %d", response.status, response.Code)
+			}
+			if response := api.call(http.MethodGet, "/channels/"+privateID+path, ownerToken, nil); response.status != http.StatusOK {
+				t.Fatalf("member got %d %d", response.status, response.Code)
+			}
+			if response := api.call(http.MethodGet, "/channels/"+publicID+path, strangerToken, nil); response.status != http.StatusOK {
+				t.Fatalf("non-member of a public channel got %d %d", response.status, response.Code)
+			}
+		})
+	}
+}
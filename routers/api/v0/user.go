@@ -0,0 +1,68 @@
+package routers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"wjjmjh/hermes/managers/logic"
+	"wjjmjh/hermes/pkg/api_response"
+	"wjjmjh/hermes/pkg/app"
+)
+
+type userApi struct {
+	server *logic.WsServer
+}
+
+type userView struct {
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Status   string    `json:"status"`
+	LastSeen time.Time `json:"last_seen"`
+	Sessions int       `json:"sessions"`
+}
+
+func (api *userApi) newUserView(account *logic.Account) userView {
+	presence, _ := api.server.GetPresence(account.GetID())
+	return userView{account.GetID(), *account.GetUsername(), presence.Status, presence.LastSeen, len(account.Sessions())}
+}
+
+// ListOnline returns every user connected to the websocket server
+func (api *userApi) ListOnline(c *gin.Context) {
+	appG := app.Gin{C: c}
+
+	views := []userView{}
+	for _, account := range api.server.ListOnlineAccounts() {
+		views = append(views, api.newUserView(account))
+	}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, views)
+}
+
+// GetOnline looks up a connected user by ID
+func (api *userApi) GetOnline(c *gin.Context) {
+	appG := app.Gin{C: c}
+
+	account := api.server.FindAccount(c.Param("id"))
+	if account == nil {
+		appG.Response(http.StatusNotFound, api_response.ERROR_NOT_EXIST_USER, nil)
+		return
+	}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, api.newUserView(account))
+}
+
+// GetPresence returns the status and last-seen time of any user seen since
+// the server started, including offline users
+func (api *userApi) GetPresence(c *gin.Context) {
+	appG := app.Gin{C: c}
+
+	presence, ok := api.server.GetPresence(c.Param("id"))
+	if !ok {
+		appG.Response(http.StatusNotFound, api_response.ERROR_NOT_EXIST_USER, nil)
+		return
+	}
+
+	appG.Response(http.StatusOK, api_response.SUCCESS, presence)
+}